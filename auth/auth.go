@@ -1,102 +1,332 @@
 package auth
 
 import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
-	"theam.io/jdavidsanchez/test_crm_api/db"
+	"theam.io/jdavidsanchez/test_crm_api/config"
+	"theam.io/jdavidsanchez/test_crm_api/logging"
 	"theam.io/jdavidsanchez/test_crm_api/models"
 	"theam.io/jdavidsanchez/test_crm_api/utils"
 )
 
-var jwtKey = []byte(os.Getenv("JWT_SECRET"))
+var jwtKey []byte
+var jwtLifetime = 5 * time.Minute
+var sessionLifetime = 30 * 24 * time.Hour
+
+// Configure sets the keys and lifetimes of the tokens and of the signed picture URLs. With RS256 and
+// ES256, the keys must then be loaded with LoadSigningKeys
+func Configure(c config.Auth) {
+	jwtAlgorithm = strings.ToUpper(c.JWTAlgorithm)
+	jwtKey = []byte(c.JWTSecret)
+	jwtLifetime = c.JWTLifetime
+	sessionLifetime = c.SessionLifetime
+	keyRefreshInterval = c.KeyRefreshInterval
+	signedURLKey = derivedSigningKey()
+	if c.PictureURLSecret != "" {
+		signedURLKey = []byte(c.PictureURLSecret)
+	}
+	signedURLTTL = c.PictureURLTTL
+	RequireSignedURLs = c.RequireSignedURLs
+}
 
 type Claims struct {
 	Username string `json:"username"`
+	// Set in the tokens of the sessions, only the session itself is looked up on every request
+	UserId int      `json:"uid,omitempty"`
+	Roles  []string `json:"roles,omitempty"`
+	// Empty for the tokens of the API, set for the challenges of two-factor authentication
+	Purpose string `json:"purpose,omitempty"`
+	// Session started by the login, whose tokens are refused once revoked
+	SessionId string `json:"sid,omitempty"`
+	// Active organization of the session, the only one whose customers the token gives access to
+	OrganizationId int `json:"org,omitempty"`
 	jwt.StandardClaims
 }
 
-func SetJWT(username string, w http.ResponseWriter, r *http.Request) {
-	expirationTime := time.Now().Add(5 * time.Minute)
-
-	claims := &Claims{
-		Username: username,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-		},
+// CheckKeyConfig returns an error if tokens cannot be safely signed with the configured key
+func CheckKeyConfig() error {
+	if asymmetric() {
+		signingKeys.mu.RLock()
+		defer signingKeys.mu.RUnlock()
+		if signingKeys.signing == nil {
+			return errors.New("the JWT signing keys are not loaded")
+		}
+		return nil
+	}
+	if len(jwtKey) == 0 {
+		return errors.New("JWT_SECRET is not set")
 	}
+	return nil
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+// Tokens of a session: the JWT, valid for a few minutes, and the refresh token to get new ones
+type Tokens struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+}
 
-	tokenString, err := token.SignedString(jwtKey)
+// SetJWT starts a session of the user from the client IP, responding with its tokens
+func SetJWT(sessions models.SessionRepository, u models.User, ip string, w http.ResponseWriter, r *http.Request) {
+	tokens, err := NewSession(r.Context(), sessions, u, r.UserAgent(), ip)
 	if err != nil {
 
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	utils.ResponseJSON(w, http.StatusAccepted, map[string]string{"result": "success", "token": tokenString})
+	utils.ResponseJSON(w, http.StatusAccepted, map[string]string{"result": "success", "token": tokens.Token, "refreshToken": tokens.RefreshToken})
 }
 
-func ValidateToken(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var token string
-		tokens, ok := r.Header["Authorization"]
-		if ok && len(tokens) >= 1 {
-			token = tokens[0]
-			token = strings.TrimPrefix(token, "Bearer ")
-		}
+// NewSession starts a session of the user from the device (user agent) and IP of its client, in
+// the first organization of the user
+func NewSession(ctx context.Context, sessions models.SessionRepository, u models.User, device, ip string) (Tokens, error) {
+	id, err := utils.RandomToken(16)
+	if err != nil {
+		return Tokens{}, err
+	}
+	refreshToken, err := utils.RandomToken(32)
+	if err != nil {
+		return Tokens{}, err
+	}
+	session := models.Session{
+		Id:          id,
+		UserId:      u.Id,
+		Username:    u.Username,
+		Role:        u.Role,
+		RefreshHash: hashToken(refreshToken),
+		Device:      truncate(device, models.MaxDeviceLength),
+		IP:          ip,
+		ExpiresAt:   time.Now().Add(sessionLifetime),
+	}
+	if err = sessions.Create(ctx, &session); err != nil {
+		return Tokens{}, err
+	}
+	token, err := newJWT(session)
+	return Tokens{Token: token, RefreshToken: refreshToken}, err
+}
 
-		if token == "" {
-			//http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			utils.ResponseJSON(w, http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
-			return
-		}
+var ErrInvalidRefreshToken = errors.New("Invalid or expired refresh token")
 
-		claims := &Claims{}
-		tkn, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
-			return jwtKey, nil
-		})
-		if err != nil {
-			if err == jwt.ErrSignatureInvalid {
-				w.WriteHeader(http.StatusUnauthorized)
-				return
-			}
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		if !tkn.Valid {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
+// RefreshSession issues new tokens for the session of the refresh token, which cannot be used
+// again. The session expires once it is not refreshed for its lifetime
+func RefreshSession(ctx context.Context, sessions models.SessionRepository, refreshToken, device, ip string) (Tokens, error) {
+	newRefreshToken, err := utils.RandomToken(32)
+	if err != nil {
+		return Tokens{}, err
+	}
+	session := models.Session{
+		RefreshHash: hashToken(newRefreshToken),
+		Device:      truncate(device, models.MaxDeviceLength),
+		IP:          ip,
+		ExpiresAt:   time.Now().Add(sessionLifetime),
+	}
+	err = sessions.Refresh(ctx, hashToken(refreshToken), &session)
+	if err == sql.ErrNoRows {
+		return Tokens{}, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return Tokens{}, err
+	}
+	token, err := newJWT(session)
+	return Tokens{Token: token, RefreshToken: newRefreshToken}, err
 }
 
-func GetUserIdFromJWT(r *http.Request) (int, error) {
-	var token string
-	tokens, ok := r.Header["Authorization"]
-	if ok && len(tokens) >= 1 {
-		token = tokens[0]
-		token = strings.TrimPrefix(token, "Bearer ")
+// SwitchOrganization makes the organization (of which the user must be a member) the active one of
+// the session of the identity, returning a token for it. The previous tokens of the session are
+// refused from then on, but its refresh token remains valid
+func SwitchOrganization(ctx context.Context, sessions models.SessionRepository, i Identity, orgId int) (string, error) {
+	if err := sessions.SetOrganization(ctx, i.SessionId, orgId); err != nil {
+		return "", err
+	}
+	session := models.Session{Id: i.SessionId, UserId: i.UserId, Username: i.Username, OrganizationId: orgId}
+	if len(i.Roles) > 0 {
+		session.Role = i.Roles[0]
 	}
+	return newJWT(session)
+}
 
-	claims := jwt.MapClaims{}
-	_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
+func newJWT(s models.Session) (string, error) {
+	return signClaims(&Claims{
+		Username:       s.Username,
+		UserId:         s.UserId,
+		Roles:          []string{s.Role},
+		SessionId:      s.Id,
+		OrganizationId: s.OrganizationId,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(jwtLifetime).Unix(),
+		},
 	})
-	if err != nil {
-		return 0, err
+}
+
+// Refresh tokens are random, so a fast hash is enough
+func hashToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+func truncate(s string, length int) string {
+	if runes := []rune(s); len(runes) > length {
+		return string(runes[:length])
+	}
+	return s
+}
+
+func signClaims(claims *Claims) (string, error) {
+	if asymmetric() {
+		return signingKeys.sign(jwt.NewWithClaims(jwt.GetSigningMethod(jwtAlgorithm), claims))
 	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtKey)
+}
+
+// ValidateToken authenticates the requests with a JWT of an active session, an API key (X-API-Key
+// header) or a client certificate, setting the identity of their user
+func ValidateToken(store models.Store) func(http.Handler) http.Handler {
+	return validateToken(store, false)
+}
+
+// ValidateEnrollmentToken also accepts the enrollment challenges of the users who must enroll in
+// two-factor authentication before getting a token, setting Identity.Enrolling
+func ValidateEnrollmentToken(store models.Store) func(http.Handler) http.Handler {
+	return validateToken(store, true)
+}
 
-	user := models.User{
-		Username: claims["username"].(string),
+// Cancelled requests and database timeouts get the same statuses as in the handlers
+func storeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch err {
+	case models.ErrCanceled:
+		status = 499 // Client Closed Request (nginx)
+	case models.ErrTimeout:
+		status = http.StatusGatewayTimeout
 	}
-	err = user.GetIdFromUsername(db.DB)
+	utils.ResponseJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func validateToken(store models.Store, allowEnrollment bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key := r.Header.Get("X-API-Key"); key != "" {
+				k, err := store.APIKeys().Authenticate(r.Context(), HashAPIKey(key))
+				if err == models.ErrAPIKeyNotFound {
+					utils.ResponseJSON(w, http.StatusUnauthorized, map[string]string{"error": "Invalid API key"})
+					return
+				}
+				if err != nil {
+					storeError(w, err)
+					return
+				}
+				logging.SetUser(r.Context(), k.Username)
+				next.ServeHTTP(w, withIdentity(r, Identity{UserId: k.UserId, Username: k.Username, Roles: []string{k.Role},
+					OrganizationId: k.OrganizationId, APIKey: &k}))
+				return
+			}
+
+			var token string
+			tokens, ok := r.Header["Authorization"]
+			if ok && len(tokens) >= 1 {
+				token = tokens[0]
+				token = strings.TrimPrefix(token, "Bearer ")
+			}
+
+			if token == "" {
+				if username := clientCertUsername(r); username != "" {
+					i, ok := userIdentity(w, r, store, username)
+					if !ok {
+						return
+					}
+					logging.SetUser(r.Context(), username)
+					next.ServeHTTP(w, withIdentity(r, i))
+					return
+				}
+				//http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				utils.ResponseJSON(w, http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+				return
+			}
+
+			claims := &Claims{}
+			tkn, err := jwt.ParseWithClaims(token, claims, keyFunc(r.Context()))
+			if err != nil {
+				if err == jwt.ErrSignatureInvalid {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if !tkn.Valid {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			enrolling := allowEnrollment && claims.Purpose == PurposeEnrollment
+			if claims.Purpose != "" && !enrolling {
+				utils.ResponseJSON(w, http.StatusUnauthorized, map[string]string{"error": "Two-factor authentication required"})
+				return
+			}
+			i := Identity{UserId: claims.UserId, Username: claims.Username, Roles: claims.Roles, OrganizationId: claims.OrganizationId}
+			if enrolling {
+				// Enrollment challenges are issued before the session starts
+				if i, ok = userIdentity(w, r, store, claims.Username); !ok {
+					return
+				}
+			} else {
+				if claims.SessionId == "" {
+					utils.ResponseJSON(w, http.StatusUnauthorized, map[string]string{"error": "Session required"})
+					return
+				}
+				// Also refused once the session switched to another organization, or its user
+				// was removed from the one of the token
+				active, err := store.Sessions().Active(r.Context(), claims.SessionId, claims.OrganizationId)
+				if err != nil {
+					storeError(w, err)
+					return
+				}
+				if !active {
+					utils.ResponseJSON(w, http.StatusUnauthorized, map[string]string{"error": "Session revoked"})
+					return
+				}
+			}
+			i.SessionId, i.Enrolling = claims.SessionId, enrolling
+			logging.SetUser(r.Context(), claims.Username)
+			next.ServeHTTP(w, withIdentity(r, i))
+		})
+	}
+}
+
+// Returns the identity of the user, in its first organization, querying the database. The response
+// is already sent if not found
+func userIdentity(w http.ResponseWriter, r *http.Request, store models.Store, username string) (Identity, bool) {
+	u, err := store.Users().Get(r.Context(), username)
+	if err == sql.ErrNoRows {
+		utils.ResponseJSON(w, http.StatusUnauthorized, map[string]string{"error": models.ErrUserNotFound.Error()})
+		return Identity{}, false
+	}
+	if err != nil {
+		storeError(w, err)
+		return Identity{}, false
+	}
+	organizations, err := store.Organizations().List(r.Context(), u.Id)
 	if err != nil {
-		return 0, err
+		storeError(w, err)
+		return Identity{}, false
+	}
+	i := Identity{UserId: u.Id, Username: u.Username, Roles: []string{u.Role}}
+	if len(organizations) > 0 {
+		i.OrganizationId = organizations[0].Id
+	}
+	return i, true
+}
+
+// Service-to-service clients can authenticate with a certificate verified with the client CA of
+// the TLS configuration instead of a token. Its common name is their username
+func clientCertUsername(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
 	}
-	return user.Id, nil
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
 }
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http"
+
+	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+/***************************************************
+API keys and identity of the authenticated requests
+****************************************************/
+
+const apiKeyPrefix = "crm_"
+
+// GenerateAPIKey returns a new random key, with the hash to store and its first characters to show
+func GenerateAPIKey() (key string, hash []byte, prefix string, err error) {
+	token, err := utils.RandomToken(24)
+	if err != nil {
+		return "", nil, "", err
+	}
+	key = apiKeyPrefix + token
+	return key, HashAPIKey(key), key[:len(apiKeyPrefix)+8], nil
+}
+
+// HashAPIKey returns the hash stored for the key. Keys are random, so a fast hash is enough
+// (unlike passwords, they cannot be guessed from a dictionary)
+func HashAPIKey(key string) []byte {
+	hash := sha256.Sum256([]byte(key))
+	return hash[:]
+}
+
+// Identity of the user of an authenticated request
+type Identity struct {
+	UserId   int
+	Username string
+	Roles    []string
+	// Key used to authenticate, nil for tokens and client certificates, which have every scope
+	APIKey *models.APIKey
+	// Session of the token, empty for API keys and client certificates
+	SessionId string
+	// Organization whose customers the request can access, 0 if none
+	OrganizationId int
+	// Authenticated with an enrollment challenge, only valid to enroll in two-factor authentication
+	Enrolling bool
+}
+
+func (i Identity) HasScope(scope string) bool {
+	return i.APIKey == nil || i.APIKey.HasScope(scope)
+}
+
+type contextKey int
+
+const identityKey contextKey = 0
+
+func (i Identity) IsAdmin() bool {
+	for _, role := range i.Roles {
+		if role == models.RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// The store limits the operations with the context to the organization of the identity, and to the
+// customers the user can access
+func withIdentity(r *http.Request, i Identity) *http.Request {
+	ctx := models.WithOrganization(r.Context(), i.OrganizationId)
+	ctx = models.WithUser(ctx, i.UserId, i.IsAdmin())
+	return r.WithContext(context.WithValue(ctx, identityKey, i))
+}
+
+// GetIdentity returns the identity set by ValidateToken
+func GetIdentity(ctx context.Context) (Identity, bool) {
+	i, ok := ctx.Value(identityKey).(Identity)
+	return i, ok
+}
+
+// RequireScope only calls the handler if the request is not authenticated with an API key, or the
+// key has the scope
+func RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if i, ok := GetIdentity(r.Context()); ok && !i.HasScope(scope) {
+			utils.ResponseJSON(w, http.StatusForbidden, map[string]string{"error": "API key without the " + scope + " scope"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// RequireOrganization refuses the requests without an active organization
+func RequireOrganization(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if i, ok := GetIdentity(r.Context()); ok && i.OrganizationId == 0 {
+			utils.ResponseJSON(w, http.StatusForbidden, map[string]string{"error": models.ErrNoOrganization.Error()})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
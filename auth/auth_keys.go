@@ -0,0 +1,286 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"theam.io/jdavidsanchez/test_crm_api/logging"
+	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+/***************************************************************
+Asymmetric signing keys (RS256, ES256), rotated in the database
+****************************************************************/
+
+var jwtAlgorithm = "HS256"
+var keyRefreshInterval = time.Minute
+
+// Unknown kids reload the keys (e.g. rotated by another instance), at most this often
+const unknownKidReloadInterval = 10 * time.Second
+
+func asymmetric() bool {
+	return jwtAlgorithm != "HS256"
+}
+
+type verificationKey struct {
+	kid       string
+	algorithm string
+	public    crypto.PublicKey
+}
+
+// Keys loaded from the store, refreshed periodically
+type keySet struct {
+	mu         sync.RWMutex
+	store      models.Store
+	signingKid string
+	signing    crypto.Signer
+	keys       map[string]verificationKey
+	loadedAt   time.Time
+}
+
+var signingKeys keySet
+
+// Retired keys verify tokens until those signed by them expire. Other instances may keep signing
+// with a retired key until they refresh their keys
+func retiredKeyValidity() time.Duration {
+	return jwtLifetime + keyRefreshInterval
+}
+
+// LoadSigningKeys loads the keys of the store, creating one if none signs tokens with the
+// configured algorithm yet. Does nothing with HS256, which signs with the JWT secret
+func LoadSigningKeys(ctx context.Context, store models.Store) error {
+	if !asymmetric() {
+		return nil
+	}
+	keys, err := store.SigningKeys().List(ctx)
+	if err != nil {
+		return err
+	}
+	active := false
+	for _, k := range keys {
+		active = active || (k.RetiredAt == nil && k.Algorithm == jwtAlgorithm)
+	}
+	if !active {
+		if _, err = RotateSigningKey(ctx, store); err != nil {
+			return err
+		}
+		if keys, err = store.SigningKeys().List(ctx); err != nil {
+			return err
+		}
+	}
+	return signingKeys.load(store, keys)
+}
+
+func (s *keySet) load(store models.Store, keys []models.SigningKey) error {
+	verification := make(map[string]verificationKey, len(keys))
+	var signingKid string
+	var signing crypto.Signer
+	for _, k := range keys {
+		if k.RetiredAt != nil && time.Since(*k.RetiredAt) > retiredKeyValidity() {
+			continue
+		}
+		private, err := x509.ParsePKCS8PrivateKey(k.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("invalid signing key %s: %s", k.Kid, err.Error())
+		}
+		signer, ok := private.(crypto.Signer)
+		if !ok {
+			return fmt.Errorf("invalid signing key %s", k.Kid)
+		}
+		verification[k.Kid] = verificationKey{kid: k.Kid, algorithm: k.Algorithm, public: signer.Public()}
+		// The newest key signs
+		if k.RetiredAt == nil && k.Algorithm == jwtAlgorithm {
+			signingKid, signing = k.Kid, signer
+		}
+	}
+	if signing == nil {
+		return errors.New("no signing key for " + jwtAlgorithm)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.store = store
+	s.signingKid = signingKid
+	s.signing = signing
+	s.keys = verification
+	s.loadedAt = time.Now()
+	return nil
+}
+
+// RefreshSigningKeys reloads the keys every key refresh interval, until the context is cancelled
+func RefreshSigningKeys(ctx context.Context, store models.Store) {
+	if !asymmetric() {
+		return
+	}
+	ticker := time.NewTicker(keyRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := LoadSigningKeys(ctx, store); err != nil {
+				logging.Error(ctx, "Could not refresh the JWT signing keys, keeping the previous ones", err, nil)
+			}
+		}
+	}
+}
+
+// RotateSigningKey adds a new key of the configured algorithm, which signs the new tokens. The
+// previous ones are retired, and deleted once their tokens have expired
+func RotateSigningKey(ctx context.Context, store models.Store) (models.SigningKey, error) {
+	if !asymmetric() {
+		return models.SigningKey{}, errors.New("signing keys are only used with the RS256 and ES256 algorithms (auth.jwt_algorithm)")
+	}
+	var private crypto.Signer
+	var err error
+	if jwtAlgorithm == "RS256" {
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return models.SigningKey{}, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return models.SigningKey{}, err
+	}
+	kid, err := utils.RandomToken(8)
+	if err != nil {
+		return models.SigningKey{}, err
+	}
+
+	k := models.SigningKey{Kid: kid, Algorithm: jwtAlgorithm, PrivateKey: der}
+	err = store.InTx(ctx, func(tx models.Store) error {
+		if err := tx.SigningKeys().Add(ctx, &k); err != nil {
+			return err
+		}
+		if err := tx.SigningKeys().Retire(ctx, k.Kid); err != nil {
+			return err
+		}
+		return tx.SigningKeys().DeleteRetired(ctx, retiredKeyValidity())
+	})
+	return k, err
+}
+
+// Signs the token with the current key, setting its kid
+func (s *keySet) sign(token *jwt.Token) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.signing == nil {
+		return "", errors.New("the JWT signing keys are not loaded")
+	}
+	token.Header["kid"] = s.signingKid
+	return token.SignedString(s.signing)
+}
+
+func (s *keySet) get(kid string) (verificationKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.keys[kid]
+	return k, ok
+}
+
+// Reloads the keys if they were not loaded recently, e.g. when another instance rotated them
+func (s *keySet) reload(ctx context.Context) {
+	s.mu.RLock()
+	store, recent := s.store, time.Since(s.loadedAt) < unknownKidReloadInterval
+	s.mu.RUnlock()
+	if store == nil || recent {
+		return
+	}
+	if err := LoadSigningKeys(ctx, store); err != nil {
+		logging.Error(ctx, "Could not reload the JWT signing keys", err, nil)
+	}
+}
+
+// keyFunc returns the key verifying the token, only if signed with the algorithm of that key
+func keyFunc(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		alg := token.Method.Alg()
+		if !asymmetric() {
+			if alg != "HS256" {
+				return nil, errors.New("unexpected signing algorithm " + alg)
+			}
+			return jwtKey, nil
+		}
+		kid, _ := token.Header["kid"].(string)
+		k, ok := signingKeys.get(kid)
+		if !ok {
+			signingKeys.reload(ctx)
+			if k, ok = signingKeys.get(kid); !ok {
+				return nil, errors.New("unknown signing key " + kid)
+			}
+		}
+		if alg != k.algorithm {
+			return nil, errors.New("unexpected signing algorithm " + alg)
+		}
+		return k.public, nil
+	}
+}
+
+// JWK is a public key of the JSON Web Key Set (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n,omitempty"` // RSA
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"` // EC
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS returns the public keys verifying the tokens, empty with HS256, whose secret cannot be published
+func JWKS() map[string][]JWK {
+	keys := []JWK{}
+	if asymmetric() {
+		signingKeys.mu.RLock()
+		defer signingKeys.mu.RUnlock()
+		for _, k := range signingKeys.keys {
+			keys = append(keys, jwk(k))
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Kid < keys[j].Kid })
+	}
+	return map[string][]JWK{"keys": keys}
+}
+
+func jwk(k verificationKey) JWK {
+	b64 := base64.RawURLEncoding.EncodeToString
+	key := JWK{Kid: k.kid, Alg: k.algorithm, Use: "sig"}
+	switch public := k.public.(type) {
+	case *rsa.PublicKey:
+		key.Kty = "RSA"
+		key.N = b64(public.N.Bytes())
+		key.E = b64(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		// Coordinates padded to the size of the curve
+		size := (public.Curve.Params().BitSize + 7) / 8
+		key.Kty = "EC"
+		key.Crv = public.Curve.Params().Name
+		key.X = b64(padded(public.X, size))
+		key.Y = b64(padded(public.Y, size))
+	}
+	return key
+}
+
+func padded(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	return append(make([]byte, size-len(b)), b...)
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+/*****************************************************
+Challenges and recovery codes of two-factor logins
+******************************************************/
+
+// Purposes of the challenge tokens, which are not valid as tokens of the API
+const (
+	PurposeTwoFactor  = "2fa"        // Exchanged for a token with a code
+	PurposeEnrollment = "2fa_enroll" // Only valid to enroll, for the users who must
+)
+
+var ErrInvalidChallenge = errors.New("Invalid or expired challenge token")
+
+// NewChallenge returns a challenge token of the purpose for the user, signed as the tokens of the API
+func NewChallenge(username, purpose string, lifetime time.Duration) (string, error) {
+	return signClaims(&Claims{
+		Username: username,
+		Purpose:  purpose,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(lifetime).Unix(),
+		},
+	})
+}
+
+// ParseChallenge returns the username of a valid challenge token of the purpose
+func ParseChallenge(ctx context.Context, token, purpose string) (string, error) {
+	claims := &Claims{}
+	tkn, err := jwt.ParseWithClaims(token, claims, keyFunc(ctx))
+	if err != nil || !tkn.Valid || claims.Purpose != purpose || claims.Username == "" {
+		return "", ErrInvalidChallenge
+	}
+	return claims.Username, nil
+}
+
+// GenerateRecoveryCodes returns n random recovery codes, formatted as xxxxx-xxxxx, with their hashes
+func GenerateRecoveryCodes(n int) (codes []string, hashes [][]byte, err error) {
+	for i := 0; i < n; i++ {
+		token, err := utils.RandomToken(5)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := token[:5] + "-" + token[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, HashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode returns the hash stored for the code, ignoring its case and separators. Codes
+// are random, so a fast hash is enough, as for the API keys
+func HashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
@@ -0,0 +1,633 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds every setting of the API. Each one can be set, from lowest to highest priority, in
+// the config file (YAML or TOML), with its environment variable or with its command line flag
+// (-section.key, e.g. -server.port=4000)
+type Config struct {
+	Server    Server    `key:"server"`
+	TLS       TLS       `key:"tls"`
+	Database  Database  `key:"database"`
+	Auth      Auth      `key:"auth"`
+	Passwords Passwords `key:"passwords"`
+	Login     Login     `key:"login"`
+	OIDC      OIDC      `key:"oidc"`
+	TwoFactor TwoFactor `key:"two_factor"`
+	Uploads   Uploads   `key:"uploads"`
+	Mail      Mail      `key:"mail"`
+	Logging   Logging   `key:"logging"`
+	Metrics   Metrics   `key:"metrics"`
+	Tracing   Tracing   `key:"tracing"`
+}
+
+type Server struct {
+	Port            int           `key:"port" env:"PORT"`
+	ImagesDir       string        `key:"images_dir" env:"IMAGES_DIR"`
+	PublicDir       string        `key:"public_dir" env:"PUBLIC_DIR"`
+	ReadTimeout     time.Duration `key:"read_timeout" env:"SERVER_READ_TIMEOUT"`
+	WriteTimeout    time.Duration `key:"write_timeout" env:"SERVER_WRITE_TIMEOUT"`
+	ShutdownDelay   time.Duration `key:"shutdown_delay" env:"SHUTDOWN_DELAY"`
+	ShutdownTimeout time.Duration `key:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+}
+
+// TLS is enabled when both the certificate and key files are set
+type TLS struct {
+	CertFile       string        `key:"cert_file" env:"TLS_CERT_FILE"`
+	KeyFile        string        `key:"key_file" env:"TLS_KEY_FILE"`
+	MinVersion     string        `key:"min_version" env:"TLS_MIN_VERSION"`
+	CipherPolicy   string        `key:"cipher_policy" env:"TLS_CIPHER_POLICY"`
+	ReloadInterval time.Duration `key:"reload_interval" env:"TLS_RELOAD_INTERVAL"`
+	RedirectPort   int           `key:"redirect_port" env:"TLS_REDIRECT_PORT"`
+	HSTSMaxAge     time.Duration `key:"hsts_max_age" env:"TLS_HSTS_MAX_AGE"`
+	ClientCAFile   string        `key:"client_ca_file" env:"TLS_CLIENT_CA_FILE"`
+	ClientAuth     string        `key:"client_auth" env:"TLS_CLIENT_AUTH"`
+}
+
+func (t TLS) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
+}
+
+type Database struct {
+	URL            string        `key:"url" env:"DATABASE_URL" secret:"true"`
+	ConnectRetries int           `key:"connect_retries" env:"DB_CONNECT_RETRIES"`
+	QueryTimeout   time.Duration `key:"query_timeout" env:"DB_QUERY_TIMEOUT"`
+	ListTimeout    time.Duration `key:"list_timeout" env:"DB_LIST_TIMEOUT"`
+}
+
+type Auth struct {
+	JWTAlgorithm       string        `key:"jwt_algorithm" env:"JWT_ALGORITHM"`
+	JWTSecret          string        `key:"jwt_secret" env:"JWT_SECRET" secret:"true"`
+	JWTLifetime        time.Duration `key:"jwt_lifetime" env:"JWT_LIFETIME"`
+	SessionLifetime    time.Duration `key:"session_lifetime" env:"SESSION_LIFETIME"` // Without refreshing its tokens
+	KeyRefreshInterval time.Duration `key:"key_refresh_interval" env:"JWT_KEY_REFRESH_INTERVAL"`
+	PictureURLSecret   string        `key:"picture_url_secret" env:"PICTURE_URL_SECRET" secret:"true"`
+	PictureURLTTL      time.Duration `key:"picture_url_ttl" env:"PICTURE_URL_TTL"`
+	RequireSignedURLs  bool          `key:"require_signed_urls" env:"STATIC_REQUIRE_SIGNATURE"` // false is deprecated
+}
+
+// Asymmetric returns whether the tokens are signed with the rotated key pairs of the database,
+// instead of the JWT secret
+func (a Auth) Asymmetric() bool {
+	return !strings.EqualFold(a.JWTAlgorithm, "HS256")
+}
+
+// New passwords are hashed with the algorithm (bcrypt or argon2id), and the existing hashes are
+// replaced on login when it or its cost change. breached_list is a file of passwords (or their
+// SHA-1 hashes) refused as new passwords. Password reset tokens are mailed to the users, with the
+// reset_url of the page of the client where they choose their new password (the token is appended to it)
+type Passwords struct {
+	Algorithm          string        `key:"algorithm" env:"PASSWORD_ALGORITHM"`
+	BcryptCost         int           `key:"bcrypt_cost" env:"BCRYPT_COST"`
+	Argon2Memory       int           `key:"argon2_memory" env:"ARGON2_MEMORY"` // KiB
+	Argon2Iterations   int           `key:"argon2_iterations" env:"ARGON2_ITERATIONS"`
+	Argon2Parallelism  int           `key:"argon2_parallelism" env:"ARGON2_PARALLELISM"`
+	MinLength          int           `key:"min_length" env:"PASSWORD_MIN_LENGTH"`
+	BreachedList       string        `key:"breached_list" env:"PASSWORD_BREACHED_LIST"`
+	ResetTokenLifetime time.Duration `key:"reset_token_lifetime" env:"PASSWORD_RESET_TOKEN_LIFETIME"`
+	ResetURL           string        `key:"reset_url" env:"PASSWORD_RESET_URL"`
+}
+
+// Login attempts are limited per client IP and per username with token buckets holding up to
+// burst attempts, refilled with one every refill. Accounts are locked after lockout_threshold
+// consecutive failures, for lockout_duration doubled with every further failure
+type Login struct {
+	IPBurst            int           `key:"ip_burst" env:"LOGIN_IP_BURST"`
+	IPRefill           time.Duration `key:"ip_refill" env:"LOGIN_IP_REFILL"`
+	UserBurst          int           `key:"user_burst" env:"LOGIN_USER_BURST"`
+	UserRefill         time.Duration `key:"user_refill" env:"LOGIN_USER_REFILL"`
+	LockoutThreshold   int           `key:"lockout_threshold" env:"LOGIN_LOCKOUT_THRESHOLD"`
+	LockoutDuration    time.Duration `key:"lockout_duration" env:"LOGIN_LOCKOUT_DURATION"`
+	LockoutMaxDuration time.Duration `key:"lockout_max_duration" env:"LOGIN_LOCKOUT_MAX_DURATION"`
+	TrustXForwardedFor bool          `key:"trust_x_forwarded_for" env:"LOGIN_TRUST_X_FORWARDED_FOR"`
+}
+
+// Single sign-on with an OpenID Connect provider, enabled if issuer_url is set. Users are created
+// or linked on their first login, as admins if they are in one of the admin_groups (of the
+// groups_claim of their ID token). If user_groups is set, only their members and admins can login
+type OIDC struct {
+	IssuerURL    string `key:"issuer_url" env:"OIDC_ISSUER_URL"`
+	ClientID     string `key:"client_id" env:"OIDC_CLIENT_ID"`
+	ClientSecret string `key:"client_secret" env:"OIDC_CLIENT_SECRET" secret:"true"`
+	RedirectURL  string `key:"redirect_url" env:"OIDC_REDIRECT_URL"`
+	Scopes       string `key:"scopes" env:"OIDC_SCOPES"`
+	GroupsClaim  string `key:"groups_claim" env:"OIDC_GROUPS_CLAIM"`
+	AdminGroups  string `key:"admin_groups" env:"OIDC_ADMIN_GROUPS"` // Comma separated
+	UserGroups   string `key:"user_groups" env:"OIDC_USER_GROUPS"`
+}
+
+func (o OIDC) Enabled() bool {
+	return o.IssuerURL != ""
+}
+
+// List splits a comma separated setting, e.g. oidc.admin_groups
+func List(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Two-factor authentication with time-based one-time passwords (TOTP). Users of the required_roles
+// must enroll before getting a token. Logins with a password are completed with a challenge token,
+// valid for challenge_lifetime, exchanged for the JWT with a code
+type TwoFactor struct {
+	Issuer            string        `key:"issuer" env:"TWO_FACTOR_ISSUER"`
+	RequiredRoles     string        `key:"required_roles" env:"TWO_FACTOR_REQUIRED_ROLES"` // Comma separated
+	ChallengeLifetime time.Duration `key:"challenge_lifetime" env:"TWO_FACTOR_CHALLENGE_LIFETIME"`
+}
+
+type Uploads struct {
+	MaxMemory         int64         `key:"max_memory" env:"UPLOAD_MAX_MEMORY"`
+	MaxAttachmentSize int64         `key:"max_attachment_size" env:"ATTACHMENT_MAX_SIZE"`
+	MaxResumableSize  int64         `key:"max_resumable_size" env:"UPLOAD_MAX_SIZE"`
+	Expiration        time.Duration `key:"expiration" env:"UPLOAD_EXPIRATION"`
+	PictureFallback   string        `key:"picture_fallback" env:"PICTURE_FALLBACK"`
+}
+
+// Mails are sent with an SMTP server, or written to the log or to a file (e.g. in development)
+type Mail struct {
+	Driver       string `key:"driver" env:"MAIL_DRIVER"`
+	From         string `key:"from" env:"MAIL_FROM"`
+	File         string `key:"file" env:"MAIL_FILE"`
+	SMTPAddr     string `key:"smtp_addr" env:"SMTP_ADDR"` // host:port
+	SMTPUsername string `key:"smtp_username" env:"SMTP_USERNAME"`
+	SMTPPassword string `key:"smtp_password" env:"SMTP_PASSWORD" secret:"true"`
+}
+
+type Logging struct {
+	Level  string `key:"level" env:"LOG_LEVEL"`
+	Format string `key:"format" env:"LOG_FORMAT"`
+}
+
+type Metrics struct {
+	Token string `key:"token" env:"METRICS_TOKEN" secret:"true"`
+}
+
+type Tracing struct {
+	Endpoint       string `key:"endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	TracesEndpoint string `key:"traces_endpoint" env:"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"`
+	ServiceName    string `key:"service_name" env:"OTEL_SERVICE_NAME"`
+}
+
+// TracesURL is where the spans are exported to, or "" if tracing is not enabled
+func (t Tracing) TracesURL() string {
+	if t.TracesEndpoint != "" || t.Endpoint == "" {
+		return t.TracesEndpoint
+	}
+	return strings.TrimSuffix(t.Endpoint, "/") + "/v1/traces"
+}
+
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Port:            8080,
+			ImagesDir:       "./img/",
+			PublicDir:       "./public/",
+			ReadTimeout:     15 * time.Second,
+			WriteTimeout:    15 * time.Second,
+			ShutdownDelay:   5 * time.Second,
+			ShutdownTimeout: 30 * time.Second,
+		},
+		TLS: TLS{
+			MinVersion:     "1.2",
+			CipherPolicy:   "modern",
+			ReloadInterval: 30 * time.Second,
+			HSTSMaxAge:     365 * 24 * time.Hour,
+			ClientAuth:     "optional",
+		},
+		Database: Database{
+			ConnectRetries: 10,
+			QueryTimeout:   5 * time.Second,
+			ListTimeout:    10 * time.Second,
+		},
+		Auth: Auth{
+			JWTAlgorithm:       "HS256",
+			JWTLifetime:        5 * time.Minute,
+			SessionLifetime:    30 * 24 * time.Hour,
+			KeyRefreshInterval: time.Minute,
+			PictureURLTTL:      15 * time.Minute,
+			RequireSignedURLs:  true,
+		},
+		Passwords: Passwords{
+			Algorithm:          "bcrypt",
+			BcryptCost:         14,
+			Argon2Memory:       64 * 1024,
+			Argon2Iterations:   3,
+			Argon2Parallelism:  2,
+			MinLength:          12,
+			ResetTokenLifetime: time.Hour,
+		},
+		Login: Login{
+			IPBurst:            20,
+			IPRefill:           3 * time.Second,
+			UserBurst:          5,
+			UserRefill:         12 * time.Second,
+			LockoutThreshold:   5,
+			LockoutDuration:    time.Minute,
+			LockoutMaxDuration: time.Hour,
+		},
+		OIDC: OIDC{
+			Scopes:      "openid profile groups",
+			GroupsClaim: "groups",
+		},
+		TwoFactor: TwoFactor{
+			Issuer:            "CRM API",
+			ChallengeLifetime: 5 * time.Minute,
+		},
+		Uploads: Uploads{
+			MaxMemory:         32 << 20,
+			MaxAttachmentSize: 512 << 20,
+			MaxResumableSize:  512 << 20,
+			Expiration:        24 * time.Hour,
+			PictureFallback:   "avatar",
+		},
+		Mail: Mail{
+			Driver: "log",
+			From:   "CRM API <noreply@localhost>",
+			File:   "mail.log",
+		},
+		Logging: Logging{
+			Level:  "info",
+			Format: "json",
+		},
+		Tracing: Tracing{
+			ServiceName: "crm-api",
+		},
+	}
+}
+
+// Load returns the validated configuration, read from the defaults, the config file given with
+// -config (or CONFIG_FILE), the environment and the flags at the beginning of args. The arguments
+// after the flags are returned, e.g. the command to run
+func Load(args []string) (c *Config, rest []string, err error) {
+	c = Default()
+	options := c.options()
+
+	fs := flag.NewFlagSet("crmapi", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML configuration file")
+	flags := make(map[string]*string)
+	for _, o := range options {
+		flags[o.key] = fs.String(o.key, "", "Overrides "+o.env)
+	}
+	// Shorter names kept from previous versions
+	flags["images"] = fs.String("images", "", "Same as -server.images_dir")
+	flags["public"] = fs.String("public", "", "Same as -server.public_dir")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	var errs []string
+	if *configFile != "" {
+		values, err := readFile(*configFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		for key, value := range values {
+			o, ok := options[key]
+			if !ok {
+				errs = append(errs, fmt.Sprintf("%s: unknown setting %s", *configFile, key))
+				continue
+			}
+			if err := o.set(value); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s: %s", *configFile, key, err.Error()))
+			}
+		}
+	}
+
+	for _, o := range options {
+		if value, ok := os.LookupEnv(o.env); ok && value != "" {
+			if err := o.set(value); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", o.env, err.Error()))
+			}
+		}
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	aliases := map[string]string{"images": "server.images_dir", "public": "server.public_dir"}
+	for name, value := range flags {
+		if !set[name] {
+			continue
+		}
+		key := name
+		if alias, ok := aliases[name]; ok {
+			key = alias
+		}
+		if err := options[key].set(*value); err != nil {
+			errs = append(errs, fmt.Sprintf("-%s: %s", name, err.Error()))
+		}
+	}
+
+	if len(errs) == 0 {
+		if err := c.Validate(); err != nil {
+			return nil, nil, err
+		}
+		return c, fs.Args(), nil
+	}
+	return nil, nil, errors.New("invalid configuration: " + strings.Join(errs, "; "))
+}
+
+// Validate returns an error listing every invalid setting
+func (c *Config) Validate() error {
+	var errs []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port < 65536, "server.port must be between 1 and 65535")
+	check(c.Server.ImagesDir != "", "server.images_dir is required")
+	check(c.Server.PublicDir != "", "server.public_dir is required")
+	check(c.Server.ReadTimeout > 0, "server.read_timeout must be positive")
+	check(c.Server.WriteTimeout > 0, "server.write_timeout must be positive")
+	check(c.Server.ShutdownDelay >= 0, "server.shutdown_delay cannot be negative")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+
+	check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "tls.cert_file and tls.key_file must be set together")
+	check(oneOf(c.TLS.MinVersion, "1.2", "1.3"), "tls.min_version must be 1.2 or 1.3")
+	check(oneOf(c.TLS.CipherPolicy, "modern", "compatible"), "tls.cipher_policy must be modern or compatible")
+	check(c.TLS.ReloadInterval >= 0, "tls.reload_interval cannot be negative")
+	check(c.TLS.RedirectPort >= 0 && c.TLS.RedirectPort < 65536, "tls.redirect_port must be between 0 (disabled) and 65535")
+	check(c.TLS.RedirectPort == 0 || c.TLS.RedirectPort != c.Server.Port, "tls.redirect_port must be different from server.port")
+	check(c.TLS.HSTSMaxAge >= 0, "tls.hsts_max_age cannot be negative")
+	check(oneOf(c.TLS.ClientAuth, "optional", "require"), "tls.client_auth must be optional or require")
+	check(c.TLS.ClientCAFile == "" || c.TLS.Enabled(), "tls.client_ca_file requires tls.cert_file and tls.key_file")
+
+	check(c.Database.URL != "", "database.url (DATABASE_URL) is required")
+	check(c.Database.ConnectRetries > 0, "database.connect_retries must be at least 1")
+	check(c.Database.QueryTimeout > 0, "database.query_timeout must be positive")
+	check(c.Database.ListTimeout > 0, "database.list_timeout must be positive")
+
+	check(oneOf(c.Auth.JWTAlgorithm, "HS256", "RS256", "ES256"), "auth.jwt_algorithm must be HS256, RS256 or ES256")
+	if c.Auth.Asymmetric() {
+		// The secret is still needed to derive the key of the picture URLs
+		check(c.Auth.JWTSecret != "" || c.Auth.PictureURLSecret != "",
+			"auth.jwt_secret (JWT_SECRET) or auth.picture_url_secret (PICTURE_URL_SECRET) is required")
+		check(c.Auth.KeyRefreshInterval > 0, "auth.key_refresh_interval must be positive")
+	} else {
+		check(c.Auth.JWTSecret != "", "auth.jwt_secret (JWT_SECRET) is required")
+	}
+	check(c.Auth.JWTLifetime > 0, "auth.jwt_lifetime must be positive")
+	check(c.Auth.SessionLifetime >= c.Auth.JWTLifetime, "auth.session_lifetime must be at least auth.jwt_lifetime")
+	check(c.Auth.PictureURLTTL > 0, "auth.picture_url_ttl must be positive")
+
+	check(oneOf(c.Passwords.Algorithm, "bcrypt", "argon2id"), "passwords.algorithm must be bcrypt or argon2id")
+	// Limits of golang.org/x/crypto/bcrypt and argon2
+	check(c.Passwords.BcryptCost >= 4 && c.Passwords.BcryptCost <= 31, "passwords.bcrypt_cost must be between 4 and 31")
+	check(c.Passwords.Argon2Parallelism >= 1 && c.Passwords.Argon2Parallelism <= 255, "passwords.argon2_parallelism must be between 1 and 255")
+	check(c.Passwords.Argon2Memory >= 8*c.Passwords.Argon2Parallelism, "passwords.argon2_memory must be at least 8 KiB per thread")
+	check(c.Passwords.Argon2Iterations >= 1, "passwords.argon2_iterations must be at least 1")
+	// bcrypt refuses passwords longer than 72 bytes
+	check(c.Passwords.MinLength >= 8 && c.Passwords.MinLength <= 72, "passwords.min_length must be between 8 and 72")
+	check(c.Passwords.ResetTokenLifetime > 0, "passwords.reset_token_lifetime must be positive")
+	check(c.Passwords.ResetURL == "" || isHTTPURL(c.Passwords.ResetURL), "passwords.reset_url must be an http(s) URL")
+
+	check(c.Login.IPBurst >= 0 && c.Login.UserBurst >= 0, "login.ip_burst and login.user_burst cannot be negative (0 disables them)")
+	check(c.Login.IPBurst == 0 || c.Login.IPRefill > 0, "login.ip_refill must be positive")
+	check(c.Login.UserBurst == 0 || c.Login.UserRefill > 0, "login.user_refill must be positive")
+	check(c.Login.LockoutThreshold >= 0, "login.lockout_threshold cannot be negative (0 disables it)")
+	check(c.Login.LockoutThreshold == 0 || c.Login.LockoutDuration > 0, "login.lockout_duration must be positive")
+	check(c.Login.LockoutMaxDuration >= c.Login.LockoutDuration, "login.lockout_max_duration must be at least login.lockout_duration")
+
+	if c.OIDC.Enabled() {
+		check(isHTTPURL(c.OIDC.IssuerURL), "oidc.issuer_url must be an http(s) URL")
+		check(c.OIDC.ClientID != "", "oidc.client_id is required")
+		check(isHTTPURL(c.OIDC.RedirectURL), "oidc.redirect_url must be the http(s) URL of /users/oidc/callback")
+		check(strings.Contains(" "+c.OIDC.Scopes+" ", " openid "), "oidc.scopes must include openid")
+	}
+
+	check(c.TwoFactor.Issuer != "", "two_factor.issuer is required")
+	for _, role := range List(c.TwoFactor.RequiredRoles) {
+		check(oneOf(role, "user", "admin"), "two_factor.required_roles must be user or admin roles")
+	}
+	check(c.TwoFactor.ChallengeLifetime > 0, "two_factor.challenge_lifetime must be positive")
+
+	check(c.Uploads.MaxMemory > 0, "uploads.max_memory must be positive")
+	check(c.Uploads.MaxAttachmentSize > 0, "uploads.max_attachment_size must be positive")
+	check(c.Uploads.MaxResumableSize > 0, "uploads.max_resumable_size must be positive")
+	check(c.Uploads.Expiration > 0, "uploads.expiration must be positive")
+	check(c.Uploads.PictureFallback == "avatar" || c.Uploads.PictureFallback == "placeholder",
+		"uploads.picture_fallback must be avatar or placeholder")
+
+	check(oneOf(c.Mail.Driver, "log", "file", "smtp"), "mail.driver must be log, file or smtp")
+	_, err := mail.ParseAddress(c.Mail.From)
+	check(err == nil, "mail.from must be an address, e.g. CRM API <noreply@example.com>")
+	check(!strings.EqualFold(c.Mail.Driver, "file") || c.Mail.File != "", "mail.file is required with the file driver")
+	check(!strings.EqualFold(c.Mail.Driver, "smtp") || c.Mail.SMTPAddr != "", "mail.smtp_addr is required with the smtp driver")
+
+	check(oneOf(c.Logging.Level, "debug", "info", "warn", "error"), "logging.level must be debug, info, warn or error")
+	check(oneOf(c.Logging.Format, "json", "text"), "logging.format must be json or text")
+
+	if url := c.Tracing.TracesURL(); url != "" {
+		check(isHTTPURL(url), "tracing endpoint must be an http(s) URL")
+	}
+
+	if len(errs) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Print writes every setting as "key = value", with the secrets redacted
+func (c *Config) Print(w io.Writer) {
+	for _, key := range c.keys() {
+		fmt.Fprintf(w, "%s = %s\n", key, c.options()[key].redacted())
+	}
+}
+
+// Redacted returns every setting by key, with the secrets redacted, e.g. to log them
+func (c *Config) Redacted() map[string]string {
+	values := make(map[string]string)
+	for key, o := range c.options() {
+		values[key] = o.redacted()
+	}
+	return values
+}
+
+func isHTTPURL(value string) bool {
+	return strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://")
+}
+
+func oneOf(value string, valid ...string) bool {
+	for _, v := range valid {
+		if strings.EqualFold(value, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func readFile(name string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]string
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		values, err = parseYAML(data)
+	case ".toml":
+		values, err = parseTOML(data)
+	default:
+		return nil, fmt.Errorf("%s: unknown config file format, use .yaml, .yml or .toml", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err.Error())
+	}
+	return values, nil
+}
+
+// option is a setting of the configuration, found with the tags of the fields
+type option struct {
+	key    string
+	env    string
+	secret bool
+	value  reflect.Value
+}
+
+func (c *Config) options() map[string]option {
+	options := make(map[string]option)
+	sections := reflect.ValueOf(c).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		prefix := sections.Type().Field(i).Tag.Get("key")
+		for j := 0; j < section.NumField(); j++ {
+			field := section.Type().Field(j)
+			key := prefix + "." + field.Tag.Get("key")
+			options[key] = option{
+				key:    key,
+				env:    field.Tag.Get("env"),
+				secret: field.Tag.Get("secret") == "true",
+				value:  section.Field(j),
+			}
+		}
+	}
+	return options
+}
+
+// Keys in the order of the fields
+func (c *Config) keys() []string {
+	var keys []string
+	sections := reflect.TypeOf(c).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		for j := 0; j < section.Type.NumField(); j++ {
+			keys = append(keys, section.Tag.Get("key")+"."+section.Type.Field(j).Tag.Get("key"))
+		}
+	}
+	return keys
+}
+
+func (o option) set(s string) error {
+	s = strings.TrimSpace(s)
+	switch v := o.value.Addr().Interface().(type) {
+	case *string:
+		*v = s
+	case *bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", s)
+		}
+		*v = b
+	case *int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		*v = n
+	case *int64:
+		n, err := parseSize(s)
+		if err != nil {
+			return err
+		}
+		*v = n
+	case *time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		*v = d
+	}
+	return nil
+}
+
+func (o option) String() string {
+	switch v := o.value.Interface().(type) {
+	case int64:
+		return formatSize(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+var dsnPassword = regexp.MustCompile(`(password=)('[^']*'|\S+)`)
+
+func (o option) redacted() string {
+	value := o.String()
+	if !o.secret || value == "" {
+		return value
+	}
+	// Only the password of the database URLs is secret
+	if o.key == "database.url" {
+		if u, err := url.Parse(value); err == nil && u.Scheme != "" {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), "REDACTED")
+			}
+			return u.String()
+		}
+		return dsnPassword.ReplaceAllString(value, "${1}REDACTED")
+	}
+	return "REDACTED"
+}
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{{"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}, {"B", 1}}
+
+// Sizes are numbers of bytes, optionally followed by KiB, MiB or GiB, e.g. 32MiB
+func parseSize(s string) (int64, error) {
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			n, err := strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(s, unit.suffix)), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid size %q", s)
+			}
+			return n * unit.bytes, nil
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n, nil
+}
+
+func formatSize(n int64) string {
+	for _, unit := range sizeUnits {
+		if n != 0 && n%unit.bytes == 0 {
+			return strconv.FormatInt(n/unit.bytes, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// The config files are made of sections of plain values, read into a map of dotted keys (e.g.
+// "server.port") to the values, which are parsed like the ones of the environment and the flags
+
+type fileValue string
+
+func (v *fileValue) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: expected a single value", node.Line)
+	}
+	*v = fileValue(node.Value)
+	return nil
+}
+
+func (v *fileValue) UnmarshalTOML(data interface{}) error {
+	switch data.(type) {
+	case map[string]interface{}, []interface{}, []map[string]interface{}:
+		return errors.New("expected a single value")
+	}
+	*v = fileValue(fmt.Sprint(data))
+	return nil
+}
+
+type fileSections map[string]map[string]fileValue
+
+func parseYAML(data []byte) (map[string]string, error) {
+	var sections fileSections
+	if err := yaml.Unmarshal(data, &sections); err != nil {
+		return nil, err
+	}
+	return sections.values(), nil
+}
+
+func parseTOML(data []byte) (map[string]string, error) {
+	var sections fileSections
+	if _, err := toml.Decode(string(data), &sections); err != nil {
+		return nil, err
+	}
+	return sections.values(), nil
+}
+
+func (s fileSections) values() map[string]string {
+	values := make(map[string]string)
+	for section, keys := range s {
+		for key, value := range keys {
+			values[section+"."+key] = string(value)
+		}
+	}
+	return values
+}
@@ -1,68 +1,65 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"log"
-	"os"
 	"path"
+	"time"
 
 	_ "github.com/lib/pq"
+	"theam.io/jdavidsanchez/test_crm_api/config"
+	"theam.io/jdavidsanchez/test_crm_api/logging"
 	"theam.io/jdavidsanchez/test_crm_api/models"
 	"theam.io/jdavidsanchez/test_crm_api/utils"
 )
 
 var DB *sql.DB
 
-func InitDB() {
-	var err error
-
-	DB, err = sql.Open("postgres", os.Getenv("DATABASE_URL"))
-
-	utils.CheckErr(err)
-
-	err = DB.Ping()
-	utils.CheckErr(err)
+func InitDB(c config.Database) {
+	err := Connect(c)
+	if err != nil {
+		log.Fatalf("Could not connect to database: %s", err.Error())
+	}
 	log.Print("Connected to database")
 
-	// First time initialization (// FIXME ?)
+	err = Migrate()
+	if err != nil {
+		log.Fatalf("Could not migrate database: %s", err.Error())
+	}
 
-	_, err = DB.Exec(`
-		CREATE TABLE IF NOT EXISTS users (
-			id SERIAL PRIMARY KEY,
-			username VARCHAR(64) UNIQUE NOT NULL,
-			passwd BYTEA NOT NULL
-		)`)
-	utils.CheckErr(err)
+	noPicturePlaceholder := models.PicturePath{
+		Id:   1,
+		Path: path.Join(utils.PathFileServer, utils.PlaceholderPicture),
+	}
 
-	_, err = DB.Exec(`
-		CREATE TABLE IF NOT EXISTS pictures (
-			id SERIAL PRIMARY KEY,
-			picturePath TEXT UNIQUE NOT NULL
-		)`)
+	err = noPicturePlaceholder.AddPicture(context.Background(), DB)
 	utils.CheckErr(err)
+}
 
-	_, err = DB.Exec(`
-		CREATE TABLE IF NOT EXISTS customers (
-			id SERIAL PRIMARY KEY,
-			customername VARCHAR(32) NOT NULL,
-			surname VARCHAR(32) NOT NULL,
-			pictureId INTEGER REFERENCES pictures,
-			createdByUserId INTEGER REFERENCES users,
-			lastModifiedByUserId INTEGER REFERENCES users
-		)`)
-	utils.CheckErr(err)
+// Connect opens the connection pool, retrying with exponential backoff until the
+// database answers or c.ConnectRetries attempts have failed
+func Connect(c config.Database) error {
+	var err error
 
-	initialUser := models.User{
-		Username: "Admin",
-		Password: "hunter2",
-	}
-	noPicturePlaceholder := models.PicturePath{
-		Id:   1,
-		Path: path.Join(utils.PathFileServer, "noPicturePlaceholder.jpg"),
+	DB, err = sql.Open("postgres", c.URL)
+	if err != nil {
+		return err
 	}
 
-	err = initialUser.CreateUser(DB)
-	utils.CheckErr(err)
-	err = noPicturePlaceholder.AddPicture(DB)
-	utils.CheckErr(err)
+	retries := c.ConnectRetries
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err = DB.Ping()
+		if err == nil || attempt >= retries {
+			return err
+		}
+		logging.Warn(context.Background(), "Database not available, retrying", logging.Fields{
+			"attempt": attempt, "retries": retries, "backoff": backoff.String(), "error": err.Error(),
+		})
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
 }
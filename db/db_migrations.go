@@ -0,0 +1,306 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"theam.io/jdavidsanchez/test_crm_api/logging"
+)
+
+// Schema migrations, applied in order. Never change an already released one, append a new one instead
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS users (
+		id SERIAL PRIMARY KEY,
+		username VARCHAR(64) UNIQUE NOT NULL,
+		passwd BYTEA NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS pictures (
+		id SERIAL PRIMARY KEY,
+		picturePath TEXT UNIQUE NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS customers (
+		id SERIAL PRIMARY KEY,
+		customername VARCHAR(32) NOT NULL,
+		surname VARCHAR(32) NOT NULL,
+		pictureId INTEGER REFERENCES pictures,
+		createdByUserId INTEGER REFERENCES users,
+		lastModifiedByUserId INTEGER REFERENCES users
+	)`,
+	`CREATE TABLE IF NOT EXISTS customer_attachments (
+		id SERIAL PRIMARY KEY,
+		customerId INTEGER NOT NULL REFERENCES customers ON DELETE CASCADE,
+		title TEXT NOT NULL,
+		fileName TEXT NOT NULL,
+		filePath TEXT UNIQUE NOT NULL,
+		mimeType TEXT NOT NULL,
+		size BIGINT NOT NULL,
+		isPrimary BOOLEAN NOT NULL DEFAULT FALSE,
+		uploadedByUserId INTEGER REFERENCES users,
+		uploadedAt TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE TABLE IF NOT EXISTS picture_uploads (
+		id VARCHAR(32) PRIMARY KEY,
+		userId INTEGER NOT NULL REFERENCES users ON DELETE CASCADE,
+		length BIGINT NOT NULL,
+		uploadOffset BIGINT NOT NULL DEFAULT 0,
+		metadata TEXT NOT NULL DEFAULT '',
+		filePath TEXT UNIQUE NOT NULL,
+		pictureId INTEGER REFERENCES pictures,
+		expiresAt TIMESTAMPTZ NOT NULL
+	)`,
+	// The Admin user seeded by the previous versions keeps its permissions
+	`ALTER TABLE users ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'user';
+	UPDATE users SET role = 'admin' WHERE username = 'Admin'`,
+	`ALTER TABLE users
+		ADD COLUMN failedLogins INTEGER NOT NULL DEFAULT 0,
+		ADD COLUMN lockedUntil TIMESTAMPTZ;
+	CREATE TABLE IF NOT EXISTS rate_limits (
+		key TEXT PRIMARY KEY,
+		fullAt TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		id SERIAL PRIMARY KEY,
+		userId INTEGER NOT NULL REFERENCES users ON DELETE CASCADE,
+		name VARCHAR(64) NOT NULL,
+		prefix VARCHAR(16) NOT NULL,
+		hash BYTEA UNIQUE NOT NULL,
+		scopes TEXT NOT NULL,
+		expiresAt TIMESTAMPTZ,
+		lastUsedAt TIMESTAMPTZ,
+		createdAt TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE TABLE IF NOT EXISTS signing_keys (
+		kid VARCHAR(64) PRIMARY KEY,
+		algorithm VARCHAR(8) NOT NULL,
+		privateKey BYTEA NOT NULL,
+		createdAt TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		retiredAt TIMESTAMPTZ
+	)`,
+	`ALTER TABLE users
+		ADD COLUMN oidcIssuer TEXT,
+		ADD COLUMN oidcSubject TEXT,
+		ADD UNIQUE (oidcIssuer, oidcSubject);
+	CREATE TABLE IF NOT EXISTS oidc_logins (
+		state VARCHAR(64) PRIMARY KEY,
+		nonce VARCHAR(64) NOT NULL,
+		codeVerifier VARCHAR(128) NOT NULL,
+		expiresAt TIMESTAMPTZ NOT NULL
+	)`,
+	`ALTER TABLE users
+		ADD COLUMN totpSecret TEXT,
+		ADD COLUMN totpEnabled BOOLEAN NOT NULL DEFAULT FALSE,
+		ADD COLUMN totpLastStep BIGINT NOT NULL DEFAULT 0;
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		userId INTEGER NOT NULL REFERENCES users ON DELETE CASCADE,
+		codeHash BYTEA NOT NULL,
+		PRIMARY KEY (userId, codeHash)
+	)`,
+	`ALTER TABLE users ADD COLUMN email TEXT;
+	CREATE TABLE IF NOT EXISTS sessions (
+		id VARCHAR(64) PRIMARY KEY,
+		userId INTEGER NOT NULL REFERENCES users ON DELETE CASCADE,
+		createdAt TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		expiresAt TIMESTAMPTZ NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS sessions_user ON sessions (userId);
+	CREATE TABLE IF NOT EXISTS password_resets (
+		tokenHash BYTEA PRIMARY KEY,
+		userId INTEGER NOT NULL REFERENCES users ON DELETE CASCADE,
+		expiresAt TIMESTAMPTZ NOT NULL
+	)`,
+	`ALTER TABLE sessions
+		ADD COLUMN refreshHash BYTEA UNIQUE,
+		ADD COLUMN device VARCHAR(255) NOT NULL DEFAULT '',
+		ADD COLUMN ip VARCHAR(64) NOT NULL DEFAULT '',
+		ADD COLUMN lastUsedAt TIMESTAMPTZ NOT NULL DEFAULT NOW()`,
+	// Organizations isolate their customers, pictures and attachments with row level security.
+	// The store switches to the crm_tenant role, which is subject to the policies even if the
+	// owner of the tables is not, and sets app.org_id for every operation. The existing users and
+	// data go to the Default organization, and the placeholder picture is shared by all
+	`CREATE TABLE IF NOT EXISTS organizations (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(64) UNIQUE NOT NULL,
+		createdAt TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE TABLE IF NOT EXISTS organization_members (
+		orgId INTEGER NOT NULL REFERENCES organizations ON DELETE CASCADE,
+		userId INTEGER NOT NULL REFERENCES users ON DELETE CASCADE,
+		addedAt TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (orgId, userId)
+	);
+	CREATE INDEX IF NOT EXISTS organization_members_user ON organization_members (userId);
+	INSERT INTO organizations (name) VALUES ('Default');
+	INSERT INTO organization_members (orgId, userId) SELECT o.id, u.id FROM organizations o, users u;
+
+	CREATE OR REPLACE FUNCTION current_org() RETURNS INTEGER AS $$
+		SELECT NULLIF(current_setting('app.org_id', true), '')::INTEGER
+	$$ LANGUAGE SQL STABLE;
+	CREATE OR REPLACE FUNCTION all_orgs() RETURNS BOOLEAN AS $$
+		SELECT COALESCE(current_setting('app.all_organizations', true), '') = 'on'
+	$$ LANGUAGE SQL STABLE;
+
+	ALTER TABLE customers ADD COLUMN orgId INTEGER REFERENCES organizations ON DELETE CASCADE;
+	ALTER TABLE pictures ADD COLUMN orgId INTEGER REFERENCES organizations ON DELETE CASCADE;
+	ALTER TABLE customer_attachments ADD COLUMN orgId INTEGER REFERENCES organizations ON DELETE CASCADE;
+	UPDATE customers SET orgId = (SELECT id FROM organizations);
+	UPDATE pictures SET orgId = (SELECT id FROM organizations) WHERE id > 1;
+	UPDATE customer_attachments SET orgId = (SELECT id FROM organizations);
+	ALTER TABLE customers ALTER COLUMN orgId SET NOT NULL, ALTER COLUMN orgId SET DEFAULT current_org();
+	ALTER TABLE pictures ALTER COLUMN orgId SET DEFAULT current_org();
+	ALTER TABLE customer_attachments ALTER COLUMN orgId SET NOT NULL, ALTER COLUMN orgId SET DEFAULT current_org();
+	CREATE INDEX IF NOT EXISTS customers_org ON customers (orgId);
+	CREATE INDEX IF NOT EXISTS pictures_org ON pictures (orgId);
+	CREATE INDEX IF NOT EXISTS customer_attachments_org ON customer_attachments (orgId);
+
+	ALTER TABLE sessions ADD COLUMN orgId INTEGER REFERENCES organizations ON DELETE SET NULL;
+	UPDATE sessions SET orgId = (SELECT id FROM organizations);
+	ALTER TABLE api_keys ADD COLUMN orgId INTEGER REFERENCES organizations ON DELETE CASCADE;
+	UPDATE api_keys SET orgId = (SELECT id FROM organizations);
+
+	ALTER TABLE customers ENABLE ROW LEVEL SECURITY;
+	ALTER TABLE pictures ENABLE ROW LEVEL SECURITY;
+	ALTER TABLE customer_attachments ENABLE ROW LEVEL SECURITY;
+	CREATE POLICY customers_org ON customers
+		USING (orgId = current_org() OR all_orgs())
+		WITH CHECK ((orgId = current_org() OR all_orgs())
+			AND (pictureId IS NULL OR EXISTS (SELECT 1 FROM pictures p WHERE p.id = pictureId)));
+	CREATE POLICY pictures_read ON pictures FOR SELECT
+		USING (orgId IS NULL OR orgId = current_org() OR all_orgs());
+	CREATE POLICY pictures_insert ON pictures FOR INSERT
+		WITH CHECK (orgId = current_org() OR all_orgs());
+	CREATE POLICY pictures_update ON pictures FOR UPDATE
+		USING (orgId = current_org() OR all_orgs());
+	CREATE POLICY pictures_delete ON pictures FOR DELETE
+		USING (orgId = current_org() OR all_orgs());
+	CREATE POLICY customer_attachments_org ON customer_attachments
+		USING (orgId = current_org() OR all_orgs())
+		WITH CHECK ((orgId = current_org() OR all_orgs())
+			AND EXISTS (SELECT 1 FROM customers c WHERE c.id = customerId));
+
+	DO $$
+	BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'crm_tenant') THEN
+			CREATE ROLE crm_tenant NOLOGIN;
+		END IF;
+	END
+	$$;
+	GRANT crm_tenant TO CURRENT_USER;
+	GRANT SELECT, INSERT, UPDATE, DELETE ON customers, pictures, customer_attachments, picture_uploads TO crm_tenant;
+	GRANT USAGE ON SEQUENCE customers_id_seq, pictures_id_seq, customer_attachments_id_seq TO crm_tenant;
+	GRANT SELECT (id, username) ON users TO crm_tenant`,
+	// Customers are assigned to an owner (their creator, for the existing ones), and can be shared
+	// with teams of the organization. Users can only access the customers they own or share with
+	// one of their teams, unless they are admins (can_access_customer). org_member runs as the
+	// owner of the tables, as crm_tenant cannot read the members of the organizations
+	`ALTER TABLE customers ADD COLUMN ownerId INTEGER REFERENCES users;
+	UPDATE customers SET ownerId = createdByUserId;
+	CREATE INDEX IF NOT EXISTS customers_owner ON customers (ownerId);
+	CREATE TABLE IF NOT EXISTS teams (
+		id SERIAL PRIMARY KEY,
+		orgId INTEGER NOT NULL DEFAULT current_org() REFERENCES organizations ON DELETE CASCADE,
+		name VARCHAR(64) NOT NULL,
+		createdAt TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		UNIQUE (orgId, name)
+	);
+	CREATE TABLE IF NOT EXISTS team_members (
+		teamId INTEGER NOT NULL REFERENCES teams ON DELETE CASCADE,
+		userId INTEGER NOT NULL REFERENCES users ON DELETE CASCADE,
+		PRIMARY KEY (teamId, userId)
+	);
+	CREATE INDEX IF NOT EXISTS team_members_user ON team_members (userId);
+	CREATE TABLE IF NOT EXISTS customer_teams (
+		customerId INTEGER NOT NULL REFERENCES customers ON DELETE CASCADE,
+		teamId INTEGER NOT NULL REFERENCES teams ON DELETE CASCADE,
+		PRIMARY KEY (customerId, teamId)
+	);
+	CREATE INDEX IF NOT EXISTS customer_teams_team ON customer_teams (teamId);
+
+	ALTER TABLE teams ENABLE ROW LEVEL SECURITY;
+	ALTER TABLE team_members ENABLE ROW LEVEL SECURITY;
+	ALTER TABLE customer_teams ENABLE ROW LEVEL SECURITY;
+	CREATE POLICY teams_org ON teams
+		USING (orgId = current_org() OR all_orgs());
+	CREATE POLICY team_members_org ON team_members
+		USING (EXISTS (SELECT 1 FROM teams t WHERE t.id = teamId));
+	CREATE POLICY customer_teams_org ON customer_teams
+		USING (EXISTS (SELECT 1 FROM customers c WHERE c.id = customerId))
+		WITH CHECK (EXISTS (SELECT 1 FROM customers c WHERE c.id = customerId)
+			AND EXISTS (SELECT 1 FROM teams t WHERE t.id = teamId));
+
+	CREATE OR REPLACE FUNCTION can_access_customer(customerId INTEGER, userId INTEGER, admin BOOLEAN) RETURNS BOOLEAN AS $$
+		SELECT EXISTS (
+			SELECT 1 FROM customers c WHERE c.id = $1 AND ($3 OR c.ownerId = $2 OR EXISTS (
+				SELECT 1 FROM customer_teams ct JOIN team_members tm ON tm.teamId = ct.teamId
+				WHERE ct.customerId = c.id AND tm.userId = $2
+			))
+		)
+	$$ LANGUAGE SQL STABLE;
+	CREATE OR REPLACE FUNCTION org_member(userId INTEGER) RETURNS BOOLEAN AS $$
+		SELECT EXISTS (SELECT 1 FROM organization_members m WHERE m.orgId = current_org() AND m.userId = $1)
+	$$ LANGUAGE SQL STABLE SECURITY DEFINER SET search_path = public;
+
+	GRANT SELECT, INSERT, UPDATE, DELETE ON teams, team_members, customer_teams TO crm_tenant;
+	GRANT USAGE ON SEQUENCE teams_id_seq TO crm_tenant`,
+	// Single sign-on logins started by a logged in user link the identity to that user
+	`ALTER TABLE oidc_logins ADD COLUMN userId INTEGER REFERENCES users ON DELETE CASCADE`,
+}
+
+// LatestSchemaVersion is the schema version this build expects
+var LatestSchemaVersion = len(migrations)
+
+// Migrate applies the pending migrations, each one in its own transaction. An advisory lock
+// prevents several instances starting at the same time from applying the same migration
+func Migrate() error {
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			appliedAt TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`)
+	if err != nil {
+		return err
+	}
+
+	for {
+		applied, err := applyNextMigration()
+		if err != nil || !applied {
+			return err
+		}
+	}
+}
+
+func applyNextMigration() (bool, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('schema_migrations'))`)
+	if err != nil {
+		return false, err
+	}
+	var version int
+	err = tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil || version >= len(migrations) {
+		return false, err
+	}
+
+	if _, err = tx.Exec(migrations[version]); err != nil {
+		return false, err
+	}
+	if _, err = tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, version+1); err != nil {
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	logging.Info(context.Background(), "Applied database migration", logging.Fields{"version": version + 1})
+	return true, nil
+}
+
+// SchemaVersion returns the version of the last applied migration
+func SchemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
@@ -0,0 +1,143 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+type Fields map[string]interface{}
+
+var logger = struct {
+	sync.Mutex
+	out   io.Writer
+	level Level
+	json  bool
+}{out: os.Stderr, level: LevelInfo, json: true}
+
+func init() {
+	Configure("info", "json")
+}
+
+// Configure sets the minimum level logged (debug, info, warn or error) and the format of the
+// lines (json or text). Lines written with the standard log package go through this logger too
+func Configure(level, format string) {
+	logger.Lock()
+	defer logger.Unlock()
+
+	logger.level = LevelInfo
+	for l, name := range levelNames {
+		if strings.EqualFold(level, name) {
+			logger.level = l
+		}
+	}
+	logger.json = !strings.EqualFold(format, "text")
+
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+}
+
+func SetOutput(w io.Writer) {
+	logger.Lock()
+	defer logger.Unlock()
+	logger.out = w
+}
+
+func Debug(ctx context.Context, msg string, fields Fields) { write(ctx, LevelDebug, msg, fields) }
+func Info(ctx context.Context, msg string, fields Fields)  { write(ctx, LevelInfo, msg, fields) }
+func Warn(ctx context.Context, msg string, fields Fields)  { write(ctx, LevelWarn, msg, fields) }
+
+func Error(ctx context.Context, msg string, err error, fields Fields) {
+	if fields == nil {
+		fields = Fields{}
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	write(ctx, LevelError, msg, fields)
+}
+
+func write(ctx context.Context, level Level, msg string, fields Fields) {
+	logger.Lock()
+	defer logger.Unlock()
+	if level < logger.level {
+		return
+	}
+
+	line := Fields{}
+	for k, v := range fields {
+		line[k] = v
+	}
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line["level"] = levelNames[level]
+	line["msg"] = msg
+	if id := RequestID(ctx); id != "" {
+		line["requestId"] = id
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		line["traceId"] = sc.TraceID().String()
+		line["spanId"] = sc.SpanID().String()
+	}
+
+	if logger.json {
+		b, err := json.Marshal(line)
+		if err != nil {
+			b = []byte(fmt.Sprintf(`{"level":"error","msg":"Could not encode log line: %s"}`, err.Error()))
+		}
+		logger.out.Write(append(b, '\n'))
+		return
+	}
+	logger.out.Write([]byte(textLine(line)))
+}
+
+// Text lines start with the time, level and message, followed by the rest of fields sorted by key
+func textLine(line Fields) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %-5s %s", line["time"], strings.ToUpper(line["level"].(string)), line["msg"])
+	keys := make([]string, 0, len(line))
+	for k := range line {
+		if k != "time" && k != "level" && k != "msg" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, line[k])
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+// Lines from the standard log package (e.g. utils.CheckErr) are logged as info
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	write(context.Background(), LevelInfo, strings.TrimSuffix(string(p), "\n"), nil)
+	return len(p), nil
+}
@@ -0,0 +1,81 @@
+package logging
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+type contextKey int
+
+const requestInfoKey contextKey = 0
+
+// Request data shared between the middleware and the inner handlers
+type requestInfo struct {
+	sync.Mutex
+	id   string
+	user string
+}
+
+var validRequestID = regexp.MustCompile(`^[a-zA-Z0-9._:-]{1,128}$`)
+
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	if info, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		return info.id
+	}
+	return ""
+}
+
+// SetUser records the authenticated user of the request, to be included in its log line
+func SetUser(ctx context.Context, user string) {
+	if info, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		info.Lock()
+		info.user = user
+		info.Unlock()
+	}
+}
+
+// Middleware propagates the X-Request-ID of the request (or assigns a new one) and logs
+// a line for every request once it is handled
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id, _ = utils.RandomToken(16)
+		}
+		info := &requestInfo{id: id}
+		w.Header().Set(RequestIDHeader, id)
+
+		recorder := utils.NewStatusRecorder(w)
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey, info))
+		next.ServeHTTP(recorder, r)
+
+		fields := Fields{
+			"method":    r.Method,
+			"path":      r.URL.Path,
+			"route":     utils.RouteTemplate(r),
+			"status":    recorder.Status,
+			"bytes":     recorder.Bytes,
+			"latencyMs": float64(time.Since(start).Microseconds()) / 1000,
+			"remote":    r.RemoteAddr,
+		}
+		info.Lock()
+		if info.user != "" {
+			fields["user"] = info.user
+		}
+		info.Unlock()
+
+		Info(r.Context(), "request", fields)
+	})
+}
@@ -0,0 +1,187 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"theam.io/jdavidsanchez/test_crm_api/config"
+	"theam.io/jdavidsanchez/test_crm_api/logging"
+)
+
+// Message is a plain text mail
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends the mails of the API, e.g. the password reset tokens
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// New returns the mailer of the configured driver
+func New(c config.Mail) Mailer {
+	switch strings.ToLower(c.Driver) {
+	case "smtp":
+		return &SMTP{Addr: c.SMTPAddr, Username: c.SMTPUsername, Password: c.SMTPPassword, From: c.From}
+	case "file":
+		return &File{Path: c.File, From: c.From}
+	}
+	return &Log{From: c.From}
+}
+
+// Formats the message with its headers (RFC 5322). Addresses and subjects with line breaks are
+// refused, so they cannot inject headers
+func format(from string, m Message, date time.Time) ([]byte, error) {
+	if strings.ContainsAny(from+m.To+m.Subject, "\r\n") {
+		return nil, errors.New("invalid mail headers")
+	}
+	if _, err := mail.ParseAddress(m.To); err != nil {
+		return nil, fmt.Errorf("invalid recipient %s: %s", m.To, err.Error())
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(m.Body, "\r\n", "\n"), "\n", "\r\n"))
+	b.WriteString("\r\n")
+	return b.Bytes(), nil
+}
+
+/***
+SMTP
+****/
+
+// SMTP sends the mails with a server, with STARTTLS if it supports it (required to authenticate)
+type SMTP struct {
+	Addr     string // host:port
+	Username string // Empty to send without authentication
+	Password string
+	From     string
+}
+
+func (s *SMTP) Send(ctx context.Context, m Message) error {
+	msg, err := format(s.From, m, time.Now())
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return err
+	}
+	to, _ := mail.ParseAddress(m.To)
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		// PlainAuth refuses to send the password without TLS, except to localhost
+		if err = c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err = c.Rcpt(to.Address); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+/*********
+Log, file
+**********/
+
+// Log writes the mails to the log, without sending them
+type Log struct {
+	From string
+}
+
+func (l *Log) Send(ctx context.Context, m Message) error {
+	if _, err := format(l.From, m, time.Now()); err != nil {
+		return err
+	}
+	logging.Info(ctx, "Mail", logging.Fields{"to": m.To, "subject": m.Subject, "body": m.Body})
+	return nil
+}
+
+// File appends the mails to a file (mbox format), without sending them
+type File struct {
+	Path string
+	From string
+	mu   sync.Mutex
+}
+
+func (f *File) Send(ctx context.Context, m Message) error {
+	date := time.Now()
+	msg, err := format(f.From, m, date)
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(f.From)
+	if err != nil {
+		return err
+	}
+	// Lines of the body starting with From are quoted, as they separate the messages
+	msg = bytes.ReplaceAll(msg, []byte("\r\nFrom "), []byte("\r\n>From "))
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(file, "From %s %s\n%s\n", from.Address, date.Format(time.ANSIC), bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n")))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
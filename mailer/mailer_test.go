@@ -0,0 +1,108 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailer-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := &File{Path: filepath.Join(dir, "mail.log"), From: "CRM API <noreply@example.com>"}
+
+	for _, to := range []string{"jane@example.com", "John <john@example.com>"} {
+		if err = f.Send(context.Background(), Message{To: to, Subject: "Password reset", Body: "Your token:\nFrom here"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content, _ := ioutil.ReadFile(f.Path)
+	if n := strings.Count(string(content), "\nFrom noreply@example.com ") + 1; n != 2 || !strings.HasPrefix(string(content), "From noreply@example.com ") {
+		t.Errorf("Expected 2 messages. Got %d:\n%s", n, content)
+	}
+	if !strings.Contains(string(content), "To: John <john@example.com>\nSubject: Password reset\n") || !strings.Contains(string(content), "\n>From here\n") {
+		t.Errorf("Unexpected messages:\n%s", content)
+	}
+}
+
+func TestHeaderInjection(t *testing.T) {
+	for _, m := range []Message{
+		{To: "jane@example.com\r\nBcc: all@example.com", Subject: "Hi"},
+		{To: "jane@example.com", Subject: "Hi\nBcc: all@example.com"},
+		{To: "not an address", Subject: "Hi"},
+	} {
+		if err := (&Log{From: "noreply@example.com"}).Send(context.Background(), m); err == nil {
+			t.Errorf("Expected %+v to be refused", m)
+		}
+	}
+}
+
+// Minimal SMTP server, receiving a single mail without TLS nor authentication
+func fakeSMTPServer(t *testing.T) (addr string, received chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received = make(chan string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost ESMTP")
+		var transcript strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			transcript.WriteString(line)
+			switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+			case "EHLO", "HELO":
+				reply("250 localhost")
+			case "DATA":
+				reply("354 Go ahead")
+				for line != ".\r\n" {
+					if line, err = r.ReadString('\n'); err != nil {
+						return
+					}
+					transcript.WriteString(line)
+				}
+				reply("250 OK")
+			case "QUIT":
+				reply("221 Bye")
+				received <- transcript.String()
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	return l.Addr().String(), received
+}
+
+func TestSMTP(t *testing.T) {
+	addr, received := fakeSMTPServer(t)
+	s := &SMTP{Addr: addr, From: "CRM API <noreply@example.com>"}
+	if err := s.Send(context.Background(), Message{To: "Jane <jane@example.com>", Subject: "Password reset", Body: "Your token"}); err != nil {
+		t.Fatal(err)
+	}
+	transcript := <-received
+	for _, expected := range []string{"MAIL FROM:<noreply@example.com>", "RCPT TO:<jane@example.com>", "Subject: Password reset\r\n", "\r\nYour token\r\n"} {
+		if !strings.Contains(transcript, expected) {
+			t.Errorf("Expected %q in the transcript:\n%s", expected, transcript)
+		}
+	}
+}
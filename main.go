@@ -1,33 +1,220 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
+	"theam.io/jdavidsanchez/test_crm_api/auth"
+	"theam.io/jdavidsanchez/test_crm_api/config"
 	"theam.io/jdavidsanchez/test_crm_api/db"
+	"theam.io/jdavidsanchez/test_crm_api/logging"
+	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/passwd"
 	"theam.io/jdavidsanchez/test_crm_api/routes"
+	"theam.io/jdavidsanchez/test_crm_api/tlsserver"
+	"theam.io/jdavidsanchez/test_crm_api/tracing"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
 )
 
-func init() {
-	db.InitDB()
-	routes.InitRouter()
+var api *routes.Server
+
+// configure applies the configuration to every package
+func configure(cfg *config.Config) error {
+	logging.Configure(cfg.Logging.Level, cfg.Logging.Format)
+	auth.Configure(cfg.Auth)
+	models.Configure(cfg.Database)
+	if err := passwd.Configure(cfg.Passwords); err != nil {
+		return err
+	}
+	utils.Configure(cfg)
+	routes.Configure(cfg)
+	return nil
+}
+
+// openStore connects to the database, applying the pending migrations
+func openStore(cfg *config.Config) *models.PostgresStore {
+	db.InitDB(cfg.Database)
+	return models.NewPostgresStore(db.DB)
+}
+
+// setup configures every package, connects to the database and returns the API
+func setup(cfg *config.Config) (*routes.Server, error) {
+	if err := configure(cfg); err != nil {
+		return nil, err
+	}
+	return routes.NewServer(openStore(cfg)), nil
 }
 
 func main() {
-	port := os.Getenv("PORT")
-	log.Printf("Starting server on :%s", port)
+	cfg, args, err := config.Load(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err = runCommand(cfg, args); err != nil {
+		fmt.Fprintln(os.Stderr, "crmapi: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+// serve runs the API until SIGTERM or SIGINT
+func serve(cfg *config.Config) error {
+	var certs *tlsserver.Certificates
+	var err error
+	if cfg.TLS.Enabled() {
+		if certs, err = tlsserver.LoadCertificates(cfg.TLS); err != nil {
+			return err
+		}
+	}
+
+	if api, err = setup(cfg); err != nil {
+		return err
+	}
+	if err := auth.LoadSigningKeys(context.Background(), api.Store); err != nil {
+		db.DB.Close()
+		return err
+	}
+	fields := logging.Fields{}
+	for key, value := range cfg.Redacted() {
+		fields[key] = value
+	}
+	logging.Info(context.Background(), "Configuration loaded", fields)
+	if !cfg.Auth.RequireSignedURLs {
+		logging.Warn(context.Background(), "Unsigned requests to /static/ are deprecated and will be rejected in a future version", logging.Fields{"setting": "auth.require_signed_urls"})
+	}
+
+	shutdownTracing := func(context.Context) error { return nil }
+	if cfg.Tracing.TracesURL() != "" {
+		if shutdownTracing, err = tracing.Setup(context.Background(), cfg.Tracing); err != nil {
+			db.DB.Close()
+			return err
+		}
+	}
+
+	// Background workers stop when the context is cancelled, and are waited for before closing the DB
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	var workers sync.WaitGroup
+
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		api.CollectExpiredUploads(workersCtx, time.Hour)
+	}()
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		api.PruneRateLimits(workersCtx, time.Hour)
+	}()
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		auth.RefreshSigningKeys(workersCtx, api.Store)
+	}()
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		api.SendPasswordResets(workersCtx)
+	}()
+
+	addr := ":" + strconv.Itoa(cfg.Server.Port)
+	logging.Info(context.Background(), "Starting server", logging.Fields{"addr": addr})
 
 	server := &http.Server{
-		Handler: routes.Router,
-		Addr:    ":" + port,
+		Handler: api,
+		Addr:    addr,
 		// Adding timeouts
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+		WriteTimeout: cfg.Server.WriteTimeout,
+		ReadTimeout:  cfg.Server.ReadTimeout,
+	}
+	// Plain HTTP requests are redirected to HTTPS, if enabled
+	var redirectServer *http.Server
+
+	serverErr := make(chan error, 2)
+	if certs == nil {
+		go func() {
+			serverErr <- server.ListenAndServe()
+		}()
+	} else {
+		server.Handler = tlsserver.HSTS(cfg.TLS.HSTSMaxAge, api)
+		server.TLSConfig = tlsserver.NewConfig(cfg.TLS, certs)
+		go func() {
+			serverErr <- server.ListenAndServeTLS("", "")
+		}()
+
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			certs.Watch(workersCtx, cfg.TLS.ReloadInterval, reload)
+		}()
+
+		if cfg.TLS.RedirectPort != 0 {
+			redirectServer = &http.Server{
+				Handler:      tlsserver.RedirectHandler(cfg.Server.Port),
+				Addr:         ":" + strconv.Itoa(cfg.TLS.RedirectPort),
+				WriteTimeout: cfg.Server.WriteTimeout,
+				ReadTimeout:  cfg.Server.ReadTimeout,
+			}
+			logging.Info(context.Background(), "Redirecting HTTP requests to HTTPS", logging.Fields{"addr": redirectServer.Addr})
+			go func() {
+				serverErr <- redirectServer.ListenAndServe()
+			}()
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-serverErr:
+		stopWorkers()
+		workers.Wait()
+		db.DB.Close()
+		return err
+	case sig := <-signals:
+		logging.Info(context.Background(), "Shutting down", logging.Fields{"signal": sig.String()})
+	}
+
+	// Fail readiness first, so the load balancer stops sending new requests before the drain starts
+	api.SetReady(false)
+	time.Sleep(cfg.Server.ShutdownDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if redirectServer != nil {
+		redirectServer.Shutdown(ctx)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		logging.Error(ctx, "Error draining connections", err, nil)
 	}
 
-	err := server.ListenAndServe()
+	stopWorkers()
+	waitWorkers(ctx, &workers)
 	db.DB.Close()
-	log.Fatal(err)
+	if err := shutdownTracing(ctx); err != nil {
+		logging.Error(ctx, "Error exporting pending spans", err, nil)
+	}
+	logging.Info(context.Background(), "Server stopped", nil)
+	return nil
+}
+
+func waitWorkers(ctx context.Context, workers *sync.WaitGroup) {
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logging.Warn(ctx, "Timed out waiting for background workers", nil)
+	}
 }
@@ -0,0 +1,740 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"theam.io/jdavidsanchez/test_crm_api/auth"
+	"theam.io/jdavidsanchez/test_crm_api/config"
+	"theam.io/jdavidsanchez/test_crm_api/db"
+	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/passwd"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+/*****************************************************************
+Admin commands, run as: crmapi [config flags] <command> [arguments]
+******************************************************************/
+
+// Where the commands read passwords from and write their output, replaced in the tests
+var (
+	stdin  io.Reader = os.Stdin
+	stdout io.Writer = os.Stdout
+)
+
+type command struct {
+	args        string
+	description string
+	run         func(cfg *config.Config, args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"serve":   {"", "Run the API (the default command)", func(cfg *config.Config, args []string) error { return serve(cfg) }},
+		"migrate": {"", "Apply the pending database migrations", migrateCommand},
+		"user":    {"create|reset-password|set-role|set-email|unlock|disable-2fa|list", "Manage the users", userCommand},
+		"keys":    {"rotate|list", "Manage the keys signing the JWTs (RS256 and ES256)", keysCommand},
+		"org":     {"create|list|add-member|remove-member", "Manage the organizations and their members", orgCommand},
+		"seed":    {"-user <username> [-org name]", "Add sample customers to an organization without customers", seedCommand},
+		"import":  {"-user <username> [-org name] <file.csv>", "Import customers from a CSV file with name and surname columns", importCommand},
+		"export":  {"[-org name] [-format csv|json] [-o file]", "Export every customer of an organization", exportCommand},
+		"config":  {"", "Print the effective configuration, with secrets redacted", configCommand},
+	}
+}
+
+// runCommand runs the command in args, or serves the API if there is none
+func runCommand(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return serve(cfg)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		printUsage(os.Stderr)
+		if args[0] == "help" {
+			return nil
+		}
+		return fmt.Errorf("unknown command %s", args[0])
+	}
+	if args[0] != "serve" {
+		if err := configure(cfg); err != nil {
+			return err
+		}
+	}
+	return cmd.run(cfg, args[1:])
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: crmapi [config flags] <command> [arguments]")
+	fmt.Fprintln(w, "\nCommands:")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", name, commands[name].args, commands[name].description)
+	}
+	tw.Flush()
+}
+
+// parseFlags parses the flags of a command, which must be followed by nargs arguments
+func parseFlags(fs *flag.FlagSet, args []string, nargs int, usage string) error {
+	fs.SetOutput(os.Stderr)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != nargs {
+		return errors.New("usage: crmapi " + usage)
+	}
+	return nil
+}
+
+func migrateCommand(cfg *config.Config, args []string) error {
+	if err := parseFlags(flag.NewFlagSet("migrate", flag.ContinueOnError), args, 0, "migrate"); err != nil {
+		return err
+	}
+	openStore(cfg)
+	defer db.DB.Close()
+	fmt.Fprintf(stdout, "Database schema at version %d\n", db.LatestSchemaVersion)
+	return nil
+}
+
+func configCommand(cfg *config.Config, args []string) error {
+	if err := parseFlags(flag.NewFlagSet("config", flag.ContinueOnError), args, 0, "config"); err != nil {
+		return err
+	}
+	cfg.Print(stdout)
+	return nil
+}
+
+/****
+Users
+*****/
+
+func userCommand(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: crmapi user create|reset-password|set-role|set-email|unlock|disable-2fa|list")
+	}
+	switch args[0] {
+	case "create":
+		return userCreate(cfg, args[1:])
+	case "reset-password":
+		return userResetPassword(cfg, args[1:])
+	case "set-role":
+		return userSetRole(cfg, args[1:])
+	case "set-email":
+		return userSetEmail(cfg, args[1:])
+	case "unlock":
+		return userUnlock(cfg, args[1:])
+	case "disable-2fa":
+		return userDisableTwoFactor(cfg, args[1:])
+	case "list":
+		return userList(cfg, args[1:])
+	}
+	return fmt.Errorf("unknown user command %s", args[0])
+}
+
+func userCreate(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("user create", flag.ContinueOnError)
+	role := fs.String("role", models.RoleUser, "Role of the user: user or admin")
+	passwordStdin := fs.Bool("password-stdin", false, "Read the password from the standard input instead of generating one")
+	org := fs.String("org", "", "Organization the user is added to, if any")
+	if err := parseFlags(fs, args, 1, "user create [-role admin] [-password-stdin] [-org name] <username>"); err != nil {
+		return err
+	}
+	if !models.ValidRole(*role) {
+		return fmt.Errorf("invalid role %s, must be user or admin", *role)
+	}
+	password, generated, err := readPassword(fs.Arg(0), *passwordStdin)
+	if err != nil {
+		return err
+	}
+
+	store := openStore(cfg)
+	defer db.DB.Close()
+	ctx := context.Background()
+	u := models.User{Username: fs.Arg(0), Password: password, Role: *role}
+	err = store.InTx(ctx, func(tx models.Store) error {
+		_, err := tx.Users().GetId(ctx, u.Username)
+		if err == nil {
+			return fmt.Errorf("user %s already exists", u.Username)
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+		if err = tx.Users().Create(ctx, &u); err != nil || *org == "" {
+			return err
+		}
+		return addMember(ctx, tx, *org, u.Username)
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "Created %s %s\n", u.Role, u.Username)
+	if generated {
+		fmt.Fprintf(stdout, "Password: %s\n", password)
+	}
+	return nil
+}
+
+func userResetPassword(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("user reset-password", flag.ContinueOnError)
+	passwordStdin := fs.Bool("password-stdin", false, "Read the password from the standard input instead of generating one")
+	if err := parseFlags(fs, args, 1, "user reset-password [-password-stdin] <username>"); err != nil {
+		return err
+	}
+	password, generated, err := readPassword(fs.Arg(0), *passwordStdin)
+	if err != nil {
+		return err
+	}
+
+	store := openStore(cfg)
+	defer db.DB.Close()
+	u := models.User{Username: fs.Arg(0), Password: password}
+	if err = store.Users().ResetPassword(context.Background(), &u); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "Password of %s reset\n", u.Username)
+	if generated {
+		fmt.Fprintf(stdout, "Password: %s\n", password)
+	}
+	return nil
+}
+
+func userSetRole(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("user set-role", flag.ContinueOnError)
+	if err := parseFlags(fs, args, 2, "user set-role <username> user|admin"); err != nil {
+		return err
+	}
+	u := models.User{Username: fs.Arg(0), Role: fs.Arg(1)}
+	if !models.ValidRole(u.Role) {
+		return fmt.Errorf("invalid role %s, must be user or admin", u.Role)
+	}
+
+	store := openStore(cfg)
+	defer db.DB.Close()
+	if err := store.Users().UpdateRole(context.Background(), &u); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s is now %s\n", u.Username, u.Role)
+	return nil
+}
+
+// Sets where the password reset tokens of the user are sent, removing it if empty
+func userSetEmail(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("user set-email", flag.ContinueOnError)
+	if err := parseFlags(fs, args, 2, "user set-email <username> <email>"); err != nil {
+		return err
+	}
+	u := models.User{Username: fs.Arg(0), Email: fs.Arg(1)}
+	if u.Email != "" && !models.ValidEmail(u.Email) {
+		return fmt.Errorf("invalid email %s", u.Email)
+	}
+
+	store := openStore(cfg)
+	defer db.DB.Close()
+	if err := store.Users().UpdateEmail(context.Background(), &u); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Email of %s set\n", u.Username)
+	return nil
+}
+
+func userUnlock(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("user unlock", flag.ContinueOnError)
+	if err := parseFlags(fs, args, 1, "user unlock <username>"); err != nil {
+		return err
+	}
+
+	store := openStore(cfg)
+	defer db.DB.Close()
+	if err := store.Users().Unlock(context.Background(), fs.Arg(0)); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s unlocked\n", fs.Arg(0))
+	return nil
+}
+
+// For the users who lost their authenticator and recovery codes
+func userDisableTwoFactor(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("user disable-2fa", flag.ContinueOnError)
+	if err := parseFlags(fs, args, 1, "user disable-2fa <username>"); err != nil {
+		return err
+	}
+
+	store := openStore(cfg)
+	defer db.DB.Close()
+	ctx := context.Background()
+	err := store.InTx(ctx, func(tx models.Store) error {
+		u, err := tx.Users().Get(ctx, fs.Arg(0))
+		if err == sql.ErrNoRows {
+			return models.ErrUserNotFound
+		} else if err != nil {
+			return err
+		}
+		return tx.TwoFactor().Disable(ctx, u.Id)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Two-factor authentication of %s disabled\n", fs.Arg(0))
+	return nil
+}
+
+func userList(cfg *config.Config, args []string) error {
+	if err := parseFlags(flag.NewFlagSet("user list", flag.ContinueOnError), args, 0, "user list"); err != nil {
+		return err
+	}
+
+	store := openStore(cfg)
+	defer db.DB.Close()
+	users, err := store.Users().List(context.Background())
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSERNAME\tROLE")
+	for _, u := range users {
+		fmt.Fprintf(w, "%d\t%s\t%s\n", u.Id, u.Username, u.Role)
+	}
+	return w.Flush()
+}
+
+/***********
+Signing keys
+************/
+
+func keysCommand(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: crmapi keys rotate|list")
+	}
+	switch args[0] {
+	case "rotate":
+		return keysRotate(cfg, args[1:])
+	case "list":
+		return keysList(cfg, args[1:])
+	}
+	return fmt.Errorf("unknown keys command %s", args[0])
+}
+
+// The running instances start signing with the new key within auth.key_refresh_interval
+func keysRotate(cfg *config.Config, args []string) error {
+	if err := parseFlags(flag.NewFlagSet("keys rotate", flag.ContinueOnError), args, 0, "keys rotate"); err != nil {
+		return err
+	}
+
+	store := openStore(cfg)
+	defer db.DB.Close()
+	k, err := auth.RotateSigningKey(context.Background(), store)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "New %s signing key %s. The previous keys verify tokens for %s more\n",
+		k.Algorithm, k.Kid, cfg.Auth.JWTLifetime+cfg.Auth.KeyRefreshInterval)
+	return nil
+}
+
+func keysList(cfg *config.Config, args []string) error {
+	if err := parseFlags(flag.NewFlagSet("keys list", flag.ContinueOnError), args, 0, "keys list"); err != nil {
+		return err
+	}
+
+	store := openStore(cfg)
+	defer db.DB.Close()
+	keys, err := store.SigningKeys().List(context.Background())
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KID\tALGORITHM\tCREATED\tRETIRED")
+	for _, k := range keys {
+		retired := "-"
+		if k.RetiredAt != nil {
+			retired = k.RetiredAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", k.Kid, k.Algorithm, k.CreatedAt.Format(time.RFC3339), retired)
+	}
+	return w.Flush()
+}
+
+// readPassword reads the first line of the standard input, or generates a random password long
+// enough for the configured minimum. Both are checked against the password policy
+func readPassword(username string, fromStdin bool) (password string, generated bool, err error) {
+	if fromStdin {
+		line, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", false, err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	} else {
+		// Two hex characters per random byte
+		size := 12
+		if min := passwd.Settings().MinLength; 2*size < min {
+			size = (min + 1) / 2
+		}
+		if password, err = utils.RandomToken(size); err != nil {
+			return "", false, err
+		}
+		generated = true
+	}
+	if err = passwd.Check(username, password); err != nil {
+		return "", false, err
+	}
+	return password, generated, nil
+}
+
+/************
+Organizations
+*************/
+
+func orgCommand(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: crmapi org create|list|add-member|remove-member")
+	}
+	switch args[0] {
+	case "create":
+		return orgCreate(cfg, args[1:])
+	case "list":
+		return orgList(cfg, args[1:])
+	case "add-member":
+		return orgAddMember(cfg, args[1:])
+	case "remove-member":
+		return orgRemoveMember(cfg, args[1:])
+	}
+	return fmt.Errorf("unknown org command %s", args[0])
+}
+
+func orgCreate(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("org create", flag.ContinueOnError)
+	if err := parseFlags(fs, args, 1, "org create <name>"); err != nil {
+		return err
+	}
+
+	store := openStore(cfg)
+	defer db.DB.Close()
+	o := models.Organization{Name: fs.Arg(0)}
+	if err := store.Organizations().Create(context.Background(), &o); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Created organization %s with ID %d\n", o.Name, o.Id)
+	return nil
+}
+
+func orgList(cfg *config.Config, args []string) error {
+	if err := parseFlags(flag.NewFlagSet("org list", flag.ContinueOnError), args, 0, "org list"); err != nil {
+		return err
+	}
+
+	store := openStore(cfg)
+	defer db.DB.Close()
+	ctx := context.Background()
+	organizations, err := store.Organizations().List(ctx, 0)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tMEMBERS")
+	for _, o := range organizations {
+		members, err := store.Organizations().Members(ctx, o.Id)
+		if err != nil {
+			return err
+		}
+		usernames := make([]string, len(members))
+		for i, m := range members {
+			usernames[i] = m.Username
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", o.Id, o.Name, strings.Join(usernames, ","))
+	}
+	return w.Flush()
+}
+
+func orgAddMember(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("org add-member", flag.ContinueOnError)
+	if err := parseFlags(fs, args, 2, "org add-member <name> <username>"); err != nil {
+		return err
+	}
+
+	store := openStore(cfg)
+	defer db.DB.Close()
+	if err := addMember(context.Background(), store, fs.Arg(0), fs.Arg(1)); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s is now a member of %s\n", fs.Arg(1), fs.Arg(0))
+	return nil
+}
+
+// The sessions of the user in the organization are left without organization
+func orgRemoveMember(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("org remove-member", flag.ContinueOnError)
+	if err := parseFlags(fs, args, 2, "org remove-member <name> <username>"); err != nil {
+		return err
+	}
+
+	store := openStore(cfg)
+	defer db.DB.Close()
+	ctx := context.Background()
+	err := store.InTx(ctx, func(tx models.Store) error {
+		orgId, err := lookupOrganization(ctx, tx, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		userId, err := lookupUser(ctx, tx, fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		return tx.Organizations().RemoveMember(ctx, orgId, userId)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s is no longer a member of %s\n", fs.Arg(1), fs.Arg(0))
+	return nil
+}
+
+func addMember(ctx context.Context, store models.Store, org, username string) error {
+	orgId, err := lookupOrganization(ctx, store, org)
+	if err != nil {
+		return err
+	}
+	userId, err := lookupUser(ctx, store, username)
+	if err != nil {
+		return err
+	}
+	return store.Organizations().AddMember(ctx, orgId, userId)
+}
+
+func lookupOrganization(ctx context.Context, store models.Store, name string) (int, error) {
+	organizations, err := store.Organizations().List(ctx, 0)
+	if err != nil {
+		return 0, err
+	}
+	for _, o := range organizations {
+		if o.Name == name {
+			return o.Id, nil
+		}
+	}
+	return 0, fmt.Errorf("organization %s does not exist", name)
+}
+
+func lookupUser(ctx context.Context, store models.Store, username string) (int, error) {
+	id, err := store.Users().GetId(ctx, username)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("user %s does not exist", username)
+	}
+	return id, err
+}
+
+// organizationContext limits the customers of the commands to the organization with the name. The
+// commands can access all of them, as the admins
+func organizationContext(store models.Store, name string) (context.Context, error) {
+	ctx := context.Background()
+	orgId, err := lookupOrganization(ctx, store, name)
+	if err != nil {
+		return nil, err
+	}
+	return models.WithUser(models.WithOrganization(ctx, orgId), 0, true), nil
+}
+
+/*********
+Customers
+**********/
+
+var sampleCustomers = []models.CustomerOut{
+	{Name: "Ada", Surname: "Lovelace"},
+	{Name: "Alan", Surname: "Turing"},
+	{Name: "Grace", Surname: "Hopper"},
+	{Name: "Edsger", Surname: "Dijkstra"},
+	{Name: "Barbara", Surname: "Liskov"},
+}
+
+func seedCommand(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+	username := fs.String("user", "", "User the customers are created by")
+	org := fs.String("org", "Default", "Organization the customers are created in")
+	if err := parseFlags(fs, args, 0, "seed -user <username> [-org name]"); err != nil {
+		return err
+	}
+
+	store := openStore(cfg)
+	defer db.DB.Close()
+	ctx, err := organizationContext(store, *org)
+	if err != nil {
+		return err
+	}
+	seeded := 0
+	err = store.InTx(ctx, func(tx models.Store) error {
+		count, err := tx.Customers().Count(ctx)
+		if err != nil || count > 0 {
+			return err
+		}
+		return createCustomers(ctx, tx, *username, sampleCustomers, &seeded)
+	})
+	if err != nil {
+		return err
+	}
+	if seeded == 0 {
+		fmt.Fprintln(stdout, "There are customers already, nothing seeded")
+		return nil
+	}
+	fmt.Fprintf(stdout, "Seeded %d customers\n", seeded)
+	return nil
+}
+
+func importCommand(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	username := fs.String("user", "", "User the customers are created by")
+	org := fs.String("org", "Default", "Organization the customers are created in")
+	if err := parseFlags(fs, args, 1, "import -user <username> [-org name] <file.csv>"); err != nil {
+		return err
+	}
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	customers, err := readCustomersCSV(file)
+	if err != nil {
+		return fmt.Errorf("%s: %s", fs.Arg(0), err.Error())
+	}
+
+	store := openStore(cfg)
+	defer db.DB.Close()
+	ctx, err := organizationContext(store, *org)
+	if err != nil {
+		return err
+	}
+	imported := 0
+	err = store.InTx(ctx, func(tx models.Store) error {
+		return createCustomers(ctx, tx, *username, customers, &imported)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Imported %d customers\n", imported)
+	return nil
+}
+
+// createCustomers creates the customers as created by the user, counting them in created
+func createCustomers(ctx context.Context, tx models.Store, username string, customers []models.CustomerOut, created *int) error {
+	if username == "" {
+		return errors.New("the -user creating the customers is required")
+	}
+	userId, err := tx.Users().GetId(ctx, username)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("user %s does not exist", username)
+	} else if err != nil {
+		return err
+	}
+	for _, c := range customers {
+		customer := models.Customer{CustomerOut: models.CustomerOut{Name: c.Name, Surname: c.Surname}, CreatedByUserId: userId}
+		if err = tx.Customers().Create(ctx, &customer); err != nil {
+			return err
+		}
+		*created++
+	}
+	return nil
+}
+
+// readCustomersCSV reads the name and surname columns of a CSV file with a header row, so the
+// files written by export can be imported again
+func readCustomersCSV(r io.Reader) ([]models.CustomerOut, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("missing header row")
+	}
+	nameColumn, surnameColumn := -1, -1
+	for i, column := range rows[0] {
+		switch strings.ToLower(strings.TrimSpace(column)) {
+		case "name":
+			nameColumn = i
+		case "surname":
+			surnameColumn = i
+		}
+	}
+	if nameColumn < 0 || surnameColumn < 0 {
+		return nil, errors.New("the header row must have name and surname columns")
+	}
+
+	customers := make([]models.CustomerOut, 0, len(rows)-1)
+	for i, row := range rows[1:] {
+		c := models.CustomerOut{Name: strings.TrimSpace(row[nameColumn]), Surname: strings.TrimSpace(row[surnameColumn])}
+		if c.Name == "" || c.Surname == "" {
+			return nil, fmt.Errorf("line %d: name and surname are required", i+2)
+		}
+		customers = append(customers, c)
+	}
+	return customers, nil
+}
+
+func exportCommand(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	org := fs.String("org", "Default", "Organization of the customers")
+	format := fs.String("format", "csv", "Format of the export: csv or json")
+	output := fs.String("o", "", "File to write to, instead of the standard output")
+	if err := parseFlags(fs, args, 0, "export [-org name] [-format csv|json] [-o file]"); err != nil {
+		return err
+	}
+	if *format != "csv" && *format != "json" {
+		return fmt.Errorf("invalid format %s, must be csv or json", *format)
+	}
+
+	store := openStore(cfg)
+	defer db.DB.Close()
+	ctx, err := organizationContext(store, *org)
+	if err != nil {
+		return err
+	}
+	customers, err := store.Customers().List(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	w := stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	if *format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(customers)
+	}
+	return writeCustomersCSV(w, customers)
+}
+
+func writeCustomersCSV(w io.Writer, customers []models.CustomerOut) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "name", "surname", "picturePath", "createdByUser", "lastModifiedByUser"})
+	for _, c := range customers {
+		cw.Write([]string{strconv.Itoa(c.Id), c.Name, c.Surname, c.PicturePath, c.CreatedByUser, c.LastModifiedByUser})
+	}
+	cw.Flush()
+	return cw.Error()
+}
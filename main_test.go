@@ -2,9 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
@@ -14,17 +18,45 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"theam.io/jdavidsanchez/test_crm_api/auth"
+	"theam.io/jdavidsanchez/test_crm_api/config"
 	"theam.io/jdavidsanchez/test_crm_api/db"
 	"theam.io/jdavidsanchez/test_crm_api/models"
-	"theam.io/jdavidsanchez/test_crm_api/routes"
+	"theam.io/jdavidsanchez/test_crm_api/storetest"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
 )
 
 /***************************************************************
 System/E2E test (whole API and its connection with the database)
 ****************************************************************/
 
+// Configured with the environment only, since the flags are the ones of the tests, and without
+// login limits, which are tested on their own
+func testConfig() *config.Config {
+	cfg, _, err := config.Load(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.Login = config.Login{}
+	return cfg
+}
+
 func TestMain(m *testing.M) {
+	var err error
+	if api, err = setup(testConfig()); err != nil {
+		log.Fatal(err)
+	}
+	// Bootstrapped as with "crmapi user create -role admin"
+	admin := models.User{Username: "Admin", Password: "hunter2", Role: models.RoleAdmin}
+	utils.CheckErr(api.Store.Users().Create(context.Background(), &admin))
+	// With access to the customers of the Default organization, as with "crmapi org add-member"
+	utils.CheckErr(addMember(context.Background(), api.Store, "Default", "Admin"))
+
 	code := m.Run()
 
 	clearCustomersTable()
@@ -170,9 +202,9 @@ func Test_Auth_Customer_Routes(t *testing.T) {
 		response := executeRequest(t, req)
 
 		checkResponseCode(t, http.StatusCreated, response.Code)
-		want := "{\"id\":1,\"name\":\"Test_Name\",\"surname\":\"Test_Surname\",\"picturePath\":\"static/noPicturePlaceholder.jpg\",\"createdByUser\":\"Admin\",\"lastModifiedByUser\":\"Admin\"}"
+		want := "{\"id\":1,\"name\":\"Test_Name\",\"surname\":\"Test_Surname\",\"picturePath\":\"" + utils.AvatarPath("Test_Name", "Test_Surname") + "\",\"createdByUser\":\"Admin\",\"lastModifiedByUser\":\"Admin\",\"owner\":\"Admin\",\"teams\":[]}"
 
-		if body := response.Body.String(); body != want {
+		if body := stripSignature(response.Body.String()); body != want {
 			t.Errorf("Expected %s. Got %s", want, body)
 		}
 	})
@@ -181,11 +213,11 @@ func Test_Auth_Customer_Routes(t *testing.T) {
 		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
 		response := executeRequest(t, req)
 
-		want := "[{\"id\":1,\"name\":\"Test_Name\",\"surname\":\"Test_Surname\",\"picturePath\":\"static/noPicturePlaceholder.jpg\",\"createdByUser\":\"Admin\",\"lastModifiedByUser\":\"Admin\"}]"
+		want := "[{\"id\":1,\"name\":\"Test_Name\",\"surname\":\"Test_Surname\",\"picturePath\":\"" + utils.AvatarPath("Test_Name", "Test_Surname") + "\",\"createdByUser\":\"Admin\",\"lastModifiedByUser\":\"Admin\",\"owner\":\"Admin\",\"teams\":[]}]"
 
 		checkResponseCode(t, http.StatusOK, response.Code)
 
-		if body := response.Body.String(); body != want {
+		if body := stripSignature(response.Body.String()); body != want {
 			t.Errorf("Expected %s. Got %s", want, body)
 		}
 	})
@@ -204,9 +236,9 @@ func Test_Auth_Customer_Routes(t *testing.T) {
 		response := executeRequest(t, req)
 
 		checkResponseCode(t, http.StatusCreated, response.Code)
-		want := "{\"id\":2,\"name\":\"Test_Name_2\",\"surname\":\"Test_Surname_2\",\"picturePath\":\"static/noPicturePlaceholder.jpg\",\"createdByUser\":\"Admin\",\"lastModifiedByUser\":\"Admin\"}"
+		want := "{\"id\":2,\"name\":\"Test_Name_2\",\"surname\":\"Test_Surname_2\",\"picturePath\":\"" + utils.AvatarPath("Test_Name_2", "Test_Surname_2") + "\",\"createdByUser\":\"Admin\",\"lastModifiedByUser\":\"Admin\",\"owner\":\"Admin\",\"teams\":[]}"
 
-		if body := response.Body.String(); body != want {
+		if body := stripSignature(response.Body.String()); body != want {
 			t.Errorf("Expected %s. Got %s", want, body)
 		}
 	})
@@ -215,11 +247,11 @@ func Test_Auth_Customer_Routes(t *testing.T) {
 		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
 		response := executeRequest(t, req)
 
-		want := "[{\"id\":1,\"name\":\"Test_Name\",\"surname\":\"Test_Surname\",\"picturePath\":\"static/noPicturePlaceholder.jpg\",\"createdByUser\":\"Admin\",\"lastModifiedByUser\":\"Admin\"},{\"id\":2,\"name\":\"Test_Name_2\",\"surname\":\"Test_Surname_2\",\"picturePath\":\"static/noPicturePlaceholder.jpg\",\"createdByUser\":\"Admin\",\"lastModifiedByUser\":\"Admin\"}]"
+		want := "[{\"id\":1,\"name\":\"Test_Name\",\"surname\":\"Test_Surname\",\"picturePath\":\"" + utils.AvatarPath("Test_Name", "Test_Surname") + "\",\"createdByUser\":\"Admin\",\"lastModifiedByUser\":\"Admin\",\"owner\":\"Admin\",\"teams\":[]},{\"id\":2,\"name\":\"Test_Name_2\",\"surname\":\"Test_Surname_2\",\"picturePath\":\"" + utils.AvatarPath("Test_Name_2", "Test_Surname_2") + "\",\"createdByUser\":\"Admin\",\"lastModifiedByUser\":\"Admin\",\"owner\":\"Admin\",\"teams\":[]}]"
 
 		checkResponseCode(t, http.StatusOK, response.Code)
 
-		if body := response.Body.String(); body != want {
+		if body := stripSignature(response.Body.String()); body != want {
 			t.Errorf("Expected %s. Got %s", want, body)
 		}
 	})
@@ -243,11 +275,11 @@ func Test_Auth_Customer_Routes(t *testing.T) {
 		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
 		response := executeRequest(t, req)
 
-		want := "{\"id\":1,\"name\":\"Test_Name\",\"surname\":\"Test_Surname\",\"picturePath\":\"static/noPicturePlaceholder.jpg\",\"createdByUser\":\"Admin\",\"lastModifiedByUser\":\"Admin\"}"
+		want := "{\"id\":1,\"name\":\"Test_Name\",\"surname\":\"Test_Surname\",\"picturePath\":\"" + utils.AvatarPath("Test_Name", "Test_Surname") + "\",\"createdByUser\":\"Admin\",\"lastModifiedByUser\":\"Admin\",\"owner\":\"Admin\",\"teams\":[]}"
 
 		checkResponseCode(t, http.StatusOK, response.Code)
 
-		if body := response.Body.String(); body != want {
+		if body := stripSignature(response.Body.String()); body != want {
 			t.Errorf("Expected %s. Got %s", want, body)
 		}
 	})
@@ -283,8 +315,8 @@ func Test_Auth_Customer_Routes(t *testing.T) {
 
 		checkResponseCode(t, http.StatusOK, response.Code)
 
-		got := response.Body.String()
-		want := "{\"id\":1,\"name\":\"Test_Name_MODIFIED\",\"surname\":\"Test_Surname_MODIFIED\",\"picturePath\":\"static/noPicturePlaceholder.jpg\",\"createdByUser\":\"Admin\",\"lastModifiedByUser\":\"Admin\"}"
+		got := stripSignature(response.Body.String())
+		want := "{\"id\":1,\"name\":\"Test_Name_MODIFIED\",\"surname\":\"Test_Surname_MODIFIED\",\"picturePath\":\"" + utils.AvatarPath("Test_Name_MODIFIED", "Test_Surname_MODIFIED") + "\",\"createdByUser\":\"Admin\",\"lastModifiedByUser\":\"Admin\",\"owner\":\"Admin\",\"teams\":[]}"
 		if got != want {
 			t.Errorf("Expected %q response. Got %q", want, got)
 		}
@@ -302,6 +334,54 @@ func Test_Auth_Customer_Routes(t *testing.T) {
 			t.Errorf("Expected %q response. Got %q", want, got)
 		}
 	})
+	t.Run("AUTH Create customer with inline picture", func(t *testing.T) {
+		newCustomer := models.Customer{
+			CustomerOut: models.CustomerOut{
+				Name:    "Test_Name_3",
+				Surname: "Test_Surname_3",
+			},
+		}
+		file := filepath.Join("tests", "assets", "theam_test_arch.png")
+		b, w := createCustomerMultiPartForm(t, newCustomer, file)
+
+		req, _ := http.NewRequest("POST", "/customers/", &b)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusCreated, response.Code)
+
+		want := `\{"id":3,"name":"Test_Name_3","surname":"Test_Surname_3","picturePath":"static/[0-9a-f]{32}\.png","createdByUser":"Admin","lastModifiedByUser":"Admin","owner":"Admin","teams":\[\]\}`
+		got := stripSignature(response.Body.String())
+
+		if matched, _ := regexp.MatchString(want, got); !matched {
+			t.Errorf("Response %v does not match expected format: %v", got, want)
+		}
+	})
+	t.Run("AUTH Update nonexistent customer with inline picture", func(t *testing.T) {
+		updatedCustomer := models.Customer{
+			CustomerOut: models.CustomerOut{
+				Name:    "Test_Name_MODIFIED",
+				Surname: "Test_Surname_MODIFIED",
+			},
+		}
+		file := filepath.Join("tests", "assets", "theam_test_arch.png")
+		b, w := createCustomerMultiPartForm(t, updatedCustomer, file)
+		filesBefore, _ := filepath.Glob(filepath.Join("img", "*"))
+
+		req, _ := http.NewRequest("PUT", "/customers/22", &b)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusNotFound, response.Code)
+
+		// The uploaded file must have been removed with the failed update
+		filesAfter, _ := filepath.Glob(filepath.Join("img", "*"))
+		if len(filesAfter) != len(filesBefore) {
+			t.Errorf("Expected %d files in the images directory. Got %d", len(filesBefore), len(filesAfter))
+		}
+	})
 }
 
 func Test_Auth_User_Routes(t *testing.T) {
@@ -346,9 +426,142 @@ func Test_Auth_User_Routes(t *testing.T) {
 			t.Fatalf("Expected response was %q, got %q", want, got)
 		}
 	})
+
+	t.Run("Unlock user", func(t *testing.T) {
+		ctx := context.Background()
+		policy := models.LockoutPolicy{Threshold: 1, Duration: time.Hour, MaxDuration: time.Hour}
+		if _, err := api.Store.Users().LoginFailed(ctx, "Admin_ANOTHER", policy); err != nil {
+			t.Fatal(err)
+		}
+		response := authenticateUser(t, models.User{Username: "Admin_ANOTHER", Password: "hunter2_ANOTHER"})
+		checkResponseCode(t, http.StatusTooManyRequests, response.Code)
+
+		req, _ := http.NewRequest("DELETE", "/users/Admin_ANOTHER/lock", nil)
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", getAdminToken(t)))
+		checkResponseCode(t, http.StatusOK, executeRequest(t, req).Code)
+		if lockedFor, _ := api.Store.Users().LockedFor(ctx, "Admin_ANOTHER"); lockedFor != 0 {
+			t.Errorf("Expected the user to be unlocked. Got %s", lockedFor)
+		}
+
+		// Only admins can unlock users
+		response = authenticateUser(t, models.User{Username: "Admin_ANOTHER", Password: "hunter2_ANOTHER"})
+		checkResponseCode(t, http.StatusAccepted, response.Code)
+		var login map[string]string
+		json.Unmarshal(response.Body.Bytes(), &login)
+		req, _ = http.NewRequest("DELETE", "/users/Admin/lock", nil)
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", login["token"]))
+		checkResponseCode(t, http.StatusForbidden, executeRequest(t, req).Code)
+	})
 	clearAdditionalUsers()
 }
 
+func Test_API_Key_Routes(t *testing.T) {
+	token := getAdminToken(t)
+	t.Cleanup(func() { db.DB.Exec("DELETE FROM api_keys") })
+
+	req, _ := http.NewRequest("POST", "/users/keys", bytes.NewBufferString(`{"name":"ETL","scopes":["customers:read","customers:write"]}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	response := executeRequest(t, req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var created map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &created)
+	key, _ := created["key"].(string)
+
+	t.Run("Use API key", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/customers/", bytes.NewBufferString(`{"name":"Key","surname":"User"}`))
+		req.Header.Set("X-API-Key", key)
+		response := executeRequest(t, req)
+		checkResponseCode(t, http.StatusCreated, response.Code)
+		var c models.CustomerOut
+		json.Unmarshal(response.Body.Bytes(), &c)
+		if c.CreatedByUser != "Admin" {
+			t.Errorf("Expected the customer created by the user of the key. Got %s", c.CreatedByUser)
+		}
+		clearCustomersTable()
+
+		req, _ = http.NewRequest("POST", "/customers/picture", nil)
+		req.Header.Set("X-API-Key", key)
+		checkResponseCode(t, http.StatusForbidden, executeRequest(t, req).Code)
+	})
+
+	t.Run("List every key as admin", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/users/keys?all=true", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		response := executeRequest(t, req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var keys []models.APIKey
+		json.Unmarshal(response.Body.Bytes(), &keys)
+		if len(keys) != 1 || keys[0].Username != "Admin" || keys[0].LastUsedAt == nil {
+			t.Errorf("Expected the used key of Admin. Got %s", response.Body.String())
+		}
+	})
+}
+
+func Test_Customer_Ownership(t *testing.T) {
+	adminToken := getAdminToken(t)
+	t.Cleanup(func() {
+		clearCustomersTable()
+		clearTeams()
+		clearAdditionalUsers()
+	})
+	colleague := models.User{Username: "Colleague", Password: "hunter2_COLLEAGUE"}
+	data, _ := json.Marshal(colleague)
+	req, _ := http.NewRequest("POST", "/users/register", bytes.NewReader(data))
+	checkResponseCode(t, http.StatusCreated, executeRequest(t, req).Code)
+	utils.CheckErr(addMember(context.Background(), api.Store, "Default", "Colleague"))
+	response := authenticateUser(t, colleague)
+	var login map[string]string
+	json.Unmarshal(response.Body.Bytes(), &login)
+	colleagueToken := login["token"]
+
+	request := func(method, path, body, token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		return executeRequest(t, req)
+	}
+	response = request("POST", "/customers/", `{"name":"Owned","surname":"Customer"}`, adminToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var c models.CustomerOut
+	json.Unmarshal(response.Body.Bytes(), &c)
+	customer := "/customers/" + strconv.Itoa(c.Id)
+
+	t.Run("Only the owner accesses the customer", func(t *testing.T) {
+		if c.Owner != "Admin" {
+			t.Errorf("Expected the creator as owner. Got %q", c.Owner)
+		}
+		checkResponseCode(t, http.StatusNotFound, request("GET", customer, "", colleagueToken).Code)
+		checkResponseCode(t, http.StatusNotFound, request("DELETE", customer, "", colleagueToken).Code)
+		checkResponseCode(t, http.StatusNotFound, request("GET", customer+"/attachments/1", "", colleagueToken).Code)
+		if body := request("GET", "/customers/all", "", colleagueToken).Body.String(); body != "[]" {
+			t.Errorf("Expected no customers for the colleague. Got %s", body)
+		}
+	})
+	t.Run("Share with a team", func(t *testing.T) {
+		response := request("POST", "/teams", `{"name":"Sales"}`, adminToken)
+		checkResponseCode(t, http.StatusCreated, response.Code)
+		var team models.Team
+		json.Unmarshal(response.Body.Bytes(), &team)
+		checkResponseCode(t, http.StatusOK, request("PUT", "/teams/"+strconv.Itoa(team.Id)+"/members/Colleague", "", adminToken).Code)
+		teams := `{"name":"Owned","surname":"Customer","teams":[` + strconv.Itoa(team.Id) + `]}`
+		checkResponseCode(t, http.StatusOK, request("PUT", customer, teams, adminToken).Code)
+
+		checkResponseCode(t, http.StatusOK, request("GET", customer, "", colleagueToken).Code)
+		checkResponseCode(t, http.StatusForbidden, request("PUT", customer, `{"name":"Owned","surname":"Customer","teams":[]}`, colleagueToken).Code)
+		checkResponseCode(t, http.StatusOK, request("PUT", customer, `{"name":"Shared","surname":"Customer"}`, colleagueToken).Code)
+	})
+	t.Run("Reassign customers", func(t *testing.T) {
+		body := `{"customerIds":[` + strconv.Itoa(c.Id) + `],"owner":"Colleague"}`
+		checkResponseCode(t, http.StatusForbidden, request("POST", "/customers/reassign", body, colleagueToken).Code)
+		checkResponseCode(t, http.StatusOK, request("POST", "/customers/reassign", body, adminToken).Code)
+
+		var mine []models.CustomerOut
+		json.Unmarshal(request("GET", "/customers/all?mine=true", "", colleagueToken).Body.Bytes(), &mine)
+		if len(mine) != 1 || mine[0].Owner != "Colleague" || mine[0].Name != "Shared" {
+			t.Errorf("Expected the reassigned customer. Got %+v", mine)
+		}
+	})
+}
+
 func Test_Non_Auth_Picture_Routes(t *testing.T) {
 	t.Run("NO_AUTH Upload picture", func(t *testing.T) {
 		// Attempt to upload picture
@@ -385,9 +598,10 @@ func Test_Non_Auth_Picture_Routes(t *testing.T) {
 }
 
 func Test_Auth_Picture_Routes(t *testing.T) {
-	const imagePathRegexp = `\{"id":[0-9]+?,"picturePath":"static/[0-9]+?\.(?:jpg|png|jpeg)"\}`
+	const imagePathRegexp = `\{"id":[0-9]+?,"picturePath":"static/[0-9a-f]{32}\.(?:jpg|png|jpeg)\?expires=[0-9]+\\u0026signature=[a-zA-Z0-9-_]+"\}`
 	var token string
 	var uploadedPictureId int
+	var uploadedPicturePath string
 	clearAdditionalPictures()
 	// Authenticating and getting token
 	t.Run("Authenticate existing user", func(t *testing.T) {
@@ -428,7 +642,7 @@ func Test_Auth_Picture_Routes(t *testing.T) {
 		response := executeRequest(t, req)
 
 		want := `{"id":1,"picturePath":"static/noPicturePlaceholder.jpg"}`
-		got := response.Body.String()
+		got := stripSignature(response.Body.String())
 
 		if got != want {
 			t.Fatalf("Expecting %q, got %q", want, got)
@@ -480,6 +694,7 @@ func Test_Auth_Picture_Routes(t *testing.T) {
 			t.Fatalf("Could not parse response body %+v. Got ID: %+v", m, uploadedPictureId)
 		}
 		uploadedPictureId = m.Id
+		uploadedPicturePath = m.Path
 	})
 	t.Run("AUTH Get one picture", func(t *testing.T) {
 		reqPath := fmt.Sprintf("/customers/picture/%s", strconv.Itoa(uploadedPictureId))
@@ -497,6 +712,636 @@ func Test_Auth_Picture_Routes(t *testing.T) {
 			t.Fatalf("Response %v does not match expected format: %v", got, want)
 		}
 	})
+	t.Run("Download picture with valid signature", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/"+uploadedPicturePath, nil)
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusOK, response.Code)
+	})
+	t.Run("Download picture without signature", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/"+strings.Split(uploadedPicturePath, "?")[0], nil)
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusForbidden, response.Code)
+
+		got := response.Body.String()
+		want := "{\"error\":\"Missing signature\"}"
+
+		if got != want {
+			t.Errorf("Expected %q response. Got %q", want, got)
+		}
+	})
+	t.Run("Download picture with tampered signature", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/"+uploadedPicturePath+"x", nil)
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusForbidden, response.Code)
+
+		got := response.Body.String()
+		want := "{\"error\":\"Invalid signature\"}"
+
+		if got != want {
+			t.Errorf("Expected %q response. Got %q", want, got)
+		}
+	})
+}
+
+func Test_Auth_Attachment_Routes(t *testing.T) {
+	clearCustomersTable()
+	token := getAdminToken(t)
+	var attachmentId int
+
+	newCustomer := models.Customer{
+		CustomerOut: models.CustomerOut{
+			Name:    "Test_Name",
+			Surname: "Test_Surname",
+		},
+	}
+	data, _ := json.Marshal(newCustomer)
+	req, _ := http.NewRequest("POST", "/customers/", bytes.NewBufferString(string(data)))
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	checkResponseCode(t, http.StatusCreated, executeRequest(t, req).Code)
+
+	t.Run("AUTH Get list with no attachments", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/customers/1/attachments", nil)
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusOK, response.Code)
+
+		if body := response.Body.String(); body != "[]" {
+			t.Errorf("Expected an empty array. Got %s", body)
+		}
+	})
+	t.Run("AUTH Upload attachment to a non existing customer", func(t *testing.T) {
+		file := filepath.Join("tests", "assets", "theam_test_arch.png")
+		b, w := createAttachmentMultiPartForm(t, "Architecture", file)
+
+		req, _ := http.NewRequest("POST", "/customers/22/attachments", &b)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusNotFound, response.Code)
+	})
+	t.Run("AUTH Upload attachment", func(t *testing.T) {
+		file := filepath.Join("tests", "assets", "theam_test_arch.png")
+		b, w := createAttachmentMultiPartForm(t, "Architecture", file)
+
+		req, _ := http.NewRequest("POST", "/customers/1/attachments", &b)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusCreated, response.Code)
+
+		var a models.Attachment
+		if err := json.Unmarshal(response.Body.Bytes(), &a); err != nil {
+			t.Fatalf("Could not parse response body %q", response.Body.String())
+		}
+		if a.Title != "Architecture" || a.MimeType != "image/png" || a.UploadedByUser != "Admin" || a.IsPrimary {
+			t.Errorf("Unexpected attachment %+v", a)
+		}
+		attachmentId = a.Id
+	})
+	t.Run("AUTH Download attachment", func(t *testing.T) {
+		reqPath := fmt.Sprintf("/customers/1/attachments/%d", attachmentId)
+		req, _ := http.NewRequest("GET", reqPath, nil)
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusOK, response.Code)
+
+		want, _ := ioutil.ReadFile(filepath.Join("tests", "assets", "theam_test_arch.png"))
+		if !bytes.Equal(response.Body.Bytes(), want) {
+			t.Errorf("Downloaded file does not match the uploaded one")
+		}
+		if got := response.Header().Get("Content-Type"); got != "image/png" {
+			t.Errorf("Expected Content-Type image/png. Got %s", got)
+		}
+	})
+	t.Run("AUTH Set primary attachment", func(t *testing.T) {
+		reqPath := fmt.Sprintf("/customers/1/attachments/%d/primary", attachmentId)
+		req, _ := http.NewRequest("PUT", reqPath, nil)
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusOK, response.Code)
+
+		req, _ = http.NewRequest("GET", "/customers/1", nil)
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		response = executeRequest(t, req)
+
+		want := `"picturePath":"static/[0-9a-f]{32}\.png"`
+		if matched, _ := regexp.MatchString(want, stripSignature(response.Body.String())); !matched {
+			t.Errorf("Response %v does not match expected format: %v", response.Body.String(), want)
+		}
+	})
+	t.Run("AUTH Delete attachment", func(t *testing.T) {
+		reqPath := fmt.Sprintf("/customers/1/attachments/%d", attachmentId)
+		req, _ := http.NewRequest("DELETE", reqPath, nil)
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusOK, response.Code)
+
+		req, _ = http.NewRequest("GET", reqPath, nil)
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		response = executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusNotFound, response.Code)
+
+		req, _ = http.NewRequest("DELETE", reqPath, nil)
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		response = executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusNotFound, response.Code)
+	})
+	t.Run("AUTH Get attachments of nonexistent customer", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/customers/22/attachments", nil)
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusNotFound, response.Code)
+	})
+	clearCustomersTable()
+}
+
+func Test_Auth_Resumable_Upload_Routes(t *testing.T) {
+	token := getAdminToken(t)
+	var uploadPath string
+
+	picture, _ := ioutil.ReadFile(filepath.Join("tests", "assets", "theam_test_arch.png"))
+	half := len(picture) / 2
+
+	t.Run("AUTH Create upload without Tus-Resumable", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/customers/picture/uploads", nil)
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		req.Header.Set("Upload-Length", strconv.Itoa(len(picture)))
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusPreconditionFailed, response.Code)
+	})
+	t.Run("AUTH Create upload", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/customers/picture/uploads", nil)
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		req.Header.Set("Upload-Length", strconv.Itoa(len(picture)))
+		req.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("theam_test_arch.png")))
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusCreated, response.Code)
+
+		uploadPath = response.Header().Get("Location")
+		if matched, _ := regexp.MatchString(`^/customers/picture/uploads/[0-9a-f]{32}$`, uploadPath); !matched {
+			t.Fatalf("Unexpected Location header %q", uploadPath)
+		}
+	})
+	t.Run("AUTH Upload first chunk", func(t *testing.T) {
+		req, _ := http.NewRequest("PATCH", uploadPath, bytes.NewReader(picture[:half]))
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", "0")
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusNoContent, response.Code)
+
+		if got := response.Header().Get("Upload-Offset"); got != strconv.Itoa(half) {
+			t.Errorf("Expected Upload-Offset %d. Got %s", half, got)
+		}
+	})
+	t.Run("AUTH Upload chunk with wrong offset", func(t *testing.T) {
+		req, _ := http.NewRequest("PATCH", uploadPath, bytes.NewReader(picture[half:]))
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", "0")
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusConflict, response.Code)
+	})
+	t.Run("AUTH Get upload offset", func(t *testing.T) {
+		req, _ := http.NewRequest("HEAD", uploadPath, nil)
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusOK, response.Code)
+
+		if got := response.Header().Get("Upload-Offset"); got != strconv.Itoa(half) {
+			t.Errorf("Expected Upload-Offset %d. Got %s", half, got)
+		}
+	})
+	t.Run("AUTH Upload last chunk", func(t *testing.T) {
+		req, _ := http.NewRequest("PATCH", uploadPath, bytes.NewReader(picture[half:]))
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", strconv.Itoa(half))
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusNoContent, response.Code)
+
+		pictureId := response.Header().Get("Picture-Id")
+		req, _ = http.NewRequest("GET", "/customers/picture/"+pictureId, nil)
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		response = executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusOK, response.Code)
+
+		want := `"picturePath":"static/[0-9a-f]{32}\.png"`
+		if matched, _ := regexp.MatchString(want, stripSignature(response.Body.String())); !matched {
+			t.Errorf("Response %v does not match expected format: %v", response.Body.String(), want)
+		}
+	})
+	t.Run("AUTH Terminate upload", func(t *testing.T) {
+		req, _ := http.NewRequest("DELETE", uploadPath, nil)
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusNoContent, response.Code)
+	})
+}
+
+func Test_Health_Routes(t *testing.T) {
+	t.Run("Liveness", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/healthz", nil)
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusOK, response.Code)
+	})
+	t.Run("Readiness", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/readyz", nil)
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusOK, response.Code)
+
+		var m struct {
+			Status string
+			Checks map[string]struct {
+				Status string
+			}
+		}
+		json.Unmarshal(response.Body.Bytes(), &m)
+		for _, check := range []string{"database", "migrations", "storage", "jwt"} {
+			if m.Checks[check].Status != "ok" {
+				t.Errorf("Expected check %q to be ok. Got %s", check, response.Body.String())
+			}
+		}
+	})
+	t.Run("Readiness when shutting down", func(t *testing.T) {
+		api.SetReady(false)
+		defer api.SetReady(true)
+
+		req, _ := http.NewRequest("GET", "/readyz", nil)
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusServiceUnavailable, response.Code)
+	})
+}
+
+func Test_Metrics_Route(t *testing.T) {
+	getAdminToken(t)
+	req, _ := http.NewRequest("GET", "/customers/1", nil)
+	executeRequest(t, req)
+
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	response := executeRequest(t, req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	body := response.Body.String()
+	for _, want := range []string{
+		`crm_http_requests_total{method="GET",route="/customers/{customerId:[0-9]+}",status="401"}`,
+		`crm_http_request_duration_seconds_bucket{method="POST",route="/users/login",status="202",le="+Inf"}`,
+		`crm_login_attempts_total{result="success"}`,
+		`go_sql_open_connections{db_name="crm"}`,
+		`crm_customers`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected metrics to contain %s. Got %s", want, body)
+		}
+	}
+}
+
+func Test_Request_ID(t *testing.T) {
+	t.Run("Propagate request ID", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/healthz", nil)
+		req.Header.Set("X-Request-ID", "test-request-id")
+		response := executeRequest(t, req)
+
+		if got := response.Header().Get("X-Request-ID"); got != "test-request-id" {
+			t.Errorf("Expected X-Request-ID test-request-id. Got %q", got)
+		}
+	})
+	t.Run("Assign request ID", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/healthz", nil)
+		response := executeRequest(t, req)
+
+		if got := response.Header().Get("X-Request-ID"); got == "" {
+			t.Errorf("Expected a new X-Request-ID")
+		}
+	})
+}
+
+func Test_Cancelled_Requests(t *testing.T) {
+	token := getAdminToken(t)
+
+	t.Run("Client cancelled the request", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req, _ := http.NewRequestWithContext(ctx, "GET", "/customers/all", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		response := executeRequest(t, req)
+		checkResponseCode(t, 499, response.Code)
+
+		if body := response.Body.String(); body != `{"error":"Request cancelled"}` {
+			t.Errorf("Expected the request cancelled error. Got %s", body)
+		}
+	})
+	t.Run("Query timed out", func(t *testing.T) {
+		timeout := models.Timeouts["ListAllCustomers"]
+		models.Timeouts["ListAllCustomers"] = time.Nanosecond
+		defer func() { models.Timeouts["ListAllCustomers"] = timeout }()
+
+		req, _ := http.NewRequest("GET", "/customers/all", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		response := executeRequest(t, req)
+		checkResponseCode(t, http.StatusGatewayTimeout, response.Code)
+
+		if body := response.Body.String(); body != `{"error":"Database query timed out"}` {
+			t.Errorf("Expected the timeout error. Got %s", body)
+		}
+	})
+}
+
+func Test_Postgres_Store(t *testing.T) {
+	clearStore := func() {
+		clearCustomersTable()
+		clearAdditionalUsers()
+		clearAdditionalPictures()
+		_, err := db.DB.Exec("DELETE FROM picture_uploads")
+		if err != nil {
+			fmt.Print(err.Error())
+		}
+		_, err = db.DB.Exec("DELETE FROM rate_limits")
+		if err != nil {
+			fmt.Print(err.Error())
+		}
+		_, err = db.DB.Exec("DELETE FROM api_keys")
+		if err != nil {
+			fmt.Print(err.Error())
+		}
+		_, err = db.DB.Exec("DELETE FROM signing_keys")
+		if err != nil {
+			fmt.Print(err.Error())
+		}
+		_, err = db.DB.Exec("DELETE FROM oidc_logins")
+		if err != nil {
+			fmt.Print(err.Error())
+		}
+		_, err = db.DB.Exec("DELETE FROM password_resets")
+		if err != nil {
+			fmt.Print(err.Error())
+		}
+		_, err = db.DB.Exec("DELETE FROM sessions")
+		if err != nil {
+			fmt.Print(err.Error())
+		}
+		clearAdditionalOrganizations()
+	}
+	storetest.Run(t, func(t *testing.T) models.Store {
+		clearStore()
+		t.Cleanup(clearStore)
+		return models.NewPostgresStore(db.DB)
+	})
+}
+
+func Test_Tracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	defer provider.Shutdown(context.Background())
+
+	token := getAdminToken(t)
+
+	req, _ := http.NewRequest("GET", "/customers/all", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	response := executeRequest(t, req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var server, query sdktrace.ReadOnlySpan
+	spans := recorder.Ended()
+	for _, span := range spans {
+		switch span.Name() {
+		case "GET /customers/all":
+			server = span
+		case "models.ListAllCustomers":
+			query = span
+		}
+	}
+	if server == nil || query == nil {
+		t.Fatalf("Expected the server and the models spans. Got %v", spans)
+	}
+	if got := server.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected the trace ID of the traceparent header. Got %s", got)
+	}
+	if got := server.Parent().SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("Expected the span ID of the traceparent header as parent. Got %s", got)
+	}
+	if query.SpanContext().TraceID() != server.SpanContext().TraceID() || query.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("Expected the models span to be a child of the server span")
+	}
+}
+
+func Test_Avatar_Routes(t *testing.T) {
+	var etag string
+	avatarPath := "/" + utils.AvatarPath("Test_Name", "Test_Surname")
+
+	t.Run("Get generated avatar", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", avatarPath, nil)
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusOK, response.Code)
+
+		if got := response.Header().Get("Content-Type"); got != "image/svg+xml" {
+			t.Errorf("Expected Content-Type image/svg+xml. Got %s", got)
+		}
+		if body := response.Body.String(); !strings.Contains(body, ">TT</text>") {
+			t.Errorf("Expected the avatar to contain the initials. Got %s", body)
+		}
+		etag = response.Header().Get("ETag")
+	})
+	t.Run("Get cached avatar", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", avatarPath, nil)
+		req.Header.Set("If-None-Match", etag)
+		response := executeRequest(t, req)
+
+		checkResponseCode(t, http.StatusNotModified, response.Code)
+	})
+}
+
+func Test_Admin_Commands(t *testing.T) {
+	cfg := testConfig()
+	// Every command opens (and closes) its own connection
+	database := db.DB
+	var out bytes.Buffer
+	stdout = &out
+	t.Cleanup(func() {
+		db.DB = database
+		stdout = os.Stdout
+		stdin = os.Stdin
+		clearCustomersTable()
+		clearAdditionalUsers()
+		clearAdditionalOrganizations()
+	})
+	run := func(args ...string) string {
+		t.Helper()
+		out.Reset()
+		if err := runCommand(cfg, args); err != nil {
+			t.Fatalf("crmapi %s: %s", strings.Join(args, " "), err.Error())
+		}
+		return out.String()
+	}
+	clearCustomersTable()
+
+	t.Run("Create user", func(t *testing.T) {
+		output := run("user", "create", "-role", "admin", "test_cli_user")
+		password := regexp.MustCompile(`Password: (\S+)`).FindStringSubmatch(output)
+		if password == nil {
+			t.Fatalf("Expected a generated password. Got %s", output)
+		}
+		response := authenticateUser(t, models.User{Username: "test_cli_user", Password: password[1]})
+		checkResponseCode(t, http.StatusAccepted, response.Code)
+
+		if err := runCommand(cfg, []string{"user", "create", "test_cli_user"}); err == nil {
+			t.Errorf("Expected an existing user to be refused")
+		}
+	})
+	t.Run("Reset password", func(t *testing.T) {
+		stdin = strings.NewReader("test_cli_password\n")
+		run("user", "reset-password", "-password-stdin", "test_cli_user")
+		response := authenticateUser(t, models.User{Username: "test_cli_user", Password: "test_cli_password"})
+		checkResponseCode(t, http.StatusAccepted, response.Code)
+	})
+	t.Run("Unlock", func(t *testing.T) {
+		policy := models.LockoutPolicy{Threshold: 1, Duration: time.Hour, MaxDuration: time.Hour}
+		if _, err := api.Store.Users().LoginFailed(context.Background(), "test_cli_user", policy); err != nil {
+			t.Fatal(err)
+		}
+		run("user", "unlock", "test_cli_user")
+		if lockedFor, _ := api.Store.Users().LockedFor(context.Background(), "test_cli_user"); lockedFor != 0 {
+			t.Errorf("Expected the user to be unlocked. Got %s", lockedFor)
+		}
+	})
+	t.Run("Disable two-factor authentication", func(t *testing.T) {
+		ctx := context.Background()
+		id, _ := api.Store.Users().GetId(ctx, "test_cli_user")
+		if err := api.Store.TwoFactor().SetSecret(ctx, id, "JBSWY3DPEHPK3PXP"); err != nil {
+			t.Fatal(err)
+		}
+		if err := api.Store.TwoFactor().Enable(ctx, id, 1); err != nil {
+			t.Fatal(err)
+		}
+		run("user", "disable-2fa", "test_cli_user")
+		if tf, _ := api.Store.TwoFactor().Get(ctx, id); tf.Enabled {
+			t.Errorf("Expected two-factor authentication to be disabled")
+		}
+	})
+	t.Run("Set email", func(t *testing.T) {
+		run("user", "set-email", "test_cli_user", "cli@example.com")
+		if u, _ := api.Store.Users().Get(context.Background(), "test_cli_user"); u.Email != "cli@example.com" {
+			t.Errorf("Expected the email to be set. Got %q", u.Email)
+		}
+	})
+	t.Run("Set role and list", func(t *testing.T) {
+		run("user", "set-role", "test_cli_user", "user")
+		output := run("user", "list")
+		if !regexp.MustCompile(`(?m)^1 +Admin +admin$`).MatchString(output) || !regexp.MustCompile(`(?m) test_cli_user +user$`).MatchString(output) {
+			t.Errorf("Unexpected users list:\n%s", output)
+		}
+	})
+	t.Run("Seed, export and import", func(t *testing.T) {
+		if output := run("seed", "-user", "test_cli_user"); output != "Seeded 5 customers\n" {
+			t.Errorf("Unexpected seed output %s", output)
+		}
+		if output := run("seed", "-user", "test_cli_user"); output != "There are customers already, nothing seeded\n" {
+			t.Errorf("Expected seed to do nothing the second time. Got %s", output)
+		}
+
+		dir, _ := ioutil.TempDir("", "crmapi-export-")
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "customers.csv")
+		run("export", "-o", file)
+		if output := run("import", "-user", "Admin", file); output != "Imported 5 customers\n" {
+			t.Errorf("Unexpected import output %s", output)
+		}
+
+		var customers []models.CustomerOut
+		if err := json.Unmarshal([]byte(run("export", "-format", "json")), &customers); err != nil {
+			t.Fatal(err)
+		}
+		createdBy := make(map[string]int)
+		for _, c := range customers {
+			createdBy[c.CreatedByUser]++
+		}
+		if len(customers) != 10 || createdBy["test_cli_user"] != 5 || createdBy["Admin"] != 5 {
+			t.Errorf("Unexpected customers after the import %+v", customers)
+		}
+	})
+	t.Run("Organizations", func(t *testing.T) {
+		if output := run("org", "create", "Acme"); !strings.HasPrefix(output, "Created organization Acme") {
+			t.Errorf("Unexpected org create output %s", output)
+		}
+		run("org", "add-member", "Acme", "test_cli_user")
+		if output := run("org", "list"); !regexp.MustCompile(`(?m) Acme +test_cli_user$`).MatchString(output) {
+			t.Errorf("Unexpected organizations list:\n%s", output)
+		}
+		if output := run("seed", "-user", "test_cli_user", "-org", "Acme"); output != "Seeded 5 customers\n" {
+			t.Errorf("Expected the customers of Default not to count in Acme. Got %s", output)
+		}
+		var customers []models.CustomerOut
+		json.Unmarshal([]byte(run("export", "-org", "Acme", "-format", "json")), &customers)
+		if len(customers) != 5 {
+			t.Errorf("Expected the 5 customers of Acme. Got %+v", customers)
+		}
+		run("org", "remove-member", "Acme", "test_cli_user")
+		if err := runCommand(cfg, []string{"org", "remove-member", "Acme", "test_cli_user"}); err != models.ErrMemberNotFound {
+			t.Errorf("Expected ErrMemberNotFound. Got %v", err)
+		}
+		if err := runCommand(cfg, []string{"export", "-org", "Unknown"}); err == nil {
+			t.Errorf("Expected an unknown organization to be refused")
+		}
+	})
+	t.Run("Rotate signing keys", func(t *testing.T) {
+		es256 := *cfg
+		es256.Auth.JWTAlgorithm = "ES256"
+		defer func() {
+			auth.Configure(cfg.Auth)
+			db.DB.Exec("DELETE FROM signing_keys")
+		}()
+		for i := 0; i < 2; i++ {
+			out.Reset()
+			if err := runCommand(&es256, []string{"keys", "rotate"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		out.Reset()
+		if err := runCommand(&es256, []string{"keys", "list"}); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != 3 || !strings.Contains(lines[1], " ES256 ") || strings.HasSuffix(lines[1], " -") || !strings.HasSuffix(lines[2], " -") {
+			t.Errorf("Expected a retired key and the signing one:\n%s", out.String())
+		}
+
+		if err := runCommand(cfg, []string{"keys", "rotate"}); err == nil {
+			t.Errorf("Expected the rotation to be refused with HS256")
+		}
+	})
 }
 
 func clearCustomersTable() {
@@ -521,6 +1366,20 @@ func clearAdditionalUsers() {
 	}
 }
 
+func clearTeams() {
+	_, err := db.DB.Exec("DELETE FROM teams")
+	if err != nil {
+		fmt.Print(err.Error())
+	}
+}
+
+func clearAdditionalOrganizations() {
+	_, err := db.DB.Exec("DELETE FROM organizations WHERE name <> 'Default'")
+	if err != nil {
+		fmt.Print(err.Error())
+	}
+}
+
 func clearAdditionalPictures() {
 	_, err := db.DB.Exec("DELETE FROM pictures WHERE id > 1")
 	if err != nil {
@@ -535,7 +1394,7 @@ func clearAdditionalPictures() {
 func executeRequest(t *testing.T, req *http.Request) *httptest.ResponseRecorder {
 	t.Helper()
 	rr := httptest.NewRecorder()
-	routes.Router.ServeHTTP(rr, req)
+	api.ServeHTTP(rr, req)
 
 	return rr
 }
@@ -555,9 +1414,25 @@ func authenticateUser(t *testing.T, u models.User) *httptest.ResponseRecorder {
 	return executeRequest(t, req)
 }
 
+func getAdminToken(t *testing.T) string {
+	t.Helper()
+	user := models.User{
+		Username: "Admin",
+		Password: "hunter2",
+	}
+	response := authenticateUser(t, user)
+
+	m := make(map[string]string)
+	err := json.NewDecoder(response.Body).Decode(&m)
+	if err != nil {
+		t.Fatalf("Error decoding response body: %q", err.Error())
+	}
+	return m["token"]
+}
+
 func matchJwtToken(t *testing.T, body string) {
 	t.Helper()
-	want := `\{"result":"success","token":"[a-zA-Z0-9-_=]+?.[a-zA-Z0-9-_=]+?.[a-zA-Z0-9-_.+/=]*?"\}`
+	want := `\{"refreshToken":"[0-9a-f]{64}","result":"success","token":"[a-zA-Z0-9-_=]+?.[a-zA-Z0-9-_=]+?.[a-zA-Z0-9-_.+/=]*?"\}`
 	got := body
 
 	if matched, err := regexp.MatchString(want, got); !matched {
@@ -567,6 +1442,65 @@ func matchJwtToken(t *testing.T, body string) {
 	}
 }
 
+// Picture paths are signed with an expiration time, so remove the query to compare them
+func stripSignature(body string) string {
+	signature := regexp.MustCompile(`\?expires=[0-9]+\\u0026signature=[a-zA-Z0-9-_]+`)
+	return signature.ReplaceAllString(body, "")
+}
+
+func createCustomerMultiPartForm(t *testing.T, c models.Customer, fileName string) (bytes.Buffer, *multipart.Writer) {
+	t.Helper()
+	var b bytes.Buffer
+	mpWriter := multipart.NewWriter(&b)
+
+	data, _ := json.Marshal(c)
+	if err := mpWriter.WriteField("customer", string(data)); err != nil {
+		t.Fatalf("Error writing customer field: %v", err)
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatalf("Error opening file: %v", err)
+	}
+	defer file.Close()
+
+	formFile, err := mpWriter.CreateFormFile("picture", file.Name())
+	if err != nil {
+		t.Fatalf("Error creating writer: %v", err)
+	}
+	if _, err = io.Copy(formFile, file); err != nil {
+		t.Fatalf("Error in io.Copy: %v", err)
+	}
+	mpWriter.Close()
+	return b, mpWriter
+}
+
+func createAttachmentMultiPartForm(t *testing.T, title, fileName string) (bytes.Buffer, *multipart.Writer) {
+	t.Helper()
+	var b bytes.Buffer
+	mpWriter := multipart.NewWriter(&b)
+
+	if err := mpWriter.WriteField("title", title); err != nil {
+		t.Fatalf("Error writing title field: %v", err)
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatalf("Error opening file: %v", err)
+	}
+	defer file.Close()
+
+	formFile, err := mpWriter.CreateFormFile("file", file.Name())
+	if err != nil {
+		t.Fatalf("Error creating writer: %v", err)
+	}
+	if _, err = io.Copy(formFile, file); err != nil {
+		t.Fatalf("Error in io.Copy: %v", err)
+	}
+	mpWriter.Close()
+	return b, mpWriter
+}
+
 func createPictureMultiPartForm(t *testing.T, fileName string) (bytes.Buffer, *multipart.Writer) {
 	t.Helper()
 	var b bytes.Buffer
@@ -0,0 +1,1827 @@
+package memstore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/passwd"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+// In-memory implementation of the repositories, behaving as the PostgreSQL one, so the route
+// handlers can be tested without a database
+
+type Store struct {
+	mu   sync.Mutex // Held during the whole transactions, so they are serialized
+	data *data
+	tx   bool
+}
+
+type data struct {
+	users            []models.User // Index is the ID - 1, with the password hashed
+	pictures         []picture     // Index is the ID - 1
+	customers        map[int]models.Customer
+	attachments      map[int]models.Attachment
+	uploads          map[string]models.Upload
+	lockouts         map[string]lockout   // By username
+	rateLimits       map[string]time.Time // Time at which each bucket is full
+	apiKeys          map[int]models.APIKey
+	signingKeys      []models.SigningKey  // From the oldest to the newest
+	oidcUsers        map[oidcIdentity]int // User IDs, by single sign-on identity
+	oidcLogins       map[string]models.OIDCLogin
+	twoFactor        map[int]twoFactor // By user ID
+	sessions         map[string]models.Session
+	passwordResets   map[string]models.PasswordReset // By token hash
+	organizations    []models.Organization           // Index is the ID - 1
+	members          map[member]time.Time            // Time at which each user was added
+	teams            map[int]team
+	teamMembers      map[teamMember]bool
+	lastCustomerId   int
+	lastAttachmentId int
+	lastAPIKeyId     int
+	lastTeamId       int
+}
+
+type picture struct {
+	path  string
+	orgId int // 0 for the placeholder, shared by every organization
+}
+
+type member struct{ orgId, userId int }
+
+type team struct {
+	models.Team // Without its members
+	orgId       int
+}
+
+type teamMember struct{ teamId, userId int }
+
+// New returns an empty store, with only the placeholder picture (ID 1)
+func New() *Store {
+	return &Store{data: &data{
+		pictures:       []picture{{path: path.Join(utils.PathFileServer, utils.PlaceholderPicture)}},
+		customers:      make(map[int]models.Customer),
+		attachments:    make(map[int]models.Attachment),
+		uploads:        make(map[string]models.Upload),
+		lockouts:       make(map[string]lockout),
+		rateLimits:     make(map[string]time.Time),
+		apiKeys:        make(map[int]models.APIKey),
+		oidcUsers:      make(map[oidcIdentity]int),
+		oidcLogins:     make(map[string]models.OIDCLogin),
+		twoFactor:      make(map[int]twoFactor),
+		sessions:       make(map[string]models.Session),
+		passwordResets: make(map[string]models.PasswordReset),
+		members:        make(map[member]time.Time),
+		teams:          make(map[int]team),
+		teamMembers:    make(map[teamMember]bool),
+	}}
+}
+
+func (d *data) clone() *data {
+	c := *d
+	c.users = append([]models.User(nil), d.users...)
+	c.pictures = append([]picture(nil), d.pictures...)
+	c.organizations = append([]models.Organization(nil), d.organizations...)
+	c.members = make(map[member]time.Time, len(d.members))
+	for k, v := range d.members {
+		c.members[k] = v
+	}
+	c.teams = make(map[int]team, len(d.teams))
+	for k, v := range d.teams {
+		c.teams[k] = v
+	}
+	c.teamMembers = make(map[teamMember]bool, len(d.teamMembers))
+	for k, v := range d.teamMembers {
+		c.teamMembers[k] = v
+	}
+	c.customers = make(map[int]models.Customer, len(d.customers))
+	for k, v := range d.customers {
+		c.customers[k] = v
+	}
+	c.attachments = make(map[int]models.Attachment, len(d.attachments))
+	for k, v := range d.attachments {
+		c.attachments[k] = v
+	}
+	c.uploads = make(map[string]models.Upload, len(d.uploads))
+	for k, v := range d.uploads {
+		c.uploads[k] = v
+	}
+	c.lockouts = make(map[string]lockout, len(d.lockouts))
+	for k, v := range d.lockouts {
+		c.lockouts[k] = v
+	}
+	c.rateLimits = make(map[string]time.Time, len(d.rateLimits))
+	for k, v := range d.rateLimits {
+		c.rateLimits[k] = v
+	}
+	c.signingKeys = append([]models.SigningKey(nil), d.signingKeys...)
+	c.apiKeys = make(map[int]models.APIKey, len(d.apiKeys))
+	for k, v := range d.apiKeys {
+		c.apiKeys[k] = v
+	}
+	c.oidcUsers = make(map[oidcIdentity]int, len(d.oidcUsers))
+	for k, v := range d.oidcUsers {
+		c.oidcUsers[k] = v
+	}
+	c.oidcLogins = make(map[string]models.OIDCLogin, len(d.oidcLogins))
+	for k, v := range d.oidcLogins {
+		c.oidcLogins[k] = v
+	}
+	c.sessions = make(map[string]models.Session, len(d.sessions))
+	for k, v := range d.sessions {
+		c.sessions[k] = v
+	}
+	c.passwordResets = make(map[string]models.PasswordReset, len(d.passwordResets))
+	for k, v := range d.passwordResets {
+		c.passwordResets[k] = v
+	}
+	c.twoFactor = make(map[int]twoFactor, len(d.twoFactor))
+	for k, v := range d.twoFactor {
+		v.recoveryCodes = append([]string(nil), v.recoveryCodes...)
+		c.twoFactor[k] = v
+	}
+	return &c
+}
+
+func (s *Store) Customers() models.CustomerRepository     { return customers{s} }
+func (s *Store) Users() models.UserRepository             { return users{s} }
+func (s *Store) Pictures() models.PictureRepository       { return pictures{s} }
+func (s *Store) Attachments() models.AttachmentRepository { return attachments{s} }
+func (s *Store) Uploads() models.UploadRepository         { return uploads{s} }
+func (s *Store) RateLimits() models.RateLimitRepository   { return rateLimits{s} }
+func (s *Store) APIKeys() models.APIKeyRepository         { return apiKeys{s} }
+func (s *Store) SigningKeys() models.SigningKeyRepository { return signingKeys{s} }
+func (s *Store) OIDCLogins() models.OIDCLoginRepository   { return oidcLogins{s} }
+func (s *Store) TwoFactor() models.TwoFactorRepository    { return twoFactors{s} }
+func (s *Store) Sessions() models.SessionRepository       { return sessions{s} }
+func (s *Store) PasswordResets() models.PasswordResetRepository {
+	return passwordResets{s}
+}
+func (s *Store) Organizations() models.OrganizationRepository {
+	return organizations{s}
+}
+func (s *Store) Teams() models.TeamRepository { return teams{s} }
+
+func (s *Store) InTx(ctx context.Context, fn func(tx models.Store) error) error {
+	if s.tx {
+		return fn(s)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	tx := &Store{data: s.data.clone(), tx: true}
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+	s.data = tx.data
+	return nil
+}
+
+func (s *Store) Ping(ctx context.Context) error {
+	return contextError(ctx)
+}
+
+// Locks the store for an operation, failing as the models do if the context is done
+func (s *Store) begin(ctx context.Context) (*data, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	return s.data, nil
+}
+
+func (s *Store) end() {
+	s.mu.Unlock()
+}
+
+func contextError(ctx context.Context) error {
+	switch ctx.Err() {
+	case context.Canceled:
+		return models.ErrCanceled
+	case context.DeadlineExceeded:
+		return models.ErrTimeout
+	}
+	return nil
+}
+
+/******************
+Data access helpers
+*******************/
+
+func (d *data) username(id int) string {
+	if id < 1 || id > len(d.users) {
+		return ""
+	}
+	return d.users[id-1].Username
+}
+
+func (d *data) picturePath(id int) string {
+	if id < 1 || id > len(d.pictures) {
+		return ""
+	}
+	return d.pictures[id-1].path
+}
+
+// Whether the data of the organization is visible with the context, as with the row level
+// security policies of PostgreSQL
+func visible(ctx context.Context, orgId int) bool {
+	id, all := models.OrganizationFrom(ctx)
+	return all || (id != 0 && id == orgId)
+}
+
+func (d *data) pictureVisible(ctx context.Context, id int) bool {
+	if id < 1 || id > len(d.pictures) {
+		return false
+	}
+	orgId := d.pictures[id-1].orgId
+	return orgId == 0 || visible(ctx, orgId)
+}
+
+// Whether the customer is visible, and the user of the context owns it or shares it with one of
+// its teams, as with can_access_customer in PostgreSQL
+func (d *data) customerAccessible(ctx context.Context, id int) bool {
+	c, ok := d.customers[id]
+	if !ok || !visible(ctx, c.OrganizationId) {
+		return false
+	}
+	userId, admin := models.UserFrom(ctx)
+	if admin || (userId != 0 && c.OwnerId == userId) {
+		return true
+	}
+	for _, teamId := range c.Teams {
+		if d.teamMembers[teamMember{teamId, userId}] {
+			return true
+		}
+	}
+	return false
+}
+
+// The teams of the customers are never modified in place, as they are shared with the clones
+func (d *data) customerOut(c models.Customer) models.CustomerOut {
+	out := c.CustomerOut
+	out.PicturePath = d.picturePath(c.PictureId)
+	out.CreatedByUser = d.username(c.CreatedByUserId)
+	out.LastModifiedByUser = d.username(c.LastModifiedByUserId)
+	out.Owner = d.username(c.OwnerId)
+	out.Teams = append([]int{}, c.Teams...)
+	return out
+}
+
+// Returns the sorted IDs of the teams, or ErrTeamNotFound if any is not in the organization
+func (d *data) checkTeams(orgId int, ids []int) ([]int, error) {
+	distinct := make(map[int]bool, len(ids))
+	teams := []int{}
+	for _, id := range ids {
+		if t, ok := d.teams[id]; !ok || t.orgId != orgId {
+			return nil, models.ErrTeamNotFound
+		}
+		if !distinct[id] {
+			distinct[id] = true
+			teams = append(teams, id)
+		}
+	}
+	sort.Ints(teams)
+	return teams, nil
+}
+
+func (d *data) checkUser(id int) error {
+	if d.username(id) == "" {
+		return fmt.Errorf("User %d does not exist", id)
+	}
+	return nil
+}
+
+func (d *data) checkPicture(ctx context.Context, id int) error {
+	if !d.pictureVisible(ctx, id) {
+		return fmt.Errorf("Picture %d does not exist", id)
+	}
+	return nil
+}
+
+// Adds the picture to the organization of the context
+func (d *data) addPicture(ctx context.Context, p *models.PicturePath) error {
+	orgId, all := models.OrganizationFrom(ctx)
+	if orgId == 0 && !all {
+		return models.ErrNoOrganization
+	}
+	for _, existing := range d.pictures {
+		if existing.path == p.Path {
+			p.Id = 1
+			return nil
+		}
+	}
+	d.pictures = append(d.pictures, picture{p.Path, orgId})
+	p.Id = len(d.pictures)
+	return nil
+}
+
+/*********
+Customers
+**********/
+
+type customers struct{ s *Store }
+
+func (r customers) Get(ctx context.Context, id int) (models.CustomerOut, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return models.CustomerOut{}, err
+	}
+	defer r.s.end()
+
+	if !d.customerAccessible(ctx, id) {
+		return models.CustomerOut{Id: id}, sql.ErrNoRows
+	}
+	return d.customerOut(d.customers[id]), nil
+}
+
+func (r customers) Create(ctx context.Context, c *models.Customer) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	orgId, _ := models.OrganizationFrom(ctx)
+	if orgId == 0 {
+		return models.ErrNoOrganization
+	}
+	if c.PictureId == 0 {
+		c.PictureId = 1
+	}
+	if err = d.checkPicture(ctx, c.PictureId); err != nil {
+		return err
+	}
+	if err = d.checkUser(c.CreatedByUserId); err != nil {
+		return err
+	}
+	if c.Teams, err = d.checkTeams(orgId, c.Teams); err != nil {
+		return err
+	}
+	c.OrganizationId = orgId
+	c.OwnerId = c.CreatedByUserId
+	d.lastCustomerId++
+	c.Id = d.lastCustomerId
+	c.LastModifiedByUserId = c.CreatedByUserId
+	d.customers[c.Id] = *c
+	c.CustomerOut = d.customerOut(*c)
+	return nil
+}
+
+func (r customers) Update(ctx context.Context, c *models.Customer) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	if !d.customerAccessible(ctx, c.Id) {
+		return models.ErrCustomerNotFound
+	}
+	existing := d.customers[c.Id]
+	if c.PictureId == 0 {
+		c.PictureId = 1
+	}
+	if err = d.checkPicture(ctx, c.PictureId); err != nil {
+		return err
+	}
+	if err = d.checkUser(c.LastModifiedByUserId); err != nil {
+		return err
+	}
+	if c.Teams == nil {
+		c.Teams = existing.Teams
+	} else {
+		if userId, admin := models.UserFrom(ctx); !admin && existing.OwnerId != userId {
+			return models.ErrNotOwner
+		}
+		if c.Teams, err = d.checkTeams(existing.OrganizationId, c.Teams); err != nil {
+			return err
+		}
+	}
+	c.CreatedByUserId = existing.CreatedByUserId
+	c.OwnerId = existing.OwnerId
+	c.OrganizationId = existing.OrganizationId
+	d.customers[c.Id] = *c
+	c.CustomerOut = d.customerOut(*c)
+	return nil
+}
+
+func (r customers) Delete(ctx context.Context, id int) ([]string, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.s.end()
+
+	if !d.customerAccessible(ctx, id) {
+		return nil, models.ErrCustomerNotFound
+	}
+	delete(d.customers, id)
+	// Attachments are deleted in cascade
+	var files []string
+	for attachmentId, a := range d.attachments {
+		if a.CustomerId == id {
+			files = append(files, a.FilePath)
+			delete(d.attachments, attachmentId)
+		}
+	}
+	return files, nil
+}
+
+func (r customers) List(ctx context.Context, mine bool) ([]models.CustomerOut, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.s.end()
+
+	userId, _ := models.UserFrom(ctx)
+	list := []models.CustomerOut{}
+	for id, c := range d.customers {
+		if d.customerAccessible(ctx, id) && (!mine || (userId != 0 && c.OwnerId == userId)) {
+			list = append(list, d.customerOut(c))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list, nil
+}
+
+func (r customers) Count(ctx context.Context) (int, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer r.s.end()
+
+	count := 0
+	for id := range d.customers {
+		if d.customerAccessible(ctx, id) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r customers) Reassign(ctx context.Context, ids []int, ownerId int) (int, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer r.s.end()
+
+	orgId, _ := models.OrganizationFrom(ctx)
+	if _, ok := d.members[member{orgId, ownerId}]; !ok {
+		return 0, models.ErrMemberNotFound
+	}
+	userId, admin := models.UserFrom(ctx)
+	for _, id := range ids {
+		if d.customerAccessible(ctx, id) && !admin && d.customers[id].OwnerId != userId {
+			return 0, models.ErrNotOwner
+		}
+	}
+	reassigned := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		if !d.customerAccessible(ctx, id) {
+			return 0, models.ErrCustomerNotFound
+		}
+		reassigned[id] = true
+	}
+	for id := range reassigned {
+		c := d.customers[id]
+		c.OwnerId = ownerId
+		if userId != 0 {
+			c.LastModifiedByUserId = userId
+		}
+		d.customers[id] = c
+	}
+	return len(reassigned), nil
+}
+
+/*****
+Users
+******/
+
+type users struct{ s *Store }
+
+func (r users) Create(ctx context.Context, u *models.User) error {
+	hash, err := passwd.Hash(u.Password)
+	if err != nil {
+		return err
+	}
+
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	for _, existing := range d.users {
+		if existing.Username == u.Username {
+			return nil
+		}
+	}
+	if u.Role == "" {
+		u.Role = models.RoleUser
+	}
+	d.users = append(d.users, models.User{Id: len(d.users) + 1, Username: u.Username, Password: hash, Email: u.Email, Role: u.Role})
+	return nil
+}
+
+func (r users) Login(ctx context.Context, u *models.User) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	var hash string
+	for _, existing := range d.users {
+		if existing.Username == u.Username {
+			u.Id = existing.Id
+			u.Role = existing.Role
+			hash = existing.Password
+		}
+	}
+	r.s.end()
+
+	ok, rehash, err := passwd.Verify(hash, u.Password)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("Invalid credentials")
+	}
+	password := u.Password
+	u.Password = hash
+	if !rehash {
+		return nil
+	}
+	newHash, err := passwd.Hash(password)
+	if err == passwd.ErrTooLong {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	err = r.update(ctx, u.Username, func(existing *models.User) {
+		if existing.Password == hash {
+			existing.Password, u.Password = newHash, newHash
+		}
+	})
+	return err
+}
+
+func (r users) GetId(ctx context.Context, username string) (int, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer r.s.end()
+
+	for _, u := range d.users {
+		if u.Username == username {
+			return u.Id, nil
+		}
+	}
+	return 0, sql.ErrNoRows
+}
+
+func (r users) Get(ctx context.Context, username string) (models.User, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return models.User{}, err
+	}
+	defer r.s.end()
+
+	for _, u := range d.users {
+		if u.Username == username {
+			return models.User{Id: u.Id, Username: u.Username, Email: u.Email, Role: u.Role}, nil
+		}
+	}
+	return models.User{Username: username}, sql.ErrNoRows
+}
+
+func (r users) ResetPassword(ctx context.Context, u *models.User) error {
+	hash, err := passwd.Hash(u.Password)
+	if err != nil {
+		return err
+	}
+	return r.update(ctx, u.Username, func(existing *models.User) { existing.Password = hash })
+}
+
+func (r users) UpdateRole(ctx context.Context, u *models.User) error {
+	if !models.ValidRole(u.Role) {
+		return errors.New("Invalid role " + u.Role)
+	}
+	return r.update(ctx, u.Username, func(existing *models.User) { existing.Role = u.Role })
+}
+
+type oidcIdentity struct{ issuer, subject string }
+
+func (r users) ProvisionOIDC(ctx context.Context, u *models.User, issuer, subject string) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	identity := oidcIdentity{issuer, subject}
+	id, linked := d.oidcUsers[identity]
+	if !linked {
+		for _, existing := range d.users {
+			if existing.Username == u.Username {
+				return models.ErrUsernameTaken
+			}
+		}
+		if u.Role == "" {
+			u.Role = models.RoleUser
+		}
+		id = len(d.users) + 1
+		d.users = append(d.users, models.User{Id: id, Username: u.Username, Role: u.Role})
+		d.oidcUsers[identity] = id
+	}
+
+	existing := &d.users[id-1]
+	if u.Role != "" {
+		existing.Role = u.Role
+	}
+	u.Id, u.Username, u.Role = existing.Id, existing.Username, existing.Role
+	return nil
+}
+
+func (r users) LinkOIDC(ctx context.Context, u *models.User, issuer, subject string) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	identity := oidcIdentity{issuer, subject}
+	if _, linked := d.oidcUsers[identity]; linked || u.Id < 1 || u.Id > len(d.users) {
+		return models.ErrOIDCLinked
+	}
+	for _, id := range d.oidcUsers {
+		if id == u.Id {
+			return models.ErrOIDCLinked
+		}
+	}
+	d.oidcUsers[identity] = u.Id
+	u.Username, u.Role = d.users[u.Id-1].Username, d.users[u.Id-1].Role
+	return nil
+}
+
+func (r users) UpdateEmail(ctx context.Context, u *models.User) error {
+	return r.update(ctx, u.Username, func(existing *models.User) { existing.Email = u.Email })
+}
+
+func (r users) update(ctx context.Context, username string, update func(u *models.User)) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	for i := range d.users {
+		if d.users[i].Username == username {
+			update(&d.users[i])
+			return nil
+		}
+	}
+	return models.ErrUserNotFound
+}
+
+func (r users) List(ctx context.Context) ([]models.User, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.s.end()
+
+	users := make([]models.User, 0, len(d.users))
+	for _, u := range d.users {
+		users = append(users, models.User{Id: u.Id, Username: u.Username, Role: u.Role})
+	}
+	return users, nil
+}
+
+func (r users) Count(ctx context.Context) (int, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer r.s.end()
+	return len(d.users), nil
+}
+
+type lockout struct {
+	failures    int
+	lockedUntil time.Time
+}
+
+func (d *data) userExists(username string) bool {
+	for _, u := range d.users {
+		if u.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (r users) LoginFailed(ctx context.Context, username string, p models.LockoutPolicy) (time.Duration, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer r.s.end()
+	if !d.userExists(username) {
+		return 0, nil
+	}
+
+	l := d.lockouts[username]
+	l.failures++
+	if p.Threshold > 0 && l.failures >= p.Threshold {
+		lockedFor := p.Duration
+		for i := p.Threshold; i < l.failures && lockedFor < p.MaxDuration; i++ {
+			lockedFor *= 2
+		}
+		if lockedFor > p.MaxDuration {
+			lockedFor = p.MaxDuration
+		}
+		l.lockedUntil = time.Now().Add(lockedFor)
+	}
+	d.lockouts[username] = l
+	return remaining(l.lockedUntil), nil
+}
+
+func (r users) LoginSucceeded(ctx context.Context, username string) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+	delete(d.lockouts, username)
+	return nil
+}
+
+func (r users) LockedFor(ctx context.Context, username string) (time.Duration, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer r.s.end()
+	return remaining(d.lockouts[username].lockedUntil), nil
+}
+
+func (r users) Unlock(ctx context.Context, username string) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+	if !d.userExists(username) {
+		return models.ErrUserNotFound
+	}
+	delete(d.lockouts, username)
+	return nil
+}
+
+// Time until t, rounded up to whole seconds as the PostgreSQL store does (0 if already passed)
+func remaining(t time.Time) time.Duration {
+	wait := time.Until(t)
+	if wait <= 0 {
+		return 0
+	}
+	if wait%time.Second != 0 {
+		wait = wait.Truncate(time.Second) + time.Second
+	}
+	return wait
+}
+
+/********
+Pictures
+*********/
+
+type pictures struct{ s *Store }
+
+func (r pictures) Add(ctx context.Context, p *models.PicturePath) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	return d.addPicture(ctx, p)
+}
+
+func (r pictures) Get(ctx context.Context, id int) (models.PicturePath, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return models.PicturePath{}, err
+	}
+	defer r.s.end()
+
+	if !d.pictureVisible(ctx, id) {
+		return models.PicturePath{Id: id}, sql.ErrNoRows
+	}
+	return models.PicturePath{Id: id, Path: d.picturePath(id)}, nil
+}
+
+/***********
+Attachments
+************/
+
+type attachments struct{ s *Store }
+
+func (r attachments) Add(ctx context.Context, a *models.Attachment) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	if orgId, _ := models.OrganizationFrom(ctx); orgId == 0 {
+		return models.ErrNoOrganization
+	}
+	if !d.customerAccessible(ctx, a.CustomerId) {
+		return models.ErrCustomerNotFound
+	}
+	if err = d.checkUser(a.UploadedByUserId); err != nil {
+		return err
+	}
+	d.lastAttachmentId++
+	a.Id = d.lastAttachmentId
+	a.IsPrimary = false
+	a.UploadedByUser = d.username(a.UploadedByUserId)
+	a.UploadedAt = time.Now()
+	d.attachments[a.Id] = *a
+	return nil
+}
+
+func (r attachments) Get(ctx context.Context, customerId, id int) (models.Attachment, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return models.Attachment{}, err
+	}
+	defer r.s.end()
+
+	a, ok := d.attachments[id]
+	if !ok || a.CustomerId != customerId || !d.customerAccessible(ctx, customerId) {
+		return models.Attachment{Id: id, CustomerId: customerId}, sql.ErrNoRows
+	}
+	return a, nil
+}
+
+func (r attachments) Delete(ctx context.Context, customerId, id int) (models.Attachment, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return models.Attachment{}, err
+	}
+	defer r.s.end()
+
+	a, ok := d.attachments[id]
+	if !ok || a.CustomerId != customerId || !d.customerAccessible(ctx, customerId) {
+		return models.Attachment{Id: id, CustomerId: customerId}, sql.ErrNoRows
+	}
+	delete(d.attachments, id)
+	if c, ok := d.customers[customerId]; ok && a.IsPrimary {
+		c.PictureId = 1
+		d.customers[customerId] = c
+	}
+	return a, nil
+}
+
+func (r attachments) SetPrimary(ctx context.Context, a *models.Attachment, p *models.PicturePath) error {
+	if !a.IsImage() {
+		return models.ErrNotAnImage
+	}
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	if !d.customerAccessible(ctx, a.CustomerId) {
+		return models.ErrCustomerNotFound
+	}
+	if err = d.addPicture(ctx, p); err != nil {
+		return err
+	}
+	for id, existing := range d.attachments {
+		if existing.CustomerId == a.CustomerId {
+			existing.IsPrimary = id == a.Id
+			d.attachments[id] = existing
+		}
+	}
+	c := d.customers[a.CustomerId]
+	c.PictureId = p.Id
+	d.customers[a.CustomerId] = c
+	a.IsPrimary = true
+	return nil
+}
+
+func (r attachments) List(ctx context.Context, customerId int) ([]models.Attachment, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.s.end()
+
+	list := []models.Attachment{}
+	if !d.customerAccessible(ctx, customerId) {
+		return list, nil
+	}
+	for _, a := range d.attachments {
+		if a.CustomerId == customerId {
+			list = append(list, a)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list, nil
+}
+
+/*******
+Uploads
+********/
+
+type uploads struct{ s *Store }
+
+func (r uploads) Create(ctx context.Context, u *models.Upload) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	if _, ok := d.uploads[u.Id]; ok {
+		return fmt.Errorf("Upload %s already exists", u.Id)
+	}
+	if err = d.checkUser(u.UserId); err != nil {
+		return err
+	}
+	u.Offset = 0
+	u.PictureId = 0
+	d.uploads[u.Id] = *u
+	return nil
+}
+
+func (r uploads) Get(ctx context.Context, userId int, id string) (models.Upload, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return models.Upload{}, err
+	}
+	defer r.s.end()
+
+	u, ok := d.uploads[id]
+	if !ok || u.UserId != userId || !u.ExpiresAt.After(time.Now()) {
+		return models.Upload{Id: id, UserId: userId}, sql.ErrNoRows
+	}
+	return u, nil
+}
+
+func (r uploads) UpdateOffset(ctx context.Context, u *models.Upload) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	if existing, ok := d.uploads[u.Id]; ok {
+		existing.Offset = u.Offset
+		existing.ExpiresAt = u.ExpiresAt
+		d.uploads[u.Id] = existing
+	}
+	return nil
+}
+
+func (r uploads) Complete(ctx context.Context, u *models.Upload, p *models.PicturePath) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	if err = d.addPicture(ctx, p); err != nil {
+		return err
+	}
+	if existing, ok := d.uploads[u.Id]; ok {
+		existing.PictureId = p.Id
+		d.uploads[u.Id] = existing
+	}
+	u.PictureId = p.Id
+	return nil
+}
+
+func (r uploads) Delete(ctx context.Context, userId int, id string) (models.Upload, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return models.Upload{}, err
+	}
+	defer r.s.end()
+
+	u, ok := d.uploads[id]
+	if !ok || u.UserId != userId {
+		return models.Upload{Id: id, UserId: userId}, errors.New("No upload was deleted")
+	}
+	delete(d.uploads, id)
+	return u, nil
+}
+
+func (r uploads) DeleteExpired(ctx context.Context) ([]string, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.s.end()
+
+	files := []string{}
+	now := time.Now()
+	for id, u := range d.uploads {
+		if u.ExpiresAt.After(now) {
+			continue
+		}
+		delete(d.uploads, id)
+		if u.PictureId == 0 {
+			files = append(files, u.FilePath)
+		}
+	}
+	return files, nil
+}
+
+/**********
+Rate limits
+***********/
+
+type rateLimits struct{ s *Store }
+
+func (r rateLimits) Take(ctx context.Context, key string, burst int, refill time.Duration) (time.Duration, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer r.s.end()
+
+	now := time.Now()
+	full := d.rateLimits[key]
+	if full.Before(now) {
+		full = now
+	}
+	tolerance := time.Duration(burst-1) * refill
+	if full.After(now.Add(tolerance)) {
+		return remaining(full.Add(-tolerance)), nil
+	}
+	d.rateLimits[key] = full.Add(refill)
+	return 0, nil
+}
+
+func (r rateLimits) Prune(ctx context.Context, idle time.Duration) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	for key, full := range d.rateLimits {
+		if time.Since(full) > idle {
+			delete(d.rateLimits, key)
+		}
+	}
+	return nil
+}
+
+/*******
+API keys
+********/
+
+type apiKeys struct{ s *Store }
+
+func (r apiKeys) Create(ctx context.Context, k *models.APIKey) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	if err = d.checkUser(k.UserId); err != nil {
+		return err
+	}
+	for _, existing := range d.apiKeys {
+		if bytes.Equal(existing.Hash, k.Hash) {
+			return errors.New("API key already exists")
+		}
+	}
+	d.lastAPIKeyId++
+	k.Id = d.lastAPIKeyId
+	k.Username = d.username(k.UserId)
+	k.CreatedAt = time.Now()
+	k.LastUsedAt = nil
+	stored := *k
+	stored.Scopes = append([]string(nil), k.Scopes...)
+	d.apiKeys[k.Id] = stored
+	return nil
+}
+
+func (r apiKeys) Authenticate(ctx context.Context, hash []byte) (models.APIKey, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return models.APIKey{}, err
+	}
+	defer r.s.end()
+
+	now := time.Now()
+	for id, k := range d.apiKeys {
+		if !bytes.Equal(k.Hash, hash) || (k.ExpiresAt != nil && !k.ExpiresAt.After(now)) {
+			continue
+		}
+		k.LastUsedAt = &now
+		d.apiKeys[id] = k
+		k = d.apiKey(k)
+		k.Role = d.users[k.UserId-1].Role
+		if _, ok := d.members[member{k.OrganizationId, k.UserId}]; !ok {
+			k.OrganizationId = 0
+		}
+		return k, nil
+	}
+	return models.APIKey{Hash: hash}, models.ErrAPIKeyNotFound
+}
+
+func (r apiKeys) List(ctx context.Context, userId int) ([]models.APIKey, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.s.end()
+
+	keys := make([]models.APIKey, 0)
+	for _, k := range d.apiKeys {
+		if userId == 0 || k.UserId == userId {
+			keys = append(keys, d.apiKey(k))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Id < keys[j].Id })
+	return keys, nil
+}
+
+func (r apiKeys) Revoke(ctx context.Context, userId, id int) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	k, ok := d.apiKeys[id]
+	if !ok || (userId != 0 && k.UserId != userId) {
+		return models.ErrAPIKeyNotFound
+	}
+	delete(d.apiKeys, id)
+	return nil
+}
+
+// Copy of a stored key, with the current username of its user, as the PostgreSQL store joins it
+func (d *data) apiKey(k models.APIKey) models.APIKey {
+	k.Username = d.username(k.UserId)
+	k.Scopes = append([]string(nil), k.Scopes...)
+	return k
+}
+
+/***********
+Signing keys
+************/
+
+type signingKeys struct{ s *Store }
+
+func (r signingKeys) Add(ctx context.Context, k *models.SigningKey) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	for _, existing := range d.signingKeys {
+		if existing.Kid == k.Kid {
+			return fmt.Errorf("Signing key %s already exists", k.Kid)
+		}
+	}
+	k.CreatedAt = time.Now()
+	k.RetiredAt = nil
+	d.signingKeys = append(d.signingKeys, *k)
+	return nil
+}
+
+func (r signingKeys) List(ctx context.Context) ([]models.SigningKey, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.s.end()
+	return append([]models.SigningKey{}, d.signingKeys...), nil
+}
+
+func (r signingKeys) Retire(ctx context.Context, exceptKid string) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	now := time.Now()
+	for i, k := range d.signingKeys {
+		if k.RetiredAt == nil && k.Kid != exceptKid {
+			d.signingKeys[i].RetiredAt = &now
+		}
+	}
+	return nil
+}
+
+func (r signingKeys) DeleteRetired(ctx context.Context, validity time.Duration) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	kept := d.signingKeys[:0:0]
+	for _, k := range d.signingKeys {
+		if k.RetiredAt == nil || time.Since(*k.RetiredAt) <= validity {
+			kept = append(kept, k)
+		}
+	}
+	d.signingKeys = kept
+	return nil
+}
+
+/***********
+OIDC logins
+************/
+
+type oidcLogins struct{ s *Store }
+
+func (r oidcLogins) Create(ctx context.Context, l *models.OIDCLogin) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	for state, existing := range d.oidcLogins {
+		if !existing.ExpiresAt.After(time.Now()) {
+			delete(d.oidcLogins, state)
+		}
+	}
+	if _, ok := d.oidcLogins[l.State]; ok {
+		return fmt.Errorf("OIDC login %s already exists", l.State)
+	}
+	d.oidcLogins[l.State] = *l
+	return nil
+}
+
+func (r oidcLogins) Take(ctx context.Context, state string) (models.OIDCLogin, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return models.OIDCLogin{}, err
+	}
+	defer r.s.end()
+
+	l, ok := d.oidcLogins[state]
+	delete(d.oidcLogins, state)
+	if !ok || !l.ExpiresAt.After(time.Now()) {
+		return models.OIDCLogin{State: state}, sql.ErrNoRows
+	}
+	return l, nil
+}
+
+/*************************
+Two-factor authentication
+**************************/
+
+type twoFactor struct {
+	secret        string
+	enabled       bool
+	lastStep      int64
+	recoveryCodes []string // Hashes
+}
+
+type twoFactors struct{ s *Store }
+
+// Runs the update of the two-factor authentication of the user
+func (r twoFactors) update(ctx context.Context, userId int, update func(tf *twoFactor)) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	if err = d.checkUser(userId); err != nil {
+		return models.ErrUserNotFound
+	}
+	tf := d.twoFactor[userId]
+	update(&tf)
+	d.twoFactor[userId] = tf
+	return nil
+}
+
+func (r twoFactors) Get(ctx context.Context, userId int) (models.TwoFactor, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return models.TwoFactor{}, err
+	}
+	defer r.s.end()
+
+	if err = d.checkUser(userId); err != nil {
+		return models.TwoFactor{}, models.ErrUserNotFound
+	}
+	tf := d.twoFactor[userId]
+	return models.TwoFactor{Secret: tf.secret, Enabled: tf.enabled, LastStep: tf.lastStep, RecoveryCodes: len(tf.recoveryCodes)}, nil
+}
+
+func (r twoFactors) SetSecret(ctx context.Context, userId int, secret string) error {
+	return r.update(ctx, userId, func(tf *twoFactor) {
+		tf.secret, tf.enabled, tf.lastStep = secret, false, 0
+	})
+}
+
+func (r twoFactors) Enable(ctx context.Context, userId int, step int64) error {
+	enabled := false
+	err := r.update(ctx, userId, func(tf *twoFactor) {
+		if tf.secret != "" {
+			tf.enabled, tf.lastStep, enabled = true, step, true
+		}
+	})
+	if err == nil && !enabled {
+		return models.ErrUserNotFound
+	}
+	return err
+}
+
+func (r twoFactors) UseStep(ctx context.Context, userId int, step int64) (bool, error) {
+	used := false
+	err := r.update(ctx, userId, func(tf *twoFactor) {
+		if tf.lastStep < step {
+			tf.lastStep, used = step, true
+		}
+	})
+	if err == models.ErrUserNotFound {
+		return false, nil
+	}
+	return used, err
+}
+
+func (r twoFactors) SetRecoveryCodes(ctx context.Context, userId int, hashes [][]byte) error {
+	return r.update(ctx, userId, func(tf *twoFactor) {
+		tf.recoveryCodes = nil
+		for _, hash := range hashes {
+			tf.recoveryCodes = append(tf.recoveryCodes, string(hash))
+		}
+	})
+}
+
+func (r twoFactors) UseRecoveryCode(ctx context.Context, userId int, hash []byte) (bool, error) {
+	used := false
+	err := r.update(ctx, userId, func(tf *twoFactor) {
+		for i, code := range tf.recoveryCodes {
+			if code == string(hash) {
+				tf.recoveryCodes = append(tf.recoveryCodes[:i:i], tf.recoveryCodes[i+1:]...)
+				used = true
+				return
+			}
+		}
+	})
+	if err == models.ErrUserNotFound {
+		return false, nil
+	}
+	return used, err
+}
+
+func (r twoFactors) Disable(ctx context.Context, userId int) error {
+	return r.update(ctx, userId, func(tf *twoFactor) { *tf = twoFactor{} })
+}
+
+/*******
+Sessions
+********/
+
+type sessions struct{ s *Store }
+
+func (r sessions) Create(ctx context.Context, s *models.Session) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	if err = d.checkUser(s.UserId); err != nil {
+		return err
+	}
+	for id, existing := range d.sessions {
+		if existing.UserId == s.UserId && !existing.ExpiresAt.After(time.Now()) {
+			delete(d.sessions, id)
+		}
+	}
+	if _, ok := d.sessions[s.Id]; ok {
+		return fmt.Errorf("Session %s already exists", s.Id)
+	}
+	if s.OrganizationId == 0 {
+		for m := range d.members {
+			if m.userId == s.UserId && (s.OrganizationId == 0 || m.orgId < s.OrganizationId) {
+				s.OrganizationId = m.orgId
+			}
+		}
+	}
+	s.CreatedAt = time.Now()
+	s.LastUsedAt = s.CreatedAt
+	d.sessions[s.Id] = *s
+	return nil
+}
+
+func (r sessions) Active(ctx context.Context, id string, orgId int) (bool, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer r.s.end()
+
+	s, ok := d.sessions[id]
+	return ok && s.ExpiresAt.After(time.Now()) && s.OrganizationId == orgId, nil
+}
+
+func (r sessions) SetOrganization(ctx context.Context, id string, orgId int) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	s, ok := d.sessions[id]
+	if !ok || !s.ExpiresAt.After(time.Now()) {
+		return models.ErrSessionNotFound
+	}
+	s.OrganizationId = orgId
+	d.sessions[id] = s
+	return nil
+}
+
+func (r sessions) Refresh(ctx context.Context, hash []byte, s *models.Session) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	now := time.Now()
+	for id, existing := range d.sessions {
+		if !bytes.Equal(existing.RefreshHash, hash) || len(hash) == 0 || !existing.ExpiresAt.After(now) {
+			continue
+		}
+		existing.RefreshHash, existing.Device, existing.IP = s.RefreshHash, s.Device, s.IP
+		existing.ExpiresAt, existing.LastUsedAt = s.ExpiresAt, now
+		d.sessions[id] = existing
+		u := d.users[existing.UserId-1]
+		existing.Username, existing.Role = u.Username, u.Role
+		*s = existing
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+func (r sessions) List(ctx context.Context, userId int) ([]models.Session, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.s.end()
+
+	list := make([]models.Session, 0)
+	for _, s := range d.sessions {
+		if s.UserId == userId && s.ExpiresAt.After(time.Now()) {
+			s.RefreshHash = nil
+			list = append(list, s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].LastUsedAt.Equal(list[j].LastUsedAt) {
+			return list[i].LastUsedAt.After(list[j].LastUsedAt)
+		}
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+	return list, nil
+}
+
+func (r sessions) Revoke(ctx context.Context, userId int, exceptId string) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	for id, s := range d.sessions {
+		if s.UserId == userId && id != exceptId {
+			delete(d.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (r sessions) Delete(ctx context.Context, userId int, id string) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	if s, ok := d.sessions[id]; !ok || s.UserId != userId {
+		return models.ErrSessionNotFound
+	}
+	delete(d.sessions, id)
+	return nil
+}
+
+/**************
+Password resets
+***************/
+
+type passwordResets struct{ s *Store }
+
+func (r passwordResets) Create(ctx context.Context, p *models.PasswordReset) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	if err = d.checkUser(p.UserId); err != nil {
+		return err
+	}
+	for hash, existing := range d.passwordResets {
+		if existing.UserId == p.UserId || !existing.ExpiresAt.After(time.Now()) {
+			delete(d.passwordResets, hash)
+		}
+	}
+	d.passwordResets[string(p.TokenHash)] = *p
+	return nil
+}
+
+func (r passwordResets) Take(ctx context.Context, tokenHash []byte) (models.PasswordReset, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return models.PasswordReset{}, err
+	}
+	defer r.s.end()
+
+	p, ok := d.passwordResets[string(tokenHash)]
+	if !ok || !p.ExpiresAt.After(time.Now()) {
+		return models.PasswordReset{TokenHash: tokenHash}, sql.ErrNoRows
+	}
+	delete(d.passwordResets, string(tokenHash))
+	p.Username = d.username(p.UserId)
+	return p, nil
+}
+
+/************
+Organizations
+*************/
+
+type organizations struct{ s *Store }
+
+func (r organizations) Create(ctx context.Context, o *models.Organization) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	for _, existing := range d.organizations {
+		if existing.Name == o.Name {
+			return models.ErrOrganizationExists
+		}
+	}
+	o.Id = len(d.organizations) + 1
+	o.CreatedAt = time.Now()
+	d.organizations = append(d.organizations, *o)
+	return nil
+}
+
+func (r organizations) Get(ctx context.Context, id int) (models.Organization, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return models.Organization{}, err
+	}
+	defer r.s.end()
+
+	if id < 1 || id > len(d.organizations) {
+		return models.Organization{Id: id}, sql.ErrNoRows
+	}
+	return d.organizations[id-1], nil
+}
+
+func (r organizations) List(ctx context.Context, userId int) ([]models.Organization, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.s.end()
+
+	list := make([]models.Organization, 0)
+	for _, o := range d.organizations {
+		if _, ok := d.members[member{o.Id, userId}]; ok || userId == 0 {
+			list = append(list, o)
+		}
+	}
+	return list, nil
+}
+
+func (r organizations) AddMember(ctx context.Context, orgId, userId int) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	if orgId < 1 || orgId > len(d.organizations) {
+		return fmt.Errorf("Organization %d does not exist", orgId)
+	}
+	if err = d.checkUser(userId); err != nil {
+		return err
+	}
+	if _, ok := d.members[member{orgId, userId}]; !ok {
+		d.members[member{orgId, userId}] = time.Now()
+	}
+	return nil
+}
+
+func (r organizations) RemoveMember(ctx context.Context, orgId, userId int) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	if _, ok := d.members[member{orgId, userId}]; !ok {
+		return models.ErrMemberNotFound
+	}
+	delete(d.members, member{orgId, userId})
+	for m := range d.teamMembers {
+		if m.userId == userId && d.teams[m.teamId].orgId == orgId {
+			delete(d.teamMembers, m)
+		}
+	}
+	for id, s := range d.sessions {
+		if s.UserId == userId && s.OrganizationId == orgId {
+			s.OrganizationId = 0
+			d.sessions[id] = s
+		}
+	}
+	return nil
+}
+
+func (r organizations) Members(ctx context.Context, orgId int) ([]models.Member, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.s.end()
+
+	list := make([]models.Member, 0)
+	for m, addedAt := range d.members {
+		if m.orgId == orgId {
+			list = append(list, models.Member{UserId: m.userId, Username: d.username(m.userId), AddedAt: addedAt})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list, nil
+}
+
+func (r organizations) IsMember(ctx context.Context, orgId, userId int) (bool, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer r.s.end()
+
+	_, ok := d.members[member{orgId, userId}]
+	return ok, nil
+}
+
+/****
+Teams
+*****/
+
+type teams struct{ s *Store }
+
+func (r teams) Create(ctx context.Context, t *models.Team) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	orgId, _ := models.OrganizationFrom(ctx)
+	if orgId == 0 {
+		return models.ErrNoOrganization
+	}
+	for _, existing := range d.teams {
+		if existing.orgId == orgId && existing.Name == t.Name {
+			return models.ErrTeamExists
+		}
+	}
+	d.lastTeamId++
+	t.Id = d.lastTeamId
+	t.CreatedAt = time.Now()
+	t.Members = []string{}
+	d.teams[t.Id] = team{models.Team{Id: t.Id, Name: t.Name, CreatedAt: t.CreatedAt}, orgId}
+	return nil
+}
+
+func (r teams) List(ctx context.Context) ([]models.Team, error) {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.s.end()
+
+	list := make([]models.Team, 0)
+	for _, t := range d.teams {
+		if !visible(ctx, t.orgId) {
+			continue
+		}
+		members := []string{}
+		for m := range d.teamMembers {
+			if m.teamId == t.Id {
+				members = append(members, d.username(m.userId))
+			}
+		}
+		sort.Strings(members)
+		t.Members = members
+		list = append(list, t.Team)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+func (r teams) Delete(ctx context.Context, id int) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	if t, ok := d.teams[id]; !ok || !visible(ctx, t.orgId) {
+		return models.ErrTeamNotFound
+	}
+	delete(d.teams, id)
+	// Its members and customers are deleted in cascade
+	for m := range d.teamMembers {
+		if m.teamId == id {
+			delete(d.teamMembers, m)
+		}
+	}
+	for customerId, c := range d.customers {
+		teams := []int{}
+		for _, teamId := range c.Teams {
+			if teamId != id {
+				teams = append(teams, teamId)
+			}
+		}
+		c.Teams = teams
+		d.customers[customerId] = c
+	}
+	return nil
+}
+
+func (r teams) AddMember(ctx context.Context, teamId, userId int) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	if t, ok := d.teams[teamId]; !ok || !visible(ctx, t.orgId) {
+		return models.ErrTeamNotFound
+	}
+	orgId, _ := models.OrganizationFrom(ctx)
+	if _, ok := d.members[member{orgId, userId}]; !ok {
+		return models.ErrMemberNotFound
+	}
+	d.teamMembers[teamMember{teamId, userId}] = true
+	return nil
+}
+
+func (r teams) RemoveMember(ctx context.Context, teamId, userId int) error {
+	d, err := r.s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.s.end()
+
+	t, ok := d.teams[teamId]
+	if !ok || !visible(ctx, t.orgId) || !d.teamMembers[teamMember{teamId, userId}] {
+		return models.ErrTeamMemberNotFound
+	}
+	delete(d.teamMembers, teamMember{teamId, userId})
+	return nil
+}
@@ -0,0 +1,23 @@
+package memstore
+
+import (
+	"os"
+	"testing"
+
+	"theam.io/jdavidsanchez/test_crm_api/config"
+	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/passwd"
+	"theam.io/jdavidsanchez/test_crm_api/storetest"
+)
+
+func TestMain(m *testing.M) {
+	// The minimum cost keeps the tests fast, hashes are never persisted anyway
+	c := config.Default().Passwords
+	c.BcryptCost = 4
+	passwd.Configure(c)
+	os.Exit(m.Run())
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) models.Store { return New() })
+}
@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+// Metrics are registered in the default Prometheus registry, which also has the Go runtime and
+// process collectors
+
+var httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "crm_http_requests_total",
+	Help: "Number of HTTP requests by method, route template and status code.",
+}, []string{"method", "route", "status"})
+var httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "crm_http_request_duration_seconds",
+	Help:    "Latency of HTTP requests by method, route template and status code.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"method", "route", "status"})
+
+// Middleware records every request handled by the router under its route template (not the actual
+// path, that would create a series for each customer ID), so new routes are covered automatically
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := utils.NewStatusRecorder(w)
+		next.ServeHTTP(recorder, r)
+
+		route := utils.RouteTemplate(r)
+		if route == "" {
+			route = "unknown"
+		}
+		status := strconv.Itoa(recorder.Status)
+		httpRequests.WithLabelValues(r.Method, route, status).Inc()
+		httpDuration.WithLabelValues(r.Method, route, status).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"theam.io/jdavidsanchez/test_crm_api/config"
+	"theam.io/jdavidsanchez/test_crm_api/tracing"
+)
+
+// Querier is satisfied by both *sql.DB and *sql.Tx, so the same functions can be used
+// alone or as part of a bigger transaction
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+var (
+	// ErrCanceled is returned when the request was cancelled (e.g. the client disconnected)
+	// while the query was running
+	ErrCanceled = errors.New("Request cancelled")
+	// ErrTimeout is returned when the query took longer than the timeout of its operation
+	ErrTimeout = errors.New("Database query timed out")
+)
+
+// Maximum duration of every operation of the models. DefaultTimeout applies to all of them,
+// except to the ones listed in Timeouts, which are expected to take longer
+var (
+	DefaultTimeout = 5 * time.Second
+	Timeouts       = map[string]time.Duration{
+		"ListAllCustomers":        10 * time.Second,
+		"ListCustomerAttachments": 10 * time.Second,
+		"DeleteExpiredUploads":    10 * time.Second,
+		// Password hashing is done within the operation
+		"CreateUser":    10 * time.Second,
+		"LoginUser":     10 * time.Second,
+		"ResetPassword": 10 * time.Second,
+	}
+)
+
+// Configure sets the timeouts of the operations
+func Configure(db config.Database) {
+	DefaultTimeout = db.QueryTimeout
+	for _, name := range []string{"ListAllCustomers", "ListCustomerAttachments", "DeleteExpiredUploads"} {
+		Timeouts[name] = db.ListTimeout
+	}
+}
+
+// Every operation of the models runs with its timeout and is traced in its own span. The returned
+// function ends both, recording the error if any (not found rows are not an error) and returning
+// it, replaced by ErrCanceled or ErrTimeout if the operation failed because the context was done
+func startOperation(ctx context.Context, name string) (context.Context, func(error) error) {
+	timeout, ok := Timeouts[name]
+	if !ok {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	ctx, span := tracing.Start(ctx, "models."+name, trace.SpanKindClient)
+	span.SetAttributes(semconv.DBSystemPostgreSQL)
+
+	return ctx, func(err error) error {
+		if err != nil && err != sql.ErrNoRows {
+			if ctxErr := contextError(ctx); ctxErr != nil {
+				err = ctxErr
+			}
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+		cancel()
+		return err
+	}
+}
+
+// contextError returns ErrCanceled or ErrTimeout if the context is done
+func contextError(ctx context.Context) error {
+	switch ctx.Err() {
+	case context.Canceled:
+		return ErrCanceled
+	case context.DeadlineExceeded:
+		return ErrTimeout
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// API key of a user, for service-to-service integrations. Only the hash of the key is stored,
+// the key itself is only shown once, when created
+type APIKey struct {
+	Id             int        `json:"id"`
+	UserId         int        `json:"-"`
+	Username       string     `json:"username"`
+	Role           string     `json:"-"`                        // Of its user, set when authenticated
+	OrganizationId int        `json:"organizationId,omitempty"` // While its user is a member, 0 if none
+	Name           string     `json:"name"`
+	Prefix         string     `json:"prefix"` // First characters of the key, to recognize it
+	Hash           []byte     `json:"-"`
+	Scopes         []string   `json:"scopes"`
+	ExpiresAt      *time.Time `json:"expiresAt,omitempty"` // Never expires if nil
+	LastUsedAt     *time.Time `json:"lastUsedAt,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+}
+
+// Scopes of the API keys. Sessions are not restricted to any of them
+const (
+	ScopeReadCustomers  = "customers:read"
+	ScopeWriteCustomers = "customers:write"
+	ScopeUploadPictures = "pictures:upload"
+)
+
+var Scopes = []string{ScopeReadCustomers, ScopeWriteCustomers, ScopeUploadPictures}
+
+func ValidScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// Scopes are stored separated by spaces, as in OAuth
+func joinScopes(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+func splitScopes(scopes string) []string {
+	return strings.Fields(scopes)
+}
+
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func (k *APIKey) CreateAPIKey(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "CreateAPIKey")
+	defer func() { err = end(err) }()
+
+	return db.QueryRowContext(ctx, `
+		INSERT INTO api_keys (userId, name, prefix, hash, scopes, expiresAt, orgId)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, 0))
+		RETURNING id, createdAt, (SELECT username FROM users WHERE id = $1)
+		`, k.UserId, k.Name, k.Prefix, k.Hash, joinScopes(k.Scopes), k.ExpiresAt, k.OrganizationId).Scan(&k.Id, &k.CreatedAt, &k.Username)
+}
+
+// AuthenticateAPIKey gets the non expired key with the hash, with the username and role of its user,
+// and records its use. Its organization is 0 once its user is no longer a member
+func (k *APIKey) AuthenticateAPIKey(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "AuthenticateAPIKey")
+	defer func() { err = end(err) }()
+
+	var scopes string
+	var expiresAt, lastUsedAt sql.NullTime
+	err = db.QueryRowContext(ctx, `
+		UPDATE api_keys k SET lastUsedAt = NOW()
+		FROM users u
+		WHERE u.id = k.userId AND k.hash = $1 AND (k.expiresAt IS NULL OR k.expiresAt > NOW())
+		RETURNING k.id, k.userId, u.username, u.role,
+		COALESCE((SELECT m.orgId FROM organization_members m WHERE m.orgId = k.orgId AND m.userId = k.userId), 0),
+		k.name, k.prefix, k.scopes, k.expiresAt, k.lastUsedAt, k.createdAt
+		`, k.Hash).Scan(&k.Id, &k.UserId, &k.Username, &k.Role, &k.OrganizationId, &k.Name, &k.Prefix, &scopes, &expiresAt, &lastUsedAt, &k.CreatedAt)
+	if err == sql.ErrNoRows {
+		return ErrAPIKeyNotFound
+	}
+	k.Scopes = splitScopes(scopes)
+	k.ExpiresAt = nullTime(expiresAt)
+	k.LastUsedAt = nullTime(lastUsedAt)
+	return err
+}
+
+// ListAPIKeys returns the keys of the user, or of every user if userId is 0
+func ListAPIKeys(ctx context.Context, db Querier, userId int) (keys []APIKey, err error) {
+	ctx, end := startOperation(ctx, "ListAPIKeys")
+	defer func() { err = end(err) }()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT k.id, k.userId, u.username, COALESCE(k.orgId, 0), k.name, k.prefix, k.scopes, k.expiresAt, k.lastUsedAt, k.createdAt
+		FROM api_keys k JOIN users u ON u.id = k.userId
+		WHERE $1 = 0 OR k.userId = $1
+		ORDER BY k.id
+		`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys = make([]APIKey, 0)
+	for rows.Next() {
+		var k APIKey
+		var scopes string
+		var expiresAt, lastUsedAt sql.NullTime
+		err = rows.Scan(&k.Id, &k.UserId, &k.Username, &k.OrganizationId, &k.Name, &k.Prefix, &scopes, &expiresAt, &lastUsedAt, &k.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		k.Scopes = splitScopes(scopes)
+		k.ExpiresAt = nullTime(expiresAt)
+		k.LastUsedAt = nullTime(lastUsedAt)
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey deletes the key of the user, or of any user if userId is 0
+func RevokeAPIKey(ctx context.Context, db Querier, userId, id int) (err error) {
+	ctx, end := startOperation(ctx, "RevokeAPIKey")
+	defer func() { err = end(err) }()
+
+	res, err := db.ExecContext(ctx, `
+		DELETE FROM api_keys
+		WHERE id = $2 AND ($1 = 0 OR userId = $1)
+		`, userId, id)
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Attachment (pictures and documents of a customer)
+type Attachment struct {
+	Id               int       `json:"id"`
+	CustomerId       int       `json:"customerId"`
+	Title            string    `json:"title"`
+	FileName         string    `json:"fileName"`
+	FilePath         string    `json:"-"`
+	MimeType         string    `json:"mimeType"`
+	Size             int64     `json:"size"`
+	IsPrimary        bool      `json:"isPrimary"`
+	UploadedByUserId int       `json:"-"`
+	UploadedByUser   string    `json:"uploadedByUser"`
+	UploadedAt       time.Time `json:"uploadedAt"`
+}
+
+var ErrNotAnImage = errors.New("Attachment is not an image")
+
+func (a *Attachment) IsImage() bool {
+	return strings.HasPrefix(a.MimeType, "image/")
+}
+
+// checkCustomerAccess returns ErrCustomerNotFound if the user of the context cannot access the
+// customer, as its attachments are only accessible with it
+func checkCustomerAccess(ctx context.Context, db Querier, customerId int) error {
+	userId, admin := UserFrom(ctx)
+	var access bool
+	err := db.QueryRowContext(ctx, `
+		SELECT can_access_customer($1, $2, $3)
+		`, customerId, userId, admin).Scan(&access)
+	if err == nil && !access {
+		err = ErrCustomerNotFound
+	}
+	return err
+}
+
+// AddAttachment returns ErrNoOrganization if the context has no organization, and
+// ErrCustomerNotFound if its user cannot access the customer
+func (a *Attachment) AddAttachment(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "AddAttachment")
+	defer func() { err = end(err) }()
+
+	if id, _ := OrganizationFrom(ctx); id == 0 {
+		return ErrNoOrganization
+	}
+	if err = checkCustomerAccess(ctx, db, a.CustomerId); err != nil {
+		return err
+	}
+
+	return db.QueryRowContext(ctx, `
+		INSERT INTO customer_attachments (
+			customerId,
+			title,
+			fileName,
+			filePath,
+			mimeType,
+			size,
+			uploadedByUserId
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, isPrimary,
+		(SELECT username FROM users WHERE id = uploadedByUserId),
+		uploadedAt
+		`, a.CustomerId, a.Title, a.FileName, a.FilePath, a.MimeType, a.Size, a.UploadedByUserId).Scan(
+		&a.Id, &a.IsPrimary, &a.UploadedByUser, &a.UploadedAt)
+}
+
+func (a *Attachment) GetAttachment(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "GetAttachment")
+	defer func() { err = end(err) }()
+
+	userId, admin := UserFrom(ctx)
+	return db.QueryRowContext(ctx, `
+		SELECT title, fileName, filePath, mimeType, size, isPrimary,
+		(SELECT username FROM users WHERE id = uploadedByUserId),
+		uploadedAt
+		FROM customer_attachments
+		WHERE id = $1 AND customerId = $2 AND can_access_customer(customerId, $3, $4)
+		`, a.Id, a.CustomerId, userId, admin).Scan(&a.Title, &a.FileName, &a.FilePath, &a.MimeType, &a.Size,
+		&a.IsPrimary, &a.UploadedByUser, &a.UploadedAt)
+}
+
+// Deletes the attachment, returning its file path so the caller can remove the file, or
+// sql.ErrNoRows if the user of the context cannot access it. If it was the primary picture, the
+// customer goes back to the placeholder picture
+func (a *Attachment) DeleteAttachment(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "DeleteAttachment")
+	defer func() { err = end(err) }()
+
+	userId, admin := UserFrom(ctx)
+	err = db.QueryRowContext(ctx, `
+		DELETE FROM customer_attachments
+		WHERE id = $1 AND customerId = $2 AND can_access_customer(customerId, $3, $4)
+		RETURNING filePath, isPrimary
+		`, a.Id, a.CustomerId, userId, admin).Scan(&a.FilePath, &a.IsPrimary)
+	if err != nil {
+		return err
+	}
+
+	if a.IsPrimary {
+		_, err = db.ExecContext(ctx, `
+			UPDATE customers SET pictureId = 1
+			WHERE id = $1
+			`, a.CustomerId)
+	}
+	return err
+}
+
+// Marks the attachment as the primary image of the customer, which will use the
+// given picture (a copy of the attachment file) from now on. It returns ErrCustomerNotFound if the
+// user of the context cannot access the customer
+func (a *Attachment) SetPrimaryAttachment(ctx context.Context, db Querier, p *PicturePath) (err error) {
+	ctx, end := startOperation(ctx, "SetPrimaryAttachment")
+	defer func() { err = end(err) }()
+
+	if !a.IsImage() {
+		return ErrNotAnImage
+	}
+	if err = checkCustomerAccess(ctx, db, a.CustomerId); err != nil {
+		return err
+	}
+	err = p.AddPicture(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `
+		UPDATE customer_attachments SET
+		isPrimary = (id = $1)
+		WHERE customerId = $2
+		`, a.Id, a.CustomerId)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `
+		UPDATE customers SET pictureId = $1
+		WHERE id = $2
+		`, p.Id, a.CustomerId)
+	if err != nil {
+		return err
+	}
+	a.IsPrimary = true
+	return nil
+}
+
+func ListCustomerAttachments(ctx context.Context, db Querier, customerId int) (attachments []Attachment, err error) {
+	ctx, end := startOperation(ctx, "ListCustomerAttachments")
+	defer func() { err = end(err) }()
+
+	userId, admin := UserFrom(ctx)
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, customerId, title, fileName, filePath, mimeType, size, isPrimary,
+		(SELECT username FROM users WHERE id = uploadedByUserId),
+		uploadedAt
+		FROM customer_attachments
+		WHERE customerId = $1 AND can_access_customer($1, $2, $3)
+		ORDER BY id`, customerId, userId, admin)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments = []Attachment{}
+
+	for rows.Next() {
+		var a Attachment
+		err := rows.Scan(&a.Id, &a.CustomerId, &a.Title, &a.FileName, &a.FilePath, &a.MimeType,
+			&a.Size, &a.IsPrimary, &a.UploadedByUser, &a.UploadedAt)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+
+	return attachments, nil
+}
@@ -1,8 +1,13 @@
 package models
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
+	"sort"
+
+	"github.com/lib/pq"
 )
 
 // Customer
@@ -11,6 +16,8 @@ type Customer struct {
 	PictureId            int `json:"pictureId"`
 	CreatedByUserId      int
 	LastModifiedByUserId int
+	OwnerId              int `json:"-"` // Its creator, until reassigned
+	OrganizationId       int `json:"-"` // Set when created, in the organization of the context
 }
 
 type CustomerOut struct {
@@ -20,107 +27,285 @@ type CustomerOut struct {
 	PicturePath        string `json:"picturePath"`
 	CreatedByUser      string `json:"createdByUser"`
 	LastModifiedByUser string `json:"lastModifiedByUser"`
+	Owner              string `json:"owner"`
+	// Teams the customer is shared with. Updates leave them unchanged if nil
+	Teams []int `json:"teams"`
+}
+
+var (
+	ErrCustomerNotFound = errors.New("Customer not found")
+	ErrNotOwner         = errors.New("Only the owner of the customer can share or reassign it")
+)
+
+type userKey int
+
+const (
+	userIdKey userKey = iota
+	adminKey
+)
+
+// WithUser limits the customers of the operations with the context, and their attachments, to the
+// ones the user owns or shares with one of its teams, unless it is an admin. Without user, none is
+// accessible
+func WithUser(ctx context.Context, id int, admin bool) context.Context {
+	return context.WithValue(context.WithValue(ctx, userIdKey, id), adminKey, admin)
+}
+
+// UserFrom returns the user of the context (0 if none), and whether it can access every customer,
+// as the admins and the contexts with access to every organization
+func UserFrom(ctx context.Context) (id int, admin bool) {
+	id, _ = ctx.Value(userIdKey).(int)
+	admin, _ = ctx.Value(adminKey).(bool)
+	_, all := OrganizationFrom(ctx)
+	return id, admin || all
+}
+
+// intArray is stored as an array of integers, e.g. the IDs of the teams of a customer
+type intArray []int
+
+func (t intArray) Value() (driver.Value, error) {
+	ids := make(pq.Int64Array, len(t))
+	for i, id := range t {
+		ids[i] = int64(id)
+	}
+	return ids.Value()
+}
+
+func (t *intArray) Scan(src interface{}) error {
+	var ids pq.Int64Array
+	if err := ids.Scan(src); err != nil {
+		return err
+	}
+	*t = make(intArray, len(ids))
+	for i, id := range ids {
+		(*t)[i] = int(id)
+	}
+	return nil
 }
 
 // Functions for interacting with DB
 
-func (c *CustomerOut) GetCustomer(db *sql.DB) error {
-	return db.QueryRow(`
-		SELECT 
+func (c *CustomerOut) GetCustomer(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "GetCustomer")
+	defer func() { err = end(err) }()
+
+	userId, admin := UserFrom(ctx)
+	return db.QueryRowContext(ctx, `
+		SELECT
 		customername,
 		surname,
 		(SELECT picturePath FROM pictures WHERE id = pictureId),
 		(SELECT username FROM users WHERE id = createdByUserId),
-		(SELECT username FROM users WHERE id = lastModifiedByUserId)
+		(SELECT username FROM users WHERE id = lastModifiedByUserId),
+		COALESCE((SELECT username FROM users WHERE id = ownerId), ''),
+		ARRAY(SELECT teamId FROM customer_teams WHERE customerId = customers.id ORDER BY teamId)
 		FROM customers
-		WHERE id = $1
-		`, c.Id).Scan(&c.Name, &c.Surname, &c.PicturePath, &c.CreatedByUser, &c.LastModifiedByUser)
+		WHERE id = $1 AND can_access_customer(id, $2, $3)
+		`, c.Id, userId, admin).Scan(&c.Name, &c.Surname, &c.PicturePath, &c.CreatedByUser, &c.LastModifiedByUser,
+		&c.Owner, (*intArray)(&c.Teams))
 }
 
-func (c *Customer) CreateCustomer(db *sql.DB) error {
+// CreateCustomer creates the customer in the organization of the context, owned by its creator,
+// or returns ErrNoOrganization if it has none. It runs several statements to share it with the
+// teams, so it must be called in a transaction
+func (c *Customer) CreateCustomer(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "CreateCustomer")
+	defer func() { err = end(err) }()
+
+	if id, _ := OrganizationFrom(ctx); id == 0 {
+		return ErrNoOrganization
+	}
+
 	pictureId := 1
 	if c.PictureId != 0 {
 		pictureId = c.PictureId
 	}
-	err := db.QueryRow(`
+	c.OwnerId = c.CreatedByUserId
+	err = db.QueryRowContext(ctx, `
 		INSERT INTO customers (
 			customername,
-			surname, 
+			surname,
 			pictureId,
 			createdByUserId,
-			lastModifiedByUserId
+			lastModifiedByUserId,
+			ownerId
 		)
-		VALUES ($1, $2, $3, $4, $4)
-		RETURNING id, (SELECT picturePath FROM pictures WHERE id = pictureId),
+		VALUES ($1, $2, $3, $4, $4, $4)
+		RETURNING id, orgId, (SELECT picturePath FROM pictures WHERE id = pictureId),
 		(SELECT username FROM users WHERE id = createdByUserId),
-		(SELECT username FROM users WHERE id = lastModifiedByUserId)
+		(SELECT username FROM users WHERE id = lastModifiedByUserId),
+		(SELECT username FROM users WHERE id = ownerId)
 		`, c.Name, c.Surname, pictureId, c.CreatedByUserId).Scan(
-		&c.Id, &c.PicturePath, &c.CreatedByUser, &c.LastModifiedByUser)
+		&c.Id, &c.OrganizationId, &c.PicturePath, &c.CreatedByUser, &c.LastModifiedByUser, &c.Owner)
 
 	if err != nil {
 		return err
 	}
-	return nil
+	c.Teams, err = setCustomerTeams(ctx, db, c.Id, c.Teams)
+	return err
 }
 
-func (c *Customer) UpdateCustomer(db *sql.DB) error {
+// UpdateCustomer returns ErrCustomerNotFound if the user of the context cannot access the
+// customer, and ErrNotOwner if it changes the teams of a customer it does not own (unless admin).
+// It runs several statements, so it must be called in a transaction
+func (c *Customer) UpdateCustomer(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "UpdateCustomer")
+	defer func() { err = end(err) }()
+
 	pictureId := 1
 	if c.PictureId != 0 {
 		pictureId = c.PictureId
 	}
-	err := db.QueryRow(`
+	userId, admin := UserFrom(ctx)
+	teams := c.Teams
+	err = db.QueryRowContext(ctx, `
 		UPDATE customers SET
 		customername = COALESCE($1, customername),
 		surname = COALESCE($2, surname),
 		pictureId = COALESCE($3, pictureId),
 		lastModifiedByUserId = COALESCE($4, lastModifiedByUserId)
-		WHERE id = $5
+		WHERE id = $5 AND can_access_customer(id, $6, $7)
 		RETURNING id, (SELECT picturePath FROM pictures WHERE id = pictureId),
 		(SELECT username FROM users WHERE id = createdByUserId),
-		(SELECT username FROM users WHERE id = lastModifiedByUserId)
-		`, c.Name, c.Surname, pictureId, c.LastModifiedByUserId, c.Id).Scan(
-		&c.Id, &c.PicturePath, &c.CreatedByUser, &c.LastModifiedByUser)
+		(SELECT username FROM users WHERE id = lastModifiedByUserId),
+		COALESCE(ownerId, 0), COALESCE((SELECT username FROM users WHERE id = ownerId), ''),
+		ARRAY(SELECT teamId FROM customer_teams WHERE customerId = customers.id ORDER BY teamId)
+		`, c.Name, c.Surname, pictureId, c.LastModifiedByUserId, c.Id, userId, admin).Scan(
+		&c.Id, &c.PicturePath, &c.CreatedByUser, &c.LastModifiedByUser, &c.OwnerId, &c.Owner,
+		(*intArray)(&c.Teams))
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			err = errors.New("No customer was updated")
+			err = ErrCustomerNotFound
 		}
+		return err
 	}
+	if teams == nil {
+		return nil
+	}
+	if !admin && c.OwnerId != userId {
+		return ErrNotOwner
+	}
+	c.Teams, err = setCustomerTeams(ctx, db, c.Id, teams)
 	return err
 }
 
-func (c *Customer) DeleteCustomer(db *sql.DB) error {
-	res, err := db.Exec(`
-		DELETE FROM customers
-		WHERE id = $1
+// Shares the customer with the teams instead of the previous ones, returning their sorted IDs, or
+// ErrTeamNotFound if any is not a team of the organization of the customer
+func setCustomerTeams(ctx context.Context, db Querier, customerId int, teams []int) ([]int, error) {
+	_, err := db.ExecContext(ctx, `DELETE FROM customer_teams WHERE customerId = $1`, customerId)
+	if err != nil {
+		return nil, err
+	}
+	distinct := make(map[int]bool, len(teams))
+	ids := []int{}
+	for _, id := range teams {
+		if !distinct[id] {
+			distinct[id] = true
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	if len(ids) == 0 {
+		return ids, nil
+	}
+
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO customer_teams (customerId, teamId)
+		SELECT $1::INTEGER, t.id FROM teams t
+		WHERE t.id = ANY($2) AND t.orgId = (SELECT orgId FROM customers WHERE id = $1)
+		`, customerId, intArray(ids))
+	if err != nil {
+		return nil, err
+	}
+	if count, err := res.RowsAffected(); err != nil || int(count) != len(ids) {
+		if err == nil {
+			err = ErrTeamNotFound
+		}
+		return nil, err
+	}
+	return ids, nil
+}
+
+// DeleteCustomer returns the files of the attachments deleted with the customer, or
+// ErrCustomerNotFound if the user of the context cannot access the customer. db must be a
+// transaction, so that no attachment is added between the deletions
+func (c *Customer) DeleteCustomer(ctx context.Context, db Querier) (files []string, err error) {
+	ctx, end := startOperation(ctx, "DeleteCustomer")
+	defer func() { err = end(err) }()
+
+	// The lock makes the attachments added concurrently wait for the deletion
+	userId, admin := UserFrom(ctx)
+	err = db.QueryRowContext(ctx, `
+		SELECT id FROM customers
+		WHERE id = $1 AND can_access_customer(id, $2, $3)
+		FOR UPDATE
+		`, c.Id, userId, admin).Scan(&c.Id)
+	if err == sql.ErrNoRows {
+		return nil, ErrCustomerNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		DELETE FROM customer_attachments
+		WHERE customerId = $1
+		RETURNING filePath
 		`, c.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	if numRows, _ := res.RowsAffected(); numRows == 0 {
-		err = errors.New("No customer was deleted")
+	for rows.Next() {
+		var file string
+		if err = rows.Scan(&file); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
 
-	return err
+	_, err = db.ExecContext(ctx, `DELETE FROM customers WHERE id = $1`, c.Id)
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
 }
 
-func ListAllCustomers(db *sql.DB) ([]CustomerOut, error) {
-	rows, err := db.Query(`
-		SELECT id, customername, 
-		surname, 
+// ListAllCustomers returns the customers the user of the context can access, or only the ones it
+// owns if mine
+func ListAllCustomers(ctx context.Context, db Querier, mine bool) (customers []CustomerOut, err error) {
+	ctx, end := startOperation(ctx, "ListAllCustomers")
+	defer func() { err = end(err) }()
+
+	userId, admin := UserFrom(ctx)
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, customername,
+		surname,
 		(SELECT picturePath FROM pictures WHERE id = pictureId),
 		(SELECT username FROM users WHERE id = createdByUserId),
-		(SELECT username FROM users WHERE id = lastModifiedByUserId)
-		FROM customers`)
+		(SELECT username FROM users WHERE id = lastModifiedByUserId),
+		COALESCE((SELECT username FROM users WHERE id = ownerId), ''),
+		ARRAY(SELECT teamId FROM customer_teams WHERE customerId = customers.id ORDER BY teamId)
+		FROM customers
+		WHERE can_access_customer(id, $1, $2) AND (NOT $3 OR ownerId = $1)
+		ORDER BY id`, userId, admin, mine)
 
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	customers := []CustomerOut{}
+	customers = []CustomerOut{}
 
 	for rows.Next() {
 		var c CustomerOut
-		err := rows.Scan(&c.Id, &c.Name, &c.Surname, &c.PicturePath, &c.CreatedByUser, &c.LastModifiedByUser)
+		err := rows.Scan(&c.Id, &c.Name, &c.Surname, &c.PicturePath, &c.CreatedByUser, &c.LastModifiedByUser,
+			&c.Owner, (*intArray)(&c.Teams))
 		if err != nil {
 			return nil, err
 		}
@@ -129,3 +314,71 @@ func ListAllCustomers(db *sql.DB) ([]CustomerOut, error) {
 
 	return customers, nil
 }
+
+// CountCustomers counts the customers the user of the context can access
+func CountCustomers(ctx context.Context, db Querier) (count int, err error) {
+	ctx, end := startOperation(ctx, "CountCustomers")
+	defer func() { err = end(err) }()
+
+	userId, admin := UserFrom(ctx)
+	err = db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM customers WHERE can_access_customer(id, $1, $2)
+		`, userId, admin).Scan(&count)
+	return count, err
+}
+
+// ReassignCustomers gives the customers to the owner, who must be a member of the organization
+// (ErrMemberNotFound otherwise). Either all of them are reassigned or none: it returns
+// ErrCustomerNotFound if the user of the context cannot access any of them, and ErrNotOwner if it
+// does not own any of them (unless admin). It runs several statements, so it must be called in a
+// transaction
+func ReassignCustomers(ctx context.Context, db Querier, ids []int, ownerId int) (count int, err error) {
+	ctx, end := startOperation(ctx, "ReassignCustomers")
+	defer func() { err = end(err) }()
+
+	var member bool
+	if err = db.QueryRowContext(ctx, `SELECT org_member($1)`, ownerId).Scan(&member); err != nil {
+		return 0, err
+	}
+	if !member {
+		return 0, ErrMemberNotFound
+	}
+
+	userId, admin := UserFrom(ctx)
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, COALESCE(ownerId, 0) FROM customers
+		WHERE id = ANY($1) AND can_access_customer(id, $2, $3)
+		FOR UPDATE
+		`, intArray(ids), userId, admin)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	found := make(map[int]bool, len(ids))
+	for rows.Next() {
+		var id, currentOwnerId int
+		if err = rows.Scan(&id, &currentOwnerId); err != nil {
+			return 0, err
+		}
+		if !admin && currentOwnerId != userId {
+			return 0, ErrNotOwner
+		}
+		found[id] = true
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		if !found[id] {
+			return 0, ErrCustomerNotFound
+		}
+	}
+
+	_, err = db.ExecContext(ctx, `
+		UPDATE customers SET
+		ownerId = $1,
+		lastModifiedByUserId = COALESCE(NULLIF($2, 0), lastModifiedByUserId)
+		WHERE id = ANY($3)
+		`, ownerId, userId, intArray(ids))
+	return len(found), err
+}
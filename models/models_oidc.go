@@ -0,0 +1,43 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// Single sign-on login in progress, from the redirection to the provider until its callback
+type OIDCLogin struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	ExpiresAt    time.Time
+	UserId       int // User linking the identity to its account, 0 for logins
+}
+
+// CreateOIDCLogin also deletes the expired logins, which were never completed
+func (l *OIDCLogin) CreateOIDCLogin(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "CreateOIDCLogin")
+	defer func() { err = end(err) }()
+
+	_, err = db.ExecContext(ctx, `DELETE FROM oidc_logins WHERE expiresAt <= NOW()`)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO oidc_logins (state, nonce, codeVerifier, expiresAt, userId)
+		VALUES ($1, $2, $3, $4, NULLIF($5, 0))
+		`, l.State, l.Nonce, l.CodeVerifier, l.ExpiresAt, l.UserId)
+	return err
+}
+
+// TakeOIDCLogin deletes the non expired login with the state, so it can only be completed once
+func (l *OIDCLogin) TakeOIDCLogin(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "TakeOIDCLogin")
+	defer func() { err = end(err) }()
+
+	return db.QueryRowContext(ctx, `
+		DELETE FROM oidc_logins
+		WHERE state = $1 AND expiresAt > NOW()
+		RETURNING nonce, codeVerifier, expiresAt, COALESCE(userId, 0)
+		`, l.State).Scan(&l.Nonce, &l.CodeVerifier, &l.ExpiresAt, &l.UserId)
+}
@@ -0,0 +1,230 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Organization (tenant) owning customers, pictures and attachments, which are only visible to the
+// requests of its members
+type Organization struct {
+	Id        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Member of an organization
+type Member struct {
+	UserId   int       `json:"id"`
+	Username string    `json:"username"`
+	AddedAt  time.Time `json:"addedAt"`
+}
+
+var (
+	ErrOrganizationExists = errors.New("Organization name already in use")
+	ErrMemberNotFound     = errors.New("User is not a member of the organization")
+	ErrNoOrganization     = errors.New("No organization selected")
+)
+
+type organizationKey int
+
+const (
+	organizationIdKey organizationKey = iota
+	allOrganizationsKey
+)
+
+// WithOrganization limits the customers, pictures and attachments of the operations with the
+// context to the organization, and creates them in it. Without organization, none is visible
+func WithOrganization(ctx context.Context, id int) context.Context {
+	return context.WithValue(ctx, organizationIdKey, id)
+}
+
+// AllOrganizations gives the operations with the context access to every organization, only for
+// the admin commands and the metrics, never for the requests
+func AllOrganizations(ctx context.Context) context.Context {
+	return context.WithValue(ctx, allOrganizationsKey, true)
+}
+
+// OrganizationFrom returns the organization of the context (0 if none), and whether it has access
+// to every organization
+func OrganizationFrom(ctx context.Context) (id int, all bool) {
+	id, _ = ctx.Value(organizationIdKey).(int)
+	all, _ = ctx.Value(allOrganizationsKey).(bool)
+	return id, all
+}
+
+// ScopeOrganization limits the following statements of the transaction to the organization of the
+// context, switching to the crm_tenant role, which is subject to the row level security policies
+func ScopeOrganization(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "ScopeOrganization")
+	defer func() { err = end(err) }()
+
+	id, all := OrganizationFrom(ctx)
+	org := ""
+	if id != 0 {
+		org = strconv.Itoa(id)
+	}
+	allOrgs := "off"
+	if all {
+		allOrgs = "on"
+	}
+	_, err = db.ExecContext(ctx, `
+		SELECT set_config('app.org_id', $1, true), set_config('app.all_organizations', $2, true)
+		`, org, allOrgs)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `SET LOCAL ROLE crm_tenant`)
+	return err
+}
+
+// UnscopeOrganization goes back to the role of the connection after ScopeOrganization
+func UnscopeOrganization(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "UnscopeOrganization")
+	defer func() { err = end(err) }()
+
+	_, err = db.ExecContext(ctx, `RESET ROLE`)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `
+		SELECT set_config('app.org_id', '', true), set_config('app.all_organizations', 'off', true)
+		`)
+	return err
+}
+
+// CreateOrganization returns ErrOrganizationExists if the name is taken
+func (o *Organization) CreateOrganization(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "CreateOrganization")
+	defer func() { err = end(err) }()
+
+	err = db.QueryRowContext(ctx, `
+		INSERT INTO organizations (name) VALUES ($1)
+		ON CONFLICT DO NOTHING
+		RETURNING id, createdAt
+		`, o.Name).Scan(&o.Id, &o.CreatedAt)
+	if err == sql.ErrNoRows {
+		return ErrOrganizationExists
+	}
+	return err
+}
+
+func (o *Organization) GetOrganization(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "GetOrganization")
+	defer func() { err = end(err) }()
+
+	return db.QueryRowContext(ctx, `
+		SELECT name, createdAt FROM organizations WHERE id = $1
+		`, o.Id).Scan(&o.Name, &o.CreatedAt)
+}
+
+// ListOrganizations returns the organizations of the user, or every one if userId is 0
+func ListOrganizations(ctx context.Context, db Querier, userId int) (organizations []Organization, err error) {
+	ctx, end := startOperation(ctx, "ListOrganizations")
+	defer func() { err = end(err) }()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, name, createdAt FROM organizations o
+		WHERE $1 = 0 OR EXISTS (SELECT 1 FROM organization_members m WHERE m.orgId = o.id AND m.userId = $1)
+		ORDER BY id
+		`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	organizations = make([]Organization, 0)
+	for rows.Next() {
+		var o Organization
+		if err = rows.Scan(&o.Id, &o.Name, &o.CreatedAt); err != nil {
+			return nil, err
+		}
+		organizations = append(organizations, o)
+	}
+	return organizations, rows.Err()
+}
+
+// AddMember does nothing if the user is already a member of the organization
+func AddMember(ctx context.Context, db Querier, orgId, userId int) (err error) {
+	ctx, end := startOperation(ctx, "AddMember")
+	defer func() { err = end(err) }()
+
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO organization_members (orgId, userId) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+		`, orgId, userId)
+	return err
+}
+
+// RemoveMember returns ErrMemberNotFound if the user is not a member. The user leaves the teams of
+// the organization, and its sessions in the organization lose it, so their tokens are refused. It
+// runs several statements, so it must be called in a transaction
+func RemoveMember(ctx context.Context, db Querier, orgId, userId int) (err error) {
+	ctx, end := startOperation(ctx, "RemoveMember")
+	defer func() { err = end(err) }()
+
+	res, err := db.ExecContext(ctx, `
+		DELETE FROM organization_members WHERE orgId = $1 AND userId = $2
+		`, orgId, userId)
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrMemberNotFound
+	}
+	_, err = db.ExecContext(ctx, `
+		DELETE FROM team_members m USING teams t
+		WHERE t.id = m.teamId AND t.orgId = $1 AND m.userId = $2
+		`, orgId, userId)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `
+		UPDATE sessions SET orgId = NULL WHERE orgId = $1 AND userId = $2
+		`, orgId, userId)
+	return err
+}
+
+// ListMembers returns the members of the organization, by username
+func ListMembers(ctx context.Context, db Querier, orgId int) (members []Member, err error) {
+	ctx, end := startOperation(ctx, "ListMembers")
+	defer func() { err = end(err) }()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT u.id, u.username, m.addedAt
+		FROM organization_members m JOIN users u ON u.id = m.userId
+		WHERE m.orgId = $1
+		ORDER BY u.username
+		`, orgId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members = make([]Member, 0)
+	for rows.Next() {
+		var m Member
+		if err = rows.Scan(&m.UserId, &m.Username, &m.AddedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func IsMember(ctx context.Context, db Querier, orgId, userId int) (member bool, err error) {
+	ctx, end := startOperation(ctx, "IsMember")
+	defer func() { err = end(err) }()
+
+	err = db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM organization_members WHERE orgId = $1 AND userId = $2)
+		`, orgId, userId).Scan(&member)
+	return member, err
+}
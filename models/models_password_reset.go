@@ -0,0 +1,42 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// Password reset requested by a user, whose token was mailed to them. Only its hash is stored
+type PasswordReset struct {
+	TokenHash []byte
+	UserId    int
+	Username  string
+	ExpiresAt time.Time
+}
+
+// CreatePasswordReset replaces the previous resets of the user, so only the last token is valid
+func (p *PasswordReset) CreatePasswordReset(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "CreatePasswordReset")
+	defer func() { err = end(err) }()
+
+	_, err = db.ExecContext(ctx, `DELETE FROM password_resets WHERE userId = $1 OR expiresAt <= NOW()`, p.UserId)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO password_resets (tokenHash, userId, expiresAt)
+		VALUES ($1, $2, $3)
+		`, p.TokenHash, p.UserId, p.ExpiresAt)
+	return err
+}
+
+// TakePasswordReset deletes the non expired reset with the token hash, so it can only be used once
+func (p *PasswordReset) TakePasswordReset(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "TakePasswordReset")
+	defer func() { err = end(err) }()
+
+	return db.QueryRowContext(ctx, `
+		DELETE FROM password_resets r USING users u
+		WHERE r.tokenHash = $1 AND r.expiresAt > NOW() AND u.id = r.userId
+		RETURNING r.userId, u.username, r.expiresAt
+		`, p.TokenHash).Scan(&p.UserId, &p.Username, &p.ExpiresAt)
+}
@@ -1,14 +1,20 @@
 package models
 
-import "database/sql"
+import (
+	"context"
+	"database/sql"
+)
 
 type PicturePath struct {
 	Id   int    `json:"id"`
 	Path string `json:"picturePath"`
 }
 
-func (p *PicturePath) AddPicture(db *sql.DB) error {
-	err := db.QueryRow(`
+func (p *PicturePath) AddPicture(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "AddPicture")
+	defer func() { err = end(err) }()
+
+	err = db.QueryRowContext(ctx, `
 		INSERT INTO pictures (picturePath)
 		VALUES ($1)
 		ON CONFLICT DO NOTHING
@@ -26,8 +32,11 @@ func (p *PicturePath) AddPicture(db *sql.DB) error {
 	return nil
 }
 
-func (p *PicturePath) GetPicturePath(db *sql.DB) error {
-	return db.QueryRow(`
+func (p *PicturePath) GetPicturePath(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "GetPicturePath")
+	defer func() { err = end(err) }()
+
+	return db.QueryRowContext(ctx, `
 		SELECT picturePath FROM pictures
 		WHERE id = $1
 		`, p.Id).Scan(&p.Path)
@@ -0,0 +1,492 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// PostgresStore implements the repositories with the functions of the models
+type PostgresStore struct {
+	db *sql.DB
+	q  Querier // The database, or the transaction of InTx
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db, q: db}
+}
+
+// DB returns the database of the store, e.g. for its connection pool stats
+func (s *PostgresStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s *PostgresStore) Customers() CustomerRepository     { return postgresCustomers{s} }
+func (s *PostgresStore) Users() UserRepository             { return postgresUsers{s.q} }
+func (s *PostgresStore) Pictures() PictureRepository       { return postgresPictures{s} }
+func (s *PostgresStore) Attachments() AttachmentRepository { return postgresAttachments{s} }
+func (s *PostgresStore) Uploads() UploadRepository         { return postgresUploads{s} }
+func (s *PostgresStore) RateLimits() RateLimitRepository   { return postgresRateLimits{s.q} }
+func (s *PostgresStore) APIKeys() APIKeyRepository         { return postgresAPIKeys{s.q} }
+func (s *PostgresStore) SigningKeys() SigningKeyRepository { return postgresSigningKeys{s.q} }
+func (s *PostgresStore) OIDCLogins() OIDCLoginRepository   { return postgresOIDCLogins{s.q} }
+func (s *PostgresStore) TwoFactor() TwoFactorRepository    { return postgresTwoFactor{s.q} }
+func (s *PostgresStore) Sessions() SessionRepository       { return postgresSessions{s.q} }
+func (s *PostgresStore) PasswordResets() PasswordResetRepository {
+	return postgresPasswordResets{s.q}
+}
+func (s *PostgresStore) Organizations() OrganizationRepository {
+	return postgresOrganizations{s.q}
+}
+func (s *PostgresStore) Teams() TeamRepository { return postgresTeams{s} }
+
+func (s *PostgresStore) InTx(ctx context.Context, fn func(tx Store) error) error {
+	// Nested transactions are part of the outer one
+	if _, ok := s.q.(*sql.Tx); ok {
+		return fn(s)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = fn(&PostgresStore{db: s.db, q: tx})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// scoped runs fn in a transaction limited to the organization of the context by the row level
+// security policies, so that not even a query missing a condition reaches other organizations
+func (s *PostgresStore) scoped(ctx context.Context, fn func(q Querier) error) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	return s.InTx(ctx, func(tx Store) error {
+		q := tx.(*PostgresStore).q
+		if err := ScopeOrganization(ctx, q); err != nil {
+			return err
+		}
+		err := fn(q)
+		// The role must be reset for the rest of an outer transaction, even if fn failed
+		if resetErr := UnscopeOrganization(ctx, q); err == nil {
+			err = resetErr
+		}
+		return err
+	})
+}
+
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+type postgresCustomers struct{ s *PostgresStore }
+
+func (r postgresCustomers) Get(ctx context.Context, id int) (c CustomerOut, err error) {
+	c.Id = id
+	err = r.s.scoped(ctx, func(q Querier) error {
+		return c.GetCustomer(ctx, q)
+	})
+	return c, err
+}
+
+func (r postgresCustomers) Create(ctx context.Context, c *Customer) error {
+	return r.s.scoped(ctx, func(q Querier) error {
+		return c.CreateCustomer(ctx, q)
+	})
+}
+
+func (r postgresCustomers) Update(ctx context.Context, c *Customer) error {
+	return r.s.scoped(ctx, func(q Querier) error {
+		return c.UpdateCustomer(ctx, q)
+	})
+}
+
+func (r postgresCustomers) Delete(ctx context.Context, id int) (files []string, err error) {
+	c := Customer{CustomerOut: CustomerOut{Id: id}}
+	err = r.s.scoped(ctx, func(q Querier) error {
+		files, err = c.DeleteCustomer(ctx, q)
+		return err
+	})
+	return files, err
+}
+
+func (r postgresCustomers) List(ctx context.Context, mine bool) (customers []CustomerOut, err error) {
+	err = r.s.scoped(ctx, func(q Querier) error {
+		customers, err = ListAllCustomers(ctx, q, mine)
+		return err
+	})
+	return customers, err
+}
+
+func (r postgresCustomers) Count(ctx context.Context) (count int, err error) {
+	err = r.s.scoped(ctx, func(q Querier) error {
+		count, err = CountCustomers(ctx, q)
+		return err
+	})
+	return count, err
+}
+
+func (r postgresCustomers) Reassign(ctx context.Context, ids []int, ownerId int) (count int, err error) {
+	err = r.s.scoped(ctx, func(q Querier) error {
+		count, err = ReassignCustomers(ctx, q, ids, ownerId)
+		return err
+	})
+	return count, err
+}
+
+type postgresUsers struct{ q Querier }
+
+func (r postgresUsers) Create(ctx context.Context, u *User) error {
+	return u.CreateUser(ctx, r.q)
+}
+
+func (r postgresUsers) Login(ctx context.Context, u *User) error {
+	return u.LoginUser(ctx, r.q)
+}
+
+func (r postgresUsers) GetId(ctx context.Context, username string) (int, error) {
+	u := User{Username: username}
+	err := u.GetIdFromUsername(ctx, r.q)
+	return u.Id, err
+}
+
+func (r postgresUsers) Get(ctx context.Context, username string) (User, error) {
+	u := User{Username: username}
+	err := u.GetUser(ctx, r.q)
+	return u, err
+}
+
+func (r postgresUsers) ProvisionOIDC(ctx context.Context, u *User, issuer, subject string) error {
+	return u.ProvisionOIDCUser(ctx, r.q, issuer, subject)
+}
+
+func (r postgresUsers) LinkOIDC(ctx context.Context, u *User, issuer, subject string) error {
+	return u.LinkOIDCUser(ctx, r.q, issuer, subject)
+}
+
+func (r postgresUsers) UpdateEmail(ctx context.Context, u *User) error {
+	return u.UpdateEmail(ctx, r.q)
+}
+
+func (r postgresUsers) ResetPassword(ctx context.Context, u *User) error {
+	return u.ResetPassword(ctx, r.q)
+}
+
+func (r postgresUsers) UpdateRole(ctx context.Context, u *User) error {
+	return u.UpdateRole(ctx, r.q)
+}
+
+func (r postgresUsers) List(ctx context.Context) ([]User, error) {
+	return ListUsers(ctx, r.q)
+}
+
+func (r postgresUsers) Count(ctx context.Context) (int, error) {
+	return CountUsers(ctx, r.q)
+}
+
+func (r postgresUsers) LoginFailed(ctx context.Context, username string, p LockoutPolicy) (time.Duration, error) {
+	u := User{Username: username}
+	return u.LoginFailed(ctx, r.q, p)
+}
+
+func (r postgresUsers) LoginSucceeded(ctx context.Context, username string) error {
+	u := User{Username: username}
+	return u.LoginSucceeded(ctx, r.q)
+}
+
+func (r postgresUsers) LockedFor(ctx context.Context, username string) (time.Duration, error) {
+	u := User{Username: username}
+	return u.LockedFor(ctx, r.q)
+}
+
+func (r postgresUsers) Unlock(ctx context.Context, username string) error {
+	u := User{Username: username}
+	return u.Unlock(ctx, r.q)
+}
+
+type postgresPictures struct{ s *PostgresStore }
+
+func (r postgresPictures) Add(ctx context.Context, p *PicturePath) error {
+	return r.s.scoped(ctx, func(q Querier) error {
+		return p.AddPicture(ctx, q)
+	})
+}
+
+func (r postgresPictures) Get(ctx context.Context, id int) (p PicturePath, err error) {
+	p.Id = id
+	err = r.s.scoped(ctx, func(q Querier) error {
+		return p.GetPicturePath(ctx, q)
+	})
+	return p, err
+}
+
+type postgresAttachments struct{ s *PostgresStore }
+
+func (r postgresAttachments) Add(ctx context.Context, a *Attachment) error {
+	return r.s.scoped(ctx, func(q Querier) error {
+		return a.AddAttachment(ctx, q)
+	})
+}
+
+func (r postgresAttachments) Get(ctx context.Context, customerId, id int) (a Attachment, err error) {
+	a = Attachment{Id: id, CustomerId: customerId}
+	err = r.s.scoped(ctx, func(q Querier) error {
+		return a.GetAttachment(ctx, q)
+	})
+	return a, err
+}
+
+func (r postgresAttachments) Delete(ctx context.Context, customerId, id int) (a Attachment, err error) {
+	a = Attachment{Id: id, CustomerId: customerId}
+	err = r.s.scoped(ctx, func(q Querier) error {
+		return a.DeleteAttachment(ctx, q)
+	})
+	return a, err
+}
+
+func (r postgresAttachments) SetPrimary(ctx context.Context, a *Attachment, p *PicturePath) error {
+	return r.s.scoped(ctx, func(q Querier) error {
+		return a.SetPrimaryAttachment(ctx, q, p)
+	})
+}
+
+func (r postgresAttachments) List(ctx context.Context, customerId int) (attachments []Attachment, err error) {
+	err = r.s.scoped(ctx, func(q Querier) error {
+		attachments, err = ListCustomerAttachments(ctx, q, customerId)
+		return err
+	})
+	return attachments, err
+}
+
+// Uploads belong to their user, but completing one adds its picture to the organization
+type postgresUploads struct{ s *PostgresStore }
+
+func (r postgresUploads) Create(ctx context.Context, u *Upload) error {
+	return u.CreateUpload(ctx, r.s.q)
+}
+
+func (r postgresUploads) Get(ctx context.Context, userId int, id string) (Upload, error) {
+	u := Upload{Id: id, UserId: userId}
+	err := u.GetUpload(ctx, r.s.q)
+	return u, err
+}
+
+func (r postgresUploads) UpdateOffset(ctx context.Context, u *Upload) error {
+	return u.UpdateUploadOffset(ctx, r.s.q)
+}
+
+func (r postgresUploads) Complete(ctx context.Context, u *Upload, p *PicturePath) error {
+	return r.s.scoped(ctx, func(q Querier) error {
+		return u.CompleteUpload(ctx, q, p)
+	})
+}
+
+func (r postgresUploads) Delete(ctx context.Context, userId int, id string) (Upload, error) {
+	u := Upload{Id: id, UserId: userId}
+	err := u.DeleteUpload(ctx, r.s.q)
+	return u, err
+}
+
+func (r postgresUploads) DeleteExpired(ctx context.Context) ([]string, error) {
+	return DeleteExpiredUploads(ctx, r.s.q)
+}
+
+type postgresRateLimits struct{ q Querier }
+
+func (r postgresRateLimits) Take(ctx context.Context, key string, burst int, refill time.Duration) (time.Duration, error) {
+	return TakeRateLimitToken(ctx, r.q, key, burst, refill)
+}
+
+func (r postgresRateLimits) Prune(ctx context.Context, idle time.Duration) error {
+	return PruneRateLimits(ctx, r.q, idle)
+}
+
+type postgresAPIKeys struct{ q Querier }
+
+func (r postgresAPIKeys) Create(ctx context.Context, k *APIKey) error {
+	return k.CreateAPIKey(ctx, r.q)
+}
+
+func (r postgresAPIKeys) Authenticate(ctx context.Context, hash []byte) (APIKey, error) {
+	k := APIKey{Hash: hash}
+	err := k.AuthenticateAPIKey(ctx, r.q)
+	return k, err
+}
+
+func (r postgresAPIKeys) List(ctx context.Context, userId int) ([]APIKey, error) {
+	return ListAPIKeys(ctx, r.q, userId)
+}
+
+func (r postgresAPIKeys) Revoke(ctx context.Context, userId, id int) error {
+	return RevokeAPIKey(ctx, r.q, userId, id)
+}
+
+type postgresSigningKeys struct{ q Querier }
+
+func (r postgresSigningKeys) Add(ctx context.Context, k *SigningKey) error {
+	return k.AddSigningKey(ctx, r.q)
+}
+
+func (r postgresSigningKeys) List(ctx context.Context) ([]SigningKey, error) {
+	return ListSigningKeys(ctx, r.q)
+}
+
+func (r postgresSigningKeys) Retire(ctx context.Context, exceptKid string) error {
+	return RetireSigningKeys(ctx, r.q, exceptKid)
+}
+
+func (r postgresSigningKeys) DeleteRetired(ctx context.Context, validity time.Duration) error {
+	return DeleteRetiredSigningKeys(ctx, r.q, validity)
+}
+
+type postgresOIDCLogins struct{ q Querier }
+
+func (r postgresOIDCLogins) Create(ctx context.Context, l *OIDCLogin) error {
+	return l.CreateOIDCLogin(ctx, r.q)
+}
+
+func (r postgresOIDCLogins) Take(ctx context.Context, state string) (OIDCLogin, error) {
+	l := OIDCLogin{State: state}
+	err := l.TakeOIDCLogin(ctx, r.q)
+	return l, err
+}
+
+type postgresTwoFactor struct{ q Querier }
+
+func (r postgresTwoFactor) Get(ctx context.Context, userId int) (TwoFactor, error) {
+	return GetTwoFactor(ctx, r.q, userId)
+}
+
+func (r postgresTwoFactor) SetSecret(ctx context.Context, userId int, secret string) error {
+	return SetTwoFactorSecret(ctx, r.q, userId, secret)
+}
+
+func (r postgresTwoFactor) Enable(ctx context.Context, userId int, step int64) error {
+	return EnableTwoFactor(ctx, r.q, userId, step)
+}
+
+func (r postgresTwoFactor) UseStep(ctx context.Context, userId int, step int64) (bool, error) {
+	return UseTwoFactorStep(ctx, r.q, userId, step)
+}
+
+func (r postgresTwoFactor) SetRecoveryCodes(ctx context.Context, userId int, hashes [][]byte) error {
+	return SetRecoveryCodes(ctx, r.q, userId, hashes)
+}
+
+func (r postgresTwoFactor) UseRecoveryCode(ctx context.Context, userId int, hash []byte) (bool, error) {
+	return UseRecoveryCode(ctx, r.q, userId, hash)
+}
+
+func (r postgresTwoFactor) Disable(ctx context.Context, userId int) error {
+	return DisableTwoFactor(ctx, r.q, userId)
+}
+
+type postgresSessions struct{ q Querier }
+
+func (r postgresSessions) Create(ctx context.Context, s *Session) error {
+	return s.CreateSession(ctx, r.q)
+}
+
+func (r postgresSessions) Active(ctx context.Context, id string, orgId int) (bool, error) {
+	return SessionActive(ctx, r.q, id, orgId)
+}
+
+func (r postgresSessions) SetOrganization(ctx context.Context, id string, orgId int) error {
+	return SetSessionOrganization(ctx, r.q, id, orgId)
+}
+
+func (r postgresSessions) Refresh(ctx context.Context, hash []byte, s *Session) error {
+	return s.RefreshSession(ctx, r.q, hash)
+}
+
+func (r postgresSessions) List(ctx context.Context, userId int) ([]Session, error) {
+	return ListSessions(ctx, r.q, userId)
+}
+
+func (r postgresSessions) Revoke(ctx context.Context, userId int, exceptId string) error {
+	return RevokeSessions(ctx, r.q, userId, exceptId)
+}
+
+func (r postgresSessions) Delete(ctx context.Context, userId int, id string) error {
+	return DeleteSession(ctx, r.q, userId, id)
+}
+
+type postgresPasswordResets struct{ q Querier }
+
+func (r postgresPasswordResets) Create(ctx context.Context, p *PasswordReset) error {
+	return p.CreatePasswordReset(ctx, r.q)
+}
+
+func (r postgresPasswordResets) Take(ctx context.Context, tokenHash []byte) (PasswordReset, error) {
+	p := PasswordReset{TokenHash: tokenHash}
+	err := p.TakePasswordReset(ctx, r.q)
+	return p, err
+}
+
+type postgresOrganizations struct{ q Querier }
+
+func (r postgresOrganizations) Create(ctx context.Context, o *Organization) error {
+	return o.CreateOrganization(ctx, r.q)
+}
+
+func (r postgresOrganizations) Get(ctx context.Context, id int) (Organization, error) {
+	o := Organization{Id: id}
+	err := o.GetOrganization(ctx, r.q)
+	return o, err
+}
+
+func (r postgresOrganizations) List(ctx context.Context, userId int) ([]Organization, error) {
+	return ListOrganizations(ctx, r.q, userId)
+}
+
+func (r postgresOrganizations) AddMember(ctx context.Context, orgId, userId int) error {
+	return AddMember(ctx, r.q, orgId, userId)
+}
+
+func (r postgresOrganizations) RemoveMember(ctx context.Context, orgId, userId int) error {
+	return RemoveMember(ctx, r.q, orgId, userId)
+}
+
+func (r postgresOrganizations) Members(ctx context.Context, orgId int) ([]Member, error) {
+	return ListMembers(ctx, r.q, orgId)
+}
+
+func (r postgresOrganizations) IsMember(ctx context.Context, orgId, userId int) (bool, error) {
+	return IsMember(ctx, r.q, orgId, userId)
+}
+
+type postgresTeams struct{ s *PostgresStore }
+
+func (r postgresTeams) Create(ctx context.Context, t *Team) error {
+	return r.s.scoped(ctx, func(q Querier) error {
+		return t.CreateTeam(ctx, q)
+	})
+}
+
+func (r postgresTeams) List(ctx context.Context) (teams []Team, err error) {
+	err = r.s.scoped(ctx, func(q Querier) error {
+		teams, err = ListTeams(ctx, q)
+		return err
+	})
+	return teams, err
+}
+
+func (r postgresTeams) Delete(ctx context.Context, id int) error {
+	return r.s.scoped(ctx, func(q Querier) error {
+		return DeleteTeam(ctx, q, id)
+	})
+}
+
+func (r postgresTeams) AddMember(ctx context.Context, teamId, userId int) error {
+	return r.s.scoped(ctx, func(q Querier) error {
+		return AddTeamMember(ctx, q, teamId, userId)
+	})
+}
+
+func (r postgresTeams) RemoveMember(ctx context.Context, teamId, userId int) error {
+	return r.s.scoped(ctx, func(q Querier) error {
+		return RemoveTeamMember(ctx, q, teamId, userId)
+	})
+}
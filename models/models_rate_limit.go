@@ -0,0 +1,62 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"time"
+)
+
+// Rate limits are token buckets, stored as the time at which the bucket will be full again
+// (generic cell rate algorithm), so a single conditional write takes a token atomically.
+// A bucket holds up to burst tokens, and gets a new one every refill
+
+// TakeRateLimitToken takes a token of the bucket with the key, returning how long to wait
+// for the next one if the bucket was empty (0 if the token was taken)
+func TakeRateLimitToken(ctx context.Context, db Querier, key string, burst int, refill time.Duration) (retryAfter time.Duration, err error) {
+	ctx, end := startOperation(ctx, "TakeRateLimitToken")
+	defer func() { err = end(err) }()
+
+	interval := refill.Seconds()
+	tolerance := float64(burst-1) * interval
+	var full time.Time
+	err = db.QueryRowContext(ctx, `
+		INSERT INTO rate_limits AS r (key, fullAt)
+		VALUES ($1, NOW() + make_interval(secs => $2::float8))
+		ON CONFLICT (key) DO UPDATE
+		SET fullAt = GREATEST(r.fullAt, NOW()) + make_interval(secs => $2::float8)
+		WHERE GREATEST(r.fullAt, NOW()) <= NOW() + make_interval(secs => $3::float8)
+		RETURNING fullAt
+		`, key, interval, tolerance).Scan(&full)
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	// Not updated, the bucket is empty
+	var wait float64
+	err = db.QueryRowContext(ctx, `
+		SELECT EXTRACT(EPOCH FROM fullAt - NOW()) - $2::float8 FROM rate_limits
+		WHERE key = $1
+		`, key, tolerance).Scan(&wait)
+	if err != nil {
+		return 0, err
+	}
+	return retryDuration(wait), nil
+}
+
+// At least one second, as it is sent in Retry-After headers
+func retryDuration(seconds float64) time.Duration {
+	return time.Duration(math.Max(1, math.Ceil(seconds))) * time.Second
+}
+
+// PruneRateLimits deletes the buckets full for longer than idle, which behave as new ones
+func PruneRateLimits(ctx context.Context, db Querier, idle time.Duration) (err error) {
+	ctx, end := startOperation(ctx, "PruneRateLimits")
+	defer func() { err = end(err) }()
+
+	_, err = db.ExecContext(ctx, `
+		DELETE FROM rate_limits
+		WHERE fullAt < NOW() - make_interval(secs => $1::float8)
+		`, idle.Seconds())
+	return err
+}
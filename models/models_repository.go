@@ -0,0 +1,212 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// Repositories used by the route handlers, so they don't depend on a specific database.
+// Not found rows are reported with sql.ErrNoRows, as the PostgreSQL implementation does.
+// Customers, pictures and attachments are limited to the organization of the context (see
+// WithOrganization), with the placeholder picture shared by all. Customers and their attachments
+// are also limited to the ones the user of the context can access (see WithUser)
+
+type CustomerRepository interface {
+	Get(ctx context.Context, id int) (CustomerOut, error)
+	// Create sets the creator as the owner, and returns ErrTeamNotFound if any of the teams is not
+	// in the organization
+	Create(ctx context.Context, c *Customer) error
+	// Update returns ErrCustomerNotFound, ErrNotOwner (when changing the teams) or ErrTeamNotFound
+	Update(ctx context.Context, c *Customer) error
+	// Delete returns the files of the attachments deleted with the customer, or ErrCustomerNotFound
+	// if the customer cannot be accessed
+	Delete(ctx context.Context, id int) ([]string, error)
+	// List returns only the customers owned by the user of the context if mine
+	List(ctx context.Context, mine bool) ([]CustomerOut, error)
+	Count(ctx context.Context) (int, error)
+	// Reassign gives all the customers to the owner, or none of them if it returns an error (see
+	// ReassignCustomers). It returns how many were reassigned
+	Reassign(ctx context.Context, ids []int, ownerId int) (int, error)
+}
+
+type UserRepository interface {
+	// Create does nothing if the username is already in use
+	Create(ctx context.Context, u *User) error
+	// Login checks the password of the user, setting its ID if valid
+	Login(ctx context.Context, u *User) error
+	GetId(ctx context.Context, username string) (int, error)
+	// Get returns the user without its password
+	Get(ctx context.Context, username string) (User, error)
+	// ProvisionOIDC finds or creates the user of a single sign-on identity, setting its ID,
+	// username and role. Returns ErrUsernameTaken if the username belongs to another user
+	ProvisionOIDC(ctx context.Context, u *User, issuer, subject string) error
+	// LinkOIDC links a single sign-on identity to the user of the ID, setting its username and role.
+	// Returns ErrOIDCLinked if the user or the identity are already linked
+	LinkOIDC(ctx context.Context, u *User, issuer, subject string) error
+	ResetPassword(ctx context.Context, u *User) error
+	UpdateRole(ctx context.Context, u *User) error
+	// UpdateEmail removes the email if empty
+	UpdateEmail(ctx context.Context, u *User) error
+	List(ctx context.Context) ([]User, error)
+	Count(ctx context.Context) (int, error)
+	// LoginFailed and LockedFor return how long the user is locked for, 0 if not locked
+	LoginFailed(ctx context.Context, username string, p LockoutPolicy) (time.Duration, error)
+	LoginSucceeded(ctx context.Context, username string) error
+	LockedFor(ctx context.Context, username string) (time.Duration, error)
+	Unlock(ctx context.Context, username string) error
+}
+
+type PictureRepository interface {
+	// Add sets the ID of the placeholder picture if the path was already added
+	Add(ctx context.Context, p *PicturePath) error
+	Get(ctx context.Context, id int) (PicturePath, error)
+}
+
+type AttachmentRepository interface {
+	Add(ctx context.Context, a *Attachment) error
+	Get(ctx context.Context, customerId, id int) (Attachment, error)
+	// Get and Delete return sql.ErrNoRows if the attachment is not found or not accessible. Delete
+	// returns the deleted attachment, whose file must be removed by the caller
+	Delete(ctx context.Context, customerId, id int) (Attachment, error)
+	SetPrimary(ctx context.Context, a *Attachment, p *PicturePath) error
+	List(ctx context.Context, customerId int) ([]Attachment, error)
+}
+
+type UploadRepository interface {
+	Create(ctx context.Context, u *Upload) error
+	// Get only returns the upload if it belongs to the user and has not expired
+	Get(ctx context.Context, userId int, id string) (Upload, error)
+	UpdateOffset(ctx context.Context, u *Upload) error
+	Complete(ctx context.Context, u *Upload, p *PicturePath) error
+	Delete(ctx context.Context, userId int, id string) (Upload, error)
+	// DeleteExpired returns the files of the expired uploads that were never completed
+	DeleteExpired(ctx context.Context) ([]string, error)
+}
+
+type APIKeyRepository interface {
+	// Create sets the ID, creation time and username of the key
+	Create(ctx context.Context, k *APIKey) error
+	// Authenticate returns the non expired key with the hash, recording its use, or ErrAPIKeyNotFound
+	Authenticate(ctx context.Context, hash []byte) (APIKey, error)
+	// List and Revoke only use the keys of the user, or of every user if userId is 0
+	List(ctx context.Context, userId int) ([]APIKey, error)
+	Revoke(ctx context.Context, userId, id int) error
+}
+
+type OIDCLoginRepository interface {
+	Create(ctx context.Context, l *OIDCLogin) error
+	// Take deletes and returns the non expired login with the state, or sql.ErrNoRows
+	Take(ctx context.Context, state string) (OIDCLogin, error)
+}
+
+type SessionRepository interface {
+	// Create sets the creation and last use times of the session
+	Create(ctx context.Context, s *Session) error
+	// Active returns whether the session exists, has not expired and is in the organization (0 for none)
+	Active(ctx context.Context, id string, orgId int) (bool, error)
+	// SetOrganization switches the session to the organization, ErrSessionNotFound if not found
+	SetOrganization(ctx context.Context, id string, orgId int) error
+	// Refresh replaces the refresh token with the hash by the one of the session, or returns
+	// sql.ErrNoRows if not found or expired
+	Refresh(ctx context.Context, hash []byte, s *Session) error
+	// List returns the active sessions of the user, the last used first
+	List(ctx context.Context, userId int) ([]Session, error)
+	// Revoke deletes the sessions of the user, except the one with the ID (empty for every one)
+	Revoke(ctx context.Context, userId int, exceptId string) error
+	// Delete revokes a session of the user, ErrSessionNotFound if not found
+	Delete(ctx context.Context, userId int, id string) error
+}
+
+// OrganizationRepository manages the organizations and their members. RemoveMember runs several
+// statements, so it must be called in a transaction
+type OrganizationRepository interface {
+	// Create sets the ID and creation time, or returns ErrOrganizationExists
+	Create(ctx context.Context, o *Organization) error
+	Get(ctx context.Context, id int) (Organization, error)
+	// List returns the organizations of the user, or every one if userId is 0
+	List(ctx context.Context, userId int) ([]Organization, error)
+	// AddMember does nothing if the user is already a member
+	AddMember(ctx context.Context, orgId, userId int) error
+	// RemoveMember returns ErrMemberNotFound if the user is not a member. The user leaves the
+	// teams of the organization, and its sessions in it are left without organization
+	RemoveMember(ctx context.Context, orgId, userId int) error
+	Members(ctx context.Context, orgId int) ([]Member, error)
+	IsMember(ctx context.Context, orgId, userId int) (bool, error)
+}
+
+// TeamRepository manages the teams of the organization of the context
+type TeamRepository interface {
+	// Create sets the ID and creation time, or returns ErrTeamExists
+	Create(ctx context.Context, t *Team) error
+	List(ctx context.Context) ([]Team, error)
+	// Delete returns ErrTeamNotFound if the team is not in the organization
+	Delete(ctx context.Context, id int) error
+	// AddMember returns ErrTeamNotFound, or ErrMemberNotFound if the user is not a member of the
+	// organization. It does nothing if the user is already a member of the team
+	AddMember(ctx context.Context, teamId, userId int) error
+	// RemoveMember returns ErrTeamMemberNotFound if the user is not a member of the team
+	RemoveMember(ctx context.Context, teamId, userId int) error
+}
+
+type PasswordResetRepository interface {
+	// Create replaces the previous resets of the user
+	Create(ctx context.Context, p *PasswordReset) error
+	// Take deletes and returns the non expired reset with the token hash, or sql.ErrNoRows
+	Take(ctx context.Context, tokenHash []byte) (PasswordReset, error)
+}
+
+// TwoFactorRepository stores the TOTP secrets and recovery codes of the users. SetRecoveryCodes
+// and Disable run several statements, so they must be called in a transaction
+type TwoFactorRepository interface {
+	// Get returns ErrUserNotFound if the user does not exist
+	Get(ctx context.Context, userId int) (TwoFactor, error)
+	SetSecret(ctx context.Context, userId int, secret string) error
+	Enable(ctx context.Context, userId int, step int64) error
+	// UseStep returns false if a code of the step or a later one was already used
+	UseStep(ctx context.Context, userId int, step int64) (bool, error)
+	SetRecoveryCodes(ctx context.Context, userId int, hashes [][]byte) error
+	// UseRecoveryCode deletes the code, returning false if the user has no code with the hash
+	UseRecoveryCode(ctx context.Context, userId int, hash []byte) (bool, error)
+	Disable(ctx context.Context, userId int) error
+}
+
+type SigningKeyRepository interface {
+	// Add sets the creation time of the key
+	Add(ctx context.Context, k *SigningKey) error
+	// List returns every key, from the oldest to the newest
+	List(ctx context.Context) ([]SigningKey, error)
+	// Retire retires the keys still signing tokens, except the one with the kid
+	Retire(ctx context.Context, exceptKid string) error
+	// DeleteRetired deletes the keys retired longer than validity ago
+	DeleteRetired(ctx context.Context, validity time.Duration) error
+}
+
+// RateLimitRepository stores token buckets, shared by every instance of the API
+type RateLimitRepository interface {
+	// Take returns how long to wait for the next token if the bucket is empty, 0 if a token was taken
+	Take(ctx context.Context, key string, burst int, refill time.Duration) (time.Duration, error)
+	// Prune deletes the buckets full for longer than idle
+	Prune(ctx context.Context, idle time.Duration) error
+}
+
+// Store gives access to all the repositories
+type Store interface {
+	Customers() CustomerRepository
+	Users() UserRepository
+	Pictures() PictureRepository
+	Attachments() AttachmentRepository
+	Uploads() UploadRepository
+	RateLimits() RateLimitRepository
+	APIKeys() APIKeyRepository
+	SigningKeys() SigningKeyRepository
+	OIDCLogins() OIDCLoginRepository
+	TwoFactor() TwoFactorRepository
+	Sessions() SessionRepository
+	PasswordResets() PasswordResetRepository
+	Organizations() OrganizationRepository
+	Teams() TeamRepository
+	// InTx runs fn with a store whose changes are only committed if fn returns nil.
+	// Within fn, only the given store must be used
+	InTx(ctx context.Context, fn func(tx Store) error) error
+	Ping(ctx context.Context) error
+}
@@ -0,0 +1,153 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Session started by a login, whose ID is in its tokens. New tokens are issued with its refresh
+// token, replaced every time it is used, until it expires without being used. Revoked sessions
+// are deleted, so their tokens are refused even before they expire
+type Session struct {
+	Id             string    `json:"id"`
+	UserId         int       `json:"-"`
+	Username       string    `json:"-"` // Of its user, set when refreshed
+	Role           string    `json:"-"`
+	RefreshHash    []byte    `json:"-"`
+	OrganizationId int       `json:"organizationId,omitempty"` // Active one of its tokens, 0 if none
+	Device         string    `json:"device"`                   // User agent of the client
+	IP             string    `json:"ip"`
+	CreatedAt      time.Time `json:"createdAt"`
+	LastUsedAt     time.Time `json:"lastUsedAt"`
+	ExpiresAt      time.Time `json:"expiresAt"`
+}
+
+var ErrSessionNotFound = errors.New("Session not found")
+
+// Length of the device column
+const MaxDeviceLength = 255
+
+// CreateSession also deletes the expired sessions of the user. Without organization, the session
+// starts in the first organization of the user (if any)
+func (s *Session) CreateSession(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "CreateSession")
+	defer func() { err = end(err) }()
+
+	_, err = db.ExecContext(ctx, `DELETE FROM sessions WHERE userId = $1 AND expiresAt <= NOW()`, s.UserId)
+	if err != nil {
+		return err
+	}
+	return db.QueryRowContext(ctx, `
+		INSERT INTO sessions (id, userId, refreshHash, device, ip, expiresAt, orgId)
+		VALUES ($1, $2, $3, $4, $5, $6,
+			COALESCE(NULLIF($7, 0), (SELECT MIN(orgId) FROM organization_members WHERE userId = $2)))
+		RETURNING createdAt, lastUsedAt, COALESCE(orgId, 0)
+		`, s.Id, s.UserId, s.RefreshHash, s.Device, s.IP, s.ExpiresAt, s.OrganizationId).Scan(&s.CreatedAt, &s.LastUsedAt, &s.OrganizationId)
+}
+
+// SessionActive returns whether the session exists, has not expired and is still in the
+// organization (0 for none), which changes when switched or when the user is removed from it
+func SessionActive(ctx context.Context, db Querier, id string, orgId int) (active bool, err error) {
+	ctx, end := startOperation(ctx, "SessionActive")
+	defer func() { err = end(err) }()
+
+	err = db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM sessions WHERE id = $1 AND expiresAt > NOW() AND COALESCE(orgId, 0) = $2)
+		`, id, orgId).Scan(&active)
+	return active, err
+}
+
+// RefreshSession replaces the refresh token of the active session with the hash by the one of the
+// session, recording its use from its device and IP until its new expiration. It sets the rest of
+// the session with its user, or returns sql.ErrNoRows if not found
+func (s *Session) RefreshSession(ctx context.Context, db Querier, hash []byte) (err error) {
+	ctx, end := startOperation(ctx, "RefreshSession")
+	defer func() { err = end(err) }()
+
+	return db.QueryRowContext(ctx, `
+		UPDATE sessions s SET refreshHash = $2, device = $3, ip = $4, expiresAt = $5, lastUsedAt = NOW()
+		FROM users u
+		WHERE u.id = s.userId AND s.refreshHash = $1 AND s.expiresAt > NOW()
+		RETURNING s.id, s.userId, u.username, u.role, COALESCE(s.orgId, 0), s.createdAt, s.lastUsedAt
+		`, hash, s.RefreshHash, s.Device, s.IP, s.ExpiresAt).Scan(&s.Id, &s.UserId, &s.Username, &s.Role, &s.OrganizationId, &s.CreatedAt, &s.LastUsedAt)
+}
+
+// SetSessionOrganization switches the active session to the organization
+func SetSessionOrganization(ctx context.Context, db Querier, id string, orgId int) (err error) {
+	ctx, end := startOperation(ctx, "SetSessionOrganization")
+	defer func() { err = end(err) }()
+
+	res, err := db.ExecContext(ctx, `
+		UPDATE sessions SET orgId = $2 WHERE id = $1 AND expiresAt > NOW()
+		`, id, orgId)
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// ListSessions returns the active sessions of the user, the last used first
+func ListSessions(ctx context.Context, db Querier, userId int) (sessions []Session, err error) {
+	ctx, end := startOperation(ctx, "ListSessions")
+	defer func() { err = end(err) }()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, userId, COALESCE(orgId, 0), device, ip, createdAt, lastUsedAt, expiresAt FROM sessions
+		WHERE userId = $1 AND expiresAt > NOW()
+		ORDER BY lastUsedAt DESC, createdAt DESC
+		`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions = make([]Session, 0)
+	for rows.Next() {
+		var s Session
+		if err = rows.Scan(&s.Id, &s.UserId, &s.OrganizationId, &s.Device, &s.IP, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSessions deletes the sessions of the user, except the one with the ID (if any)
+func RevokeSessions(ctx context.Context, db Querier, userId int, exceptId string) (err error) {
+	ctx, end := startOperation(ctx, "RevokeSessions")
+	defer func() { err = end(err) }()
+
+	_, err = db.ExecContext(ctx, `
+		DELETE FROM sessions WHERE userId = $1 AND id <> $2
+		`, userId, exceptId)
+	return err
+}
+
+// DeleteSession revokes the session of the user with the ID
+func DeleteSession(ctx context.Context, db Querier, userId int, id string) (err error) {
+	ctx, end := startOperation(ctx, "DeleteSession")
+	defer func() { err = end(err) }()
+
+	res, err := db.ExecContext(ctx, `
+		DELETE FROM sessions WHERE userId = $1 AND id = $2
+		`, userId, id)
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Key pair signing the JWTs, stored in the database so every instance of the API uses the same
+// ones. Retired keys no longer sign tokens, but still verify the ones they signed until they expire
+type SigningKey struct {
+	Kid        string
+	Algorithm  string // RS256 or ES256
+	PrivateKey []byte // PKCS #8, DER encoded
+	CreatedAt  time.Time
+	RetiredAt  *time.Time // Nil while it signs the new tokens
+}
+
+func (k *SigningKey) AddSigningKey(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "AddSigningKey")
+	defer func() { err = end(err) }()
+
+	return db.QueryRowContext(ctx, `
+		INSERT INTO signing_keys (kid, algorithm, privateKey)
+		VALUES ($1, $2, $3)
+		RETURNING createdAt
+		`, k.Kid, k.Algorithm, k.PrivateKey).Scan(&k.CreatedAt)
+}
+
+// ListSigningKeys returns every key, from the oldest to the newest
+func ListSigningKeys(ctx context.Context, db Querier) (keys []SigningKey, err error) {
+	ctx, end := startOperation(ctx, "ListSigningKeys")
+	defer func() { err = end(err) }()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT kid, algorithm, privateKey, createdAt, retiredAt FROM signing_keys
+		ORDER BY createdAt, kid
+		`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys = make([]SigningKey, 0)
+	for rows.Next() {
+		var k SigningKey
+		var retiredAt sql.NullTime
+		if err = rows.Scan(&k.Kid, &k.Algorithm, &k.PrivateKey, &k.CreatedAt, &retiredAt); err != nil {
+			return nil, err
+		}
+		k.RetiredAt = nullTime(retiredAt)
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// RetireSigningKeys retires the keys still signing tokens, except the one with the kid
+func RetireSigningKeys(ctx context.Context, db Querier, exceptKid string) (err error) {
+	ctx, end := startOperation(ctx, "RetireSigningKeys")
+	defer func() { err = end(err) }()
+
+	_, err = db.ExecContext(ctx, `
+		UPDATE signing_keys SET retiredAt = NOW()
+		WHERE retiredAt IS NULL AND kid <> $1
+		`, exceptKid)
+	return err
+}
+
+// DeleteRetiredSigningKeys deletes the keys retired longer than validity ago, whose tokens expired
+func DeleteRetiredSigningKeys(ctx context.Context, db Querier, validity time.Duration) (err error) {
+	ctx, end := startOperation(ctx, "DeleteRetiredSigningKeys")
+	defer func() { err = end(err) }()
+
+	_, err = db.ExecContext(ctx, `
+		DELETE FROM signing_keys
+		WHERE retiredAt < NOW() - make_interval(secs => $1::float8)
+		`, validity.Seconds())
+	return err
+}
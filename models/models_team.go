@@ -0,0 +1,134 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Team of members of an organization, sharing the customers shared with it
+type Team struct {
+	Id        int       `json:"id"`
+	Name      string    `json:"name"`
+	Members   []string  `json:"members"` // Usernames
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+var (
+	ErrTeamExists         = errors.New("Team name already in use")
+	ErrTeamNotFound       = errors.New("Team not found")
+	ErrTeamMemberNotFound = errors.New("User is not a member of the team")
+)
+
+// CreateTeam creates the team in the organization of the context, returning ErrTeamExists if the
+// name is taken in it, or ErrNoOrganization if it has none
+func (t *Team) CreateTeam(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "CreateTeam")
+	defer func() { err = end(err) }()
+
+	if id, _ := OrganizationFrom(ctx); id == 0 {
+		return ErrNoOrganization
+	}
+	err = db.QueryRowContext(ctx, `
+		INSERT INTO teams (name) VALUES ($1)
+		ON CONFLICT DO NOTHING
+		RETURNING id, createdAt
+		`, t.Name).Scan(&t.Id, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return ErrTeamExists
+	}
+	t.Members = []string{}
+	return err
+}
+
+// ListTeams returns the teams of the organization of the context, by name
+func ListTeams(ctx context.Context, db Querier) (teams []Team, err error) {
+	ctx, end := startOperation(ctx, "ListTeams")
+	defer func() { err = end(err) }()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT t.id, t.name, t.createdAt,
+		ARRAY(SELECT u.username FROM team_members m JOIN users u ON u.id = m.userId
+			WHERE m.teamId = t.id ORDER BY u.username)
+		FROM teams t
+		ORDER BY t.name
+		`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	teams = make([]Team, 0)
+	for rows.Next() {
+		var t Team
+		if err = rows.Scan(&t.Id, &t.Name, &t.CreatedAt, (*pq.StringArray)(&t.Members)); err != nil {
+			return nil, err
+		}
+		teams = append(teams, t)
+	}
+	return teams, rows.Err()
+}
+
+// DeleteTeam returns ErrTeamNotFound if the team is not in the organization of the context. Its
+// customers stop being shared with its members
+func DeleteTeam(ctx context.Context, db Querier, id int) (err error) {
+	ctx, end := startOperation(ctx, "DeleteTeam")
+	defer func() { err = end(err) }()
+
+	res, err := db.ExecContext(ctx, `DELETE FROM teams WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return ErrTeamNotFound
+	}
+	return nil
+}
+
+// AddTeamMember returns ErrTeamNotFound if the team is not in the organization of the context, and
+// ErrMemberNotFound if the user is not a member of the organization. It does nothing if the user
+// is already a member of the team
+func AddTeamMember(ctx context.Context, db Querier, teamId, userId int) (err error) {
+	ctx, end := startOperation(ctx, "AddTeamMember")
+	defer func() { err = end(err) }()
+
+	var team, member bool
+	err = db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM teams WHERE id = $1), org_member($2)
+		`, teamId, userId).Scan(&team, &member)
+	if err != nil {
+		return err
+	}
+	if !team {
+		return ErrTeamNotFound
+	}
+	if !member {
+		return ErrMemberNotFound
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO team_members (teamId, userId) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+		`, teamId, userId)
+	return err
+}
+
+// RemoveTeamMember returns ErrTeamMemberNotFound if the user is not a member of the team (or the
+// team is not in the organization of the context)
+func RemoveTeamMember(ctx context.Context, db Querier, teamId, userId int) (err error) {
+	ctx, end := startOperation(ctx, "RemoveTeamMember")
+	defer func() { err = end(err) }()
+
+	res, err := db.ExecContext(ctx, `
+		DELETE FROM team_members WHERE teamId = $1 AND userId = $2
+		`, teamId, userId)
+	if err != nil {
+		return err
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return ErrTeamMemberNotFound
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Two-factor authentication of a user. The secret is set on enrollment, but only required on
+// login once enabled, after the user has verified a code
+type TwoFactor struct {
+	Secret        string
+	Enabled       bool
+	LastStep      int64 // Time step of the last code used, which cannot be used again
+	RecoveryCodes int   // Recovery codes left
+}
+
+// GetTwoFactor returns the two-factor authentication of the user, empty if never enrolled
+func GetTwoFactor(ctx context.Context, db Querier, userId int) (tf TwoFactor, err error) {
+	ctx, end := startOperation(ctx, "GetTwoFactor")
+	defer func() { err = end(err) }()
+
+	var secret sql.NullString
+	err = db.QueryRowContext(ctx, `
+		SELECT totpSecret, totpEnabled, totpLastStep,
+			(SELECT COUNT(*) FROM recovery_codes WHERE userId = users.id)
+		FROM users WHERE id = $1
+		`, userId).Scan(&secret, &tf.Enabled, &tf.LastStep, &tf.RecoveryCodes)
+	if err == sql.ErrNoRows {
+		return tf, ErrUserNotFound
+	}
+	tf.Secret = secret.String
+	return tf, err
+}
+
+// SetTwoFactorSecret sets the secret of a new enrollment, not enabled until verified
+func SetTwoFactorSecret(ctx context.Context, db Querier, userId int, secret string) (err error) {
+	ctx, end := startOperation(ctx, "SetTwoFactorSecret")
+	defer func() { err = end(err) }()
+
+	res, err := db.ExecContext(ctx, `
+		UPDATE users SET totpSecret = $2, totpEnabled = FALSE, totpLastStep = 0
+		WHERE id = $1
+		`, userId, secret)
+	return checkUserUpdated(res, err)
+}
+
+// EnableTwoFactor enables the enrolled secret, whose code of the step was verified
+func EnableTwoFactor(ctx context.Context, db Querier, userId int, step int64) (err error) {
+	ctx, end := startOperation(ctx, "EnableTwoFactor")
+	defer func() { err = end(err) }()
+
+	res, err := db.ExecContext(ctx, `
+		UPDATE users SET totpEnabled = TRUE, totpLastStep = $2
+		WHERE id = $1 AND totpSecret IS NOT NULL
+		`, userId, step)
+	return checkUserUpdated(res, err)
+}
+
+// UseTwoFactorStep stores the time step of a valid code, returning false if a code of that
+// step or a later one was already used (replayed codes)
+func UseTwoFactorStep(ctx context.Context, db Querier, userId int, step int64) (used bool, err error) {
+	ctx, end := startOperation(ctx, "UseTwoFactorStep")
+	defer func() { err = end(err) }()
+
+	res, err := db.ExecContext(ctx, `
+		UPDATE users SET totpLastStep = $2
+		WHERE id = $1 AND totpLastStep < $2
+		`, userId, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// SetRecoveryCodes replaces the recovery codes of the user with the hashes
+func SetRecoveryCodes(ctx context.Context, db Querier, userId int, hashes [][]byte) (err error) {
+	ctx, end := startOperation(ctx, "SetRecoveryCodes")
+	defer func() { err = end(err) }()
+
+	_, err = db.ExecContext(ctx, `DELETE FROM recovery_codes WHERE userId = $1`, userId)
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		_, err = db.ExecContext(ctx, `
+			INSERT INTO recovery_codes (userId, codeHash) VALUES ($1, $2)
+			`, userId, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseRecoveryCode deletes the recovery code with the hash, returning false if the user has none
+func UseRecoveryCode(ctx context.Context, db Querier, userId int, hash []byte) (used bool, err error) {
+	ctx, end := startOperation(ctx, "UseRecoveryCode")
+	defer func() { err = end(err) }()
+
+	res, err := db.ExecContext(ctx, `
+		DELETE FROM recovery_codes WHERE userId = $1 AND codeHash = $2
+		`, userId, hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// DisableTwoFactor deletes the secret and the recovery codes of the user
+func DisableTwoFactor(ctx context.Context, db Querier, userId int) (err error) {
+	ctx, end := startOperation(ctx, "DisableTwoFactor")
+	defer func() { err = end(err) }()
+
+	_, err = db.ExecContext(ctx, `DELETE FROM recovery_codes WHERE userId = $1`, userId)
+	if err != nil {
+		return err
+	}
+	res, err := db.ExecContext(ctx, `
+		UPDATE users SET totpSecret = NULL, totpEnabled = FALSE, totpLastStep = 0
+		WHERE id = $1
+		`, userId)
+	return checkUserUpdated(res, err)
+}
@@ -0,0 +1,140 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Resumable picture upload (tus protocol)
+type Upload struct {
+	Id        string
+	UserId    int
+	Length    int64
+	Offset    int64
+	Metadata  string
+	FilePath  string
+	PictureId int
+	ExpiresAt time.Time
+}
+
+func (u *Upload) IsComplete() bool {
+	return u.Offset == u.Length
+}
+
+func (u *Upload) CreateUpload(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "CreateUpload")
+	defer func() { err = end(err) }()
+
+	return db.QueryRowContext(ctx, `
+		INSERT INTO picture_uploads (
+			id,
+			userId,
+			length,
+			uploadOffset,
+			metadata,
+			filePath,
+			expiresAt
+		)
+		VALUES ($1, $2, $3, 0, $4, $5, $6)
+		RETURNING uploadOffset
+		`, u.Id, u.UserId, u.Length, u.Metadata, u.FilePath, u.ExpiresAt).Scan(&u.Offset)
+}
+
+// Gets a non expired upload of the user
+func (u *Upload) GetUpload(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "GetUpload")
+	defer func() { err = end(err) }()
+
+	var pictureId sql.NullInt64
+	err = db.QueryRowContext(ctx, `
+		SELECT length, uploadOffset, metadata, filePath, pictureId, expiresAt
+		FROM picture_uploads
+		WHERE id = $1 AND userId = $2 AND expiresAt > NOW()
+		`, u.Id, u.UserId).Scan(&u.Length, &u.Offset, &u.Metadata, &u.FilePath, &pictureId, &u.ExpiresAt)
+	u.PictureId = int(pictureId.Int64)
+	return err
+}
+
+func (u *Upload) UpdateUploadOffset(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "UpdateUploadOffset")
+	defer func() { err = end(err) }()
+
+	_, err = db.ExecContext(ctx, `
+		UPDATE picture_uploads SET
+		uploadOffset = $1,
+		expiresAt = $2
+		WHERE id = $3
+		`, u.Offset, u.ExpiresAt, u.Id)
+	return err
+}
+
+func (u *Upload) CompleteUpload(ctx context.Context, db Querier, p *PicturePath) (err error) {
+	ctx, end := startOperation(ctx, "CompleteUpload")
+	defer func() { err = end(err) }()
+
+	err = p.AddPicture(ctx, db)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `
+		UPDATE picture_uploads SET
+		pictureId = $1
+		WHERE id = $2
+		`, p.Id, u.Id)
+	if err != nil {
+		return err
+	}
+	u.PictureId = p.Id
+	return nil
+}
+
+func (u *Upload) DeleteUpload(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "DeleteUpload")
+	defer func() { err = end(err) }()
+
+	var pictureId sql.NullInt64
+	err = db.QueryRowContext(ctx, `
+		DELETE FROM picture_uploads
+		WHERE id = $1 AND userId = $2
+		RETURNING filePath, pictureId
+		`, u.Id, u.UserId).Scan(&u.FilePath, &pictureId)
+	if err == sql.ErrNoRows {
+		err = errors.New("No upload was deleted")
+	}
+	u.PictureId = int(pictureId.Int64)
+	return err
+}
+
+// Deletes the expired uploads, returning the files of the ones that were never completed
+func DeleteExpiredUploads(ctx context.Context, db Querier) (files []string, err error) {
+	ctx, end := startOperation(ctx, "DeleteExpiredUploads")
+	defer func() { err = end(err) }()
+
+	rows, err := db.QueryContext(ctx, `
+		DELETE FROM picture_uploads
+		WHERE expiresAt <= NOW()
+		RETURNING filePath, pictureId IS NULL`)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files = []string{}
+
+	for rows.Next() {
+		var filePath string
+		var incomplete bool
+		err := rows.Scan(&filePath, &incomplete)
+		if err != nil {
+			return nil, err
+		}
+		if incomplete {
+			files = append(files, filePath)
+		}
+	}
+
+	return files, nil
+}
@@ -1,11 +1,14 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"math"
+	"net/mail"
+	"time"
 
-	"golang.org/x/crypto/bcrypt"
-	"theam.io/jdavidsanchez/test_crm_api/utils"
+	"theam.io/jdavidsanchez/test_crm_api/passwd"
 )
 
 // User
@@ -13,17 +16,54 @@ type User struct {
 	Id       int
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Email    string `json:"email,omitempty"` // Optional, where the password reset tokens are sent
+	Role     string `json:"-"`               // Only set by the admin commands, never from requests
 }
 
-func (u *User) CreateUser(db *sql.DB) error {
-	passwdHash, err := bcrypt.GenerateFromPassword([]byte(u.Password), 14)
-	utils.CheckErr(err)
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+func ValidRole(role string) bool {
+	return role == RoleUser || role == RoleAdmin
+}
+
+// ValidEmail checks the email is a bare address, without a display name
+func ValidEmail(email string) bool {
+	a, err := mail.ParseAddress(email)
+	return err == nil && a.Address == email
+}
+
+var ErrUserNotFound = errors.New("User not found")
+
+// ErrUsernameTaken is returned when provisioning a single sign-on user whose username belongs to
+// another user
+var ErrUsernameTaken = errors.New("Username already in use")
+
+// ErrOIDCLinked is returned when linking a single sign-on identity already linked to a user, or to
+// a user already linked to another identity
+var ErrOIDCLinked = errors.New("Single sign-on identity already linked")
+
+const MaxUsernameLength = 64 // Characters of the username column
+
+func (u *User) CreateUser(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "CreateUser")
+	defer func() { err = end(err) }()
+
+	passwdHash, err := passwd.Hash(u.Password)
+	if err != nil {
+		return err
+	}
 
-	_, err = db.Exec(`
-		INSERT INTO users (username, passwd)
-		VALUES ($1, $2)
+	if u.Role == "" {
+		u.Role = RoleUser
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO users (username, passwd, role, email)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
 		ON CONFLICT DO NOTHING
-		`, u.Username, passwdHash)
+		`, u.Username, passwdHash, u.Role, u.Email)
 
 	// If the ON CONFLICT DO NOTHING was not there, this would be the way
 	// to catch the same-user error
@@ -41,25 +81,298 @@ func (u *User) CreateUser(db *sql.DB) error {
 	return nil
 }
 
-func (u *User) LoginUser(db *sql.DB) error {
-	passwd := []byte(u.Password)
-	_ = db.QueryRow(`
-		SELECT id, username, passwd FROM users
+// LoginUser checks the password of the user, setting its ID, role and password hash. The hash is
+// replaced when it was not made with the configured algorithm and cost
+func (u *User) LoginUser(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "LoginUser")
+	defer func() { err = end(err) }()
+
+	password := u.Password
+	var hash string
+	err = db.QueryRowContext(ctx, `
+		SELECT id, username, passwd, role FROM users
 		WHERE username = $1
-		`, u.Username).Scan(&u.Id, &u.Username, &u.Password)
+		`, u.Username).Scan(&u.Id, &u.Username, &hash, &u.Role)
+	// Unknown users are compared too, failing as invalid credentials
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
 
-	err := bcrypt.CompareHashAndPassword([]byte(u.Password), passwd)
-	if err == bcrypt.ErrMismatchedHashAndPassword {
+	ok, rehash, err := passwd.Verify(hash, password)
+	if err != nil {
+		return err
+	}
+	if !ok {
 		return errors.New("Invalid credentials")
+	}
+	u.Password = hash
+	if !rehash {
+		return nil
+	}
+
+	newHash, err := passwd.Hash(password)
+	if err == passwd.ErrTooLong {
+		// Kept as it is, as the password is too long for the configured algorithm
+		return nil
 	} else if err != nil {
 		return err
 	}
+	// Unless the password was changed meanwhile
+	_, err = db.ExecContext(ctx, `
+		UPDATE users SET passwd = $2
+		WHERE id = $1 AND passwd = $3
+		`, u.Id, newHash, hash)
+	if err != nil {
+		return err
+	}
+	u.Password = newHash
 	return nil
 }
 
-func (u *User) GetIdFromUsername(db *sql.DB) error {
-	return db.QueryRow(`
+func (u *User) GetIdFromUsername(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "GetIdFromUsername")
+	defer func() { err = end(err) }()
+
+	return db.QueryRowContext(ctx, `
 	SELECT id FROM users
 	WHERE username = $1
 	`, u.Username).Scan(&u.Id)
 }
+
+// GetUser gets the ID, role and email of the user with the username, without its password
+func (u *User) GetUser(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "GetUser")
+	defer func() { err = end(err) }()
+
+	return db.QueryRowContext(ctx, `
+		SELECT id, role, COALESCE(email, '') FROM users
+		WHERE username = $1
+		`, u.Username).Scan(&u.Id, &u.Role, &u.Email)
+}
+
+func CountUsers(ctx context.Context, db Querier) (count int, err error) {
+	ctx, end := startOperation(ctx, "CountUsers")
+	defer func() { err = end(err) }()
+
+	err = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users`).Scan(&count)
+	return count, err
+}
+
+// ResetPassword replaces the password of the user with the username
+func (u *User) ResetPassword(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "ResetPassword")
+	defer func() { err = end(err) }()
+
+	passwdHash, err := passwd.Hash(u.Password)
+	if err != nil {
+		return err
+	}
+	res, err := db.ExecContext(ctx, `
+		UPDATE users SET passwd = $2
+		WHERE username = $1
+		`, u.Username, passwdHash)
+	return checkUserUpdated(res, err)
+}
+
+// UpdateRole sets the role of the user with the username
+func (u *User) UpdateRole(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "UpdateRole")
+	defer func() { err = end(err) }()
+
+	if !ValidRole(u.Role) {
+		return errors.New("Invalid role " + u.Role)
+	}
+	res, err := db.ExecContext(ctx, `
+		UPDATE users SET role = $2
+		WHERE username = $1
+		`, u.Username, u.Role)
+	return checkUserUpdated(res, err)
+}
+
+// UpdateEmail sets the email of the user with the username, removing it if empty
+func (u *User) UpdateEmail(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "UpdateEmail")
+	defer func() { err = end(err) }()
+
+	res, err := db.ExecContext(ctx, `
+		UPDATE users SET email = NULLIF($2, '')
+		WHERE username = $1
+		`, u.Username, u.Email)
+	return checkUserUpdated(res, err)
+}
+
+func checkUserUpdated(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// ListUsers returns every user, without their password
+func ListUsers(ctx context.Context, db Querier) (users []User, err error) {
+	ctx, end := startOperation(ctx, "ListUsers")
+	defer func() { err = end(err) }()
+
+	rows, err := db.QueryContext(ctx, `SELECT id, username, role FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users = make([]User, 0)
+	for rows.Next() {
+		var u User
+		if err = rows.Scan(&u.Id, &u.Username, &u.Role); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// LockoutPolicy locks accounts after Threshold consecutive login failures, for Duration,
+// doubled with every further failure up to MaxDuration. A Threshold of 0 disables it
+type LockoutPolicy struct {
+	Threshold   int
+	Duration    time.Duration
+	MaxDuration time.Duration
+}
+
+// LoginFailed counts a login failure of the user, returning how long it is locked for (0 if not
+// locked). Unknown users are never locked
+func (u *User) LoginFailed(ctx context.Context, db Querier, p LockoutPolicy) (lockedFor time.Duration, err error) {
+	ctx, end := startOperation(ctx, "LoginFailed")
+	defer func() { err = end(err) }()
+
+	threshold := p.Threshold
+	if threshold <= 0 {
+		threshold = math.MaxInt32
+	}
+	var seconds sql.NullFloat64
+	err = db.QueryRowContext(ctx, `
+		UPDATE users SET
+		failedLogins = failedLogins + 1,
+		lockedUntil = CASE WHEN failedLogins + 1 >= $2
+			THEN NOW() + make_interval(secs => LEAST($3::float8 * POWER(2, LEAST(failedLogins + 1 - $2, 30)), $4::float8))
+			ELSE lockedUntil END
+		WHERE username = $1
+		RETURNING EXTRACT(EPOCH FROM lockedUntil - NOW())
+		`, u.Username, threshold, p.Duration.Seconds(), p.MaxDuration.Seconds()).Scan(&seconds)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil || !seconds.Valid || seconds.Float64 <= 0 {
+		return 0, err
+	}
+	return retryDuration(seconds.Float64), nil
+}
+
+// LoginSucceeded resets the failures of the user
+func (u *User) LoginSucceeded(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "LoginSucceeded")
+	defer func() { err = end(err) }()
+
+	_, err = db.ExecContext(ctx, `
+		UPDATE users SET failedLogins = 0, lockedUntil = NULL
+		WHERE username = $1 AND (failedLogins > 0 OR lockedUntil IS NOT NULL)
+		`, u.Username)
+	return err
+}
+
+// LockedFor returns how long the user is still locked for (0 if not locked)
+func (u *User) LockedFor(ctx context.Context, db Querier) (lockedFor time.Duration, err error) {
+	ctx, end := startOperation(ctx, "LockedFor")
+	defer func() { err = end(err) }()
+
+	var seconds sql.NullFloat64
+	err = db.QueryRowContext(ctx, `
+		SELECT EXTRACT(EPOCH FROM lockedUntil - NOW()) FROM users
+		WHERE username = $1
+		`, u.Username).Scan(&seconds)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil || !seconds.Valid || seconds.Float64 <= 0 {
+		return 0, err
+	}
+	return retryDuration(seconds.Float64), nil
+}
+
+// Unlock resets the failures of the user, unlocking it
+func (u *User) Unlock(ctx context.Context, db Querier) (err error) {
+	ctx, end := startOperation(ctx, "Unlock")
+	defer func() { err = end(err) }()
+
+	res, err := db.ExecContext(ctx, `
+		UPDATE users SET failedLogins = 0, lockedUntil = NULL
+		WHERE username = $1
+		`, u.Username)
+	return checkUserUpdated(res, err)
+}
+
+// ProvisionOIDCUser finds the user linked to the subject of the single sign-on issuer, or creates
+// it without password (so it can only login with single sign-on). Its role is updated if set. It
+// returns ErrUsernameTaken if the username belongs to another user: usernames are chosen by the
+// users in most providers, so existing users must link their identity with LinkOIDCUser instead
+func (u *User) ProvisionOIDCUser(ctx context.Context, db Querier, issuer, subject string) (err error) {
+	ctx, end := startOperation(ctx, "ProvisionOIDCUser")
+	defer func() { err = end(err) }()
+
+	// Usernames of linked users are kept, as they are shown in the customers they modified
+	err = db.QueryRowContext(ctx, `
+		UPDATE users SET role = COALESCE(NULLIF($3, ''), role)
+		WHERE oidcIssuer = $1 AND oidcSubject = $2
+		RETURNING id, username, role
+		`, issuer, subject, u.Role).Scan(&u.Id, &u.Username, &u.Role)
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	if u.Role == "" {
+		u.Role = RoleUser
+	}
+	err = db.QueryRowContext(ctx, `
+		INSERT INTO users (username, passwd, role, oidcIssuer, oidcSubject)
+		VALUES ($1, '', $2, $3, $4)
+		ON CONFLICT DO NOTHING
+		RETURNING id
+		`, u.Username, u.Role, issuer, subject).Scan(&u.Id)
+	if err == sql.ErrNoRows {
+		return ErrUsernameTaken
+	}
+	return err
+}
+
+// LinkOIDCUser links the subject of the single sign-on issuer to the user with the ID, keeping its
+// username and role. It returns ErrOIDCLinked if the user or the identity are already linked
+func (u *User) LinkOIDCUser(ctx context.Context, db Querier, issuer, subject string) (err error) {
+	ctx, end := startOperation(ctx, "LinkOIDCUser")
+	defer func() { err = end(err) }()
+
+	var linked bool
+	err = db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM users WHERE oidcIssuer = $1 AND oidcSubject = $2)
+		`, issuer, subject).Scan(&linked)
+	if err != nil {
+		return err
+	}
+	if linked {
+		return ErrOIDCLinked
+	}
+	err = db.QueryRowContext(ctx, `
+		UPDATE users SET oidcIssuer = $1, oidcSubject = $2
+		WHERE id = $3 AND oidcSubject IS NULL
+		RETURNING username, role
+		`, issuer, subject, u.Id).Scan(&u.Username, &u.Role)
+	if err == sql.ErrNoRows {
+		return ErrOIDCLinked
+	}
+	return err
+}
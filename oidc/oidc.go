@@ -0,0 +1,353 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"theam.io/jdavidsanchez/test_crm_api/config"
+	"theam.io/jdavidsanchez/test_crm_api/models"
+)
+
+// Provider logs users in with the authorization code flow of an OpenID Connect provider, with
+// PKCE. Its configuration is discovered on first use, and its keys fetched when needed
+type Provider struct {
+	c           config.OIDC
+	adminGroups []string
+	userGroups  []string
+	client      *http.Client
+
+	mu            sync.Mutex
+	metadata      *metadata
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+}
+
+// Keys are fetched again for unknown kids (e.g. rotated by the provider), at most this often
+const keysRefetchInterval = 10 * time.Second
+
+func NewProvider(c config.OIDC) *Provider {
+	return &Provider{
+		c:           c,
+		adminGroups: config.List(c.AdminGroups),
+		userGroups:  config.List(c.UserGroups),
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Provider metadata, from its discovery document
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+	var m metadata
+	err := p.getJSON(ctx, strings.TrimSuffix(p.c.IssuerURL, "/")+"/.well-known/openid-configuration", &m)
+	if err != nil {
+		return nil, err
+	}
+	// The issuer must be the one configured, so its tokens cannot be mixed with another provider's
+	if m.Issuer != p.c.IssuerURL || m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+		return nil, fmt.Errorf("invalid discovery document of %s", p.c.IssuerURL)
+	}
+	p.metadata = &m
+	return p.metadata, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// Challenge returns the PKCE code challenge of the verifier (S256 method)
+func Challenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// AuthCodeURL returns the URL of the provider to redirect the user to
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.c.ClientID},
+		"redirect_uri":          {p.c.RedirectURL},
+		"scope":                 {p.c.Scopes},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {Challenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(m.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return m.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Identity of a user authenticated by the provider
+type Identity struct {
+	Issuer   string
+	Subject  string
+	Username string
+	Groups   []string
+}
+
+var ErrNotAllowed = errors.New("User not allowed to login")
+
+// Role returns the role of the user from its groups, or ErrNotAllowed if it cannot login
+func (p *Provider) Role(i Identity) (string, error) {
+	if memberOf(i.Groups, p.adminGroups) {
+		return models.RoleAdmin, nil
+	}
+	if len(p.userGroups) > 0 && !memberOf(i.Groups, p.userGroups) {
+		return "", ErrNotAllowed
+	}
+	return models.RoleUser, nil
+}
+
+func memberOf(groups, any []string) bool {
+	for _, g := range groups {
+		for _, a := range any {
+			if g == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Login exchanges the code of the callback for an ID token, returning the identity of its user
+func (p *Provider) Login(ctx context.Context, code, verifier, nonce string) (Identity, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+	rawIDToken, err := p.exchange(ctx, m, code, verifier)
+	if err != nil {
+		return Identity{}, err
+	}
+	return p.verify(ctx, m, rawIDToken, nonce)
+}
+
+func (p *Provider) exchange(ctx context.Context, m *metadata, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.c.RedirectURL},
+		"client_id":     {p.c.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// Public clients (without secret) are authenticated with PKCE only
+	if p.c.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.c.ClientID), url.QueryEscape(p.c.ClientSecret))
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("invalid token response: %s", err.Error())
+	}
+	if res.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("token request failed: %s %s %s", res.Status, body.Error, body.ErrorDescription)
+	}
+	return body.IDToken, nil
+}
+
+// Verifies the signature and the claims of the ID token
+func (p *Provider) verify(ctx context.Context, m *metadata, rawIDToken, nonce string) (Identity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := p.key(ctx, m, kid)
+		if err != nil {
+			return nil, err
+		}
+		// Only the algorithms of the key type, never HMAC (signed with a public value) or none
+		switch key.(type) {
+		case *rsa.PublicKey:
+			if _, ok := token.Method.(*jwt.SigningMethodRSA); ok {
+				return key, nil
+			}
+		case *ecdsa.PublicKey:
+			if _, ok := token.Method.(*jwt.SigningMethodECDSA); ok {
+				return key, nil
+			}
+		}
+		return nil, errors.New("unexpected signing algorithm " + token.Method.Alg())
+	})
+	if err != nil {
+		return Identity{}, fmt.Errorf("invalid ID token: %s", err.Error())
+	}
+
+	if iss, _ := claims["iss"].(string); iss != m.Issuer {
+		return Identity{}, errors.New("invalid ID token: unexpected issuer " + iss)
+	}
+	if !claims.VerifyAudience(p.c.ClientID, true) && !containsString(claims["aud"], p.c.ClientID) {
+		return Identity{}, errors.New("invalid ID token: not issued for this client")
+	}
+	if _, ok := claims["exp"]; !ok {
+		return Identity{}, errors.New("invalid ID token: without expiration")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return Identity{}, errors.New("invalid ID token: unexpected nonce")
+	}
+
+	i := Identity{Issuer: m.Issuer}
+	i.Subject, _ = claims["sub"].(string)
+	i.Username, _ = claims["preferred_username"].(string)
+	if i.Subject == "" || i.Username == "" {
+		return Identity{}, errors.New("invalid ID token: without sub or preferred_username")
+	}
+	switch groups := claims[p.c.GroupsClaim].(type) {
+	case string:
+		i.Groups = []string{groups}
+	case []interface{}:
+		for _, g := range groups {
+			if group, ok := g.(string); ok {
+				i.Groups = append(i.Groups, group)
+			}
+		}
+	}
+	return i, nil
+}
+
+// The aud claim can be an array, which jwt-go only accepts as a string
+func containsString(value interface{}, s string) bool {
+	values, _ := value.([]interface{})
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the key of the provider with the kid, fetching the keys again if unknown
+func (p *Provider) key(ctx context.Context, m *metadata, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetchedAt) < keysRefetchInterval {
+		return nil, errors.New("unknown key " + kid)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, m.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if key, err := k.publicKey(); err == nil && (k.Use == "" || k.Use == "sig") {
+			p.keys[k.Kid] = key
+		}
+	}
+	p.keysFetchedAt = time.Now()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errors.New("unknown key " + kid)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+var curves = map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b), err
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, errors.New("unsupported curve " + k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.New("unsupported key type " + k.Kty)
+}
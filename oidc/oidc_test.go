@@ -0,0 +1,97 @@
+package oidc_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"theam.io/jdavidsanchez/test_crm_api/config"
+	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/oidc"
+	"theam.io/jdavidsanchez/test_crm_api/oidc/oidctest"
+)
+
+func newProvider(t *testing.T) (*oidctest.Provider, *oidc.Provider) {
+	mock := oidctest.NewProvider("crm", "crm_secret")
+	t.Cleanup(mock.Close)
+	c := config.Default().OIDC
+	c.IssuerURL = mock.URL
+	c.ClientID = "crm"
+	c.ClientSecret = "crm_secret"
+	c.RedirectURL = "http://crm.test/users/oidc/callback"
+	c.AdminGroups = "crm-admins, it"
+	c.UserGroups = "crm-users"
+	return mock, oidc.NewProvider(c)
+}
+
+// Runs the authorization request, returning the code of the callback
+func authorize(t *testing.T, p *oidc.Provider, state, nonce, verifier string) string {
+	t.Helper()
+	authURL, err := p.AuthCodeURL(context.Background(), state, nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	response, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	callback, err := url.Parse(response.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(callback.String(), "http://crm.test/users/oidc/callback?") {
+		t.Fatalf("Unexpected redirect %d to %s", response.StatusCode, response.Header.Get("Location"))
+	}
+	if got := callback.Query().Get("state"); got != state {
+		t.Errorf("Expected the state %s. Got %s", state, got)
+	}
+	return callback.Query().Get("code")
+}
+
+func TestLogin(t *testing.T) {
+	mock, p := newProvider(t)
+	mock.SetUser(oidctest.User{Subject: "1234", Username: "jane", Groups: []string{"crm-users", "it"}})
+
+	code := authorize(t, p, "state", "nonce", "verifier_verifier_verifier_verifier_verifier")
+	i, err := p.Login(context.Background(), code, "verifier_verifier_verifier_verifier_verifier", "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Issuer != mock.URL || i.Subject != "1234" || i.Username != "jane" || len(i.Groups) != 2 {
+		t.Errorf("Unexpected identity %+v", i)
+	}
+	if role, err := p.Role(i); role != models.RoleAdmin || err != nil {
+		t.Errorf("Expected the it group to be admins. Got %s (%v)", role, err)
+	}
+
+	// Codes can only be used once
+	if _, err = p.Login(context.Background(), code, "verifier_verifier_verifier_verifier_verifier", "nonce"); err == nil {
+		t.Errorf("Expected a used code to be refused")
+	}
+}
+
+func TestLoginRefused(t *testing.T) {
+	mock, p := newProvider(t)
+	mock.SetUser(oidctest.User{Subject: "5678", Username: "john"})
+
+	code := authorize(t, p, "state", "nonce", "verifier_verifier_verifier_verifier_verifier")
+	if _, err := p.Login(context.Background(), code, "another_verifier_another_verifier_another", "nonce"); err == nil {
+		t.Errorf("Expected a wrong code verifier to be refused")
+	}
+
+	code = authorize(t, p, "state", "nonce", "verifier_verifier_verifier_verifier_verifier")
+	_, err := p.Login(context.Background(), code, "verifier_verifier_verifier_verifier_verifier", "another_nonce")
+	if err == nil || !strings.Contains(err.Error(), "nonce") {
+		t.Errorf("Expected a wrong nonce to be refused. Got %v", err)
+	}
+
+	code = authorize(t, p, "state", "nonce", "verifier_verifier_verifier_verifier_verifier")
+	i, err := p.Login(context.Background(), code, "verifier_verifier_verifier_verifier_verifier", "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = p.Role(i); err != oidc.ErrNotAllowed {
+		t.Errorf("Expected users out of the user groups to be refused. Got %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+// Package passwd hashes the passwords of the users with bcrypt or argon2id, and checks the new
+// ones against the password policy
+package passwd
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"theam.io/jdavidsanchez/test_crm_api/config"
+)
+
+const (
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+)
+
+// bcrypt only uses the first 72 bytes of the passwords, so longer ones are refused instead of
+// being silently truncated
+const bcryptMaxLength = 72
+
+// Hashing megabytes is cheap, but there is no reason to accept them
+const maxLength = 1024
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+var settings = config.Default().Passwords
+var breached = map[string]bool{} // SHA-1 hashes, in hexadecimal uppercase
+
+// Configure sets the algorithm of the new hashes and the policy of the new passwords, loading the
+// breached passwords list
+func Configure(c config.Passwords) error {
+	list, err := loadBreachedList(c.BreachedList)
+	if err != nil {
+		return err
+	}
+	settings, breached = c, list
+	return nil
+}
+
+// Settings returns the configuration in use
+func Settings() config.Passwords {
+	return settings
+}
+
+// The list has a password per line, or the SHA-1 hash of a password (optionally followed by
+// :count, as in the lists of Have I Been Pwned)
+func loadBreachedList(name string) (map[string]bool, error) {
+	list := map[string]bool{}
+	if name == "" {
+		return list, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the breached passwords list: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		hash := strings.SplitN(line, ":", 2)[0]
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 2*sha1.Size {
+			hash = sha1Hex(line)
+		}
+		list[strings.ToUpper(hash)] = true
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read the breached passwords list: %w", err)
+	}
+	return list, nil
+}
+
+func sha1Hex(password string) string {
+	hash := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(hash[:]))
+}
+
+// Check validates a new password of the user against the policy, returning the reason it is
+// refused, meant to be shown to the user
+func Check(username, password string) error {
+	if utf8.RuneCountInString(password) < settings.MinLength {
+		return fmt.Errorf("Password less than %d characters", settings.MinLength)
+	}
+	if max := maxBytes(); len(password) > max {
+		return fmt.Errorf("Password longer than %d bytes", max)
+	}
+	if breached[sha1Hex(password)] {
+		return errors.New("Password found in a list of breached passwords")
+	}
+	if similar(username, password) {
+		return errors.New("Password too similar to the username")
+	}
+	return nil
+}
+
+func maxBytes() int {
+	if strings.EqualFold(settings.Algorithm, Bcrypt) {
+		return bcryptMaxLength
+	}
+	return maxLength
+}
+
+// Passwords containing the username (or reversed), or a few edits away from it
+func similar(username, password string) bool {
+	u, p := []rune(strings.ToLower(username)), []rune(strings.ToLower(password))
+	if len(u) == 0 {
+		return false
+	}
+	reversed := make([]rune, len(u))
+	for i, r := range u {
+		reversed[len(u)-1-i] = r
+	}
+	if len(u) >= 3 && (strings.Contains(string(p), string(u)) || strings.Contains(string(p), string(reversed))) {
+		return true
+	}
+	return distance(u, p) <= len(p)/3
+}
+
+// Levenshtein distance
+func distance(a, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = smallest(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func smallest(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// ErrTooLong is returned when hashing a password longer than the algorithm supports
+var ErrTooLong = errors.New("Password too long")
+
+// Hash hashes the password with the configured algorithm
+func Hash(password string) (string, error) {
+	if len(password) > maxBytes() {
+		return "", ErrTooLong
+	}
+	if strings.EqualFold(settings.Algorithm, Bcrypt) {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), settings.BcryptCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	p := argon2Params{settings.Argon2Memory, settings.Argon2Iterations, settings.Argon2Parallelism}
+	key := argon2.IDKey([]byte(password), salt, uint32(p.iterations), uint32(p.memory), uint8(p.parallelism), argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.memory, p.iterations, p.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+type argon2Params struct {
+	memory, iterations, parallelism int
+}
+
+// Verify checks the password against its hash, and whether it must be hashed again as the hash
+// was not made with the configured algorithm and cost. Empty hashes (unknown users, or users
+// without password) never match, but the password is hashed anyway so it takes as long
+func Verify(hash, password string) (ok bool, rehash bool, err error) {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		ok, p, err := verifyArgon2id(hash, password)
+		current := argon2Params{settings.Argon2Memory, settings.Argon2Iterations, settings.Argon2Parallelism}
+		return ok, ok && (!strings.EqualFold(settings.Algorithm, Argon2id) || p != current), err
+	case strings.HasPrefix(hash, "$2"):
+		// Hashes from before the limit was enforced were made with the first 72 bytes only
+		if len(password) > bcryptMaxLength {
+			password = password[:bcryptMaxLength]
+		}
+		err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, false, nil
+		} else if err != nil {
+			return false, false, err
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		return true, !strings.EqualFold(settings.Algorithm, Bcrypt) || cost != settings.BcryptCost, err
+	case hash == "":
+		if len(password) > maxBytes() {
+			password = password[:maxBytes()]
+		}
+		_, err = Hash(password)
+		return false, false, err
+	}
+	return false, false, errors.New("Unknown password hash algorithm")
+}
+
+func verifyArgon2id(hash, password string) (bool, argon2Params, error) {
+	var p argon2Params
+	var version int
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, p, errors.New("Invalid argon2id hash")
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, p, errors.New("Unsupported argon2id version")
+	}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism)
+	if err != nil || p.iterations < 1 || p.parallelism < 1 || p.parallelism > 255 || p.memory < 8*p.parallelism {
+		return false, p, errors.New("Invalid argon2id parameters")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, p, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, p, err
+	}
+	other := argon2.IDKey([]byte(password), salt, uint32(p.iterations), uint32(p.memory), uint8(p.parallelism), uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, p, nil
+}
@@ -0,0 +1,127 @@
+package passwd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"theam.io/jdavidsanchez/test_crm_api/config"
+)
+
+func configure(t *testing.T, update func(c *config.Passwords)) {
+	t.Helper()
+	c := config.Default().Passwords
+	c.BcryptCost = 4
+	c.Argon2Memory, c.Argon2Iterations, c.Argon2Parallelism = 64, 1, 1
+	if update != nil {
+		update(&c)
+	}
+	if err := Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Configure(config.Default().Passwords) })
+}
+
+func TestHashAndVerify(t *testing.T) {
+	for _, algorithm := range []string{Bcrypt, Argon2id} {
+		configure(t, func(c *config.Passwords) { c.Algorithm = algorithm })
+		hash, err := Hash("correct horse battery")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, rehash, err := Verify(hash, "correct horse battery"); !ok || rehash || err != nil {
+			t.Errorf("%s: expected a valid password without rehash. Got %t, %t, %v", algorithm, ok, rehash, err)
+		}
+		if ok, _, err := Verify(hash, "correct horse staple"); ok || err != nil {
+			t.Errorf("%s: expected a wrong password to fail. Got %t, %v", algorithm, ok, err)
+		}
+	}
+
+	if ok, _, err := Verify("", "correct horse battery"); ok || err != nil {
+		t.Errorf("Expected an empty hash to never match. Got %t, %v", ok, err)
+	}
+	if _, _, err := Verify("$argon2id$v=19$m=0,t=0,p=0$AAAA$AAAA", "correct horse battery"); err == nil {
+		t.Errorf("Expected invalid argon2id parameters to be refused")
+	}
+}
+
+func TestRehash(t *testing.T) {
+	configure(t, nil)
+	hash, _ := Hash("correct horse battery")
+
+	configure(t, func(c *config.Passwords) { c.BcryptCost = 5 })
+	if ok, rehash, _ := Verify(hash, "correct horse battery"); !ok || !rehash {
+		t.Errorf("Expected a rehash when the bcrypt cost changes")
+	}
+	configure(t, func(c *config.Passwords) { c.Algorithm = Argon2id })
+	if ok, rehash, _ := Verify(hash, "correct horse battery"); !ok || !rehash {
+		t.Errorf("Expected a rehash when the algorithm changes")
+	}
+	hash, _ = Hash("correct horse battery")
+	configure(t, func(c *config.Passwords) { c.Algorithm, c.Argon2Iterations = Argon2id, 2 })
+	if ok, rehash, _ := Verify(hash, "correct horse battery"); !ok || !rehash {
+		t.Errorf("Expected a rehash when the argon2id parameters change")
+	}
+	if ok, rehash, _ := Verify(hash, "correct horse staple"); ok || rehash {
+		t.Errorf("Expected no rehash with a wrong password")
+	}
+}
+
+func TestBcryptLimit(t *testing.T) {
+	configure(t, nil)
+	long := strings.Repeat("a", 73)
+	if _, err := Hash(long); err != ErrTooLong {
+		t.Errorf("Expected passwords over 72 bytes to be refused. Got %v", err)
+	}
+	if err := Check("user", long); err == nil || !strings.Contains(err.Error(), "72 bytes") {
+		t.Errorf("Expected the policy to refuse passwords over 72 bytes. Got %v", err)
+	}
+
+	configure(t, func(c *config.Passwords) { c.Algorithm = Argon2id })
+	hash, err := Hash(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, _ := Verify(hash, strings.Repeat("a", 72)); ok {
+		t.Errorf("Expected argon2id to use the whole password")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "passwd-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	list := filepath.Join(dir, "breached.txt")
+	// A password, and the SHA-1 hash of "correct horse battery staple" with its count
+	content := "password123456\r\nabf7aad6438836dbe526aa231abde2d0eef74d42:42\n"
+	if err = ioutil.WriteFile(list, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configure(t, func(c *config.Passwords) { c.BreachedList = list })
+
+	for _, test := range []struct {
+		username, password, err string
+	}{
+		{"alice", "short", "Password less than 12 characters"},
+		{"alice", "password123456", "Password found in a list of breached passwords"},
+		{"alice", "correct horse battery staple", "Password found in a list of breached passwords"},
+		{"alice", "my-ALICE-password", "Password too similar to the username"},
+		{"alice", "my-ecila-password", "Password too similar to the username"},
+		{"longusername1", "longusername", "Password too similar to the username"},
+		{"alice", "correct horse battery", ""},
+		{"", "correct horse battery", ""},
+	} {
+		err := Check(test.username, test.password)
+		if (err == nil && test.err != "") || (err != nil && err.Error() != test.err) {
+			t.Errorf("%s/%s: expected %q. Got %v", test.username, test.password, test.err, err)
+		}
+	}
+
+	if err = Configure(config.Passwords{BreachedList: filepath.Join(dir, "missing.txt")}); err == nil {
+		t.Errorf("Expected a missing list to be an error")
+	}
+}
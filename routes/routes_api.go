@@ -1,59 +1,217 @@
 package routes
 
 import (
-	"flag"
+	"context"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"theam.io/jdavidsanchez/test_crm_api/auth"
+	"theam.io/jdavidsanchez/test_crm_api/config"
+	"theam.io/jdavidsanchez/test_crm_api/logging"
+	"theam.io/jdavidsanchez/test_crm_api/mailer"
+	"theam.io/jdavidsanchez/test_crm_api/metrics"
+	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/oidc"
+	"theam.io/jdavidsanchez/test_crm_api/tracing"
 	"theam.io/jdavidsanchez/test_crm_api/utils"
 )
 
-var Router = mux.NewRouter()
+// Server is the API, whose handlers use the repositories of its store
+type Server struct {
+	Router *mux.Router
+	Store  models.Store
+	ready  int32
+	// The router wrapped by the middlewares that must see every request, including the 404s
+	handler http.Handler
+	// Usernames of the password reset requests, mailed by SendPasswordResets
+	passwordResets chan string
+}
+
+// NewServer returns the API, ready to serve requests with the given store
+func NewServer(store models.Store) *Server {
+	s := &Server{
+		Router: mux.NewRouter(),
+		Store:  store,
+		ready:  1,
+
+		passwordResets: make(chan string, passwordResetQueueSize),
+	}
+	s.initRouter()
+	s.registerMetrics()
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+var publicDir = "./public/" // Directory to serve the homepage
+var jwksMaxAge = time.Minute
+
+// Configure sets the homepage directory and the settings of the routes. It must be called before NewServer
+func Configure(c *config.Config) {
+	publicDir = c.Server.PublicDir
+	uploadExpiration = c.Uploads.Expiration
+	useGeneratedAvatars = c.Uploads.PictureFallback != "placeholder"
+	metricsToken = c.Metrics.Token
+	loginLimits = c.Login
+	twoFactor = c.TwoFactor
+	passwords = c.Passwords
+	passwordMailer = mailer.New(c.Mail)
+	jwksMaxAge = c.Auth.KeyRefreshInterval
+	oidcProvider = nil
+	if c.OIDC.Enabled() {
+		oidcProvider = oidc.NewProvider(c.OIDC)
+	}
+}
+
 var notFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 	utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": "Not found"})
 })
 
-func InitRouter() {
-	// As it is an API, handle invalid routes with a JSON-formatted 404 Not Found
-	Router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": "Not found"})
-	})
+// Non-standard status (from nginx) logged for the requests cancelled by the client,
+// which will never receive the response anyway
+const statusClientClosedRequest = 499
 
+// Logs the error with the request ID before sending it as the response. Cancelled requests and
+// database timeouts are not internal errors, so they get their own status codes
+func internalError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == models.ErrCanceled || r.Context().Err() == context.Canceled {
+		logging.Warn(r.Context(), "Request cancelled", logging.Fields{"path": r.URL.Path, "error": err.Error()})
+		utils.ResponseJSON(w, statusClientClosedRequest, map[string]string{"error": models.ErrCanceled.Error()})
+		return
+	}
+	if err == models.ErrTimeout {
+		logging.Error(r.Context(), "Database timeout", err, logging.Fields{"path": r.URL.Path})
+		utils.ResponseJSON(w, http.StatusGatewayTimeout, map[string]string{"error": err.Error()})
+		return
+	}
+	logging.Error(r.Context(), "Internal error", err, logging.Fields{"path": r.URL.Path})
+	utils.ResponseJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+}
+
+func (s *Server) initRouter() {
 	// Customer subroute for the API
-	customers := Router.PathPrefix("/customers").Subrouter()
-
-	customers.HandleFunc("/all", listAllCustomers).Methods("GET")
-	customers.HandleFunc("/{customerId:[0-9]+}", getCustomer).Methods("GET")
-	customers.HandleFunc("/", createCustomer).Methods("POST")
-	customers.HandleFunc("/{customerId:[0-9]+}", updateCustomer).Methods("PUT")
-	customers.HandleFunc("/{customerId:[0-9]+}", deleteCustomer).Methods("DELETE")
-	customers.HandleFunc("/picture/{pictureId:[0-9]+}", getPicturePath).Methods("GET")
-	customers.HandleFunc("/picture", addPicture).Methods("POST")
+	customers := s.Router.PathPrefix("/customers").Subrouter()
+
+	// API keys are restricted to their scopes
+	read := func(h http.HandlerFunc) http.HandlerFunc { return auth.RequireScope(models.ScopeReadCustomers, h) }
+	write := func(h http.HandlerFunc) http.HandlerFunc { return auth.RequireScope(models.ScopeWriteCustomers, h) }
+	upload := func(h http.HandlerFunc) http.HandlerFunc { return auth.RequireScope(models.ScopeUploadPictures, h) }
+
+	customers.HandleFunc("/all", read(s.listAllCustomers)).Methods("GET")
+	customers.HandleFunc("/{customerId:[0-9]+}", read(s.getCustomer)).Methods("GET")
+	customers.HandleFunc("/", write(s.createCustomer)).Methods("POST")
+	customers.HandleFunc("/{customerId:[0-9]+}", write(s.updateCustomer)).Methods("PUT")
+	customers.HandleFunc("/{customerId:[0-9]+}", write(s.deleteCustomer)).Methods("DELETE")
+	customers.HandleFunc("/reassign", write(s.reassignCustomers)).Methods("POST")
+	customers.HandleFunc("/picture/{pictureId:[0-9]+}", read(s.getPicturePath)).Methods("GET")
+	customers.HandleFunc("/picture", upload(s.addPicture)).Methods("POST")
+	// Resumable picture uploads (tus protocol)
+	uploads := customers.PathPrefix("/picture/uploads").Subrouter()
+	uploads.Use(tusResumable)
+	uploads.HandleFunc("", uploadOptions).Methods("OPTIONS")
+	uploads.HandleFunc("", upload(s.createUpload)).Methods("POST")
+	uploads.HandleFunc("/{uploadId:[0-9a-f]+}", upload(s.getUploadStatus)).Methods("HEAD")
+	uploads.HandleFunc("/{uploadId:[0-9a-f]+}", upload(s.patchUpload)).Methods("PATCH")
+	uploads.HandleFunc("/{uploadId:[0-9a-f]+}", upload(s.deleteUpload)).Methods("DELETE")
+	uploads.NotFoundHandler = notFoundHandler
+	customers.HandleFunc("/{customerId:[0-9]+}/attachments", read(s.listAttachments)).Methods("GET")
+	customers.HandleFunc("/{customerId:[0-9]+}/attachments", write(s.uploadAttachment)).Methods("POST")
+	customers.HandleFunc("/{customerId:[0-9]+}/attachments/{attachmentId:[0-9]+}", read(s.downloadAttachment)).Methods("GET")
+	customers.HandleFunc("/{customerId:[0-9]+}/attachments/{attachmentId:[0-9]+}/primary", write(s.setPrimaryAttachment)).Methods("PUT")
+	customers.HandleFunc("/{customerId:[0-9]+}/attachments/{attachmentId:[0-9]+}", write(s.deleteAttachment)).Methods("DELETE")
 	// User authentication
-	users := Router.PathPrefix("/users").Subrouter()
+	users := s.Router.PathPrefix("/users").Subrouter()
+
+	users.HandleFunc("/register", s.registerUser).Methods("POST")
+	users.HandleFunc("/login", s.loginUser).Methods("POST")
+	users.HandleFunc("/login/2fa", s.loginTwoFactor).Methods("POST")
+	users.HandleFunc("/password/forgot", s.forgotPassword).Methods("POST")
+	users.HandleFunc("/password/reset", s.resetPassword).Methods("POST")
+	users.HandleFunc("/token/refresh", s.refreshToken).Methods("POST")
+	// Single sign-on, redirecting to the identity provider and back
+	users.HandleFunc("/oidc/login", s.oidcLogin).Methods("GET")
+	users.HandleFunc("/oidc/callback", s.oidcCallback).Methods("GET")
+	// Lockout of any user, managed by the admins. Before the other subroutes, so any username matches
+	locks := users.PathPrefix("/{username}/lock").Subrouter()
+	locks.HandleFunc("", s.unlockUser).Methods("DELETE")
+	// API keys of the authenticated user
+	keys := users.PathPrefix("/keys").Subrouter()
+	keys.HandleFunc("", s.createAPIKey).Methods("POST")
+	keys.HandleFunc("", s.listAPIKeys).Methods("GET")
+	keys.HandleFunc("/{keyId:[0-9]+}", s.revokeAPIKey).Methods("DELETE")
+	// Account of the authenticated user
+	me := users.PathPrefix("/me").Subrouter()
+	me.HandleFunc("", s.getMe).Methods("GET")
+	me.HandleFunc("/password", s.changePassword).Methods("POST")
+	me.HandleFunc("/sessions", s.listSessions).Methods("GET")
+	me.HandleFunc("/sessions/{sessionId:[0-9a-f]+}", s.revokeSession).Methods("DELETE")
+	me.HandleFunc("/organizations", s.listMyOrganizations).Methods("GET")
+	me.HandleFunc("/organization", s.switchOrganization).Methods("PUT")
+	me.HandleFunc("/oidc", s.linkOIDC).Methods("POST")
+	// Two-factor authentication of the authenticated user
+	twoFactor := users.PathPrefix("/2fa").Subrouter()
+	twoFactor.HandleFunc("", s.getTwoFactor).Methods("GET")
+	twoFactor.HandleFunc("", s.disableTwoFactor).Methods("DELETE")
+	twoFactor.HandleFunc("/enroll", s.enrollTwoFactor).Methods("POST")
+	twoFactor.HandleFunc("/verify", s.verifyTwoFactor).Methods("POST")
+	twoFactor.HandleFunc("/recovery-codes", s.regenerateRecoveryCodes).Methods("POST")
+
+	// Organizations and their members, managed by the admins
+	organizations := s.Router.PathPrefix("/organizations").Subrouter()
+	organizations.HandleFunc("", s.listOrganizations).Methods("GET")
+	organizations.HandleFunc("", s.createOrganization).Methods("POST")
+	organizations.HandleFunc("/{orgId:[0-9]+}/members", s.listMembers).Methods("GET")
+	organizations.HandleFunc("/{orgId:[0-9]+}/members/{username}", s.addMember).Methods("PUT")
+	organizations.HandleFunc("/{orgId:[0-9]+}/members/{username}", s.removeMember).Methods("DELETE")
+	// Teams of the organization of the request, sharing customers
+	teams := s.Router.PathPrefix("/teams").Subrouter()
+	teams.HandleFunc("", s.listTeams).Methods("GET")
+	teams.HandleFunc("", s.createTeam).Methods("POST")
+	teams.HandleFunc("/{teamId:[0-9]+}", s.deleteTeam).Methods("DELETE")
+	teams.HandleFunc("/{teamId:[0-9]+}/members/{username}", s.addTeamMember).Methods("PUT")
+	teams.HandleFunc("/{teamId:[0-9]+}/members/{username}", s.removeTeamMember).Methods("DELETE")
 
-	users.HandleFunc("/register", registerUser).Methods("POST")
-	users.HandleFunc("/login", loginUser).Methods("POST")
+	// Public keys of the tokens, for the services verifying them
+	s.Router.HandleFunc("/.well-known/jwks.json", jwks).Methods("GET")
+
+	// Probes for the orchestrator
+	s.Router.HandleFunc("/healthz", liveness).Methods("GET")
+	s.Router.HandleFunc("/readyz", s.readiness).Methods("GET")
+	s.Router.Handle("/metrics", metricsHandler()).Methods("GET")
+
+	// Generated avatars for customers without picture
+	s.Router.HandleFunc("/"+utils.PathAvatars+"/{initials}-{color:[0-9a-f]{6}}.svg", getAvatar).Methods("GET")
 
 	// Static files (customer pictures)
-	var dir string
-	flag.StringVar(&dir, "images", "./"+utils.PathToImagesDir+"/", "Directory to serve the images")
-	Router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir(dir))))
+	s.Router.PathPrefix("/static/").Handler(auth.ValidateSignedURL(http.StripPrefix("/static/", http.FileServer(http.Dir(utils.ImagesDir)))))
+
+	// Register JWT and API key middleware
+	customers.Use(auth.ValidateToken(s.Store))
+	customers.Use(auth.RequireOrganization)
+	keys.Use(auth.ValidateToken(s.Store))
+	locks.Use(auth.ValidateToken(s.Store))
+	me.Use(auth.ValidateToken(s.Store))
+	organizations.Use(auth.ValidateToken(s.Store))
+	teams.Use(auth.ValidateToken(s.Store))
+	teams.Use(auth.RequireOrganization)
+	twoFactor.Use(auth.ValidateEnrollmentToken(s.Store))
 
-	// Register JWT middleware
-	customers.Use(auth.ValidateToken)
+	// Trace, log and record the metrics of every request, under the template of its route
+	s.Router.Use(utils.SetRoute)
+	s.handler = utils.WithRoute(tracing.Middleware(logging.Middleware(metrics.Middleware(s.Router))))
 
-	var publicDir string
-	flag.StringVar(&publicDir, "public", "./public/", "Directory to serve the homepage")
-	Router.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir(publicDir))))
+	s.Router.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir(publicDir))))
 
 	// As it is an API, handle invalid routes with a JSON-formatted 404 Not Found
-	Router.NotFoundHandler = notFoundHandler
+	s.Router.NotFoundHandler = notFoundHandler
 	customers.NotFoundHandler = notFoundHandler
 	users.NotFoundHandler = notFoundHandler
+	keys.NotFoundHandler = notFoundHandler
+	locks.NotFoundHandler = notFoundHandler
+	organizations.NotFoundHandler = notFoundHandler
+	teams.NotFoundHandler = notFoundHandler
+	twoFactor.NotFoundHandler = notFoundHandler
 }
-
-func rootHandler(w http.ResponseWriter, r *http.Request) {
-
-}
\ No newline at end of file
@@ -0,0 +1,163 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"theam.io/jdavidsanchez/test_crm_api/auth"
+	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+/*************
+API key routes
+**************/
+
+type apiKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+	Username  string     `json:"username"` // Only admins can create keys for other users
+}
+
+// The key is only sent when created, afterwards only its prefix is known
+type createdAPIKey struct {
+	models.APIKey
+	Key string `json:"key"`
+}
+
+// Returns the user managing the keys. API keys cannot manage keys, so a leaked key cannot be
+// used to create new ones, and the response is already sent if the user is not found
+func (s *Server) apiKeysUser(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	i, _ := auth.GetIdentity(r.Context())
+	if i.APIKey != nil {
+		utils.ResponseJSON(w, http.StatusForbidden, map[string]string{"error": "API keys cannot manage API keys"})
+		return models.User{}, false
+	}
+	u, err := s.Store.Users().Get(r.Context(), i.Username)
+	if err != nil {
+		internalError(w, r, err)
+		return models.User{}, false
+	}
+	return u, true
+}
+
+func (s *Server) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req apiKeyRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		return
+	}
+	defer r.Body.Close()
+
+	if len := utf8.RuneCountInString(req.Name); len == 0 || len > 64 {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "The name must have between 1 and 64 characters"})
+		return
+	}
+	if len(req.Scopes) == 0 {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "At least one scope is required"})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !models.ValidScope(scope) {
+			utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid scope " + scope})
+			return
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "The expiration must be in the future"})
+		return
+	}
+
+	u, ok := s.apiKeysUser(w, r)
+	if !ok {
+		return
+	}
+	if req.Username != "" && req.Username != u.Username {
+		if u.Role != models.RoleAdmin {
+			utils.ResponseJSON(w, http.StatusForbidden, map[string]string{"error": "Only admins can create keys for other users"})
+			return
+		}
+		u, err = s.Store.Users().Get(r.Context(), req.Username)
+		if err == sql.ErrNoRows {
+			utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": models.ErrUserNotFound.Error()})
+			return
+		}
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+	}
+
+	key, hash, prefix, err := auth.GenerateAPIKey()
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	// The key is limited to the active organization of the request, while its user is a member
+	i, _ := auth.GetIdentity(r.Context())
+	k := models.APIKey{UserId: u.Id, Name: req.Name, Prefix: prefix, Hash: hash, Scopes: req.Scopes, ExpiresAt: req.ExpiresAt,
+		OrganizationId: i.OrganizationId}
+	if err = s.Store.APIKeys().Create(r.Context(), &k); err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusCreated, createdAPIKey{APIKey: k, Key: key})
+}
+
+// Lists the keys of the user, or of every user for admins with ?all=true
+func (s *Server) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.apiKeysUser(w, r)
+	if !ok {
+		return
+	}
+	userId := u.Id
+	if r.URL.Query().Get("all") == "true" {
+		if u.Role != models.RoleAdmin {
+			utils.ResponseJSON(w, http.StatusForbidden, map[string]string{"error": "Only admins can list the keys of every user"})
+			return
+		}
+		userId = 0
+	}
+
+	keys, err := s.Store.APIKeys().List(r.Context(), userId)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusOK, keys)
+}
+
+// Revokes a key of the user, or of any user for admins
+func (s *Server) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["keyId"])
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid API key ID"})
+		return
+	}
+	u, ok := s.apiKeysUser(w, r)
+	if !ok {
+		return
+	}
+	userId := u.Id
+	if u.Role == models.RoleAdmin {
+		userId = 0
+	}
+
+	err = s.Store.APIKeys().Revoke(r.Context(), userId, id)
+	if err == models.ErrAPIKeyNotFound {
+		utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
@@ -0,0 +1,230 @@
+package routes
+
+import (
+	"database/sql"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"theam.io/jdavidsanchez/test_crm_api/auth"
+	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+/****************************
+Customer attachment routes
+*****************************/
+
+func (s *Server) listAttachments(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	customerId, err := strconv.Atoi(params["customerId"])
+
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid customer ID"})
+		return
+	}
+	if !s.checkCustomerFound(w, r, customerId) {
+		return
+	}
+
+	attachments, err := s.Store.Attachments().List(r.Context(), customerId)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusOK, attachments)
+}
+
+func (s *Server) uploadAttachment(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	customerId, err := strconv.Atoi(params["customerId"])
+
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid customer ID"})
+		return
+	}
+
+	if !s.checkCustomerFound(w, r, customerId) {
+		return
+	}
+
+	i, _ := auth.GetIdentity(r.Context())
+	userId := i.UserId
+
+	r.Body = http.MaxBytesReader(w, r.Body, utils.MaxAttachmentSize)
+	file, fields, err := utils.StreamFileUpload(r, "file", utils.PathToAttachmentsDir)
+	if err == utils.ErrFieldTooLong {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid data"})
+		return
+	}
+	uploadedBytes.WithLabelValues("attachment").Add(float64(file.Size))
+
+	a := models.Attachment{
+		CustomerId:       customerId,
+		Title:            fields["title"],
+		FileName:         file.FileName,
+		FilePath:         file.Path,
+		MimeType:         file.MimeType,
+		Size:             file.Size,
+		UploadedByUserId: userId,
+	}
+	if a.Title == "" {
+		a.Title = file.FileName
+	}
+
+	err = s.Store.Attachments().Add(r.Context(), &a)
+	if err != nil {
+		utils.CheckErr(os.Remove(file.Path))
+		if err == models.ErrCustomerNotFound {
+			utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusCreated, a)
+}
+
+func (s *Server) downloadAttachment(w http.ResponseWriter, r *http.Request) {
+	a, ok := s.getAttachmentFromParams(w, r)
+	if !ok {
+		return
+	}
+
+	f, err := os.Open(a.FilePath)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", a.MimeType)
+	// RFC 6266, with filename* for the names that are not plain ASCII
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": a.FileName})
+	if disposition == "" {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Disposition", disposition)
+	// ServeContent streams the file and supports range requests for resuming downloads
+	http.ServeContent(w, r, a.FileName, a.UploadedAt, f)
+}
+
+func (s *Server) setPrimaryAttachment(w http.ResponseWriter, r *http.Request) {
+	a, ok := s.getAttachmentFromParams(w, r)
+	if !ok {
+		return
+	}
+	if !a.IsImage() {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": models.ErrNotAnImage.Error()})
+		return
+	}
+
+	// The customer picture is a copy, so it is not affected if the attachment is deleted
+	f, err := os.Open(a.FilePath)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	pictureFileName, _, err := utils.SaveFile(utils.ImagesDir, a.FileName, f)
+	f.Close()
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	p := models.PicturePath{
+		Path: utils.PathFileServer + "/" + pictureFileName,
+	}
+
+	err = s.Store.InTx(r.Context(), func(tx models.Store) error {
+		return tx.Attachments().SetPrimary(r.Context(), &a, &p)
+	})
+	if err != nil {
+		utils.CheckErr(utils.RemoveUploadedFile(p.Path))
+		if err == models.ErrCustomerNotFound {
+			utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusOK, a)
+}
+
+func (s *Server) deleteAttachment(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	customerId, err := strconv.Atoi(params["customerId"])
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid customer ID"})
+		return
+	}
+	attachmentId, err := strconv.Atoi(params["attachmentId"])
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid attachment ID"})
+		return
+	}
+
+	var a models.Attachment
+	err = s.Store.InTx(r.Context(), func(tx models.Store) error {
+		a, err = tx.Attachments().Delete(r.Context(), customerId, attachmentId)
+		return err
+	})
+	if err == sql.ErrNoRows {
+		utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": "Attachment not found"})
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.CheckErr(os.Remove(a.FilePath))
+
+	utils.ResponseJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// Checks that the customer exists and the user can access it, writing the error response otherwise
+func (s *Server) checkCustomerFound(w http.ResponseWriter, r *http.Request, customerId int) bool {
+	_, err := s.Store.Customers().Get(r.Context(), customerId)
+	switch err {
+	case nil:
+		return true
+	case sql.ErrNoRows:
+		utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": "Customer not found"})
+	default:
+		internalError(w, r, err)
+	}
+	return false
+}
+
+// Gets the attachment of the request parameters, writing the error response if it fails
+func (s *Server) getAttachmentFromParams(w http.ResponseWriter, r *http.Request) (models.Attachment, bool) {
+	var a models.Attachment
+	params := mux.Vars(r)
+	customerId, err := strconv.Atoi(params["customerId"])
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid customer ID"})
+		return a, false
+	}
+	attachmentId, err := strconv.Atoi(params["attachmentId"])
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid attachment ID"})
+		return a, false
+	}
+
+	a, err = s.Store.Attachments().Get(r.Context(), customerId, attachmentId)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": "Attachment not found"})
+		default:
+			internalError(w, r, err)
+		}
+		return a, false
+	}
+	return a, true
+}
@@ -0,0 +1,67 @@
+package routes
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"theam.io/jdavidsanchez/test_crm_api/auth"
+	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+/************
+Avatar routes
+*************/
+
+// Customers without picture get a generated avatar, unless the picture fallback is "placeholder"
+var useGeneratedAvatars = true
+
+func customerPictureURL(c models.CustomerOut) string {
+	if useGeneratedAvatars && c.PicturePath == path.Join(utils.PathFileServer, utils.PlaceholderPicture) {
+		return utils.AvatarPath(c.Name, c.Surname)
+	}
+	return auth.SignPicturePath(c.PicturePath)
+}
+
+func getAvatar(w http.ResponseWriter, r *http.Request) {
+	// The router matches the decoded path, so the initials are already unescaped
+	params := mux.Vars(r)
+	initials := params["initials"]
+	if utf8.RuneCountInString(initials) > 2 {
+		utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": "Not found"})
+		return
+	}
+
+	avatar := utils.RenderAvatar(initials, params["color"])
+	// The avatar depends only on its URL, so it can be cached forever
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(avatar))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+
+	if etagMatches(r.Header.Values("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(avatar)
+}
+
+// etagMatches reports whether the If-None-Match headers list the ETag (or are "*"), with the weak
+// comparison the header requires: W/ prefixes are ignored
+func etagMatches(headers []string, etag string) bool {
+	for _, header := range headers {
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -3,12 +3,14 @@ package routes
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"theam.io/jdavidsanchez/test_crm_api/auth"
-	"theam.io/jdavidsanchez/test_crm_api/db"
 	"theam.io/jdavidsanchez/test_crm_api/models"
 	"theam.io/jdavidsanchez/test_crm_api/utils"
 )
@@ -17,16 +19,21 @@ import (
 Customer routes
 ***************/
 
-func listAllCustomers(w http.ResponseWriter, r *http.Request) {
-	customers, err := models.ListAllCustomers(db.DB)
+// Lists the customers the user can access, or only the ones it owns with ?mine=true
+func (s *Server) listAllCustomers(w http.ResponseWriter, r *http.Request) {
+	mine := r.URL.Query().Get("mine") == "true"
+	customers, err := s.Store.Customers().List(r.Context(), mine)
 	if err != nil {
-		utils.ResponseJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		internalError(w, r, err)
 		return
 	}
+	for i := range customers {
+		customers[i].PicturePath = customerPictureURL(customers[i])
+	}
 	utils.ResponseJSON(w, http.StatusOK, customers)
 }
 
-func getCustomer(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getCustomer(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	id, err := strconv.Atoi(params["customerId"]) // This parameter is always an int (Regex in mux route)
 
@@ -35,53 +42,58 @@ func getCustomer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	c := models.Customer{
-		CustomerOut: models.CustomerOut{
-			Id: id,
-		},
-	}
-	err = c.GetCustomer(db.DB)
+	c, err := s.Store.Customers().Get(r.Context(), id)
 
 	if err != nil {
 		switch err {
 		case sql.ErrNoRows:
 			utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": "Customer not found"})
 		default:
-			utils.ResponseJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			internalError(w, r, err)
 		}
 		return
 	}
-	cOut := c.CustomerOut
-	utils.ResponseJSON(w, http.StatusOK, cOut)
+	c.PicturePath = customerPictureURL(c)
+	utils.ResponseJSON(w, http.StatusOK, c)
 }
 
-func createCustomer(w http.ResponseWriter, r *http.Request) {
+func (s *Server) createCustomer(w http.ResponseWriter, r *http.Request) {
 	var c models.Customer
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&c)
+	err := decodeCustomer(r, &c)
 	if err != nil {
 		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
 		return
 	}
 	defer r.Body.Close()
 
-	id, err := auth.GetUserIdFromJWT(r)
-	if err != nil {
-		utils.ResponseJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	i, _ := auth.GetIdentity(r.Context())
+	c.CreatedByUserId = i.UserId
+
+	if hasPictureFile(r) {
+		err = s.withUploadedPicture(r, &c, func(tx models.Store) error {
+			return tx.Customers().Create(r.Context(), &c)
+		})
+	} else {
+		err = s.Store.Customers().Create(r.Context(), &c)
+	}
+	if err == errInvalidPicture {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid data"})
+		return
+	}
+	if err == models.ErrTeamNotFound {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
-	c.CreatedByUserId = id
-
-	err = c.CreateCustomer(db.DB)
 	if err != nil {
-		utils.ResponseJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		internalError(w, r, err)
 		return
 	}
 	cOut := c.CustomerOut
+	cOut.PicturePath = customerPictureURL(cOut)
 	utils.ResponseJSON(w, http.StatusCreated, cOut)
 }
 
-func updateCustomer(w http.ResponseWriter, r *http.Request) {
+func (s *Server) updateCustomer(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	userId, err := strconv.Atoi(params["customerId"])
 
@@ -91,34 +103,49 @@ func updateCustomer(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var c models.Customer
-	decoder := json.NewDecoder(r.Body)
-	err = decoder.Decode(&c)
+	err = decodeCustomer(r, &c)
 	if err != nil {
 		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
 		return
 	}
 	defer r.Body.Close()
 
-	id, err := auth.GetUserIdFromJWT(r)
-	if err != nil {
-		utils.ResponseJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
-		return
-	}
-	c.LastModifiedByUserId = id
+	i, _ := auth.GetIdentity(r.Context())
+	c.LastModifiedByUserId = i.UserId
 
 	c.Id = userId
-	err = c.UpdateCustomer(db.DB)
-	if err != nil {
-		utils.ResponseJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	if hasPictureFile(r) {
+		err = s.withUploadedPicture(r, &c, func(tx models.Store) error {
+			return tx.Customers().Update(r.Context(), &c)
+		})
+	} else {
+		err = s.Store.Customers().Update(r.Context(), &c)
+	}
+	switch err {
+	case nil:
+	case errInvalidPicture:
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid data"})
+		return
+	case models.ErrTeamNotFound:
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	case models.ErrCustomerNotFound:
+		utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	case models.ErrNotOwner:
+		utils.ResponseJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+		return
+	default:
+		internalError(w, r, err)
 		return
 	}
-	//c.GetCustomer(db.DB)
 
 	cOut := c.CustomerOut
+	cOut.PicturePath = customerPictureURL(cOut)
 	utils.ResponseJSON(w, http.StatusOK, cOut)
 }
 
-func deleteCustomer(w http.ResponseWriter, r *http.Request) {
+func (s *Server) deleteCustomer(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	id, err := strconv.Atoi(params["customerId"])
 
@@ -127,17 +154,110 @@ func deleteCustomer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	c := models.Customer{
-		CustomerOut: models.CustomerOut{
-			Id: id,
-		},
-	}
-	err = c.DeleteCustomer(db.DB)
+	// Attachment rows are deleted with the customer, but their files must be removed here
+	files, err := s.Store.Customers().Delete(r.Context(), id)
 
+	if err == models.ErrCustomerNotFound {
+		utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
 	if err != nil {
-		utils.ResponseJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		internalError(w, r, err)
 		return
 	}
+	for _, file := range files {
+		utils.CheckErr(os.Remove(file))
+	}
 
 	utils.ResponseJSON(w, http.StatusOK, map[string]string{"result": "success"})
 }
+
+// Reassigns several customers to another member of the organization at once, either all of them
+// or none. Only their owner (or an admin) can reassign them
+func (s *Server) reassignCustomers(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CustomerIds []int  `json:"customerIds"`
+		Owner       string `json:"owner"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.CustomerIds) == 0 || req.Owner == "" {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		return
+	}
+	defer r.Body.Close()
+
+	ownerId, err := s.Store.Users().GetId(r.Context(), req.Owner)
+	if err == sql.ErrNoRows {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": models.ErrUserNotFound.Error()})
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	var count int
+	err = s.Store.InTx(r.Context(), func(tx models.Store) error {
+		count, err = tx.Customers().Reassign(r.Context(), req.CustomerIds, ownerId)
+		return err
+	})
+	switch err {
+	case nil:
+	case models.ErrMemberNotFound:
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	case models.ErrCustomerNotFound:
+		utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	case models.ErrNotOwner:
+		utils.ResponseJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+		return
+	default:
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusOK, map[string]interface{}{"result": "success", "reassigned": count})
+}
+
+// Customers are sent either as a JSON body, or as a multipart form with the same JSON
+// in its "customer" field and, optionally, the customer picture in its "picture" field
+func decodeCustomer(r *http.Request, c *models.Customer) error {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return json.NewDecoder(r.Body).Decode(c)
+	}
+	err := r.ParseMultipartForm(utils.MaxUploadMemory)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(r.FormValue("customer")), c)
+}
+
+func hasPictureFile(r *http.Request) bool {
+	return r.MultipartForm != nil && len(r.MultipartForm.File["picture"]) > 0
+}
+
+var errInvalidPicture = errors.New("Invalid picture")
+
+// Stores the uploaded picture and runs the customer query in the same transaction as the
+// picture insertion. If any of them fails, nothing is committed and the file is removed
+func (s *Server) withUploadedPicture(r *http.Request, c *models.Customer, query func(tx models.Store) error) error {
+	picturePath, err := utils.FileUpload(r)
+	if err != nil {
+		return errInvalidPicture
+	}
+	uploadedBytes.WithLabelValues("picture").Add(float64(uploadedPictureSize(r)))
+
+	p := models.PicturePath{
+		Path: picturePath,
+	}
+	err = s.Store.InTx(r.Context(), func(tx models.Store) error {
+		err := tx.Pictures().Add(r.Context(), &p)
+		if err != nil {
+			return err
+		}
+		c.PictureId = p.Id
+		return query(tx)
+	})
+	if err != nil {
+		utils.CheckErr(utils.RemoveUploadedFile(picturePath))
+	}
+	return err
+}
@@ -0,0 +1,132 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"theam.io/jdavidsanchez/test_crm_api/auth"
+	"theam.io/jdavidsanchez/test_crm_api/db"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+/************
+Health routes
+*************/
+
+const readinessCheckTimeout = 2 * time.Second
+
+type checkResult struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Stores backed by a database also report its schema version and connection pool stats
+type databaseStore interface {
+	DB() *sql.DB
+}
+
+// Dependencies checked by /readyz. All of them must pass to receive traffic
+func (s *Server) readinessChecks() map[string]func(ctx context.Context) error {
+	checks := map[string]func(ctx context.Context) error{
+		"database": s.Store.Ping,
+		"storage":  checkStorage,
+		"jwt":      func(ctx context.Context) error { return auth.CheckKeyConfig() },
+	}
+	if store, ok := s.Store.(databaseStore); ok {
+		checks["migrations"] = func(ctx context.Context) error { return checkMigrations(ctx, store.DB()) }
+	}
+	return checks
+}
+
+// SetReady changes the readiness reported at /readyz, e.g. to stop receiving traffic before shutting down
+func (s *Server) SetReady(isReady bool) {
+	if isReady {
+		atomic.StoreInt32(&s.ready, 1)
+	} else {
+		atomic.StoreInt32(&s.ready, 0)
+	}
+}
+
+// The process is alive as long as it can answer, no matter the state of its dependencies
+func liveness(w http.ResponseWriter, r *http.Request) {
+	utils.ResponseJSON(w, http.StatusOK, map[string]string{"status": "alive"})
+}
+
+func (s *Server) readiness(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.ready) == 0 {
+		utils.ResponseJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "shutting down"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]checkResult)
+	status, code := "ready", http.StatusOK
+
+	for name, check := range s.readinessChecks() {
+		wg.Add(1)
+		go func(name string, check func(ctx context.Context) error) {
+			defer wg.Done()
+			start := time.Now()
+			err := check(ctx)
+			result := checkResult{
+				Status:    "ok",
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				result.Status = "failing"
+				result.Error = err.Error()
+				status, code = "not ready", http.StatusServiceUnavailable
+			}
+			results[name] = result
+		}(name, check)
+	}
+	wg.Wait()
+
+	utils.ResponseJSON(w, code, map[string]interface{}{"status": status, "checks": results})
+}
+
+// Newer schemas are accepted, as they are applied by the new builds while the old ones still run
+// during a rolling deploy
+func checkMigrations(ctx context.Context, database *sql.DB) error {
+	version, err := db.SchemaVersion(ctx, database)
+	if err != nil {
+		return err
+	}
+	if version < db.LatestSchemaVersion {
+		return fmt.Errorf("schema version is %d, expected at least %d", version, db.LatestSchemaVersion)
+	}
+	return nil
+}
+
+// Every directory where files are stored must be writable, including the configured images directory
+func checkStorage(ctx context.Context) error {
+	for _, dir := range []string{utils.ImagesDir, utils.PathToAttachmentsDir, utils.PathToUploadsDir} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+		f, err := ioutil.TempFile(dir, ".readyz-")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		if err = os.Remove(f.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package routes
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"theam.io/jdavidsanchez/test_crm_api/config"
+	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+/***********************************
+Rate limits and lockout of the logins
+************************************/
+
+var loginLimits = config.Default().Login
+
+func lockoutPolicy() models.LockoutPolicy {
+	return models.LockoutPolicy{
+		Threshold:   loginLimits.LockoutThreshold,
+		Duration:    loginLimits.LockoutDuration,
+		MaxDuration: loginLimits.LockoutMaxDuration,
+	}
+}
+
+// clientIP returns the address of the client, or the last one of X-Forwarded-For (added by
+// the closest proxy, the other ones can be forged by the client) if the proxy is trusted
+func clientIP(r *http.Request) string {
+	if loginLimits.TrustXForwardedFor {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			addrs := strings.Split(forwarded, ",")
+			return strings.TrimSpace(addrs[len(addrs)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkLoginLimits takes a token of the buckets of the client IP and of the username, returning
+// how long to wait before trying again if any is empty or the user is locked (0 otherwise)
+func (s *Server) checkLoginLimits(ctx context.Context, ip, username string) (time.Duration, error) {
+	if loginLimits.IPBurst > 0 {
+		wait, err := s.Store.RateLimits().Take(ctx, "login-ip:"+ip, loginLimits.IPBurst, loginLimits.IPRefill)
+		if err != nil || wait > 0 {
+			return wait, err
+		}
+	}
+	if loginLimits.UserBurst > 0 {
+		wait, err := s.Store.RateLimits().Take(ctx, "login-user:"+username, loginLimits.UserBurst, loginLimits.UserRefill)
+		if err != nil || wait > 0 {
+			return wait, err
+		}
+	}
+	if loginLimits.LockoutThreshold > 0 {
+		return s.Store.Users().LockedFor(ctx, username)
+	}
+	return 0, nil
+}
+
+// Locked users get the same response, so it does not tell whether a username exists. The wait is
+// rounded up, so clients do not retry before it ends
+func tooManyLoginAttempts(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	utils.ResponseJSON(w, http.StatusTooManyRequests, map[string]string{"error": "Too many login attempts"})
+}
+
+// Unlocks a user locked by failed logins, only allowed to the admins
+func (s *Server) unlockUser(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r, "users") {
+		return
+	}
+	u, ok := s.routeMember(w, r)
+	if !ok {
+		return
+	}
+	if err := s.Store.Users().Unlock(r.Context(), u.Username); err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// PruneRateLimits deletes the buckets not used for an hour every interval, until the context is cancelled
+func (s *Server) PruneRateLimits(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			utils.CheckErr(s.Store.RateLimits().Prune(ctx, time.Hour))
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"theam.io/jdavidsanchez/test_crm_api/auth"
+	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+/*******************************
+Current user and session routes
+********************************/
+
+type profile struct {
+	Id        int            `json:"id"`
+	Username  string         `json:"username"`
+	Email     string         `json:"email,omitempty"`
+	Roles     []string       `json:"roles"`
+	SessionId string         `json:"sessionId,omitempty"`
+	APIKey    *models.APIKey `json:"apiKey,omitempty"` // If authenticated with an API key
+}
+
+// Returns the authenticated user, and the session or API key of its credentials
+func (s *Server) getMe(w http.ResponseWriter, r *http.Request) {
+	i, _ := auth.GetIdentity(r.Context())
+	u, err := s.Store.Users().Get(r.Context(), i.Username)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusOK, profile{
+		Id:        u.Id,
+		Username:  u.Username,
+		Email:     u.Email,
+		Roles:     []string{u.Role},
+		SessionId: i.SessionId,
+		APIKey:    i.APIKey,
+	})
+}
+
+type sessionResponse struct {
+	models.Session
+	Current bool `json:"current"` // Whether it is the session of the request
+}
+
+// Returns the identity managing its sessions, which cannot be done with an API key. The response
+// is already sent otherwise
+func sessionsIdentity(w http.ResponseWriter, r *http.Request) (auth.Identity, bool) {
+	i, _ := auth.GetIdentity(r.Context())
+	if i.APIKey != nil {
+		utils.ResponseJSON(w, http.StatusForbidden, map[string]string{"error": "API keys cannot manage sessions"})
+		return i, false
+	}
+	return i, true
+}
+
+func (s *Server) listSessions(w http.ResponseWriter, r *http.Request) {
+	i, ok := sessionsIdentity(w, r)
+	if !ok {
+		return
+	}
+	sessions, err := s.Store.Sessions().List(r.Context(), i.UserId)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	response := make([]sessionResponse, len(sessions))
+	for n, session := range sessions {
+		response[n] = sessionResponse{session, session.Id == i.SessionId}
+	}
+	utils.ResponseJSON(w, http.StatusOK, response)
+}
+
+// Revokes a session of the user, whose tokens are refused from then on (including the current one)
+func (s *Server) revokeSession(w http.ResponseWriter, r *http.Request) {
+	i, ok := sessionsIdentity(w, r)
+	if !ok {
+		return
+	}
+	err := s.Store.Sessions().Delete(r.Context(), i.UserId, mux.Vars(r)["sessionId"])
+	if err == models.ErrSessionNotFound {
+		utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// Exchanges a refresh token for new tokens, with the current roles of the user
+func (s *Server) refreshToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		return
+	}
+	defer r.Body.Close()
+
+	// Limited as the logins from the IP, although refresh tokens are too long to be guessed
+	if loginLimits.IPBurst > 0 {
+		wait, err := s.Store.RateLimits().Take(r.Context(), "refresh-ip:"+clientIP(r), loginLimits.IPBurst, loginLimits.IPRefill)
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		if wait > 0 {
+			tooManyLoginAttempts(w, wait)
+			return
+		}
+	}
+
+	tokens, err := auth.RefreshSession(r.Context(), s.Store.Sessions(), req.RefreshToken, r.UserAgent(), clientIP(r))
+	if err == auth.ErrInvalidRefreshToken {
+		utils.ResponseJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusOK, map[string]string{"result": "success", "token": tokens.Token, "refreshToken": tokens.RefreshToken})
+}
@@ -0,0 +1,95 @@
+package routes
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promcollectors "github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+/*************
+Metrics routes
+**************/
+
+var loginAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "crm_login_attempts_total",
+	Help: "Number of login attempts by result (success, failure or limited).",
+}, []string{"result"})
+var uploadedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "crm_uploaded_bytes_total",
+	Help: "Bytes received in uploaded files by kind of upload (picture, attachment or resumable).",
+}, []string{"kind"})
+
+// Collectors of the last server, replaced when another one is created
+var serverCollectors struct {
+	sync.Mutex
+	collectors []prometheus.Collector
+}
+
+// Business gauges, and the connection pool stats if the store has a database, are read when scraped
+func (s *Server) registerMetrics() {
+	collectors := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "crm_customers",
+			Help: "Total number of customers, of every organization.",
+		}, func() float64 {
+			return countOrNaN(func(ctx context.Context) (int, error) {
+				return s.Store.Customers().Count(models.AllOrganizations(ctx))
+			})
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "crm_users",
+			Help: "Total number of users.",
+		}, func() float64 { return countOrNaN(s.Store.Users().Count) }),
+	}
+	if store, ok := s.Store.(databaseStore); ok {
+		collectors = append(collectors, promcollectors.NewDBStatsCollector(store.DB(), "crm"))
+	}
+
+	serverCollectors.Lock()
+	defer serverCollectors.Unlock()
+	for _, c := range serverCollectors.collectors {
+		prometheus.Unregister(c)
+	}
+	prometheus.MustRegister(collectors...)
+	serverCollectors.collectors = collectors
+}
+
+func countOrNaN(count func(ctx context.Context) (int, error)) float64 {
+	n, err := count(context.Background())
+	if err != nil {
+		utils.CheckErr(err)
+		return math.NaN()
+	}
+	return float64(n)
+}
+
+// If the metrics token is set, scrapers must send it as a bearer token
+var metricsToken string
+
+func metricsHandler() http.Handler {
+	handler := promhttp.Handler()
+	token := metricsToken
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+			utils.ResponseJSON(w, http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Size of the picture sent in a multipart form already parsed by utils.FileUpload
+func uploadedPictureSize(r *http.Request) int64 {
+	if r.MultipartForm == nil || len(r.MultipartForm.File["picture"]) == 0 {
+		return 0
+	}
+	return r.MultipartForm.File["picture"][0].Size
+}
@@ -0,0 +1,172 @@
+package routes
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"theam.io/jdavidsanchez/test_crm_api/auth"
+	"theam.io/jdavidsanchez/test_crm_api/logging"
+	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/oidc"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+/*************************************
+Single sign-on with OpenID Connect
+**************************************/
+
+var oidcProvider *oidc.Provider // Nil if single sign-on is not configured
+
+// Time the user has to login with the provider
+const oidcLoginExpiration = 10 * time.Minute
+
+// The state is also set in a cookie, so a callback can only complete the login started by the
+// same browser (login CSRF)
+const oidcStateCookie = "oidc_state"
+
+// Redirects the user to the provider, storing the state of the login until its callback
+func (s *Server) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		notFoundHandler(w, r)
+		return
+	}
+	if authURL, ok := s.startOIDCLogin(w, r, 0); ok {
+		http.Redirect(w, r, authURL, http.StatusFound)
+	}
+}
+
+// Starts a login with the provider linking its identity to the authenticated user, which existing
+// users need to login with single sign-on. The client follows the returned URL, as the request
+// needs the token of the user
+func (s *Server) linkOIDC(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		notFoundHandler(w, r)
+		return
+	}
+	i, _ := auth.GetIdentity(r.Context())
+	if i.APIKey != nil {
+		utils.ResponseJSON(w, http.StatusForbidden, map[string]string{"error": "API keys cannot link single sign-on identities"})
+		return
+	}
+	if authURL, ok := s.startOIDCLogin(w, r, i.UserId); ok {
+		utils.ResponseJSON(w, http.StatusOK, map[string]string{"url": authURL})
+	}
+}
+
+// Stores the state of a login of the user (0 for a new login) and sets its cookie, returning the
+// URL of the provider. The response is already sent if it fails
+func (s *Server) startOIDCLogin(w http.ResponseWriter, r *http.Request, userId int) (string, bool) {
+	l := models.OIDCLogin{UserId: userId}
+	var err error
+	for _, value := range []*string{&l.State, &l.Nonce, &l.CodeVerifier} {
+		if *value, err = utils.RandomToken(32); err != nil {
+			internalError(w, r, err)
+			return "", false
+		}
+	}
+	l.ExpiresAt = time.Now().Add(oidcLoginExpiration)
+	authURL, err := oidcProvider.AuthCodeURL(r.Context(), l.State, l.Nonce, l.CodeVerifier)
+	if err != nil {
+		logging.Error(r.Context(), "OIDC provider unavailable", err, nil)
+		utils.ResponseJSON(w, http.StatusBadGateway, map[string]string{"error": "Identity provider unavailable"})
+		return "", false
+	}
+	if err = s.Store.OIDCLogins().Create(r.Context(), &l); err != nil {
+		internalError(w, r, err)
+		return "", false
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    l.State,
+		Path:     "/users/oidc",
+		Expires:  l.ExpiresAt,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return authURL, true
+}
+
+// Completes the login redirected back by the provider, issuing a JWT for its user, or links the
+// identity to the user who started it
+func (s *Server) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		notFoundHandler(w, r)
+		return
+	}
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		utils.ResponseJSON(w, http.StatusUnauthorized, map[string]string{"error": "Login refused by the identity provider: " + e})
+		return
+	}
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid login state"})
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/users/oidc", MaxAge: -1, HttpOnly: true})
+
+	l, err := s.Store.OIDCLogins().Take(r.Context(), state)
+	if err == sql.ErrNoRows {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Login expired or already completed"})
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	identity, err := oidcProvider.Login(r.Context(), query.Get("code"), l.CodeVerifier, l.Nonce)
+	if err != nil {
+		loginAttempts.WithLabelValues("failure").Inc()
+		logging.Warn(r.Context(), "OIDC login failed", logging.Fields{"error": err.Error()})
+		utils.ResponseJSON(w, http.StatusUnauthorized, map[string]string{"error": "Invalid credentials"})
+		return
+	}
+	role, err := oidcProvider.Role(identity)
+	if err == oidc.ErrNotAllowed || utf8.RuneCountInString(identity.Username) > models.MaxUsernameLength {
+		loginAttempts.WithLabelValues("failure").Inc()
+		utils.ResponseJSON(w, http.StatusForbidden, map[string]string{"error": oidc.ErrNotAllowed.Error()})
+		return
+	}
+
+	if l.UserId != 0 {
+		u := models.User{Id: l.UserId}
+		err = s.Store.Users().LinkOIDC(r.Context(), &u, identity.Issuer, identity.Subject)
+		if err == models.ErrOIDCLinked {
+			utils.ResponseJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		logging.SetUser(r.Context(), u.Username)
+		utils.ResponseJSON(w, http.StatusOK, map[string]string{"result": "success"})
+		return
+	}
+
+	u := models.User{Username: identity.Username, Role: role}
+	err = s.Store.Users().ProvisionOIDC(r.Context(), &u, identity.Issuer, identity.Subject)
+	if err == models.ErrUsernameTaken {
+		loginAttempts.WithLabelValues("failure").Inc()
+		utils.ResponseJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	logging.SetUser(r.Context(), u.Username)
+	// Users with two-factor authentication are challenged as with their password
+	if s.loginChallenge(w, r, u) {
+		return
+	}
+	loginAttempts.WithLabelValues("success").Inc()
+
+	auth.SetJWT(s.Store.Sessions(), u, clientIP(r), w, r)
+}
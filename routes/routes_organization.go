@@ -0,0 +1,233 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"theam.io/jdavidsanchez/test_crm_api/auth"
+	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+/******************
+Organization routes
+*******************/
+
+type organizationResponse struct {
+	models.Organization
+	Active bool `json:"active"` // Whether it is the organization of the request
+}
+
+// Lists the organizations of the authenticated user
+func (s *Server) listMyOrganizations(w http.ResponseWriter, r *http.Request) {
+	i, _ := auth.GetIdentity(r.Context())
+	organizations, err := s.Store.Organizations().List(r.Context(), i.UserId)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	response := make([]organizationResponse, len(organizations))
+	for n, o := range organizations {
+		response[n] = organizationResponse{o, o.Id == i.OrganizationId}
+	}
+	utils.ResponseJSON(w, http.StatusOK, response)
+}
+
+// Switches the session to another organization of the user, responding with a token for it. API
+// keys and client certificates stay in their organization
+func (s *Server) switchOrganization(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		OrganizationId int `json:"organizationId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		return
+	}
+	defer r.Body.Close()
+
+	i, _ := auth.GetIdentity(r.Context())
+	if i.SessionId == "" {
+		utils.ResponseJSON(w, http.StatusForbidden, map[string]string{"error": "Only sessions can switch organization"})
+		return
+	}
+	member, err := s.Store.Organizations().IsMember(r.Context(), req.OrganizationId, i.UserId)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if !member {
+		utils.ResponseJSON(w, http.StatusForbidden, map[string]string{"error": models.ErrMemberNotFound.Error()})
+		return
+	}
+	token, err := auth.SwitchOrganization(r.Context(), s.Store.Sessions(), i, req.OrganizationId)
+	if err == models.ErrSessionNotFound {
+		utils.ResponseJSON(w, http.StatusUnauthorized, map[string]string{"error": "Session revoked"})
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusOK, map[string]string{"result": "success", "token": token})
+}
+
+// Only admins manage the organizations and teams (what), checked with their current role rather
+// than the one of the token. API keys cannot, so a leaked key cannot give access to other
+// organizations. The response is already sent if not allowed
+func (s *Server) requireAdmin(w http.ResponseWriter, r *http.Request, what string) bool {
+	i, _ := auth.GetIdentity(r.Context())
+	if i.APIKey != nil {
+		utils.ResponseJSON(w, http.StatusForbidden, map[string]string{"error": "API keys cannot manage " + what})
+		return false
+	}
+	u, err := s.Store.Users().Get(r.Context(), i.Username)
+	if err != nil {
+		internalError(w, r, err)
+		return false
+	}
+	if u.Role != models.RoleAdmin {
+		utils.ResponseJSON(w, http.StatusForbidden, map[string]string{"error": "Only admins can manage " + what})
+		return false
+	}
+	return true
+}
+
+func (s *Server) listOrganizations(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r, "organizations") {
+		return
+	}
+	organizations, err := s.Store.Organizations().List(r.Context(), 0)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusOK, organizations)
+}
+
+func (s *Server) createOrganization(w http.ResponseWriter, r *http.Request) {
+	var o models.Organization
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		return
+	}
+	defer r.Body.Close()
+
+	o.Name = strings.TrimSpace(o.Name)
+	if len := utf8.RuneCountInString(o.Name); len == 0 || len > 64 {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "The name must have between 1 and 64 characters"})
+		return
+	}
+	if !s.requireAdmin(w, r, "organizations") {
+		return
+	}
+	err := s.Store.Organizations().Create(r.Context(), &o)
+	if err == models.ErrOrganizationExists {
+		utils.ResponseJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusCreated, o)
+}
+
+// Returns the organization of the route. The response is already sent if not found
+func (s *Server) routeOrganization(w http.ResponseWriter, r *http.Request) (models.Organization, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["orgId"])
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid organization ID"})
+		return models.Organization{}, false
+	}
+	o, err := s.Store.Organizations().Get(r.Context(), id)
+	if err == sql.ErrNoRows {
+		utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": "Organization not found"})
+		return o, false
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return o, false
+	}
+	return o, true
+}
+
+// Returns the user of the route. The response is already sent if not found
+func (s *Server) routeMember(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	u, err := s.Store.Users().Get(r.Context(), mux.Vars(r)["username"])
+	if err == sql.ErrNoRows {
+		utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": models.ErrUserNotFound.Error()})
+		return u, false
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return u, false
+	}
+	return u, true
+}
+
+func (s *Server) listMembers(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r, "organizations") {
+		return
+	}
+	o, ok := s.routeOrganization(w, r)
+	if !ok {
+		return
+	}
+	members, err := s.Store.Organizations().Members(r.Context(), o.Id)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusOK, members)
+}
+
+func (s *Server) addMember(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r, "organizations") {
+		return
+	}
+	o, ok := s.routeOrganization(w, r)
+	if !ok {
+		return
+	}
+	u, ok := s.routeMember(w, r)
+	if !ok {
+		return
+	}
+	if err := s.Store.Organizations().AddMember(r.Context(), o.Id, u.Id); err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// Removes a member, whose tokens in the organization are refused from then on
+func (s *Server) removeMember(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r, "organizations") {
+		return
+	}
+	o, ok := s.routeOrganization(w, r)
+	if !ok {
+		return
+	}
+	u, ok := s.routeMember(w, r)
+	if !ok {
+		return
+	}
+	err := s.Store.InTx(r.Context(), func(tx models.Store) error {
+		return tx.Organizations().RemoveMember(r.Context(), o.Id, u.Id)
+	})
+	if err == models.ErrMemberNotFound {
+		utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
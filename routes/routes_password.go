@@ -0,0 +1,232 @@
+package routes
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"theam.io/jdavidsanchez/test_crm_api/auth"
+	"theam.io/jdavidsanchez/test_crm_api/config"
+	"theam.io/jdavidsanchez/test_crm_api/logging"
+	"theam.io/jdavidsanchez/test_crm_api/mailer"
+	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/passwd"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+/*************************************
+Password change and reset routes
+**************************************/
+
+var passwords = config.Default().Passwords
+var passwordMailer mailer.Mailer = mailer.New(config.Default().Mail)
+
+// Reset requests are handled in the background by SendPasswordResets, looking up the user there, so
+// the time of the response does not tell whether the user exists
+const mailTimeout = 30 * time.Second
+const passwordResetQueueSize = 64
+
+type passwordRequest struct {
+	Username        string `json:"username"`
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+	Token           string `json:"token"`
+}
+
+func decodePasswordRequest(w http.ResponseWriter, r *http.Request) (passwordRequest, bool) {
+	var req passwordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		return req, false
+	}
+	defer r.Body.Close()
+	return req, true
+}
+
+// Changes the password of the authenticated user, revoking its other sessions
+func (s *Server) changePassword(w http.ResponseWriter, r *http.Request) {
+	i, _ := auth.GetIdentity(r.Context())
+	if i.APIKey != nil {
+		utils.ResponseJSON(w, http.StatusForbidden, map[string]string{"error": "API keys cannot change passwords"})
+		return
+	}
+	req, ok := decodePasswordRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := passwd.Check(i.Username, req.NewPassword); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	// The current password is limited as the logins, so a stolen token cannot be used to guess it
+	wait, err := s.checkLoginLimits(r.Context(), clientIP(r), i.Username)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if wait > 0 {
+		tooManyLoginAttempts(w, wait)
+		return
+	}
+	u := models.User{Username: i.Username, Password: req.CurrentPassword}
+	err = s.Store.Users().Login(r.Context(), &u)
+	if err == models.ErrCanceled || err == models.ErrTimeout {
+		internalError(w, r, err)
+		return
+	}
+	if err != nil {
+		if loginLimits.LockoutThreshold > 0 {
+			_, err = s.Store.Users().LoginFailed(r.Context(), i.Username, lockoutPolicy())
+			utils.CheckErr(err)
+		}
+		utils.ResponseJSON(w, http.StatusForbidden, map[string]string{"error": "Invalid current password"})
+		return
+	}
+
+	err = s.Store.InTx(r.Context(), func(tx models.Store) error {
+		if err := tx.Users().ResetPassword(r.Context(), &models.User{Username: u.Username, Password: req.NewPassword}); err != nil {
+			return err
+		}
+		return tx.Sessions().Revoke(r.Context(), u.Id, i.SessionId)
+	})
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func hashResetToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// Queues the mail of a reset token to the user, sent if it exists and has an email. The response is
+// the same otherwise, so it does not tell whether the username exists
+func (s *Server) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodePasswordRequest(w, r)
+	if !ok {
+		return
+	}
+	// Limited as the logins, so the mailbox of a user cannot be flooded
+	wait, err := s.checkLoginLimits(r.Context(), clientIP(r), req.Username)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if wait > 0 {
+		tooManyLoginAttempts(w, wait)
+		return
+	}
+
+	select {
+	case s.passwordResets <- req.Username:
+	case <-r.Context().Done():
+		return
+	}
+	utils.ResponseJSON(w, http.StatusAccepted, map[string]string{"result": "success"})
+}
+
+// SendPasswordResets mails the reset tokens of the requests until the context is cancelled, and then
+// the ones still queued, so none is lost on shutdown
+func (s *Server) SendPasswordResets(ctx context.Context) {
+	for {
+		select {
+		case username := <-s.passwordResets:
+			s.sendPasswordReset(username)
+		case <-ctx.Done():
+			for {
+				select {
+				case username := <-s.passwordResets:
+					s.sendPasswordReset(username)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *Server) sendPasswordReset(username string) {
+	ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+	defer cancel()
+	fields := logging.Fields{"username": username}
+
+	u, err := s.Store.Users().Get(ctx, username)
+	if err == sql.ErrNoRows || (err == nil && u.Email == "") {
+		return
+	}
+	if err != nil {
+		logging.Error(ctx, "Could not send the password reset mail", err, fields)
+		return
+	}
+	token, err := utils.RandomToken(32)
+	if err != nil {
+		logging.Error(ctx, "Could not send the password reset mail", err, fields)
+		return
+	}
+	reset := models.PasswordReset{TokenHash: hashResetToken(token), UserId: u.Id, ExpiresAt: time.Now().Add(passwords.ResetTokenLifetime)}
+	if err = s.Store.PasswordResets().Create(ctx, &reset); err != nil {
+		logging.Error(ctx, "Could not send the password reset mail", err, fields)
+		return
+	}
+
+	link := "send it with your new password to POST /users/password/reset:\n\n" + token
+	if passwords.ResetURL != "" {
+		link = "open this link:\n\n" + passwords.ResetURL + token
+	}
+	err = passwordMailer.Send(ctx, mailer.Message{
+		To:      u.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("A password reset was requested for your user %s. To choose a new password, %s\n\n"+
+			"It expires in %s and can only be used once. If you did not request it, you can ignore this mail.\n",
+			u.Username, link, passwords.ResetTokenLifetime),
+	})
+	if err != nil {
+		logging.Error(ctx, "Could not send the password reset mail", err, fields)
+	}
+}
+
+// Sets the password of the user of a reset token, revoking every session and unlocking it
+func (s *Server) resetPassword(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodePasswordRequest(w, r)
+	if !ok {
+		return
+	}
+	// The token is only used if the password is valid, as the transaction is rolled back otherwise
+	var policyErr error
+	err := s.Store.InTx(r.Context(), func(tx models.Store) error {
+		reset, err := tx.PasswordResets().Take(r.Context(), hashResetToken(req.Token))
+		if err != nil {
+			return err
+		}
+		if policyErr = passwd.Check(reset.Username, req.NewPassword); policyErr != nil {
+			return policyErr
+		}
+		if err = tx.Users().ResetPassword(r.Context(), &models.User{Username: reset.Username, Password: req.NewPassword}); err != nil {
+			return err
+		}
+		if err = tx.Sessions().Revoke(r.Context(), reset.UserId, ""); err != nil {
+			return err
+		}
+		return tx.Users().LoginSucceeded(r.Context(), reset.Username)
+	})
+	if err == sql.ErrNoRows {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid or expired reset token"})
+		return
+	}
+	if policyErr != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": policyErr.Error()})
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
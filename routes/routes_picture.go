@@ -6,7 +6,7 @@ import (
 	"strconv"
 
 	"github.com/gorilla/mux"
-	"theam.io/jdavidsanchez/test_crm_api/db"
+	"theam.io/jdavidsanchez/test_crm_api/auth"
 	"theam.io/jdavidsanchez/test_crm_api/models"
 	"theam.io/jdavidsanchez/test_crm_api/utils"
 )
@@ -15,7 +15,7 @@ import (
 Picture routes
 **************/
 
-func getPicturePath(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getPicturePath(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	id, err := strconv.Atoi(params["pictureId"])
 
@@ -24,25 +24,23 @@ func getPicturePath(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	p := models.PicturePath{
-		Id: id,
-	}
-	err = p.GetPicturePath(db.DB)
+	p, err := s.Store.Pictures().Get(r.Context(), id)
 
 	if err != nil {
 		switch err {
 		case sql.ErrNoRows:
 			utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": "Picture not found"})
 		default:
-			utils.ResponseJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			internalError(w, r, err)
 		}
 		return
 	}
 
+	p.Path = auth.SignPicturePath(p.Path)
 	utils.ResponseJSON(w, http.StatusOK, p)
 }
 
-func addPicture(w http.ResponseWriter, r *http.Request) {
+func (s *Server) addPicture(w http.ResponseWriter, r *http.Request) {
 
 	var p models.PicturePath
 	imageName, err := utils.FileUpload(r)
@@ -50,13 +48,15 @@ func addPicture(w http.ResponseWriter, r *http.Request) {
 		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid data"})
 		return
 	}
+	uploadedBytes.WithLabelValues("picture").Add(float64(uploadedPictureSize(r)))
 
 	p.Path = imageName
-	err = p.AddPicture(db.DB)
+	err = s.Store.Pictures().Add(r.Context(), &p)
 	if err != nil {
-		utils.ResponseJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		internalError(w, r, err)
 		return
 	}
 
+	p.Path = auth.SignPicturePath(p.Path)
 	utils.ResponseJSON(w, http.StatusOK, p)
 }
@@ -0,0 +1,117 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+/**********
+Team routes
+***********/
+
+// Lists the teams of the organization of the request, with their members
+func (s *Server) listTeams(w http.ResponseWriter, r *http.Request) {
+	teams, err := s.Store.Teams().List(r.Context())
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusOK, teams)
+}
+
+func (s *Server) createTeam(w http.ResponseWriter, r *http.Request) {
+	var t models.Team
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		return
+	}
+	defer r.Body.Close()
+
+	t.Name = strings.TrimSpace(t.Name)
+	if len := utf8.RuneCountInString(t.Name); len == 0 || len > 64 {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "The name must have between 1 and 64 characters"})
+		return
+	}
+	if !s.requireAdmin(w, r, "teams") {
+		return
+	}
+	err := s.Store.Teams().Create(r.Context(), &t)
+	if err == models.ErrTeamExists {
+		utils.ResponseJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusCreated, t)
+}
+
+// The customers shared with the team stop being shared with its members
+func (s *Server) deleteTeam(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r, "teams") {
+		return
+	}
+	id, _ := strconv.Atoi(mux.Vars(r)["teamId"]) // Always an int (Regex in mux route)
+	err := s.Store.Teams().Delete(r.Context(), id)
+	if err == models.ErrTeamNotFound {
+		utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// Adds a member of the organization to the team
+func (s *Server) addTeamMember(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r, "teams") {
+		return
+	}
+	u, ok := s.routeMember(w, r)
+	if !ok {
+		return
+	}
+	teamId, _ := strconv.Atoi(mux.Vars(r)["teamId"])
+	err := s.Store.Teams().AddMember(r.Context(), teamId, u.Id)
+	switch err {
+	case nil:
+		utils.ResponseJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	case models.ErrTeamNotFound:
+		utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+	case models.ErrMemberNotFound:
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	default:
+		internalError(w, r, err)
+	}
+}
+
+func (s *Server) removeTeamMember(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r, "teams") {
+		return
+	}
+	u, ok := s.routeMember(w, r)
+	if !ok {
+		return
+	}
+	teamId, _ := strconv.Atoi(mux.Vars(r)["teamId"])
+	err := s.Store.Teams().RemoveMember(r.Context(), teamId, u.Id)
+	if err == models.ErrTeamMemberNotFound {
+		utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
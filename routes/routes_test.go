@@ -0,0 +1,1145 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"theam.io/jdavidsanchez/test_crm_api/auth"
+	"theam.io/jdavidsanchez/test_crm_api/config"
+	"theam.io/jdavidsanchez/test_crm_api/logging"
+	"theam.io/jdavidsanchez/test_crm_api/mailer"
+	"theam.io/jdavidsanchez/test_crm_api/memstore"
+	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/oidc"
+	"theam.io/jdavidsanchez/test_crm_api/oidc/oidctest"
+	"theam.io/jdavidsanchez/test_crm_api/passwd"
+	"theam.io/jdavidsanchez/test_crm_api/totp"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+/*************************************************************
+Unit tests of the handlers, with the in-memory store (no database)
+**************************************************************/
+
+func TestMain(m *testing.M) {
+	// Uploaded files are stored in directories relative to the working directory
+	dir, err := ioutil.TempDir("", "routes-test-")
+	if err != nil {
+		panic(err)
+	}
+	os.Chdir(dir)
+	logging.SetOutput(ioutil.Discard)
+	// The minimum cost keeps the tests fast
+	passwords := config.Default().Passwords
+	passwords.BcryptCost = 4
+	passwd.Configure(passwords)
+
+	code := m.Run()
+
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func newTestServer(t *testing.T) (*Server, string) {
+	t.Helper()
+	s := NewServer(memstore.New())
+
+	u := models.User{Username: "test_user", Password: "test_password"}
+	body, _ := json.Marshal(u)
+	response := serve(s, httptest.NewRequest("POST", "/users/register", bytes.NewReader(body)), "")
+	if response.Code != http.StatusCreated {
+		t.Fatalf("Could not register user: %d %s", response.Code, response.Body.String())
+	}
+	o := models.Organization{Name: "Default"}
+	if err := s.Store.Organizations().Create(context.Background(), &o); err != nil {
+		t.Fatal(err)
+	}
+	joinOrganization(t, s, o.Id, "test_user")
+	response = serve(s, httptest.NewRequest("POST", "/users/login", bytes.NewReader(body)), "")
+	var login map[string]string
+	if err := json.Unmarshal(response.Body.Bytes(), &login); err != nil || login["token"] == "" {
+		t.Fatalf("Could not login: %d %s", response.Code, response.Body.String())
+	}
+	return s, login["token"]
+}
+
+func joinOrganization(t *testing.T, s *Server, orgId int, username string) {
+	t.Helper()
+	ctx := context.Background()
+	userId, err := s.Store.Users().GetId(ctx, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Store.Organizations().AddMember(ctx, orgId, userId); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func serve(s *Server, req *http.Request, token string) *httptest.ResponseRecorder {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	return rr
+}
+
+func checkCode(t *testing.T, expected int, response *httptest.ResponseRecorder) {
+	t.Helper()
+	if response.Code != expected {
+		t.Fatalf("Expected response code %d. Got %d: %s", expected, response.Code, response.Body.String())
+	}
+}
+
+func TestCustomerHandlers(t *testing.T) {
+	s, token := newTestServer(t)
+
+	response := serve(s, httptest.NewRequest("GET", "/customers/all", nil), token)
+	checkCode(t, http.StatusOK, response)
+	if body := response.Body.String(); body != "[]" {
+		t.Errorf("Expected an empty list. Got %s", body)
+	}
+
+	response = serve(s, httptest.NewRequest("POST", "/customers/", bytes.NewBufferString(`{"name":"Name","surname":"Surname"}`)), token)
+	checkCode(t, http.StatusCreated, response)
+	var c models.CustomerOut
+	json.Unmarshal(response.Body.Bytes(), &c)
+	want := models.CustomerOut{
+		Id:                 1,
+		Name:               "Name",
+		Surname:            "Surname",
+		PicturePath:        utils.AvatarPath("Name", "Surname"),
+		CreatedByUser:      "test_user",
+		LastModifiedByUser: "test_user",
+		Owner:              "test_user",
+		Teams:              []int{},
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("Expected customer %+v. Got %+v", want, c)
+	}
+
+	response = serve(s, httptest.NewRequest("PUT", "/customers/1", bytes.NewBufferString(`{"name":"New","surname":"Surname"}`)), token)
+	checkCode(t, http.StatusOK, response)
+
+	response = serve(s, httptest.NewRequest("GET", "/customers/1", nil), token)
+	checkCode(t, http.StatusOK, response)
+	json.Unmarshal(response.Body.Bytes(), &c)
+	if c.Name != "New" {
+		t.Errorf("Expected the updated name. Got %s", c.Name)
+	}
+
+	response = serve(s, httptest.NewRequest("DELETE", "/customers/1", nil), token)
+	checkCode(t, http.StatusOK, response)
+
+	response = serve(s, httptest.NewRequest("GET", "/customers/1", nil), token)
+	checkCode(t, http.StatusNotFound, response)
+}
+
+func TestAvatar(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	// Escaped initials, which could be taken for escapes themselves once decoded
+	avatarPath := "/" + utils.AvatarPath("%name", "Surname")
+	response := serve(s, httptest.NewRequest("GET", avatarPath, nil), "")
+	checkCode(t, http.StatusOK, response)
+	if !strings.Contains(response.Body.String(), "%S") {
+		t.Errorf("Expected the initials %%S. Got %s", response.Body.String())
+	}
+
+	etag := response.Header().Get("ETag")
+	for header, code := range map[string]int{
+		etag:                    http.StatusNotModified,
+		`"other", W/` + etag:    http.StatusNotModified,
+		"*":                     http.StatusNotModified,
+		`"other"`:               http.StatusOK,
+		strings.Trim(etag, `"`): http.StatusOK,
+	} {
+		req := httptest.NewRequest("GET", avatarPath, nil)
+		req.Header.Set("If-None-Match", header)
+		if response = serve(s, req, ""); response.Code != code {
+			t.Errorf("Expected %d with If-None-Match %s. Got %d", code, header, response.Code)
+		}
+	}
+}
+
+func TestAttachmentHandlers(t *testing.T) {
+	s, token := newTestServer(t)
+	response := serve(s, httptest.NewRequest("POST", "/customers/", bytes.NewBufferString(`{"name":"Name","surname":"Surname"}`)), token)
+	checkCode(t, http.StatusCreated, response)
+
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	mw.WriteField("title", "Notes")
+	fw, _ := mw.CreateFormFile("file", "notes é.txt")
+	fw.Write([]byte("Some notes about the customer"))
+	mw.Close()
+	req := httptest.NewRequest("POST", "/customers/1/attachments", &b)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	response = serve(s, req, token)
+	checkCode(t, http.StatusCreated, response)
+
+	var a models.Attachment
+	json.Unmarshal(response.Body.Bytes(), &a)
+	if a.Title != "Notes" || a.FileName != "notes é.txt" || a.UploadedByUser != "test_user" {
+		t.Errorf("Unexpected attachment %+v", a)
+	}
+
+	response = serve(s, httptest.NewRequest("GET", "/customers/1/attachments/1", nil), token)
+	checkCode(t, http.StatusOK, response)
+	if body := response.Body.String(); body != "Some notes about the customer" {
+		t.Errorf("Expected the attachment content. Got %s", body)
+	}
+	if got := response.Header().Get("Content-Disposition"); got != "attachment; filename*=utf-8''notes%20%C3%A9.txt" {
+		t.Errorf("Expected the RFC 6266 file name. Got %s", got)
+	}
+
+	// Fields are refused instead of truncated
+	b.Reset()
+	mw = multipart.NewWriter(&b)
+	mw.WriteField("title", strings.Repeat("a", 1025))
+	fw, _ = mw.CreateFormFile("file", "notes.txt")
+	fw.Write([]byte("Some notes about the customer"))
+	mw.Close()
+	req = httptest.NewRequest("POST", "/customers/1/attachments", &b)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	response = serve(s, req, token)
+	checkCode(t, http.StatusBadRequest, response)
+	if body := response.Body.String(); body != `{"error":"Form field too long"}` {
+		t.Errorf("Expected the long title to be refused. Got %s", body)
+	}
+
+	// Only images can be the customer picture
+	response = serve(s, httptest.NewRequest("PUT", "/customers/1/attachments/1/primary", nil), token)
+	checkCode(t, http.StatusBadRequest, response)
+
+	response = serve(s, httptest.NewRequest("DELETE", "/customers/1/attachments/1", nil), token)
+	checkCode(t, http.StatusOK, response)
+	response = serve(s, httptest.NewRequest("GET", "/customers/1/attachments/1", nil), token)
+	checkCode(t, http.StatusNotFound, response)
+	response = serve(s, httptest.NewRequest("DELETE", "/customers/1/attachments/1", nil), token)
+	checkCode(t, http.StatusNotFound, response)
+	response = serve(s, httptest.NewRequest("GET", "/customers/2/attachments", nil), token)
+	checkCode(t, http.StatusNotFound, response)
+}
+
+// Store whose uploads fail to complete while fail is set
+type failingStore struct {
+	models.Store
+	fail *bool
+}
+
+type failingUploads struct {
+	models.UploadRepository
+	fail *bool
+}
+
+func (s failingStore) Uploads() models.UploadRepository {
+	return failingUploads{s.Store.Uploads(), s.fail}
+}
+
+func (s failingStore) InTx(ctx context.Context, fn func(tx models.Store) error) error {
+	return s.Store.InTx(ctx, func(tx models.Store) error { return fn(failingStore{tx, s.fail}) })
+}
+
+func (u failingUploads) Complete(ctx context.Context, upload *models.Upload, p *models.PicturePath) error {
+	if *u.fail {
+		return errors.New("Injected failure")
+	}
+	return u.UploadRepository.Complete(ctx, upload, p)
+}
+
+func TestUploadCompletionRetry(t *testing.T) {
+	// Pictures are stored in and served from the configured directory
+	defer func(dir string) { utils.ImagesDir = dir }(utils.ImagesDir)
+	utils.ImagesDir = t.TempDir()
+	s, token := newTestServer(t)
+	const png = "\x89PNG\r\n\x1a\n"
+	fail := true
+	s.Store = failingStore{s.Store, &fail}
+	tus := func(method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		return serve(s, req, token)
+	}
+	response := tus("POST", "/customers/picture/uploads", "", map[string]string{"Upload-Length": "8", "Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("picture.html"))})
+	checkCode(t, http.StatusCreated, response)
+	location := response.Header().Get("Location")
+	patch := func(offset, body string) *httptest.ResponseRecorder {
+		return tus("PATCH", location, body, map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": offset})
+	}
+
+	// The final offset is not stored if the picture cannot be added, so the chunk can be sent again
+	checkCode(t, http.StatusInternalServerError, patch("0", png))
+	response = tus("HEAD", location, "", nil)
+	checkCode(t, http.StatusOK, response)
+	if offset, id := response.Header().Get("Upload-Offset"), response.Header().Get("Picture-Id"); offset != "0" || id != "" {
+		t.Errorf("Expected the upload at offset 0 without picture. Got %s and %q", offset, id)
+	}
+
+	fail = false
+	response = patch("0", png)
+	checkCode(t, http.StatusNoContent, response)
+	if response.Header().Get("Picture-Id") == "" {
+		t.Errorf("Expected the picture of the completed upload")
+	}
+	checkCode(t, http.StatusForbidden, patch("8", ""))
+	response = tus("HEAD", location, "", nil)
+	if offset := response.Header().Get("Upload-Offset"); offset != "8" || response.Header().Get("Picture-Id") == "" {
+		t.Errorf("Expected the completed upload. Got offset %s", offset)
+	}
+
+	response = serve(s, httptest.NewRequest("GET", "/customers/picture/"+response.Header().Get("Picture-Id"), nil), token)
+	checkCode(t, http.StatusOK, response)
+	var p models.PicturePath
+	json.Unmarshal(response.Body.Bytes(), &p)
+	response = serve(s, httptest.NewRequest("GET", "/"+p.Path, nil), "")
+	checkCode(t, http.StatusOK, response)
+	if body, contentType := response.Body.String(), response.Header().Get("Content-Type"); body != png || contentType != "image/png" {
+		t.Errorf("Expected the uploaded picture, named after its sniffed type. Got %q as %s", body, contentType)
+	}
+
+	// Files that are not pictures are refused, whatever their name, and the upload removed
+	response = tus("POST", "/customers/picture/uploads", "", map[string]string{"Upload-Length": "15"})
+	checkCode(t, http.StatusCreated, response)
+	location = response.Header().Get("Location")
+	checkCode(t, http.StatusUnsupportedMediaType, patch("0", "<script></html>"))
+	checkCode(t, http.StatusNotFound, tus("HEAD", location, "", nil))
+}
+
+func TestCancelledRequest(t *testing.T) {
+	s, token := newTestServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	response := serve(s, httptest.NewRequest("GET", "/customers/all", nil).WithContext(ctx), token)
+	checkCode(t, statusClientClosedRequest, response)
+}
+
+func TestRequestLogging(t *testing.T) {
+	s, token := newTestServer(t)
+	var out bytes.Buffer
+	logging.SetOutput(&out)
+	defer logging.SetOutput(ioutil.Discard)
+
+	// Requests that match no route are logged too
+	checkCode(t, http.StatusNotFound, serve(s, httptest.NewRequest("GET", "/customers/none", nil), token))
+	checkCode(t, http.StatusOK, serve(s, httptest.NewRequest("GET", "/customers/all", nil), token))
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var fields map[string]interface{}
+		json.Unmarshal([]byte(line), &fields)
+		if fields["msg"] == "request" {
+			lines = append(lines, fields)
+		}
+	}
+	if len(lines) != 2 || lines[0]["status"] != float64(404) || lines[0]["route"] != "" {
+		t.Fatalf("Expected a 404 logged without route. Got %+v", lines)
+	}
+	if lines[1]["route"] != "/customers/all" {
+		t.Errorf("Expected the route template /customers/all. Got %v", lines[1]["route"])
+	}
+}
+
+func TestReadinessWithoutDatabase(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	response := serve(s, httptest.NewRequest("GET", "/readyz", nil), "")
+	var result struct {
+		Checks map[string]checkResult `json:"checks"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &result)
+	if result.Checks["database"].Status != "ok" {
+		t.Errorf("Expected the store to be ready. Got %+v", result.Checks["database"])
+	}
+	// Migrations are only checked for stores backed by a database
+	if _, ok := result.Checks["migrations"]; ok {
+		t.Errorf("Expected no migrations check")
+	}
+}
+
+func TestReadinessStorage(t *testing.T) {
+	s, _ := newTestServer(t)
+	defer func(dir string) { utils.ImagesDir = dir }(utils.ImagesDir)
+
+	// A file where the configured images directory should be
+	file := filepath.Join(t.TempDir(), "img")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	utils.ImagesDir = file
+	response := serve(s, httptest.NewRequest("GET", "/readyz", nil), "")
+	checkCode(t, http.StatusServiceUnavailable, response)
+	var result struct {
+		Checks map[string]checkResult `json:"checks"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &result)
+	if result.Checks["storage"].Status == "ok" {
+		t.Errorf("Expected the images directory to be checked. Got %+v", result.Checks["storage"])
+	}
+}
+
+func TestClientCertificateAuth(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	// As verified by the TLS configuration with a client CA
+	req := httptest.NewRequest("POST", "/customers/", bytes.NewBufferString(`{"name":"Name","surname":"Surname"}`))
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "test_user"}}}}}
+	response := serve(s, req, "")
+	checkCode(t, http.StatusCreated, response)
+	var c models.CustomerOut
+	json.Unmarshal(response.Body.Bytes(), &c)
+	if c.CreatedByUser != "test_user" {
+		t.Errorf("Expected the customer created by the user of the certificate. Got %s", c.CreatedByUser)
+	}
+
+	// Unverified certificates are ignored
+	req = httptest.NewRequest("GET", "/customers/all", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "test_user"}}}}
+	checkCode(t, http.StatusUnauthorized, serve(s, req, ""))
+}
+
+func TestLoginLimits(t *testing.T) {
+	defaults := loginLimits
+	defer func() { loginLimits = defaults }()
+	loginLimits = config.Login{}
+	s, _ := newTestServer(t)
+	login := func(password, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/users/login", bytes.NewBufferString(`{"username":"test_user","password":"`+password+`"}`))
+		req.RemoteAddr = ip + ":1234"
+		return serve(s, req, "")
+	}
+
+	t.Run("Lockout", func(t *testing.T) {
+		loginLimits = config.Login{LockoutThreshold: 2, LockoutDuration: time.Minute, LockoutMaxDuration: time.Hour}
+		checkCode(t, http.StatusUnauthorized, login("wrong_password", "192.0.2.1"))
+		checkCode(t, http.StatusUnauthorized, login("wrong_password", "192.0.2.1"))
+		// Even with the right password
+		response := login("test_password", "192.0.2.1")
+		checkCode(t, http.StatusTooManyRequests, response)
+		if retry := response.Header().Get("Retry-After"); retry != "60" {
+			t.Errorf("Expected Retry-After 60. Got %s", retry)
+		}
+
+		// Admins unlock it without waiting. Named "me" to check the route of /users/me/lock
+		admin := models.User{Username: "me", Password: "admin_password"}
+		if err := s.Store.Users().Create(context.Background(), &admin); err != nil {
+			t.Fatal(err)
+		}
+		admin.Role = models.RoleAdmin
+		s.Store.Users().UpdateRole(context.Background(), &admin)
+		var body map[string]string
+		response = serve(s, httptest.NewRequest("POST", "/users/login", bytes.NewBufferString(`{"username":"me","password":"admin_password"}`)), "")
+		json.Unmarshal(response.Body.Bytes(), &body)
+		checkCode(t, http.StatusNotFound, serve(s, httptest.NewRequest("DELETE", "/users/nobody/lock", nil), body["token"]))
+		checkCode(t, http.StatusOK, serve(s, httptest.NewRequest("DELETE", "/users/test_user/lock", nil), body["token"]))
+		checkCode(t, http.StatusAccepted, login("test_password", "192.0.2.1"))
+
+		// Other users cannot
+		json.Unmarshal(login("test_password", "192.0.2.1").Body.Bytes(), &body)
+		checkCode(t, http.StatusForbidden, serve(s, httptest.NewRequest("DELETE", "/users/me/lock", nil), body["token"]))
+	})
+	t.Run("Rate limits", func(t *testing.T) {
+		loginLimits = config.Login{IPBurst: 2, IPRefill: time.Hour, UserBurst: 3, UserRefill: time.Hour}
+		checkCode(t, http.StatusAccepted, login("test_password", "192.0.2.2"))
+		checkCode(t, http.StatusUnauthorized, login("wrong_password", "192.0.2.2"))
+		response := login("test_password", "192.0.2.2")
+		checkCode(t, http.StatusTooManyRequests, response)
+		if retry := response.Header().Get("Retry-After"); retry != "3600" {
+			t.Errorf("Expected Retry-After 3600. Got %s", retry)
+		}
+
+		// Other clients can still login, until the bucket of the user is empty too
+		checkCode(t, http.StatusAccepted, login("test_password", "192.0.2.3"))
+		checkCode(t, http.StatusTooManyRequests, login("test_password", "192.0.2.4"))
+	})
+}
+
+func TestRetryAfter(t *testing.T) {
+	for wait, want := range map[time.Duration]string{0: "1", 300 * time.Millisecond: "1", 1500 * time.Millisecond: "2", time.Minute: "60"} {
+		response := httptest.NewRecorder()
+		tooManyLoginAttempts(response, wait)
+		if retry := response.Header().Get("Retry-After"); retry != want {
+			t.Errorf("Expected Retry-After %s for %s. Got %s", want, wait, retry)
+		}
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	s, token := newTestServer(t)
+	withKey := func(req *http.Request, key string) *httptest.ResponseRecorder {
+		req.Header.Set("X-API-Key", key)
+		return serve(s, req, "")
+	}
+
+	response := serve(s, httptest.NewRequest("POST", "/users/keys", bytes.NewBufferString(`{"name":"ETL","scopes":["customers:read"]}`)), token)
+	checkCode(t, http.StatusCreated, response)
+	var created struct {
+		Id     int      `json:"id"`
+		Key    string   `json:"key"`
+		Prefix string   `json:"prefix"`
+		Scopes []string `json:"scopes"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &created)
+	if !strings.HasPrefix(created.Key, created.Prefix) || len(created.Key) != 52 {
+		t.Errorf("Unexpected key %+v", created)
+	}
+	checkCode(t, http.StatusBadRequest, serve(s, httptest.NewRequest("POST", "/users/keys", bytes.NewBufferString(`{"name":"ETL","scopes":["customers:admin"]}`)), token))
+
+	checkCode(t, http.StatusOK, withKey(httptest.NewRequest("GET", "/customers/all", nil), created.Key))
+	checkCode(t, http.StatusForbidden, withKey(httptest.NewRequest("POST", "/customers/", bytes.NewBufferString(`{"name":"Name","surname":"Surname"}`)), created.Key))
+	checkCode(t, http.StatusUnauthorized, withKey(httptest.NewRequest("GET", "/customers/all", nil), created.Key+"0"))
+	// Keys cannot create new keys
+	checkCode(t, http.StatusForbidden, withKey(httptest.NewRequest("POST", "/users/keys", bytes.NewBufferString(`{"name":"New","scopes":["customers:write"]}`)), created.Key))
+
+	response = serve(s, httptest.NewRequest("GET", "/users/keys", nil), token)
+	checkCode(t, http.StatusOK, response)
+	var keys []models.APIKey
+	json.Unmarshal(response.Body.Bytes(), &keys)
+	if len(keys) != 1 || keys[0].Id != created.Id || keys[0].LastUsedAt == nil || strings.Contains(response.Body.String(), created.Key) {
+		t.Errorf("Expected the key, used and without its secret. Got %s", response.Body.String())
+	}
+	checkCode(t, http.StatusForbidden, serve(s, httptest.NewRequest("GET", "/users/keys?all=true", nil), token))
+
+	checkCode(t, http.StatusOK, serve(s, httptest.NewRequest("DELETE", "/users/keys/"+strconv.Itoa(created.Id), nil), token))
+	checkCode(t, http.StatusUnauthorized, withKey(httptest.NewRequest("GET", "/customers/all", nil), created.Key))
+	checkCode(t, http.StatusNotFound, serve(s, httptest.NewRequest("DELETE", "/users/keys/"+strconv.Itoa(created.Id), nil), token))
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	defer auth.Configure(config.Default().Auth)
+	for _, algorithm := range []string{"RS256", "ES256"} {
+		t.Run(algorithm, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			c := config.Default().Auth
+			c.JWTAlgorithm = algorithm
+			auth.Configure(c)
+			if err := auth.LoadSigningKeys(context.Background(), s.Store); err != nil {
+				t.Fatal(err)
+			}
+			login := func() (token, kid string) {
+				t.Helper()
+				response := serve(s, httptest.NewRequest("POST", "/users/login", bytes.NewBufferString(`{"username":"test_user","password":"test_password"}`)), "")
+				var body map[string]string
+				json.Unmarshal(response.Body.Bytes(), &body)
+				parsed, _, err := new(jwt.Parser).ParseUnverified(body["token"], jwt.MapClaims{})
+				if err != nil {
+					t.Fatalf("Invalid token %s: %s", body["token"], err.Error())
+				}
+				if parsed.Method.Alg() != algorithm {
+					t.Errorf("Expected a token signed with %s. Got %s", algorithm, parsed.Method.Alg())
+				}
+				return body["token"], parsed.Header["kid"].(string)
+			}
+			jwks := func() []auth.JWK {
+				t.Helper()
+				response := serve(s, httptest.NewRequest("GET", "/.well-known/jwks.json", nil), "")
+				checkCode(t, http.StatusOK, response)
+				var body map[string][]auth.JWK
+				json.Unmarshal(response.Body.Bytes(), &body)
+				return body["keys"]
+			}
+
+			oldToken, oldKid := login()
+			if keys := jwks(); len(keys) != 1 || keys[0].Kid != oldKid || keys[0].Alg != algorithm {
+				t.Errorf("Expected the key %s. Got %+v", oldKid, keys)
+			}
+
+			if _, err := auth.RotateSigningKey(context.Background(), s.Store); err != nil {
+				t.Fatal(err)
+			}
+			if err := auth.LoadSigningKeys(context.Background(), s.Store); err != nil {
+				t.Fatal(err)
+			}
+			newToken, newKid := login()
+			if newKid == oldKid {
+				t.Errorf("Expected tokens signed with the new key")
+			}
+			if keys := jwks(); len(keys) != 2 {
+				t.Errorf("Expected the new and the retired keys. Got %+v", keys)
+			}
+			// Tokens of the retired key are still valid until they expire
+			checkCode(t, http.StatusOK, serve(s, httptest.NewRequest("GET", "/customers/all", nil), oldToken))
+			checkCode(t, http.StatusOK, serve(s, httptest.NewRequest("GET", "/customers/all", nil), newToken))
+
+			// HS256 tokens are refused, as any other invalid token
+			forged, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"username": "test_user"}).SignedString([]byte(""))
+			checkCode(t, http.StatusBadRequest, serve(s, httptest.NewRequest("GET", "/customers/all", nil), forged))
+		})
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	s, token := newTestServer(t)
+	checkCode(t, http.StatusNotFound, serve(s, httptest.NewRequest("GET", "/users/oidc/login", nil), ""))
+
+	mock := oidctest.NewProvider("crm", "crm_secret")
+	defer mock.Close()
+	c := config.Default().OIDC
+	c.IssuerURL = mock.URL
+	c.ClientID = "crm"
+	c.ClientSecret = "crm_secret"
+	c.RedirectURL = "http://crm.test/users/oidc/callback"
+	c.AdminGroups = "crm-admins"
+	c.UserGroups = "crm-users"
+	oidcProvider = oidc.NewProvider(c)
+	defer func() { oidcProvider = nil }()
+
+	// Follows the URL of the provider until it redirects back, returning the callback request
+	follow := func(u oidctest.User, start *httptest.ResponseRecorder, authURL string) *http.Request {
+		t.Helper()
+		mock.SetUser(u)
+		cookies := start.Result().Cookies()
+		if len(cookies) != 1 || !cookies[0].HttpOnly {
+			t.Fatalf("Expected the state cookie. Got %+v", cookies)
+		}
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		authorized, err := client.Get(authURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authorized.Body.Close()
+		callback := httptest.NewRequest("GET", authorized.Header.Get("Location"), nil)
+		callback.AddCookie(cookies[0])
+		return callback
+	}
+	// Runs the flow until the provider redirects back, returning the callback request
+	authorize := func(u oidctest.User) *http.Request {
+		t.Helper()
+		response := serve(s, httptest.NewRequest("GET", "/users/oidc/login", nil), "")
+		checkCode(t, http.StatusFound, response)
+		return follow(u, response, response.Header().Get("Location"))
+	}
+	login := func(u oidctest.User) (*http.Request, *httptest.ResponseRecorder) {
+		t.Helper()
+		callback := authorize(u)
+		return callback, serve(s, callback, "")
+	}
+	user := func(username string) models.User {
+		t.Helper()
+		u, err := s.Store.Users().Get(context.Background(), username)
+		if err != nil {
+			t.Fatalf("Could not get user %s: %s", username, err.Error())
+		}
+		return u
+	}
+
+	callback, response := login(oidctest.User{Subject: "1", Username: "jane", Groups: []string{"crm-admins"}})
+	checkCode(t, http.StatusAccepted, response)
+	var body map[string]string
+	json.Unmarshal(response.Body.Bytes(), &body)
+	// Provisioned users join no organization until an admin adds them
+	checkCode(t, http.StatusForbidden, serve(s, httptest.NewRequest("GET", "/customers/all", nil), body["token"]))
+	joinOrganization(t, s, 1, "jane")
+	jane := user("jane")
+	if jane.Role != models.RoleAdmin {
+		t.Errorf("Expected jane to be provisioned as admin. Got %+v", jane)
+	}
+	// Logins can only be completed once
+	checkCode(t, http.StatusBadRequest, serve(s, callback, ""))
+	// Provisioned users have no password
+	checkCode(t, http.StatusUnauthorized, serve(s, httptest.NewRequest("POST", "/users/login", bytes.NewBufferString(`{"username":"jane","password":""}`)), ""))
+
+	// The user keeps its username, and its role follows its groups
+	_, response = login(oidctest.User{Subject: "1", Username: "jane.doe", Groups: []string{"crm-users"}})
+	checkCode(t, http.StatusAccepted, response)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	checkCode(t, http.StatusOK, serve(s, httptest.NewRequest("GET", "/customers/all", nil), body["token"]))
+	if u := user("jane"); u.Id != jane.Id || u.Role != models.RoleUser {
+		t.Errorf("Expected jane to be a user now. Got %+v", u)
+	}
+
+	// Existing users are not linked by their username (chosen by the user in most providers), but
+	// by logging in with the provider while authenticated
+	_, response = login(oidctest.User{Subject: "2", Username: "test_user", Groups: []string{"crm-admins"}})
+	checkCode(t, http.StatusConflict, response)
+	link := func(u oidctest.User) *httptest.ResponseRecorder {
+		t.Helper()
+		response := serve(s, httptest.NewRequest("POST", "/users/me/oidc", nil), token)
+		checkCode(t, http.StatusOK, response)
+		json.Unmarshal(response.Body.Bytes(), &body)
+		return serve(s, follow(u, response, body["url"]), "")
+	}
+	checkCode(t, http.StatusOK, link(oidctest.User{Subject: "2", Username: "tester", Groups: []string{"crm-users"}}))
+	checkCode(t, http.StatusConflict, link(oidctest.User{Subject: "3", Username: "tester", Groups: []string{"crm-users"}}))
+	_, response = login(oidctest.User{Subject: "2", Username: "tester", Groups: []string{"crm-users"}})
+	checkCode(t, http.StatusAccepted, response)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	response = serve(s, httptest.NewRequest("GET", "/users/me", nil), body["token"])
+	if !strings.Contains(response.Body.String(), `"username":"test_user"`) {
+		t.Errorf("Expected the linked test_user. Got %s", response.Body.String())
+	}
+
+	_, response = login(oidctest.User{Subject: "4", Username: "john", Groups: []string{"sales"}})
+	checkCode(t, http.StatusForbidden, response)
+
+	// Callbacks without the cookie of the login are refused
+	callback = authorize(oidctest.User{Subject: "1", Username: "jane", Groups: []string{"crm-users"}})
+	checkCode(t, http.StatusBadRequest, serve(s, httptest.NewRequest("GET", callback.URL.String(), nil), ""))
+	checkCode(t, http.StatusAccepted, serve(s, callback, ""))
+
+	// Single sign-on does not bypass two-factor authentication
+	_, response = login(oidctest.User{Subject: "1", Username: "jane", Groups: []string{"crm-users"}})
+	json.Unmarshal(response.Body.Bytes(), &body)
+	janeToken := body["token"]
+	response = serve(s, httptest.NewRequest("POST", "/users/2fa/enroll", nil), janeToken)
+	checkCode(t, http.StatusCreated, response)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	code, _ := totp.Code(body["secret"], totp.Step(time.Now()))
+	checkCode(t, http.StatusOK, serve(s, httptest.NewRequest("POST", "/users/2fa/verify", bytes.NewBufferString(`{"code":"`+code+`"}`)), janeToken))
+	_, response = login(oidctest.User{Subject: "1", Username: "jane", Groups: []string{"crm-users"}})
+	checkCode(t, http.StatusAccepted, response)
+	body = map[string]string{}
+	json.Unmarshal(response.Body.Bytes(), &body)
+	if body["result"] != "two_factor_required" || body["challengeToken"] == "" || body["token"] != "" {
+		t.Errorf("Expected a challenge. Got %s", response.Body.String())
+	}
+	checkCode(t, http.StatusUnauthorized, serve(s, httptest.NewRequest("GET", "/customers/all", nil), body["challengeToken"]))
+
+	// Nor the enrollment of the required roles
+	defer func() { twoFactor = config.Default().TwoFactor }()
+	twoFactor.RequiredRoles = "admin"
+	_, response = login(oidctest.User{Subject: "5", Username: "joe", Groups: []string{"crm-admins"}})
+	body = map[string]string{}
+	json.Unmarshal(response.Body.Bytes(), &body)
+	if body["result"] != "two_factor_enrollment_required" || body["token"] != "" {
+		t.Errorf("Expected an enrollment challenge. Got %s", response.Body.String())
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	defaults := loginLimits
+	defer func() { loginLimits, twoFactor = defaults, config.Default().TwoFactor }()
+	loginLimits = config.Login{}
+	s, token := newTestServer(t)
+	post := func(path, body, token string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		t.Helper()
+		response := serve(s, httptest.NewRequest("POST", path, bytes.NewBufferString(body)), token)
+		var parsed map[string]interface{}
+		json.Unmarshal(response.Body.Bytes(), &parsed)
+		return response, parsed
+	}
+	login := func() (*httptest.ResponseRecorder, map[string]interface{}) {
+		return post("/users/login", `{"username":"test_user","password":"test_password"}`, "")
+	}
+	enroll := func(token string) (secret string, step int64) {
+		t.Helper()
+		response, body := post("/users/2fa/enroll", "", token)
+		checkCode(t, http.StatusCreated, response)
+		secret, _ = body["secret"].(string)
+		if uri, _ := body["uri"].(string); !strings.HasPrefix(uri, "otpauth://totp/") {
+			t.Errorf("Expected an otpauth URI. Got %s", uri)
+		}
+		checkCode(t, http.StatusBadRequest, serve(s, httptest.NewRequest("POST", "/users/2fa/verify", bytes.NewBufferString(`{"code":"000000"}`)), token))
+		return secret, totp.Step(time.Now())
+	}
+	code := func(secret string, step int64) string {
+		code, _ := totp.Code(secret, step)
+		return code
+	}
+
+	secret, step := enroll(token)
+	response, body := post("/users/2fa/verify", `{"code":"`+code(secret, step)+`"}`, token)
+	checkCode(t, http.StatusOK, response)
+	recoveryCodes, _ := body["recoveryCodes"].([]interface{})
+	if len(recoveryCodes) != 10 || body["token"] != nil {
+		t.Fatalf("Expected 10 recovery codes. Got %s", response.Body.String())
+	}
+	checkCode(t, http.StatusConflict, serve(s, httptest.NewRequest("POST", "/users/2fa/enroll", nil), token))
+
+	// Logins need a code now
+	response, body = login()
+	checkCode(t, http.StatusAccepted, response)
+	challenge, _ := body["challengeToken"].(string)
+	if body["result"] != "two_factor_required" || body["token"] != nil {
+		t.Fatalf("Expected a challenge. Got %s", response.Body.String())
+	}
+	checkCode(t, http.StatusUnauthorized, serve(s, httptest.NewRequest("GET", "/customers/all", nil), challenge))
+	// Codes cannot be used twice
+	response, _ = post("/users/login/2fa", `{"challengeToken":"`+challenge+`","code":"`+code(secret, step)+`"}`, "")
+	checkCode(t, http.StatusUnauthorized, response)
+	response, body = post("/users/login/2fa", `{"challengeToken":"`+challenge+`","code":"`+code(secret, step+1)+`"}`, "")
+	checkCode(t, http.StatusAccepted, response)
+	token, _ = body["token"].(string)
+	checkCode(t, http.StatusOK, serve(s, httptest.NewRequest("GET", "/customers/all", nil), token))
+
+	recoveryCode := strings.ToUpper(recoveryCodes[0].(string))
+	response, _ = post("/users/login/2fa", `{"challengeToken":"`+challenge+`","recoveryCode":"`+recoveryCode+`"}`, "")
+	checkCode(t, http.StatusAccepted, response)
+	response, _ = post("/users/login/2fa", `{"challengeToken":"`+challenge+`","recoveryCode":"`+recoveryCode+`"}`, "")
+	checkCode(t, http.StatusUnauthorized, response)
+	// Challenges of users deleted since then
+	deleted, _ := auth.NewChallenge("deleted_user", auth.PurposeTwoFactor, time.Minute)
+	response, _ = post("/users/login/2fa", `{"challengeToken":"`+deleted+`","code":"000000"}`, "")
+	checkCode(t, http.StatusUnauthorized, response)
+
+	req := httptest.NewRequest("DELETE", "/users/2fa", bytes.NewBufferString(`{"recoveryCode":"`+recoveryCodes[1].(string)+`"}`))
+	checkCode(t, http.StatusOK, serve(s, req, token))
+	response, body = login()
+	checkCode(t, http.StatusAccepted, response)
+	if body["token"] == nil {
+		t.Errorf("Expected a token without two-factor authentication. Got %s", response.Body.String())
+	}
+
+	// Users of the required roles must enroll to get a token
+	twoFactor.RequiredRoles = "admin, user"
+	response, body = login()
+	challenge, _ = body["challengeToken"].(string)
+	if body["result"] != "two_factor_enrollment_required" {
+		t.Fatalf("Expected an enrollment challenge. Got %s", response.Body.String())
+	}
+	checkCode(t, http.StatusUnauthorized, serve(s, httptest.NewRequest("GET", "/customers/all", nil), challenge))
+	checkCode(t, http.StatusUnauthorized, serve(s, httptest.NewRequest("GET", "/users/keys", nil), challenge))
+	secret, step = enroll(challenge)
+	response, body = post("/users/2fa/verify", `{"code":"`+code(secret, step)+`"}`, challenge)
+	checkCode(t, http.StatusOK, response)
+	token, _ = body["token"].(string)
+	checkCode(t, http.StatusOK, serve(s, httptest.NewRequest("GET", "/customers/all", nil), token))
+	req = httptest.NewRequest("DELETE", "/users/2fa", bytes.NewBufferString(`{"code":"`+code(secret, step+1)+`"}`))
+	checkCode(t, http.StatusForbidden, serve(s, req, token))
+}
+
+type fakeMailer chan mailer.Message
+
+func (m fakeMailer) Send(ctx context.Context, msg mailer.Message) error {
+	m <- msg
+	return nil
+}
+
+func TestPasswordChangeAndReset(t *testing.T) {
+	defaults := loginLimits
+	defer func() {
+		loginLimits, passwords, passwordMailer = defaults, config.Default().Passwords, mailer.New(config.Default().Mail)
+	}()
+	loginLimits = config.Login{}
+	mails := make(fakeMailer, 3)
+	passwordMailer = mails
+	passwords.ResetURL = "https://crm.example.com/reset?token="
+
+	s, token := newTestServer(t)
+	post := func(path, body, token string) *httptest.ResponseRecorder {
+		return serve(s, httptest.NewRequest("POST", path, bytes.NewBufferString(body)), token)
+	}
+	login := func(password string) string {
+		t.Helper()
+		response := post("/users/login", `{"username":"test_user","password":"`+password+`"}`, "")
+		checkCode(t, http.StatusAccepted, response)
+		var body map[string]string
+		json.Unmarshal(response.Body.Bytes(), &body)
+		return body["token"]
+	}
+
+	// Changing the password revokes the other sessions
+	other := login("test_password")
+	checkCode(t, http.StatusForbidden, post("/users/me/password", `{"currentPassword":"wrong_password","newPassword":"new_password_1"}`, token))
+	checkCode(t, http.StatusBadRequest, post("/users/me/password", `{"currentPassword":"test_password","newPassword":"short"}`, token))
+	response := post("/users/me/password", `{"currentPassword":"test_password","newPassword":"my_test_user_password"}`, token)
+	checkCode(t, http.StatusBadRequest, response)
+	if !strings.Contains(response.Body.String(), "Password too similar to the username") {
+		t.Errorf("Expected the password policy to be checked. Got %s", response.Body.String())
+	}
+	checkCode(t, http.StatusOK, post("/users/me/password", `{"currentPassword":"test_password","newPassword":"new_password_1"}`, token))
+	checkCode(t, http.StatusOK, serve(s, httptest.NewRequest("GET", "/customers/all", nil), token))
+	response = serve(s, httptest.NewRequest("GET", "/customers/all", nil), other)
+	checkCode(t, http.StatusUnauthorized, response)
+	if !strings.Contains(response.Body.String(), "Session revoked") {
+		t.Errorf("Expected the session to be revoked. Got %s", response.Body.String())
+	}
+
+	// Users without email cannot reset it, but the response is the same
+	checkCode(t, http.StatusAccepted, post("/users/password/forgot", `{"username":"test_user"}`, ""))
+	checkCode(t, http.StatusAccepted, post("/users/password/forgot", `{"username":"unknown_user"}`, ""))
+
+	checkCode(t, http.StatusBadRequest, post("/users/register", `{"username":"reset_user","password":"test_password","email":"Reset <reset@example.com>"}`, ""))
+	checkCode(t, http.StatusCreated, post("/users/register", `{"username":"reset_user","password":"test_password","email":"reset@example.com"}`, ""))
+	checkCode(t, http.StatusAccepted, post("/users/password/forgot", `{"username":"reset_user"}`, ""))
+
+	// The requests still queued are mailed when the worker stops, as on shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.SendPasswordResets(ctx)
+	if len(mails) != 1 {
+		t.Fatalf("Expected a single password reset mail. Got %d", len(mails))
+	}
+	msg := <-mails
+	i := strings.Index(msg.Body, passwords.ResetURL)
+	if msg.To != "reset@example.com" || i < 0 {
+		t.Fatalf("Unexpected mail %+v", msg)
+	}
+	resetToken := strings.Fields(msg.Body[i+len(passwords.ResetURL):])[0]
+
+	checkCode(t, http.StatusBadRequest, post("/users/password/reset", `{"token":"invalid","newPassword":"reset_password"}`, ""))
+	checkCode(t, http.StatusBadRequest, post("/users/password/reset", `{"token":"`+resetToken+`","newPassword":"short"}`, ""))
+	checkCode(t, http.StatusOK, post("/users/password/reset", `{"token":"`+resetToken+`","newPassword":"reset_password"}`, ""))
+	checkCode(t, http.StatusBadRequest, post("/users/password/reset", `{"token":"`+resetToken+`","newPassword":"reset_password"}`, ""))
+	checkCode(t, http.StatusAccepted, post("/users/login", `{"username":"reset_user","password":"reset_password"}`, ""))
+}
+
+func TestCurrentUserAndSessions(t *testing.T) {
+	defaults := loginLimits
+	defer func() { loginLimits = defaults }()
+	loginLimits = config.Login{}
+
+	s, token := newTestServer(t)
+	response := serve(s, httptest.NewRequest("GET", "/users/me", nil), token)
+	checkCode(t, http.StatusOK, response)
+	var me struct {
+		Id        int      `json:"id"`
+		Username  string   `json:"username"`
+		Roles     []string `json:"roles"`
+		SessionId string   `json:"sessionId"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &me)
+	if me.Id == 0 || me.Username != "test_user" || len(me.Roles) != 1 || me.SessionId == "" {
+		t.Errorf("Unexpected user %s", response.Body.String())
+	}
+	checkCode(t, http.StatusUnauthorized, serve(s, httptest.NewRequest("GET", "/users/me", nil), ""))
+	// Validly signed tokens must belong to a session, so they can be revoked
+	sessionless, _ := auth.NewChallenge("test_user", "", time.Minute)
+	response = serve(s, httptest.NewRequest("GET", "/users/me", nil), sessionless)
+	checkCode(t, http.StatusUnauthorized, response)
+	if body := response.Body.String(); body != `{"error":"Session required"}` {
+		t.Errorf("Expected the token without session to be refused. Got %s", body)
+	}
+
+	// A second session from another device, refreshed with its refresh token
+	req := httptest.NewRequest("POST", "/users/login", bytes.NewBufferString(`{"username":"test_user","password":"test_password"}`))
+	req.Header.Set("User-Agent", "test-device")
+	response = serve(s, req, "")
+	checkCode(t, http.StatusAccepted, response)
+	var login map[string]string
+	json.Unmarshal(response.Body.Bytes(), &login)
+	refresh := func(refreshToken string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/users/token/refresh", bytes.NewBufferString(`{"refreshToken":"`+refreshToken+`"}`))
+		req.Header.Set("User-Agent", "test-device")
+		return serve(s, req, "")
+	}
+	response = refresh(login["refreshToken"])
+	checkCode(t, http.StatusOK, response)
+	var refreshed map[string]string
+	json.Unmarshal(response.Body.Bytes(), &refreshed)
+	if refreshed["token"] == "" || refreshed["refreshToken"] == "" || refreshed["refreshToken"] == login["refreshToken"] {
+		t.Errorf("Expected new tokens. Got %s", response.Body.String())
+	}
+	checkCode(t, http.StatusUnauthorized, refresh(login["refreshToken"]))
+	checkCode(t, http.StatusOK, serve(s, httptest.NewRequest("GET", "/customers/all", nil), refreshed["token"]))
+
+	response = serve(s, httptest.NewRequest("GET", "/users/me/sessions", nil), token)
+	checkCode(t, http.StatusOK, response)
+	var sessions []struct {
+		Id      string `json:"id"`
+		Device  string `json:"device"`
+		Current bool   `json:"current"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &sessions)
+	if len(sessions) != 2 || sessions[0].Current || sessions[0].Device != "test-device" || !sessions[1].Current || sessions[1].Id != me.SessionId {
+		t.Fatalf("Expected both sessions, the refreshed one first. Got %s", response.Body.String())
+	}
+
+	// Revoking a session refuses its tokens
+	checkCode(t, http.StatusOK, serve(s, httptest.NewRequest("DELETE", "/users/me/sessions/"+sessions[0].Id, nil), token))
+	checkCode(t, http.StatusNotFound, serve(s, httptest.NewRequest("DELETE", "/users/me/sessions/"+sessions[0].Id, nil), token))
+	checkCode(t, http.StatusUnauthorized, serve(s, httptest.NewRequest("GET", "/customers/all", nil), refreshed["token"]))
+	checkCode(t, http.StatusUnauthorized, refresh(refreshed["refreshToken"]))
+
+	// API keys can tell who they are, but not manage the sessions
+	response = serve(s, httptest.NewRequest("POST", "/users/keys", bytes.NewBufferString(`{"name":"ETL","scopes":["customers:read"]}`)), token)
+	checkCode(t, http.StatusCreated, response)
+	var created map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &created)
+	req = httptest.NewRequest("GET", "/users/me", nil)
+	req.Header.Set("X-API-Key", created["key"].(string))
+	response = serve(s, req, "")
+	checkCode(t, http.StatusOK, response)
+	if !strings.Contains(response.Body.String(), `"apiKey":{`) {
+		t.Errorf("Expected the API key. Got %s", response.Body.String())
+	}
+	req = httptest.NewRequest("GET", "/users/me/sessions", nil)
+	req.Header.Set("X-API-Key", created["key"].(string))
+	checkCode(t, http.StatusForbidden, serve(s, req, ""))
+}
+
+func TestOrganizations(t *testing.T) {
+	s, token := newTestServer(t)
+	request := func(method, path, body, token string) *httptest.ResponseRecorder {
+		return serve(s, httptest.NewRequest(method, path, bytes.NewBufferString(body)), token)
+	}
+	checkCode(t, http.StatusCreated, request("POST", "/users/register", `{"username":"test_admin","password":"test_password"}`, ""))
+	s.Store.Users().UpdateRole(context.Background(), &models.User{Username: "test_admin", Role: models.RoleAdmin})
+	response := request("POST", "/users/login", `{"username":"test_admin","password":"test_password"}`, "")
+	var login map[string]string
+	json.Unmarshal(response.Body.Bytes(), &login)
+	adminToken := login["token"]
+
+	checkCode(t, http.StatusForbidden, request("GET", "/organizations", "", token))
+	checkCode(t, http.StatusForbidden, request("POST", "/organizations", `{"name":"Acme"}`, token))
+	// Admins without organization manage them, but cannot access any customer
+	checkCode(t, http.StatusForbidden, request("GET", "/customers/all", "", adminToken))
+	checkCode(t, http.StatusBadRequest, request("POST", "/organizations", `{"name":" "}`, adminToken))
+	response = request("POST", "/organizations", `{"name":"Acme"}`, adminToken)
+	checkCode(t, http.StatusCreated, response)
+	var acme models.Organization
+	json.Unmarshal(response.Body.Bytes(), &acme)
+	checkCode(t, http.StatusConflict, request("POST", "/organizations", `{"name":"Acme"}`, adminToken))
+	members := "/organizations/" + strconv.Itoa(acme.Id) + "/members/"
+	checkCode(t, http.StatusOK, request("PUT", members+"test_user", "", adminToken))
+	checkCode(t, http.StatusNotFound, request("PUT", members+"unknown_user", "", adminToken))
+	checkCode(t, http.StatusNotFound, request("PUT", "/organizations/1000/members/test_user", "", adminToken))
+	response = request("GET", "/organizations/"+strconv.Itoa(acme.Id)+"/members", "", adminToken)
+	checkCode(t, http.StatusOK, response)
+	if body := response.Body.String(); !strings.Contains(body, `"username":"test_user"`) {
+		t.Errorf("Expected test_user to be a member. Got %s", body)
+	}
+
+	// The customers of the first organization are not visible from the second one
+	response = request("POST", "/customers/", `{"name":"Name","surname":"Surname"}`, token)
+	checkCode(t, http.StatusCreated, response)
+	var c models.CustomerOut
+	json.Unmarshal(response.Body.Bytes(), &c)
+	response = request("GET", "/users/me/organizations", "", token)
+	checkCode(t, http.StatusOK, response)
+	var organizations []organizationResponse
+	json.Unmarshal(response.Body.Bytes(), &organizations)
+	if len(organizations) != 2 || !organizations[0].Active || organizations[1].Active {
+		t.Errorf("Expected both organizations, the first one active. Got %s", response.Body.String())
+	}
+
+	checkCode(t, http.StatusForbidden, request("PUT", "/users/me/organization", `{"organizationId":1000}`, token))
+	response = request("PUT", "/users/me/organization", `{"organizationId":`+strconv.Itoa(acme.Id)+`}`, token)
+	checkCode(t, http.StatusOK, response)
+	json.Unmarshal(response.Body.Bytes(), &login)
+	acmeToken := login["token"]
+	checkCode(t, http.StatusUnauthorized, request("GET", "/customers/all", "", token))
+	response = request("GET", "/customers/all", "", acmeToken)
+	checkCode(t, http.StatusOK, response)
+	if body := response.Body.String(); body != "[]" {
+		t.Errorf("Expected no customers in the second organization. Got %s", body)
+	}
+	checkCode(t, http.StatusNotFound, request("GET", "/customers/"+strconv.Itoa(c.Id), "", acmeToken))
+	checkCode(t, http.StatusForbidden, request("GET", "/customers/"+strconv.Itoa(c.Id)+"/attachments", "", adminToken))
+
+	// Removed members lose access to the organization
+	checkCode(t, http.StatusOK, request("DELETE", members+"test_user", "", adminToken))
+	checkCode(t, http.StatusNotFound, request("DELETE", members+"test_user", "", adminToken))
+	checkCode(t, http.StatusUnauthorized, request("GET", "/customers/all", "", acmeToken))
+}
+
+func TestCustomerOwnership(t *testing.T) {
+	s, token := newTestServer(t)
+	request := func(method, path, body, token string) *httptest.ResponseRecorder {
+		return serve(s, httptest.NewRequest(method, path, bytes.NewBufferString(body)), token)
+	}
+	login := func(username string) string {
+		t.Helper()
+		credentials := `{"username":"` + username + `","password":"test_password"}`
+		checkCode(t, http.StatusCreated, request("POST", "/users/register", credentials, ""))
+		joinOrganization(t, s, 1, username)
+		response := request("POST", "/users/login", credentials, "")
+		var login map[string]string
+		json.Unmarshal(response.Body.Bytes(), &login)
+		return login["token"]
+	}
+	colleagueToken := login("test_colleague")
+	s.Store.Users().Create(context.Background(), &models.User{Username: "test_admin", Password: "test_password"})
+	s.Store.Users().UpdateRole(context.Background(), &models.User{Username: "test_admin", Role: models.RoleAdmin})
+	joinOrganization(t, s, 1, "test_admin")
+	response := request("POST", "/users/login", `{"username":"test_admin","password":"test_password"}`, "")
+	var adminLogin map[string]string
+	json.Unmarshal(response.Body.Bytes(), &adminLogin)
+	adminToken := adminLogin["token"]
+
+	response = request("POST", "/customers/", `{"name":"Name","surname":"Surname"}`, token)
+	checkCode(t, http.StatusCreated, response)
+	var c models.CustomerOut
+	json.Unmarshal(response.Body.Bytes(), &c)
+	customer := "/customers/" + strconv.Itoa(c.Id)
+
+	// Only the owner and the admins see the customer
+	checkCode(t, http.StatusNotFound, request("GET", customer, "", colleagueToken))
+	checkCode(t, http.StatusNotFound, request("PUT", customer, `{"name":"Name","surname":"Surname"}`, colleagueToken))
+	checkCode(t, http.StatusNotFound, request("DELETE", customer, "", colleagueToken))
+	checkCode(t, http.StatusOK, request("GET", customer, "", adminToken))
+	if body := request("GET", "/customers/all", "", colleagueToken).Body.String(); body != "[]" {
+		t.Errorf("Expected no customers for the colleague. Got %s", body)
+	}
+
+	// Teams are managed by the admins, and customers shared with them by their owners
+	checkCode(t, http.StatusForbidden, request("POST", "/teams", `{"name":"Sales"}`, token))
+	response = request("POST", "/teams", `{"name":"Sales"}`, adminToken)
+	checkCode(t, http.StatusCreated, response)
+	var team models.Team
+	json.Unmarshal(response.Body.Bytes(), &team)
+	checkCode(t, http.StatusConflict, request("POST", "/teams", `{"name":"Sales"}`, adminToken))
+	members := "/teams/" + strconv.Itoa(team.Id) + "/members/"
+	checkCode(t, http.StatusOK, request("PUT", members+"test_colleague", "", adminToken))
+	checkCode(t, http.StatusNotFound, request("PUT", "/teams/1000/members/test_colleague", "", adminToken))
+	response = request("GET", "/teams", "", token)
+	checkCode(t, http.StatusOK, response)
+	if body := response.Body.String(); !strings.Contains(body, `"members":["test_colleague"]`) {
+		t.Errorf("Expected the team with its member. Got %s", body)
+	}
+
+	teams := `{"name":"Name","surname":"Surname","teams":[` + strconv.Itoa(team.Id) + `]}`
+	checkCode(t, http.StatusBadRequest, request("PUT", customer, `{"name":"Name","surname":"Surname","teams":[1000]}`, token))
+	checkCode(t, http.StatusOK, request("PUT", customer, teams, token))
+	response = request("GET", customer, "", colleagueToken)
+	checkCode(t, http.StatusOK, response)
+	if body := response.Body.String(); !strings.Contains(body, `"owner":"test_user"`) {
+		t.Errorf("Expected the owner of the shared customer. Got %s", body)
+	}
+	checkCode(t, http.StatusForbidden, request("PUT", customer, `{"name":"Name","surname":"Surname","teams":[]}`, colleagueToken))
+	checkCode(t, http.StatusOK, request("PUT", customer, `{"name":"Shared","surname":"Surname"}`, colleagueToken))
+	if body := request("GET", "/customers/all?mine=true", "", colleagueToken).Body.String(); body != "[]" {
+		t.Errorf("Expected no customers owned by the colleague. Got %s", body)
+	}
+
+	// Bulk reassignment by the owner
+	reassign := func(ids, owner string) string {
+		return `{"customerIds":[` + ids + `],"owner":"` + owner + `"}`
+	}
+	checkCode(t, http.StatusForbidden, request("POST", "/customers/reassign", reassign(strconv.Itoa(c.Id), "test_colleague"), colleagueToken))
+	checkCode(t, http.StatusNotFound, request("POST", "/customers/reassign", reassign(strconv.Itoa(c.Id)+",1000", "test_colleague"), token))
+	checkCode(t, http.StatusBadRequest, request("POST", "/customers/reassign", reassign(strconv.Itoa(c.Id), "unknown_user"), token))
+	checkCode(t, http.StatusBadRequest, request("POST", "/customers/reassign", reassign("", "test_colleague"), token))
+	response = request("POST", "/customers/reassign", reassign(strconv.Itoa(c.Id), "test_colleague"), token)
+	checkCode(t, http.StatusOK, response)
+	if body := response.Body.String(); !strings.Contains(body, `"reassigned":1`) {
+		t.Errorf("Expected 1 customer reassigned. Got %s", body)
+	}
+	response = request("GET", "/customers/all?mine=true", "", colleagueToken)
+	var mine []models.CustomerOut
+	json.Unmarshal(response.Body.Bytes(), &mine)
+	if len(mine) != 1 || mine[0].Id != c.Id || mine[0].Owner != "test_colleague" {
+		t.Errorf("Expected the reassigned customer. Got %s", response.Body.String())
+	}
+	// The previous owner only keeps access through the team
+	checkCode(t, http.StatusNotFound, request("GET", customer, "", token))
+	checkCode(t, http.StatusOK, request("PUT", members+"test_user", "", adminToken))
+	checkCode(t, http.StatusOK, request("GET", customer, "", token))
+	checkCode(t, http.StatusOK, request("DELETE", members+"test_user", "", adminToken))
+	checkCode(t, http.StatusNotFound, request("DELETE", members+"test_user", "", adminToken))
+	checkCode(t, http.StatusNotFound, request("GET", customer, "", token))
+
+	checkCode(t, http.StatusOK, request("DELETE", "/teams/"+strconv.Itoa(team.Id), "", adminToken))
+	checkCode(t, http.StatusNotFound, request("DELETE", "/teams/"+strconv.Itoa(team.Id), "", adminToken))
+}
@@ -0,0 +1,323 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"theam.io/jdavidsanchez/test_crm_api/auth"
+	"theam.io/jdavidsanchez/test_crm_api/config"
+	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/totp"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+/*****************************************
+Two-factor authentication (TOTP) routes
+******************************************/
+
+var twoFactor = config.Default().TwoFactor
+
+const recoveryCodeCount = 10
+
+// Users of the roles must enroll before getting a token
+func twoFactorRequired(role string) bool {
+	for _, required := range config.List(twoFactor.RequiredRoles) {
+		if strings.EqualFold(required, role) {
+			return true
+		}
+	}
+	return false
+}
+
+type twoFactorRequest struct {
+	ChallengeToken string `json:"challengeToken"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recoveryCode"`
+}
+
+func decodeTwoFactorRequest(w http.ResponseWriter, r *http.Request) (twoFactorRequest, bool) {
+	var req twoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+		return req, false
+	}
+	defer r.Body.Close()
+	return req, true
+}
+
+// Completes the login after the password with a challenge token, sent instead of the JWT when the
+// user has enabled two-factor authentication or must enroll
+func (s *Server) loginChallenge(w http.ResponseWriter, r *http.Request, u models.User) (sent bool) {
+	tf, err := s.Store.TwoFactor().Get(r.Context(), u.Id)
+	if err != nil {
+		internalError(w, r, err)
+		return true
+	}
+	result, purpose := "two_factor_required", auth.PurposeTwoFactor
+	if !tf.Enabled {
+		if !twoFactorRequired(u.Role) {
+			return false
+		}
+		result, purpose = "two_factor_enrollment_required", auth.PurposeEnrollment
+	}
+	challenge, err := auth.NewChallenge(u.Username, purpose, twoFactor.ChallengeLifetime)
+	if err != nil {
+		internalError(w, r, err)
+		return true
+	}
+	utils.ResponseJSON(w, http.StatusAccepted, map[string]string{"result": result, "challengeToken": challenge})
+	return true
+}
+
+// Exchanges a challenge token and a code (or a recovery code) for the JWT
+func (s *Server) loginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeTwoFactorRequest(w, r)
+	if !ok {
+		return
+	}
+	username, err := auth.ParseChallenge(r.Context(), req.ChallengeToken, auth.PurposeTwoFactor)
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	u, err := s.Store.Users().Get(r.Context(), username)
+	if err == sql.ErrNoRows {
+		// Deleted after the challenge was issued
+		utils.ResponseJSON(w, http.StatusUnauthorized, map[string]string{"error": models.ErrUserNotFound.Error()})
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if !s.checkTwoFactorCode(w, r, u, req) {
+		return
+	}
+	loginAttempts.WithLabelValues("success").Inc()
+	if loginLimits.LockoutThreshold > 0 {
+		if err = s.Store.Users().LoginSucceeded(r.Context(), username); err != nil {
+			internalError(w, r, err)
+			return
+		}
+	}
+
+	auth.SetJWT(s.Store.Sessions(), u, clientIP(r), w, r)
+}
+
+// Checks the code or the recovery code of the request, which can only be used once. Codes are
+// limited and lock the user as the passwords, so they cannot be guessed. The response is already
+// sent if not valid
+func (s *Server) checkTwoFactorCode(w http.ResponseWriter, r *http.Request, u models.User, req twoFactorRequest) bool {
+	wait, err := s.checkLoginLimits(r.Context(), clientIP(r), u.Username)
+	if err != nil {
+		internalError(w, r, err)
+		return false
+	}
+	if wait > 0 {
+		loginAttempts.WithLabelValues("limited").Inc()
+		tooManyLoginAttempts(w, wait)
+		return false
+	}
+
+	tf, err := s.Store.TwoFactor().Get(r.Context(), u.Id)
+	if err != nil {
+		internalError(w, r, err)
+		return false
+	}
+	valid := false
+	if tf.Enabled && req.Code != "" {
+		if step, ok := totp.Validate(tf.Secret, req.Code, time.Now()); ok {
+			valid, err = s.Store.TwoFactor().UseStep(r.Context(), u.Id, step)
+		}
+	} else if tf.Enabled && req.RecoveryCode != "" {
+		valid, err = s.Store.TwoFactor().UseRecoveryCode(r.Context(), u.Id, auth.HashRecoveryCode(req.RecoveryCode))
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return false
+	}
+	if !valid {
+		loginAttempts.WithLabelValues("failure").Inc()
+		if loginLimits.LockoutThreshold > 0 {
+			_, err = s.Store.Users().LoginFailed(r.Context(), u.Username, lockoutPolicy())
+			utils.CheckErr(err)
+		}
+		utils.ResponseJSON(w, http.StatusUnauthorized, map[string]string{"error": "Invalid code"})
+		return false
+	}
+	return true
+}
+
+// Returns the user managing its two-factor authentication, which cannot be done with an API key.
+// The response is already sent if not found
+func (s *Server) twoFactorUser(w http.ResponseWriter, r *http.Request) (models.User, auth.Identity, bool) {
+	i, _ := auth.GetIdentity(r.Context())
+	if i.APIKey != nil {
+		utils.ResponseJSON(w, http.StatusForbidden, map[string]string{"error": "API keys cannot manage two-factor authentication"})
+		return models.User{}, i, false
+	}
+	u, err := s.Store.Users().Get(r.Context(), i.Username)
+	if err != nil {
+		internalError(w, r, err)
+		return models.User{}, i, false
+	}
+	return u, i, true
+}
+
+func (s *Server) getTwoFactor(w http.ResponseWriter, r *http.Request) {
+	u, _, ok := s.twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+	tf, err := s.Store.TwoFactor().Get(r.Context(), u.Id)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusOK, map[string]interface{}{
+		"enabled":       tf.Enabled,
+		"required":      twoFactorRequired(u.Role),
+		"recoveryCodes": tf.RecoveryCodes,
+	})
+}
+
+// Generates the secret of the user, enabled once a code is verified
+func (s *Server) enrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	u, _, ok := s.twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+	tf, err := s.Store.TwoFactor().Get(r.Context(), u.Id)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if tf.Enabled {
+		utils.ResponseJSON(w, http.StatusConflict, map[string]string{"error": "Two-factor authentication already enabled"})
+		return
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if err = s.Store.TwoFactor().SetSecret(r.Context(), u.Id, secret); err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusCreated, map[string]string{
+		"secret": secret,
+		"uri":    totp.URI(twoFactor.Issuer, u.Username, secret),
+	})
+}
+
+// Enables the enrolled secret with a code, returning the recovery codes (and the JWT if enrolling
+// with an enrollment challenge)
+func (s *Server) verifyTwoFactor(w http.ResponseWriter, r *http.Request) {
+	u, i, ok := s.twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+	req, ok := decodeTwoFactorRequest(w, r)
+	if !ok {
+		return
+	}
+	tf, err := s.Store.TwoFactor().Get(r.Context(), u.Id)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if tf.Enabled || tf.Secret == "" {
+		utils.ResponseJSON(w, http.StatusConflict, map[string]string{"error": "No two-factor authentication enrollment to verify"})
+		return
+	}
+	step, valid := totp.Validate(tf.Secret, req.Code, time.Now())
+	if !valid {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid code"})
+		return
+	}
+	codes, hashes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	err = s.Store.InTx(r.Context(), func(tx models.Store) error {
+		if err := tx.TwoFactor().Enable(r.Context(), u.Id, step); err != nil {
+			return err
+		}
+		return tx.TwoFactor().SetRecoveryCodes(r.Context(), u.Id, hashes)
+	})
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	response := map[string]interface{}{"result": "success", "recoveryCodes": codes}
+	if i.Enrolling {
+		tokens, err := auth.NewSession(r.Context(), s.Store.Sessions(), u, r.UserAgent(), clientIP(r))
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		response["token"], response["refreshToken"] = tokens.Token, tokens.RefreshToken
+	}
+	utils.ResponseJSON(w, http.StatusOK, response)
+}
+
+// Replaces the recovery codes of the user, with a code
+func (s *Server) regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	u, _, ok := s.twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+	req, ok := decodeTwoFactorRequest(w, r)
+	if !ok {
+		return
+	}
+	if !s.checkTwoFactorCode(w, r, u, twoFactorRequest{Code: req.Code}) {
+		return
+	}
+	codes, hashes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	err = s.Store.InTx(r.Context(), func(tx models.Store) error {
+		return tx.TwoFactor().SetRecoveryCodes(r.Context(), u.Id, hashes)
+	})
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusOK, map[string]interface{}{"result": "success", "recoveryCodes": codes})
+}
+
+// Disables two-factor authentication, with a code or a recovery code
+func (s *Server) disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	u, _, ok := s.twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+	req, ok := decodeTwoFactorRequest(w, r)
+	if !ok {
+		return
+	}
+	if twoFactorRequired(u.Role) {
+		utils.ResponseJSON(w, http.StatusForbidden, map[string]string{"error": "Two-factor authentication is required for the " + u.Role + " role"})
+		return
+	}
+	if !s.checkTwoFactorCode(w, r, u, req) {
+		return
+	}
+	err := s.Store.InTx(r.Context(), func(tx models.Store) error {
+		return tx.TwoFactor().Disable(r.Context(), u.Id)
+	})
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	utils.ResponseJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
@@ -0,0 +1,369 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"theam.io/jdavidsanchez/test_crm_api/auth"
+	"theam.io/jdavidsanchez/test_crm_api/logging"
+	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+/*****************************************
+Resumable picture upload routes (tus 1.0.0)
+******************************************/
+
+const tusVersion = "1.0.0"
+
+var uploadExpiration = 24 * time.Hour
+
+// PATCH requests to the same upload must not write to its file at the same time
+var uploadLocks = struct {
+	sync.Mutex
+	m map[string]*uploadLock
+}{m: make(map[string]*uploadLock)}
+
+type uploadLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Sets the tus headers in every response and rejects unsupported protocol versions
+func tusResumable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func uploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,expiration,termination")
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(utils.MaxResumableSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid Upload-Length"})
+		return
+	}
+	if length > utils.MaxResumableSize {
+		utils.ResponseJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": "Upload too large"})
+		return
+	}
+	metadata := r.Header.Get("Upload-Metadata")
+	if _, err = parseUploadMetadata(metadata); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid Upload-Metadata"})
+		return
+	}
+
+	i, _ := auth.GetIdentity(r.Context())
+	userId := i.UserId
+
+	id, err := utils.RandomToken(16)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	u := models.Upload{
+		Id:        id,
+		UserId:    userId,
+		Length:    length,
+		Metadata:  metadata,
+		FilePath:  path.Join(utils.PathToUploadsDir, id),
+		ExpiresAt: time.Now().Add(uploadExpiration),
+	}
+
+	err = os.MkdirAll(utils.PathToUploadsDir, 0755)
+	if err == nil {
+		var f *os.File
+		f, err = os.OpenFile(u.FilePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			f.Close()
+		}
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	err = s.Store.Uploads().Create(r.Context(), &u)
+	if err != nil {
+		utils.CheckErr(os.Remove(u.FilePath))
+		internalError(w, r, err)
+		return
+	}
+
+	// Empty files are complete as soon as they are created
+	if u.IsComplete() && !s.finishUpload(w, r, &u) {
+		return
+	}
+
+	w.Header().Set("Location", r.URL.Path+"/"+u.Id)
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) getUploadStatus(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.getUploadFromParams(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	if u.Metadata != "" {
+		w.Header().Set("Upload-Metadata", u.Metadata)
+	}
+	if u.PictureId != 0 {
+		w.Header().Set("Picture-Id", strconv.Itoa(u.PictureId))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) patchUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		utils.ResponseJSON(w, http.StatusUnsupportedMediaType, map[string]string{"error": "Invalid Content-Type"})
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid Upload-Offset"})
+		return
+	}
+
+	unlock := lockUpload(mux.Vars(r)["uploadId"])
+	defer unlock()
+
+	u, ok := s.getUploadFromParams(w, r)
+	if !ok {
+		return
+	}
+	if offset != u.Offset {
+		utils.ResponseJSON(w, http.StatusConflict, map[string]string{"error": "Upload-Offset does not match"})
+		return
+	}
+	// Complete uploads without picture (whose completion failed) are completed again
+	if u.IsComplete() && u.PictureId != 0 {
+		utils.ResponseJSON(w, http.StatusForbidden, map[string]string{"error": "Upload already completed"})
+		return
+	}
+
+	f, err := os.OpenFile(u.FilePath, os.O_WRONLY, 0600)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	_, err = f.Seek(u.Offset, io.SeekStart)
+	if err != nil {
+		f.Close()
+		internalError(w, r, err)
+		return
+	}
+
+	// Whatever was received is kept even if the connection breaks, so the client can resume from there
+	written, copyErr := io.Copy(f, io.LimitReader(r.Body, u.Length-u.Offset))
+	f.Close()
+	uploadedBytes.WithLabelValues("resumable").Add(float64(written))
+
+	u.Offset += written
+	u.ExpiresAt = time.Now().Add(uploadExpiration)
+	if u.IsComplete() {
+		// The final offset is only stored with the picture, so a failed completion is retried by
+		// sending the last chunk again
+		if !s.finishUpload(w, r, &u) {
+			return
+		}
+	} else {
+		err = s.Store.Uploads().UpdateOffset(r.Context(), &u)
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		if copyErr != nil {
+			logging.Warn(r.Context(), "Upload interrupted", logging.Fields{"uploadId": u.Id, "offset": u.Offset, "error": copyErr.Error()})
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) deleteUpload(w http.ResponseWriter, r *http.Request) {
+	i, _ := auth.GetIdentity(r.Context())
+	userId := i.UserId
+
+	unlock := lockUpload(mux.Vars(r)["uploadId"])
+	defer unlock()
+
+	u, err := s.Store.Uploads().Delete(r.Context(), userId, mux.Vars(r)["uploadId"])
+	if err != nil {
+		utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	// Once completed, the file belongs to the picture
+	if u.PictureId == 0 {
+		utils.CheckErr(os.Remove(u.FilePath))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Completes the upload, setting the Picture-Id header. Otherwise the error response is sent, and
+// uploads of files that are not pictures are removed, as they can never be completed
+func (s *Server) finishUpload(w http.ResponseWriter, r *http.Request, u *models.Upload) bool {
+	err := s.completeUpload(r.Context(), u)
+	if err == utils.ErrUnsupportedPicture {
+		if _, err = s.Store.Uploads().Delete(r.Context(), u.UserId, u.Id); err != nil {
+			internalError(w, r, err)
+			return false
+		}
+		utils.CheckErr(os.Remove(u.FilePath))
+		utils.ResponseJSON(w, http.StatusUnsupportedMediaType, map[string]string{"error": utils.ErrUnsupportedPicture.Error()})
+		return false
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return false
+	}
+	w.Header().Set("Picture-Id", strconv.Itoa(u.PictureId))
+	return true
+}
+
+// Moves the uploaded file to the images directory and adds it as a picture, storing the final
+// offset of the upload in the same transaction. The extension comes from the sniffed type, not
+// from the filename of the metadata
+func (s *Server) completeUpload(ctx context.Context, u *models.Upload) error {
+	ext, err := utils.PictureExtension(u.FilePath)
+	if err != nil {
+		return err
+	}
+	newFileName, err := utils.MoveFile(u.FilePath, utils.ImagesDir, "picture"+ext)
+	if err != nil {
+		return err
+	}
+	p := models.PicturePath{
+		Path: path.Join(utils.PathFileServer, newFileName),
+	}
+
+	err = s.Store.InTx(ctx, func(tx models.Store) error {
+		if err := tx.Uploads().UpdateOffset(ctx, u); err != nil {
+			return err
+		}
+		return tx.Uploads().Complete(ctx, u, &p)
+	})
+	if err != nil {
+		// Give the file back to the upload, so completing it can be retried
+		utils.CheckErr(os.Rename(path.Join(utils.ImagesDir, newFileName), u.FilePath))
+	}
+	return err
+}
+
+// CollectExpiredUploads removes the expired uploads, and the files of the incomplete ones, every
+// interval until the context is done. A collection in progress is always finished before returning
+func (s *Server) CollectExpiredUploads(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.collectExpiredUploads(ctx)
+		}
+	}
+}
+
+func (s *Server) collectExpiredUploads(ctx context.Context) {
+	files, err := s.Store.Uploads().DeleteExpired(ctx)
+	if err != nil {
+		utils.CheckErr(err)
+		return
+	}
+	for _, f := range files {
+		utils.CheckErr(os.Remove(f))
+	}
+}
+
+// Gets the upload of the request parameters, writing the error response if it fails
+func (s *Server) getUploadFromParams(w http.ResponseWriter, r *http.Request) (models.Upload, bool) {
+	i, _ := auth.GetIdentity(r.Context())
+	userId := i.UserId
+
+	u, err := s.Store.Uploads().Get(r.Context(), userId, mux.Vars(r)["uploadId"])
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			w.Header().Set("Cache-Control", "no-store")
+			utils.ResponseJSON(w, http.StatusNotFound, map[string]string{"error": "Upload not found"})
+		default:
+			internalError(w, r, err)
+		}
+		return u, false
+	}
+	return u, true
+}
+
+func lockUpload(id string) func() {
+	uploadLocks.Lock()
+	l, ok := uploadLocks.m[id]
+	if !ok {
+		l = &uploadLock{}
+		uploadLocks.m[id] = l
+	}
+	l.refs++
+	uploadLocks.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		uploadLocks.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(uploadLocks.m, id)
+		}
+		uploadLocks.Unlock()
+	}
+}
+
+// Upload-Metadata is a comma separated list of "key base64value" pairs
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if header == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		var value []byte
+		if len(kv) == 2 {
+			var err error
+			value, err = base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		metadata[kv[0]] = string(value)
+	}
+	return metadata, nil
+}
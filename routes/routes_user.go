@@ -3,11 +3,11 @@ package routes
 import (
 	"encoding/json"
 	"net/http"
-	"unicode/utf8"
+	"strconv"
 
 	"theam.io/jdavidsanchez/test_crm_api/auth"
-	"theam.io/jdavidsanchez/test_crm_api/db"
 	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/passwd"
 	"theam.io/jdavidsanchez/test_crm_api/utils"
 )
 
@@ -15,7 +15,7 @@ import (
 User auth routes
 ****************/
 
-func registerUser(w http.ResponseWriter, r *http.Request) {
+func (s *Server) registerUser(w http.ResponseWriter, r *http.Request) {
 	var u models.User
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&u)
@@ -25,21 +25,25 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	if len := utf8.RuneCountInString(string(u.Password)); len < 12 {
-		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Password less than 12 characters"})
+	if err = passwd.Check(u.Username, u.Password); err != nil {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if u.Email != "" && !models.ValidEmail(u.Email) {
+		utils.ResponseJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid email"})
 		return
 	}
 
-	err = u.CreateUser(db.DB)
+	err = s.Store.Users().Create(r.Context(), &u)
 	if err != nil {
-		utils.ResponseJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		internalError(w, r, err)
 		return
 	}
 
 	utils.ResponseJSON(w, http.StatusCreated, map[string]string{"result": "success"})
 }
 
-func loginUser(w http.ResponseWriter, r *http.Request) {
+func (s *Server) loginUser(w http.ResponseWriter, r *http.Request) {
 	var u models.User
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&u)
@@ -49,11 +53,50 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	err = u.LoginUser(db.DB)
+	// Checked before the password, so the attempts over the limits don't cost a hash
+	username := u.Username
+	wait, err := s.checkLoginLimits(r.Context(), clientIP(r), username)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if wait > 0 {
+		loginAttempts.WithLabelValues("limited").Inc()
+		tooManyLoginAttempts(w, wait)
+		return
+	}
+
+	err = s.Store.Users().Login(r.Context(), &u)
+	if err == models.ErrCanceled || err == models.ErrTimeout {
+		internalError(w, r, err)
+		return
+	}
 	if err != nil {
+		loginAttempts.WithLabelValues("failure").Inc()
+		if loginLimits.LockoutThreshold > 0 {
+			_, err = s.Store.Users().LoginFailed(r.Context(), username, lockoutPolicy())
+			utils.CheckErr(err)
+		}
 		utils.ResponseJSON(w, http.StatusUnauthorized, map[string]string{"error": "Invalid credentials"})
 		return
 	}
+	// The failures are only reset once the code is checked too
+	if s.loginChallenge(w, r, u) {
+		return
+	}
+	loginAttempts.WithLabelValues("success").Inc()
+	if loginLimits.LockoutThreshold > 0 {
+		if err = s.Store.Users().LoginSucceeded(r.Context(), username); err != nil {
+			internalError(w, r, err)
+			return
+		}
+	}
+
+	auth.SetJWT(s.Store.Sessions(), u, clientIP(r), w, r)
+}
 
-	auth.SetJWT(u.Username, w, r)
-}
\ No newline at end of file
+// Public keys verifying the tokens, cached by the clients until the next refresh of the keys
+func jwks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(jwksMaxAge.Seconds())))
+	utils.ResponseJSON(w, http.StatusOK, auth.JWKS())
+}
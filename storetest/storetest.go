@@ -0,0 +1,1317 @@
+package storetest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"theam.io/jdavidsanchez/test_crm_api/models"
+	"theam.io/jdavidsanchez/test_crm_api/passwd"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+/*********************************************************************
+Conformance suite of the repositories, run against every implementation
+**********************************************************************/
+
+// Run checks the behaviour the route handlers expect from a store. newStore must return a store
+// without customers, attachments, uploads, teams or organizations (but the Default one), with the
+// placeholder picture (ID 1)
+func Run(t *testing.T, newStore func(t *testing.T) models.Store) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s models.Store)
+	}{
+		{"Users", testUsers},
+		{"Pictures", testPictures},
+		{"Customers", testCustomers},
+		{"Customer ownership", testOwnership},
+		{"Attachments", testAttachments},
+		{"Uploads", testUploads},
+		{"Password rehash", testPasswordRehash},
+		{"Login lockout", testLoginLockout},
+		{"Rate limits", testRateLimits},
+		{"API keys", testAPIKeys},
+		{"Signing keys", testSigningKeys},
+		{"Single sign-on", testOIDC},
+		{"Two-factor authentication", testTwoFactor},
+		{"Sessions", testSessions},
+		{"Password resets", testPasswordResets},
+		{"Organizations", testOrganizations},
+		{"Transactions", testTransactions},
+		{"Cancelled context", testCancelledContext},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStore(t))
+		})
+	}
+}
+
+var placeholderPath = path.Join(utils.PathFileServer, utils.PlaceholderPicture)
+
+// Creates a user (users are never deleted), returning its ID
+func createUser(t *testing.T, s models.Store, username string) int {
+	t.Helper()
+	ctx := context.Background()
+	u := models.User{Username: username, Password: "storetest_password"}
+	if err := s.Users().Create(ctx, &u); err != nil {
+		t.Fatalf("Could not create user %s: %s", username, err.Error())
+	}
+	id, err := s.Users().GetId(ctx, username)
+	if err != nil {
+		t.Fatalf("Could not get user %s: %s", username, err.Error())
+	}
+	return id
+}
+
+// Creates an organization, returning a context limited to it, with access to all of its customers
+// as an admin
+func createOrganization(t *testing.T, s models.Store, name string) context.Context {
+	t.Helper()
+	o := models.Organization{Name: name}
+	if err := s.Organizations().Create(context.Background(), &o); err != nil {
+		t.Fatalf("Could not create organization %s: %s", name, err.Error())
+	}
+	return models.WithUser(models.WithOrganization(context.Background(), o.Id), 0, true)
+}
+
+func createCustomer(t *testing.T, ctx context.Context, s models.Store, userId int) models.Customer {
+	t.Helper()
+	c := models.Customer{CustomerOut: models.CustomerOut{Name: "Name", Surname: "Surname"}, CreatedByUserId: userId}
+	if err := s.Customers().Create(ctx, &c); err != nil {
+		t.Fatalf("Could not create customer: %s", err.Error())
+	}
+	return c
+}
+
+func testUsers(t *testing.T, s models.Store) {
+	ctx := context.Background()
+	before, err := s.Users().Count(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := createUser(t, s, "storetest_user")
+	// Creating an existing user does nothing
+	createUser(t, s, "storetest_user")
+
+	if count, _ := s.Users().Count(ctx); count != before+1 {
+		t.Errorf("Expected %d users. Got %d", before+1, count)
+	}
+
+	u := models.User{Username: "storetest_user", Password: "storetest_password"}
+	if err = s.Users().Login(ctx, &u); err != nil {
+		t.Errorf("Expected valid credentials. Got %s", err.Error())
+	}
+	if u.Id != id {
+		t.Errorf("Expected user ID %d after login. Got %d", id, u.Id)
+	}
+
+	u = models.User{Username: "storetest_user", Password: "wrong_password"}
+	if err = s.Users().Login(ctx, &u); err == nil {
+		t.Errorf("Expected invalid credentials with a wrong password")
+	}
+	u = models.User{Username: "storetest_unknown", Password: "storetest_password"}
+	if err = s.Users().Login(ctx, &u); err == nil {
+		t.Errorf("Expected invalid credentials with an unknown user")
+	}
+
+	if _, err = s.Users().GetId(ctx, "storetest_unknown"); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for an unknown user. Got %v", err)
+	}
+
+	u = models.User{Username: "storetest_user", Password: "storetest_new_password"}
+	if err = s.Users().ResetPassword(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Users().Login(ctx, &u); err != nil || u.Role != models.RoleUser {
+		t.Errorf("Expected to login with the new password as a user. Got %v, role %s", err, u.Role)
+	}
+	u = models.User{Username: "storetest_user", Role: models.RoleAdmin}
+	if err = s.Users().UpdateRole(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	users, err := s.Users().List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, listed := range users {
+		if listed.Id == id {
+			found = listed.Username == "storetest_user" && listed.Role == models.RoleAdmin && listed.Password == ""
+		}
+	}
+	if !found {
+		t.Errorf("Expected storetest_user listed as an admin, without password. Got %+v", users)
+	}
+	got, err := s.Users().Get(ctx, "storetest_user")
+	if err != nil || got.Id != id || got.Role != models.RoleAdmin || got.Password != "" {
+		t.Errorf("Expected storetest_user as an admin, without password. Got %+v (%v)", got, err)
+	}
+	if _, err = s.Users().Get(ctx, "storetest_unknown"); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for an unknown user. Got %v", err)
+	}
+
+	u = models.User{Username: "storetest_unknown", Password: "storetest_password"}
+	if err = s.Users().ResetPassword(ctx, &u); err != models.ErrUserNotFound {
+		t.Errorf("Expected ErrUserNotFound for an unknown user. Got %v", err)
+	}
+	u.Role = "superuser"
+	if err = s.Users().UpdateRole(ctx, &u); err == nil {
+		t.Errorf("Expected an invalid role to be refused")
+	}
+}
+
+func testPictures(t *testing.T, s models.Store) {
+	ctx := createOrganization(t, s, "storetest_pictures")
+	p, err := s.Pictures().Get(ctx, 1)
+	if err != nil || p.Path != placeholderPath {
+		t.Errorf("Expected the placeholder picture %s. Got %s (%v)", placeholderPath, p.Path, err)
+	}
+
+	p = models.PicturePath{Path: "static/storetest.jpg"}
+	if err = s.Pictures().Add(ctx, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Id <= 1 {
+		t.Errorf("Expected a new picture ID. Got %d", p.Id)
+	}
+	added, err := s.Pictures().Get(ctx, p.Id)
+	if err != nil || added.Path != p.Path {
+		t.Errorf("Expected picture path %s. Got %s (%v)", p.Path, added.Path, err)
+	}
+
+	// Adding an existing path returns the placeholder
+	again := models.PicturePath{Path: "static/storetest.jpg"}
+	if err = s.Pictures().Add(ctx, &again); err != nil || again.Id != 1 {
+		t.Errorf("Expected the placeholder ID for an existing path. Got %d (%v)", again.Id, err)
+	}
+
+	if _, err = s.Pictures().Get(ctx, 1000000); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for an unknown picture. Got %v", err)
+	}
+}
+
+func testCustomers(t *testing.T, s models.Store) {
+	ctx := createOrganization(t, s, "storetest_customers")
+	creator := createUser(t, s, "storetest_creator")
+	modifier := createUser(t, s, "storetest_modifier")
+
+	c := createCustomer(t, ctx, s, creator)
+	if c.Id == 0 || c.PicturePath != placeholderPath || c.CreatedByUser != "storetest_creator" || c.LastModifiedByUser != "storetest_creator" ||
+		c.Owner != "storetest_creator" || c.Teams == nil || len(c.Teams) != 0 {
+		t.Errorf("Unexpected created customer %+v", c.CustomerOut)
+	}
+
+	got, err := s.Customers().Get(ctx, c.Id)
+	if err != nil || !reflect.DeepEqual(got, c.CustomerOut) {
+		t.Errorf("Expected customer %+v. Got %+v (%v)", c.CustomerOut, got, err)
+	}
+
+	p := models.PicturePath{Path: "static/storetest_customer.jpg"}
+	if err = s.Pictures().Add(ctx, &p); err != nil {
+		t.Fatal(err)
+	}
+	update := models.Customer{
+		CustomerOut:          models.CustomerOut{Id: c.Id, Name: "New_name", Surname: "New_surname"},
+		PictureId:            p.Id,
+		LastModifiedByUserId: modifier,
+	}
+	if err = s.Customers().Update(ctx, &update); err != nil {
+		t.Fatal(err)
+	}
+	want := models.CustomerOut{
+		Id:                 c.Id,
+		Name:               "New_name",
+		Surname:            "New_surname",
+		PicturePath:        p.Path,
+		CreatedByUser:      "storetest_creator",
+		LastModifiedByUser: "storetest_modifier",
+		Owner:              "storetest_creator",
+		Teams:              []int{},
+	}
+	if !reflect.DeepEqual(update.CustomerOut, want) {
+		t.Errorf("Expected updated customer %+v. Got %+v", want, update.CustomerOut)
+	}
+	if got, _ = s.Customers().Get(ctx, c.Id); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected stored customer %+v. Got %+v", want, got)
+	}
+
+	second := createCustomer(t, ctx, s, creator)
+	// The order of the customers is not specified
+	list, err := s.Customers().List(ctx, false)
+	if err != nil || len(list) != 2 || list[0].Id+list[1].Id != c.Id+second.Id {
+		t.Errorf("Expected customers %d and %d. Got %+v (%v)", c.Id, second.Id, list, err)
+	}
+	if count, _ := s.Customers().Count(ctx); count != 2 {
+		t.Errorf("Expected 2 customers. Got %d", count)
+	}
+
+	if _, err = s.Customers().Delete(ctx, c.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Customers().Get(ctx, c.Id); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for a deleted customer. Got %v", err)
+	}
+	if _, err = s.Customers().Delete(ctx, c.Id); err != models.ErrCustomerNotFound {
+		t.Errorf("Expected ErrCustomerNotFound deleting a deleted customer. Got %v", err)
+	}
+	if err = s.Customers().Update(ctx, &update); err != models.ErrCustomerNotFound {
+		t.Errorf("Expected ErrCustomerNotFound updating a deleted customer. Got %v", err)
+	}
+}
+
+func testOwnership(t *testing.T, s models.Store) {
+	adminCtx := createOrganization(t, s, "storetest_ownership")
+	orgId, _ := models.OrganizationFrom(adminCtx)
+	owner := createUser(t, s, "storetest_owner")
+	teammate := createUser(t, s, "storetest_teammate")
+	outsider := createUser(t, s, "storetest_outsider")
+	nonMember := createUser(t, s, "storetest_non_member")
+	for _, id := range []int{owner, teammate, outsider} {
+		if err := s.Organizations().AddMember(adminCtx, orgId, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ownerCtx := models.WithUser(adminCtx, owner, false)
+	teammateCtx := models.WithUser(adminCtx, teammate, false)
+	outsiderCtx := models.WithUser(adminCtx, outsider, false)
+
+	c := createCustomer(t, ownerCtx, s, owner)
+	if c.Owner != "storetest_owner" {
+		t.Errorf("Expected the creator as owner. Got %q", c.Owner)
+	}
+
+	// Only its owner and the admins can access it
+	for name, ctx := range map[string]context.Context{"owner": ownerCtx, "admin": adminCtx} {
+		if got, err := s.Customers().Get(ctx, c.Id); err != nil || got.Owner != "storetest_owner" {
+			t.Errorf("Expected the customer for the %s. Got %+v (%v)", name, got, err)
+		}
+	}
+	if _, err := s.Customers().Get(outsiderCtx, c.Id); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for another user. Got %v", err)
+	}
+	if list, _ := s.Customers().List(outsiderCtx, false); len(list) != 0 {
+		t.Errorf("Expected no customers for another user. Got %+v", list)
+	}
+	if count, _ := s.Customers().Count(outsiderCtx); count != 0 {
+		t.Errorf("Expected no customers counted for another user. Got %d", count)
+	}
+	update := models.Customer{CustomerOut: models.CustomerOut{Id: c.Id, Name: "Name", Surname: "Surname"}, LastModifiedByUserId: outsider}
+	if err := s.Customers().Update(outsiderCtx, &update); err != models.ErrCustomerNotFound {
+		t.Errorf("Expected ErrCustomerNotFound updating as another user. Got %v", err)
+	}
+	if _, err := s.Customers().Delete(outsiderCtx, c.Id); err != models.ErrCustomerNotFound {
+		t.Errorf("Expected ErrCustomerNotFound deleting as another user. Got %v", err)
+	}
+	a := models.Attachment{CustomerId: c.Id, Title: "Contract", FileName: "contract.pdf",
+		FilePath: "attachments/storetest_owned.pdf", MimeType: "application/pdf", Size: 100, UploadedByUserId: owner}
+	if err := s.Attachments().Add(outsiderCtx, &a); err != models.ErrCustomerNotFound {
+		t.Errorf("Expected ErrCustomerNotFound adding an attachment as another user. Got %v", err)
+	}
+	if err := s.Attachments().Add(ownerCtx, &a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Attachments().Get(outsiderCtx, c.Id, a.Id); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for an attachment as another user. Got %v", err)
+	}
+	if list, _ := s.Attachments().List(outsiderCtx, c.Id); len(list) != 0 {
+		t.Errorf("Expected no attachments for another user. Got %+v", list)
+	}
+
+	// Teams
+	team := models.Team{Name: "storetest_team"}
+	if err := s.Teams().Create(adminCtx, &team); err != nil || team.Id == 0 {
+		t.Fatalf("Could not create the team %+v: %v", team, err)
+	}
+	if err := s.Teams().Create(adminCtx, &models.Team{Name: "storetest_team"}); err != models.ErrTeamExists {
+		t.Errorf("Expected ErrTeamExists. Got %v", err)
+	}
+	if err := s.Teams().Create(context.Background(), &models.Team{Name: "storetest_team"}); err != models.ErrNoOrganization {
+		t.Errorf("Expected ErrNoOrganization creating a team without organization. Got %v", err)
+	}
+	if err := s.Teams().AddMember(adminCtx, team.Id, teammate); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Teams().AddMember(adminCtx, team.Id, nonMember); err != models.ErrMemberNotFound {
+		t.Errorf("Expected ErrMemberNotFound adding a user of another organization. Got %v", err)
+	}
+	if err := s.Teams().AddMember(adminCtx, 1000000, teammate); err != models.ErrTeamNotFound {
+		t.Errorf("Expected ErrTeamNotFound. Got %v", err)
+	}
+	teams, err := s.Teams().List(adminCtx)
+	if err != nil || len(teams) != 1 || teams[0].Name != "storetest_team" || !reflect.DeepEqual(teams[0].Members, []string{"storetest_teammate"}) {
+		t.Errorf("Expected the team with its member. Got %+v (%v)", teams, err)
+	}
+	otherCtx := createOrganization(t, s, "storetest_ownership_other")
+	if teams, _ = s.Teams().List(otherCtx); len(teams) != 0 {
+		t.Errorf("Expected no teams in another organization. Got %+v", teams)
+	}
+	otherTeam := models.Team{Name: "storetest_other_team"}
+	if err = s.Teams().Create(otherCtx, &otherTeam); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sharing with a team, only by the owner
+	share := func(ctx context.Context, teams []int) error {
+		update := models.Customer{CustomerOut: models.CustomerOut{Id: c.Id, Name: "Name", Surname: "Surname", Teams: teams}, LastModifiedByUserId: owner}
+		return s.InTx(ctx, func(tx models.Store) error {
+			return tx.Customers().Update(ctx, &update)
+		})
+	}
+	for _, teams := range [][]int{{1000000}, {otherTeam.Id}} {
+		if err = share(ownerCtx, teams); err != models.ErrTeamNotFound {
+			t.Errorf("Expected ErrTeamNotFound sharing with %v. Got %v", teams, err)
+		}
+	}
+	if err = share(ownerCtx, []int{team.Id, team.Id}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Customers().Get(teammateCtx, c.Id)
+	if err != nil || !reflect.DeepEqual(got.Teams, []int{team.Id}) {
+		t.Errorf("Expected the customer shared with the team. Got %+v (%v)", got, err)
+	}
+	if err = share(teammateCtx, []int{}); err != models.ErrNotOwner {
+		t.Errorf("Expected ErrNotOwner sharing as a teammate. Got %v", err)
+	}
+	update = models.Customer{CustomerOut: models.CustomerOut{Id: c.Id, Name: "Shared", Surname: "Surname"}, LastModifiedByUserId: teammate}
+	if err = s.Customers().Update(teammateCtx, &update); err != nil || !reflect.DeepEqual(update.Teams, []int{team.Id}) {
+		t.Errorf("Expected the teammate to update the customer, keeping its teams. Got %+v (%v)", update.CustomerOut, err)
+	}
+	if _, err = s.Attachments().Get(teammateCtx, c.Id, a.Id); err != nil {
+		t.Errorf("Expected the attachment for the teammate. Got %v", err)
+	}
+
+	// Only the customers owned by the user with mine
+	own := createCustomer(t, teammateCtx, s, teammate)
+	if list, _ := s.Customers().List(teammateCtx, false); len(list) != 2 {
+		t.Errorf("Expected the owned and shared customers. Got %+v", list)
+	}
+	if list, _ := s.Customers().List(teammateCtx, true); len(list) != 1 || list[0].Id != own.Id {
+		t.Errorf("Expected only customer %d. Got %+v", own.Id, list)
+	}
+
+	// Reassignment, all or nothing
+	reassign := func(ctx context.Context, ids []int, ownerId int) (count int, err error) {
+		err = s.InTx(ctx, func(tx models.Store) error {
+			count, err = tx.Customers().Reassign(ctx, ids, ownerId)
+			return err
+		})
+		return count, err
+	}
+	if _, err = reassign(teammateCtx, []int{c.Id}, teammate); err != models.ErrNotOwner {
+		t.Errorf("Expected ErrNotOwner reassigning a shared customer. Got %v", err)
+	}
+	if _, err = reassign(ownerCtx, []int{c.Id, 1000000}, teammate); err != models.ErrCustomerNotFound {
+		t.Errorf("Expected ErrCustomerNotFound. Got %v", err)
+	}
+	if _, err = reassign(ownerCtx, []int{c.Id}, nonMember); err != models.ErrMemberNotFound {
+		t.Errorf("Expected ErrMemberNotFound reassigning to a user of another organization. Got %v", err)
+	}
+	if got, _ = s.Customers().Get(ownerCtx, c.Id); got.Owner != "storetest_owner" {
+		t.Errorf("Expected the customer not reassigned. Got %q", got.Owner)
+	}
+	if count, err := reassign(ownerCtx, []int{c.Id}, teammate); err != nil || count != 1 {
+		t.Errorf("Expected 1 customer reassigned. Got %d (%v)", count, err)
+	}
+	got, err = s.Customers().Get(teammateCtx, c.Id)
+	if err != nil || got.Owner != "storetest_teammate" || got.LastModifiedByUser != "storetest_owner" {
+		t.Errorf("Expected the customer reassigned by its owner. Got %+v (%v)", got, err)
+	}
+	if count, err := reassign(adminCtx, []int{c.Id, own.Id, c.Id}, outsider); err != nil || count != 2 {
+		t.Errorf("Expected 2 customers reassigned by an admin. Got %d (%v)", count, err)
+	}
+	if list, _ := s.Customers().List(outsiderCtx, true); len(list) != 2 {
+		t.Errorf("Expected the reassigned customers. Got %+v", list)
+	}
+
+	// Leaving the team or the organization, or deleting the team, stops the sharing
+	if err = s.Teams().RemoveMember(adminCtx, team.Id, teammate); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Teams().RemoveMember(adminCtx, team.Id, teammate); err != models.ErrTeamMemberNotFound {
+		t.Errorf("Expected ErrTeamMemberNotFound. Got %v", err)
+	}
+	if _, err = s.Customers().Get(teammateCtx, c.Id); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows after leaving the team. Got %v", err)
+	}
+	if err = s.Teams().AddMember(adminCtx, team.Id, teammate); err != nil {
+		t.Fatal(err)
+	}
+	err = s.InTx(adminCtx, func(tx models.Store) error {
+		return tx.Organizations().RemoveMember(adminCtx, orgId, teammate)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if teams, _ = s.Teams().List(adminCtx); len(teams) != 1 || len(teams[0].Members) != 0 {
+		t.Errorf("Expected the team without members. Got %+v", teams)
+	}
+	if err = s.Organizations().AddMember(adminCtx, orgId, teammate); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Teams().AddMember(adminCtx, team.Id, teammate); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Teams().Delete(adminCtx, team.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Teams().Delete(adminCtx, team.Id); err != models.ErrTeamNotFound {
+		t.Errorf("Expected ErrTeamNotFound deleting a deleted team. Got %v", err)
+	}
+	if _, err = s.Customers().Get(teammateCtx, c.Id); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows after deleting the team. Got %v", err)
+	}
+	if got, _ = s.Customers().Get(adminCtx, c.Id); len(got.Teams) != 0 {
+		t.Errorf("Expected the customer without teams. Got %v", got.Teams)
+	}
+}
+
+func testAttachments(t *testing.T, s models.Store) {
+	ctx := createOrganization(t, s, "storetest_attachments")
+	userId := createUser(t, s, "storetest_uploader")
+	c := createCustomer(t, ctx, s, userId)
+
+	document := models.Attachment{CustomerId: c.Id, Title: "Contract", FileName: "contract.pdf",
+		FilePath: "attachments/storetest_contract.pdf", MimeType: "application/pdf", Size: 100, UploadedByUserId: userId}
+	image := models.Attachment{CustomerId: c.Id, Title: "Photo", FileName: "photo.jpg",
+		FilePath: "attachments/storetest_photo.jpg", MimeType: "image/jpeg", Size: 200, UploadedByUserId: userId}
+	for _, a := range []*models.Attachment{&document, &image} {
+		if err := s.Attachments().Add(ctx, a); err != nil {
+			t.Fatal(err)
+		}
+		if a.Id == 0 || a.IsPrimary || a.UploadedByUser != "storetest_uploader" || a.UploadedAt.IsZero() {
+			t.Errorf("Unexpected added attachment %+v", a)
+		}
+	}
+
+	got, err := s.Attachments().Get(ctx, c.Id, document.Id)
+	if err != nil || got.FilePath != document.FilePath || got.MimeType != document.MimeType || got.Size != document.Size {
+		t.Errorf("Expected attachment %+v. Got %+v (%v)", document, got, err)
+	}
+	if _, err = s.Attachments().Get(ctx, c.Id+1, document.Id); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for the attachment of another customer. Got %v", err)
+	}
+
+	list, err := s.Attachments().List(ctx, c.Id)
+	if err != nil || len(list) != 2 || list[0].Id != document.Id || list[1].Id != image.Id {
+		t.Errorf("Expected attachments %d and %d. Got %+v (%v)", document.Id, image.Id, list, err)
+	}
+
+	p := models.PicturePath{Path: "static/storetest_photo.jpg"}
+	if err = s.Attachments().SetPrimary(ctx, &document, &p); err != models.ErrNotAnImage {
+		t.Errorf("Expected models.ErrNotAnImage. Got %v", err)
+	}
+	if err = s.Attachments().SetPrimary(ctx, &image, &p); err != nil {
+		t.Fatal(err)
+	}
+	if customer, _ := s.Customers().Get(ctx, c.Id); customer.PicturePath != p.Path {
+		t.Errorf("Expected customer picture %s. Got %s", p.Path, customer.PicturePath)
+	}
+	if got, _ = s.Attachments().Get(ctx, c.Id, image.Id); !got.IsPrimary {
+		t.Errorf("Expected the attachment to be primary")
+	}
+
+	// Deleting the primary attachment restores the placeholder
+	deleted, err := s.Attachments().Delete(ctx, c.Id, image.Id)
+	if err != nil || deleted.FilePath != image.FilePath || !deleted.IsPrimary {
+		t.Errorf("Expected deleted attachment %+v. Got %+v (%v)", image, deleted, err)
+	}
+	if customer, _ := s.Customers().Get(ctx, c.Id); customer.PicturePath != placeholderPath {
+		t.Errorf("Expected customer picture %s. Got %s", placeholderPath, customer.PicturePath)
+	}
+	if _, err = s.Attachments().Delete(ctx, c.Id, image.Id); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows deleting a deleted attachment. Got %v", err)
+	}
+
+	// Attachments are deleted with their customer, which returns their files
+	list, _ = s.Attachments().List(ctx, c.Id)
+	files, err := s.Customers().Delete(ctx, c.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(list) || len(files) == 0 {
+		t.Errorf("Expected the files of %+v. Got %v", list, files)
+	}
+	for _, a := range list {
+		found := false
+		for _, f := range files {
+			found = found || f == a.FilePath
+		}
+		if !found {
+			t.Errorf("Expected file %s in %v", a.FilePath, files)
+		}
+	}
+	if list, _ = s.Attachments().List(ctx, c.Id); len(list) != 0 {
+		t.Errorf("Expected no attachments. Got %+v", list)
+	}
+}
+
+func testUploads(t *testing.T, s models.Store) {
+	ctx := createOrganization(t, s, "storetest_uploads")
+	userId := createUser(t, s, "storetest_uploader")
+	otherId := createUser(t, s, "storetest_other")
+
+	u := models.Upload{Id: "0123456789abcdef", UserId: userId, Length: 10, Metadata: "filename cGhvdG8uanBn",
+		FilePath: "uploads/0123456789abcdef", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := s.Uploads().Create(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Offset != 0 || u.IsComplete() {
+		t.Errorf("Expected an empty upload. Got offset %d", u.Offset)
+	}
+
+	got, err := s.Uploads().Get(ctx, userId, u.Id)
+	if err != nil || got.Length != u.Length || got.Metadata != u.Metadata || got.FilePath != u.FilePath {
+		t.Errorf("Expected upload %+v. Got %+v (%v)", u, got, err)
+	}
+	if _, err = s.Uploads().Get(ctx, otherId, u.Id); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for the upload of another user. Got %v", err)
+	}
+
+	u.Offset = 10
+	if err = s.Uploads().UpdateOffset(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	p := models.PicturePath{Path: "static/storetest_upload.jpg"}
+	if err = s.Uploads().Complete(ctx, &u, &p); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = s.Uploads().Get(ctx, userId, u.Id); got.Offset != 10 || got.PictureId != p.Id || p.Id <= 1 {
+		t.Errorf("Expected completed upload with picture %d. Got %+v", p.Id, got)
+	}
+
+	if _, err = s.Uploads().Delete(ctx, otherId, u.Id); err == nil {
+		t.Errorf("Expected an error deleting the upload of another user")
+	}
+	deleted, err := s.Uploads().Delete(ctx, userId, u.Id)
+	if err != nil || deleted.FilePath != u.FilePath || deleted.PictureId != p.Id {
+		t.Errorf("Expected deleted upload %+v. Got %+v (%v)", u, deleted, err)
+	}
+
+	// Only the files of the incomplete expired uploads must be removed
+	expired := []models.Upload{
+		{Id: "aaaaaaaaaaaaaaaa", Length: 10, FilePath: "uploads/aaaaaaaaaaaaaaaa", ExpiresAt: time.Now().Add(-time.Hour)},
+		{Id: "bbbbbbbbbbbbbbbb", Length: 0, FilePath: "uploads/bbbbbbbbbbbbbbbb", ExpiresAt: time.Now().Add(-time.Hour)},
+		{Id: "cccccccccccccccc", Length: 10, FilePath: "uploads/cccccccccccccccc", ExpiresAt: time.Now().Add(time.Hour)},
+	}
+	for i := range expired {
+		expired[i].UserId = userId
+		if err = s.Uploads().Create(ctx, &expired[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	completed := models.PicturePath{Path: "static/storetest_expired.jpg"}
+	if err = s.Uploads().Complete(ctx, &expired[1], &completed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Uploads().Get(ctx, userId, expired[0].Id); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for an expired upload. Got %v", err)
+	}
+
+	files, err := s.Uploads().DeleteExpired(ctx)
+	if err != nil || len(files) != 1 || files[0] != expired[0].FilePath {
+		t.Errorf("Expected file %s. Got %v (%v)", expired[0].FilePath, files, err)
+	}
+	if _, err = s.Uploads().Get(ctx, userId, expired[2].Id); err != nil {
+		t.Errorf("Expected the non expired upload to be kept. Got %v", err)
+	}
+}
+
+// Durations are rounded up to seconds, and the database clock may be a bit off
+func checkDuration(t *testing.T, what string, expected, got time.Duration) {
+	t.Helper()
+	if got < expected-2*time.Second || got > expected+2*time.Second {
+		t.Errorf("Expected %s of about %s. Got %s", what, expected, got)
+	}
+}
+
+func testPasswordRehash(t *testing.T, s models.Store) {
+	ctx := context.Background()
+	defaults := passwd.Settings()
+	defer passwd.Configure(defaults)
+	configure := func(algorithm string, bcryptCost int) {
+		c := defaults
+		c.Algorithm, c.BcryptCost = algorithm, bcryptCost
+		c.Argon2Memory, c.Argon2Iterations, c.Argon2Parallelism = 64, 1, 1
+		if err := passwd.Configure(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	login := func(password string) (string, error) {
+		t.Helper()
+		u := models.User{Username: "storetest_rehash", Password: password}
+		err := s.Users().Login(ctx, &u)
+		return u.Password, err
+	}
+
+	configure(passwd.Bcrypt, 4)
+	createUser(t, s, "storetest_rehash")
+	// Hashes are replaced once the password is checked, when the cost or the algorithm changed
+	configure(passwd.Bcrypt, 5)
+	if _, err := login("wrong_password"); err == nil {
+		t.Fatal("Expected invalid credentials with a wrong password")
+	}
+	for _, expected := range []string{"$2a$05$", "$2a$05$"} {
+		if hash, err := login("storetest_password"); err != nil || !strings.HasPrefix(hash, expected) {
+			t.Errorf("Expected a %s hash. Got %s, %v", expected, hash, err)
+		}
+	}
+	configure(passwd.Argon2id, 5)
+	for _, expected := range []string{"$argon2id$v=19$m=64,t=1,p=1$", "$argon2id$v=19$m=64,t=1,p=1$"} {
+		if hash, err := login("storetest_password"); err != nil || !strings.HasPrefix(hash, expected) {
+			t.Errorf("Expected a %s hash. Got %s, %v", expected, hash, err)
+		}
+	}
+	if _, err := login("wrong_password"); err == nil {
+		t.Error("Expected invalid credentials with a wrong password after the rehash")
+	}
+}
+
+func testLoginLockout(t *testing.T, s models.Store) {
+	ctx := context.Background()
+	createUser(t, s, "storetest_locked")
+	policy := models.LockoutPolicy{Threshold: 2, Duration: time.Minute, MaxDuration: 3 * time.Minute}
+
+	for i, expected := range []time.Duration{0, time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		lockedFor, err := s.Users().LoginFailed(ctx, "storetest_locked", policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkDuration(t, fmt.Sprintf("lockout after %d failures", i+1), expected, lockedFor)
+	}
+	lockedFor, err := s.Users().LockedFor(ctx, "storetest_locked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDuration(t, "remaining lockout", 3*time.Minute, lockedFor)
+
+	if err = s.Users().Unlock(ctx, "storetest_locked"); err != nil {
+		t.Fatal(err)
+	}
+	if lockedFor, _ = s.Users().LockedFor(ctx, "storetest_locked"); lockedFor != 0 {
+		t.Errorf("Expected the user to be unlocked. Got %s", lockedFor)
+	}
+	// Failures start counting again
+	if lockedFor, _ = s.Users().LoginFailed(ctx, "storetest_locked", policy); lockedFor != 0 {
+		t.Errorf("Expected no lockout after the unlock. Got %s", lockedFor)
+	}
+	if err = s.Users().LoginSucceeded(ctx, "storetest_locked"); err != nil {
+		t.Fatal(err)
+	}
+	if lockedFor, _ = s.Users().LoginFailed(ctx, "storetest_locked", policy); lockedFor != 0 {
+		t.Errorf("Expected a successful login to reset the failures. Got %s", lockedFor)
+	}
+
+	// Unknown users are never locked
+	lockedFor, err = s.Users().LoginFailed(ctx, "storetest_unknown", models.LockoutPolicy{Threshold: 1, Duration: time.Minute, MaxDuration: time.Minute})
+	if err != nil || lockedFor != 0 {
+		t.Errorf("Expected no lockout of unknown users. Got %s (%v)", lockedFor, err)
+	}
+	if err = s.Users().Unlock(ctx, "storetest_unknown"); err != models.ErrUserNotFound {
+		t.Errorf("Expected ErrUserNotFound. Got %v", err)
+	}
+}
+
+func testRateLimits(t *testing.T, s models.Store) {
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if wait, err := s.RateLimits().Take(ctx, "storetest:a", 2, time.Hour); err != nil || wait != 0 {
+			t.Fatalf("Expected token %d to be taken. Got %s (%v)", i+1, wait, err)
+		}
+	}
+	wait, err := s.RateLimits().Take(ctx, "storetest:a", 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDuration(t, "wait for the next token", time.Hour, wait)
+
+	if wait, _ = s.RateLimits().Take(ctx, "storetest:b", 1, time.Hour); wait != 0 {
+		t.Errorf("Expected buckets to be independent. Got %s", wait)
+	}
+
+	// Buckets that refill quickly
+	if wait, _ = s.RateLimits().Take(ctx, "storetest:c", 1, 10*time.Millisecond); wait != 0 {
+		t.Fatalf("Expected the token to be taken. Got %s", wait)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if wait, _ = s.RateLimits().Take(ctx, "storetest:c", 1, 10*time.Millisecond); wait != 0 {
+		t.Errorf("Expected the bucket to be refilled. Got %s", wait)
+	}
+
+	if err = s.RateLimits().Prune(ctx, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if wait, _ = s.RateLimits().Take(ctx, "storetest:a", 2, time.Hour); wait == 0 {
+		t.Errorf("Expected buckets in use to be kept")
+	}
+}
+
+func testAPIKeys(t *testing.T, s models.Store) {
+	ctx := context.Background()
+	userId := createUser(t, s, "storetest_keys")
+	otherId := createUser(t, s, "storetest_other_keys")
+
+	k := models.APIKey{UserId: userId, Name: "ETL", Prefix: "crm_0001", Hash: []byte("storetest_hash_1"), Scopes: []string{models.ScopeReadCustomers}}
+	if err := s.APIKeys().Create(ctx, &k); err != nil {
+		t.Fatal(err)
+	}
+	if k.Id == 0 || k.Username != "storetest_keys" || k.CreatedAt.IsZero() {
+		t.Errorf("Expected the ID, username and creation time to be set. Got %+v", k)
+	}
+	past := time.Now().Add(-time.Minute)
+	expired := models.APIKey{UserId: userId, Name: "Expired", Prefix: "crm_0002", Hash: []byte("storetest_hash_2"), Scopes: []string{models.ScopeWriteCustomers}, ExpiresAt: &past}
+	other := models.APIKey{UserId: otherId, Name: "Other", Prefix: "crm_0003", Hash: []byte("storetest_hash_3"), Scopes: models.Scopes}
+	for _, key := range []*models.APIKey{&expired, &other} {
+		if err := s.APIKeys().Create(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := s.APIKeys().Authenticate(ctx, []byte("storetest_hash_1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Id != k.Id || got.Username != "storetest_keys" || !got.HasScope(models.ScopeReadCustomers) || got.HasScope(models.ScopeWriteCustomers) || got.LastUsedAt == nil || got.Role == "" {
+		t.Errorf("Unexpected key %+v", got)
+	}
+	for _, hash := range []string{"storetest_hash_2", "storetest_unknown"} {
+		if _, err = s.APIKeys().Authenticate(ctx, []byte(hash)); err != models.ErrAPIKeyNotFound {
+			t.Errorf("Expected ErrAPIKeyNotFound for %s. Got %v", hash, err)
+		}
+	}
+
+	keys, err := s.APIKeys().List(ctx, userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Name != "ETL" || keys[0].LastUsedAt == nil || keys[1].Name != "Expired" || keys[1].ExpiresAt == nil {
+		t.Errorf("Expected the keys of the user. Got %+v", keys)
+	}
+	if keys, _ = s.APIKeys().List(ctx, 0); len(keys) != 3 || keys[2].Username != "storetest_other_keys" {
+		t.Errorf("Expected the keys of every user. Got %+v", keys)
+	}
+
+	// Keys of other users can only be revoked without user
+	if err = s.APIKeys().Revoke(ctx, userId, other.Id); err != models.ErrAPIKeyNotFound {
+		t.Errorf("Expected ErrAPIKeyNotFound. Got %v", err)
+	}
+	if err = s.APIKeys().Revoke(ctx, 0, other.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.APIKeys().Revoke(ctx, userId, k.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.APIKeys().Authenticate(ctx, []byte("storetest_hash_1")); err != models.ErrAPIKeyNotFound {
+		t.Errorf("Expected revoked keys to be refused. Got %v", err)
+	}
+	if keys, _ = s.APIKeys().List(ctx, 0); len(keys) != 1 {
+		t.Errorf("Expected only the expired key. Got %+v", keys)
+	}
+}
+
+func testSigningKeys(t *testing.T, s models.Store) {
+	ctx := context.Background()
+	for _, kid := range []string{"storetest_1", "storetest_2"} {
+		k := models.SigningKey{Kid: kid, Algorithm: "ES256", PrivateKey: []byte(kid)}
+		if err := s.SigningKeys().Add(ctx, &k); err != nil {
+			t.Fatal(err)
+		}
+		if k.CreatedAt.IsZero() {
+			t.Errorf("Expected the creation time to be set")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := s.SigningKeys().Retire(ctx, "storetest_2"); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := s.SigningKeys().List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Kid != "storetest_1" || keys[0].RetiredAt == nil || keys[1].RetiredAt != nil || string(keys[1].PrivateKey) != "storetest_2" {
+		t.Errorf("Expected the first key retired and the second one signing. Got %+v", keys)
+	}
+
+	if err = s.SigningKeys().DeleteRetired(ctx, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ = s.SigningKeys().List(ctx); len(keys) != 2 {
+		t.Errorf("Expected the keys retired recently to be kept. Got %+v", keys)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err = s.SigningKeys().DeleteRetired(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ = s.SigningKeys().List(ctx); len(keys) != 1 || keys[0].Kid != "storetest_2" {
+		t.Errorf("Expected only the signing key. Got %+v", keys)
+	}
+}
+
+func testOIDC(t *testing.T, s models.Store) {
+	ctx := context.Background()
+	// Users are never deleted, so each run uses its own identities
+	run := fmt.Sprint(time.Now().UnixNano())
+	issuer := "https://storetest.example/" + run
+
+	u := models.User{Username: "storetest_sso_" + run, Role: models.RoleAdmin}
+	if err := s.Users().ProvisionOIDC(ctx, &u, issuer, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if u.Id == 0 || u.Role != models.RoleAdmin {
+		t.Errorf("Expected the user to be created. Got %+v", u)
+	}
+	// Provisioned users cannot login with a password
+	if err := s.Users().Login(ctx, &models.User{Username: u.Username, Password: ""}); err == nil {
+		t.Errorf("Expected the password login to fail")
+	}
+
+	// Linked users keep their username, and get the role of their groups
+	again := models.User{Username: "storetest_renamed_" + run, Role: models.RoleUser}
+	if err := s.Users().ProvisionOIDC(ctx, &again, issuer, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if again.Id != u.Id || again.Username != u.Username || again.Role != models.RoleUser {
+		t.Errorf("Expected the linked user %d with the user role. Got %+v", u.Id, again)
+	}
+
+	// Existing users are never linked by their username, only explicitly and once
+	id := createUser(t, s, "storetest_local_"+run)
+	taken := models.User{Username: "storetest_local_" + run, Role: models.RoleAdmin}
+	if err := s.Users().ProvisionOIDC(ctx, &taken, issuer, "2"); err != models.ErrUsernameTaken {
+		t.Errorf("Expected ErrUsernameTaken. Got %v", err)
+	}
+	local := models.User{Id: id}
+	if err := s.Users().LinkOIDC(ctx, &local, issuer, "2"); err != nil {
+		t.Fatal(err)
+	}
+	if local.Username != "storetest_local_"+run || local.Role != models.RoleUser {
+		t.Errorf("Expected the existing user to keep its role. Got %+v", local)
+	}
+	provisioned := models.User{Username: "storetest_other_" + run}
+	if err := s.Users().ProvisionOIDC(ctx, &provisioned, issuer, "2"); err != nil || provisioned.Id != id {
+		t.Errorf("Expected the linked user %d. Got %+v (%v)", id, provisioned, err)
+	}
+	if err := s.Users().LinkOIDC(ctx, &models.User{Id: id}, issuer, "3"); err != models.ErrOIDCLinked {
+		t.Errorf("Expected ErrOIDCLinked for a linked user. Got %v", err)
+	}
+	if err := s.Users().LinkOIDC(ctx, &models.User{Id: u.Id}, issuer, "2"); err != models.ErrOIDCLinked {
+		t.Errorf("Expected ErrOIDCLinked for a linked identity. Got %v", err)
+	}
+
+	l := models.OIDCLogin{State: "storetest_state_" + run, Nonce: "nonce", CodeVerifier: "verifier", ExpiresAt: time.Now().Add(time.Minute)}
+	expired := models.OIDCLogin{State: "storetest_expired_" + run, Nonce: "nonce", CodeVerifier: "verifier", ExpiresAt: time.Now().Add(-time.Minute)}
+	for _, login := range []*models.OIDCLogin{&expired, &l} {
+		if err := s.OIDCLogins().Create(ctx, login); err != nil {
+			t.Fatal(err)
+		}
+	}
+	linking := models.OIDCLogin{State: "storetest_linking_" + run, Nonce: "nonce", CodeVerifier: "verifier", ExpiresAt: time.Now().Add(time.Minute), UserId: id}
+	if err := s.OIDCLogins().Create(ctx, &linking); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.OIDCLogins().Take(ctx, linking.State); err != nil || got.UserId != id {
+		t.Errorf("Expected the login linking the user %d. Got %+v (%v)", id, got, err)
+	}
+	got, err := s.OIDCLogins().Take(ctx, l.State)
+	if err != nil || got.Nonce != "nonce" || got.CodeVerifier != "verifier" || got.UserId != 0 {
+		t.Errorf("Expected the login. Got %+v (%v)", got, err)
+	}
+	for _, state := range []string{l.State, expired.State, "storetest_unknown"} {
+		if _, err = s.OIDCLogins().Take(ctx, state); err != sql.ErrNoRows {
+			t.Errorf("Expected sql.ErrNoRows for %s. Got %v", state, err)
+		}
+	}
+}
+
+func testTwoFactor(t *testing.T, s models.Store) {
+	ctx := context.Background()
+	userId := createUser(t, s, "storetest_2fa")
+	// Users are never deleted, so it may be enabled from a previous run
+	if err := s.InTx(ctx, func(tx models.Store) error { return tx.TwoFactor().Disable(ctx, userId) }); err != nil {
+		t.Fatal(err)
+	}
+
+	if tf, err := s.TwoFactor().Get(ctx, userId); err != nil || tf.Enabled || tf.Secret != "" {
+		t.Errorf("Expected two-factor authentication to be disabled. Got %+v (%v)", tf, err)
+	}
+	if _, err := s.TwoFactor().Get(ctx, 1<<30); err != models.ErrUserNotFound {
+		t.Errorf("Expected ErrUserNotFound. Got %v", err)
+	}
+	if err := s.TwoFactor().Enable(ctx, userId, 10); err != models.ErrUserNotFound {
+		t.Errorf("Expected users without secret not to be enabled. Got %v", err)
+	}
+
+	if err := s.TwoFactor().SetSecret(ctx, userId, "STORETEST"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.TwoFactor().Enable(ctx, userId, 10); err != nil {
+		t.Fatal(err)
+	}
+	err := s.InTx(ctx, func(tx models.Store) error {
+		return tx.TwoFactor().SetRecoveryCodes(ctx, userId, [][]byte{[]byte("storetest_1"), []byte("storetest_2")})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err := s.TwoFactor().Get(ctx, userId)
+	if err != nil || !tf.Enabled || tf.Secret != "STORETEST" || tf.LastStep != 10 || tf.RecoveryCodes != 2 {
+		t.Errorf("Unexpected two-factor authentication %+v (%v)", tf, err)
+	}
+
+	// Codes of a step can only be used once
+	for _, tt := range []struct {
+		step int64
+		used bool
+	}{{10, false}, {9, false}, {11, true}, {11, false}} {
+		if used, err := s.TwoFactor().UseStep(ctx, userId, tt.step); err != nil || used != tt.used {
+			t.Errorf("Expected step %d used to be %t. Got %t (%v)", tt.step, tt.used, used, err)
+		}
+	}
+	for _, tt := range []struct {
+		hash string
+		used bool
+	}{{"storetest_1", true}, {"storetest_1", false}, {"storetest_unknown", false}} {
+		if used, err := s.TwoFactor().UseRecoveryCode(ctx, userId, []byte(tt.hash)); err != nil || used != tt.used {
+			t.Errorf("Expected recovery code %s used to be %t. Got %t (%v)", tt.hash, tt.used, used, err)
+		}
+	}
+	if tf, _ = s.TwoFactor().Get(ctx, userId); tf.RecoveryCodes != 1 {
+		t.Errorf("Expected 1 recovery code left. Got %d", tf.RecoveryCodes)
+	}
+
+	if err = s.InTx(ctx, func(tx models.Store) error { return tx.TwoFactor().Disable(ctx, userId) }); err != nil {
+		t.Fatal(err)
+	}
+	if tf, _ = s.TwoFactor().Get(ctx, userId); tf.Enabled || tf.Secret != "" || tf.RecoveryCodes != 0 {
+		t.Errorf("Expected two-factor authentication to be disabled. Got %+v", tf)
+	}
+}
+
+func testSessions(t *testing.T, s models.Store) {
+	ctx := context.Background()
+	userId := createUser(t, s, "storetest_sessions")
+	otherId := createUser(t, s, "storetest_other_sessions")
+
+	future := time.Now().Add(time.Hour)
+	for _, session := range []models.Session{
+		{Id: "storetest_1", UserId: userId, RefreshHash: []byte("storetest_refresh_1"), ExpiresAt: future},
+		{Id: "storetest_2", UserId: userId, ExpiresAt: future},
+		{Id: "storetest_3", UserId: otherId, ExpiresAt: future},
+		{Id: "storetest_expired", UserId: userId, RefreshHash: []byte("storetest_refresh_expired"), ExpiresAt: time.Now().Add(-time.Minute)},
+	} {
+		if err := s.Sessions().Create(ctx, &session); err != nil {
+			t.Fatal(err)
+		}
+		if session.CreatedAt.IsZero() {
+			t.Errorf("Expected the creation time to be set")
+		}
+	}
+	active := func(id string) bool {
+		t.Helper()
+		active, err := s.Sessions().Active(ctx, id, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return active
+	}
+	if !active("storetest_1") || active("storetest_expired") || active("storetest_unknown") {
+		t.Errorf("Expected only the non expired sessions to be active")
+	}
+
+	refreshed := models.Session{RefreshHash: []byte("storetest_refresh_2"), Device: "storetest device", IP: "127.0.0.1", ExpiresAt: future}
+	if err := s.Sessions().Refresh(ctx, []byte("storetest_refresh_1"), &refreshed); err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.Id != "storetest_1" || refreshed.UserId != userId || refreshed.Username != "storetest_sessions" || refreshed.Role == "" {
+		t.Errorf("Expected the refreshed session with its user. Got %+v", refreshed)
+	}
+	for _, hash := range []string{"storetest_refresh_1", "storetest_refresh_expired", ""} {
+		if err := s.Sessions().Refresh(ctx, []byte(hash), &models.Session{ExpiresAt: future}); err != sql.ErrNoRows {
+			t.Errorf("Expected sql.ErrNoRows refreshing %q. Got %v", hash, err)
+		}
+	}
+
+	list, err := s.Sessions().List(ctx, userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Id != "storetest_1" || list[0].Device != "storetest device" || list[0].IP != "127.0.0.1" {
+		t.Errorf("Expected the active sessions of the user, the last used first. Got %+v", list)
+	}
+	if err = s.Sessions().Delete(ctx, otherId, "storetest_2"); err != models.ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound deleting the session of another user. Got %v", err)
+	}
+	if err = s.Sessions().Delete(ctx, userId, "storetest_2"); err != nil {
+		t.Fatal(err)
+	}
+	if active("storetest_2") {
+		t.Errorf("Expected the deleted session to be revoked")
+	}
+	if err = s.Sessions().Create(ctx, &models.Session{Id: "storetest_2", UserId: userId, ExpiresAt: future}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Sessions().Revoke(ctx, userId, "storetest_1"); err != nil {
+		t.Fatal(err)
+	}
+	if !active("storetest_1") || active("storetest_2") || !active("storetest_3") {
+		t.Errorf("Expected only the other sessions of the user to be revoked")
+	}
+	if err := s.Sessions().Revoke(ctx, userId, ""); err != nil {
+		t.Fatal(err)
+	}
+	if active("storetest_1") {
+		t.Errorf("Expected every session of the user to be revoked")
+	}
+}
+
+func testPasswordResets(t *testing.T, s models.Store) {
+	ctx := context.Background()
+	userId := createUser(t, s, "storetest_resets")
+	u := models.User{Username: "storetest_resets", Email: "storetest@example.com"}
+	if err := s.Users().UpdateEmail(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.Users().Get(ctx, u.Username); got.Email != u.Email {
+		t.Errorf("Expected the email %s. Got %+v", u.Email, got)
+	}
+
+	first := models.PasswordReset{TokenHash: []byte("storetest_1"), UserId: userId, ExpiresAt: time.Now().Add(time.Hour)}
+	second := models.PasswordReset{TokenHash: []byte("storetest_2"), UserId: userId, ExpiresAt: time.Now().Add(time.Hour)}
+	for _, p := range []*models.PasswordReset{&first, &second} {
+		if err := s.PasswordResets().Create(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the last reset of the user is valid, and only once
+	if _, err := s.PasswordResets().Take(ctx, first.TokenHash); err != sql.ErrNoRows {
+		t.Errorf("Expected the previous reset to be replaced. Got %v", err)
+	}
+	got, err := s.PasswordResets().Take(ctx, second.TokenHash)
+	if err != nil || got.UserId != userId || got.Username != "storetest_resets" {
+		t.Errorf("Expected the reset of the user. Got %+v (%v)", got, err)
+	}
+	if _, err = s.PasswordResets().Take(ctx, second.TokenHash); err != sql.ErrNoRows {
+		t.Errorf("Expected the reset to be used once. Got %v", err)
+	}
+
+	expired := models.PasswordReset{TokenHash: []byte("storetest_expired"), UserId: userId, ExpiresAt: time.Now().Add(-time.Minute)}
+	if err = s.PasswordResets().Create(ctx, &expired); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.PasswordResets().Take(ctx, expired.TokenHash); err != sql.ErrNoRows {
+		t.Errorf("Expected the expired reset to be refused. Got %v", err)
+	}
+}
+
+func testTransactions(t *testing.T, s models.Store) {
+	ctx := createOrganization(t, s, "storetest_transactions")
+	userId := createUser(t, s, "storetest_tx")
+
+	errRollback := errors.New("rollback")
+	err := s.InTx(ctx, func(tx models.Store) error {
+		c := models.Customer{CustomerOut: models.CustomerOut{Name: "Rolled", Surname: "Back"}, CreatedByUserId: userId}
+		if err := tx.Customers().Create(ctx, &c); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Errorf("Expected the error of the function. Got %v", err)
+	}
+	if count, _ := s.Customers().Count(ctx); count != 0 {
+		t.Errorf("Expected no customers after the rollback. Got %d", count)
+	}
+
+	var c models.Customer
+	err = s.InTx(ctx, func(tx models.Store) error {
+		c = models.Customer{CustomerOut: models.CustomerOut{Name: "Committed", Surname: "Customer"}, CreatedByUserId: userId}
+		return tx.Customers().Create(ctx, &c)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Customers().Get(ctx, c.Id); err != nil || got.Name != "Committed" {
+		t.Errorf("Expected the committed customer. Got %+v (%v)", got, err)
+	}
+}
+
+func testCancelledContext(t *testing.T, s models.Store) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.Customers().List(ctx, false); err != models.ErrCanceled {
+		t.Errorf("Expected models.ErrCanceled. Got %v", err)
+	}
+}
+
+func testOrganizations(t *testing.T, s models.Store) {
+	// As an admin, so only the organizations limit the customers
+	ctx := models.WithUser(context.Background(), 0, true)
+	userId := createUser(t, s, "storetest_member")
+	first := models.Organization{Name: "storetest_first"}
+	second := models.Organization{Name: "storetest_second"}
+	for _, o := range []*models.Organization{&first, &second} {
+		if err := s.Organizations().Create(ctx, o); err != nil {
+			t.Fatal(err)
+		}
+		if o.Id == 0 || o.CreatedAt.IsZero() {
+			t.Errorf("Unexpected created organization %+v", o)
+		}
+	}
+	if err := s.Organizations().Create(ctx, &models.Organization{Name: "storetest_first"}); err != models.ErrOrganizationExists {
+		t.Errorf("Expected ErrOrganizationExists. Got %v", err)
+	}
+	if got, err := s.Organizations().Get(ctx, first.Id); err != nil || got.Name != first.Name {
+		t.Errorf("Expected organization %+v. Got %+v (%v)", first, got, err)
+	}
+	if _, err := s.Organizations().Get(ctx, 1000000); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for an unknown organization. Got %v", err)
+	}
+
+	for _, orgId := range []int{first.Id, second.Id, second.Id} {
+		if err := s.Organizations().AddMember(ctx, orgId, userId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := s.Organizations().List(ctx, userId)
+	if err != nil || len(list) != 2 || list[0].Id != first.Id || list[1].Id != second.Id {
+		t.Errorf("Expected the organizations %d and %d of the user. Got %+v (%v)", first.Id, second.Id, list, err)
+	}
+	if all, _ := s.Organizations().List(ctx, 0); len(all) < 2 {
+		t.Errorf("Expected every organization. Got %+v", all)
+	}
+	members, err := s.Organizations().Members(ctx, second.Id)
+	if err != nil || len(members) != 1 || members[0].UserId != userId || members[0].Username != "storetest_member" {
+		t.Errorf("Expected the member storetest_member. Got %+v (%v)", members, err)
+	}
+
+	// Sessions start in the first organization of the user, and are switched to another one
+	session := models.Session{Id: "storetest_org", UserId: userId, ExpiresAt: time.Now().Add(time.Hour)}
+	if err = s.Sessions().Create(ctx, &session); err != nil {
+		t.Fatal(err)
+	}
+	if session.OrganizationId != first.Id {
+		t.Errorf("Expected the session in organization %d. Got %d", first.Id, session.OrganizationId)
+	}
+	if err = s.Sessions().SetOrganization(ctx, session.Id, second.Id); err != nil {
+		t.Fatal(err)
+	}
+	if active, _ := s.Sessions().Active(ctx, session.Id, first.Id); active {
+		t.Errorf("Expected the tokens of the previous organization to be refused")
+	}
+	if active, _ := s.Sessions().Active(ctx, session.Id, second.Id); !active {
+		t.Errorf("Expected the session to be active in organization %d", second.Id)
+	}
+	if err = s.Sessions().SetOrganization(ctx, "storetest_unknown", second.Id); err != models.ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound. Got %v", err)
+	}
+
+	key := models.APIKey{UserId: userId, Name: "storetest", Prefix: "storetest", Hash: []byte("storetest_org_key"), OrganizationId: second.Id}
+	if err = s.APIKeys().Create(ctx, &key); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.APIKeys().Authenticate(ctx, key.Hash); err != nil || got.OrganizationId != second.Id {
+		t.Errorf("Expected the key in organization %d. Got %+v (%v)", second.Id, got, err)
+	}
+
+	// Removed members lose the organization in their sessions and API keys
+	err = s.InTx(ctx, func(tx models.Store) error {
+		return tx.Organizations().RemoveMember(ctx, second.Id, userId)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if member, _ := s.Organizations().IsMember(ctx, second.Id, userId); member {
+		t.Errorf("Expected the user to be removed")
+	}
+	if member, _ := s.Organizations().IsMember(ctx, first.Id, userId); !member {
+		t.Errorf("Expected the user to remain in organization %d", first.Id)
+	}
+	if active, _ := s.Sessions().Active(ctx, session.Id, 0); !active {
+		t.Errorf("Expected the session to be left without organization")
+	}
+	if got, _ := s.APIKeys().Authenticate(ctx, key.Hash); got.OrganizationId != 0 {
+		t.Errorf("Expected the key without organization. Got %d", got.OrganizationId)
+	}
+	err = s.InTx(ctx, func(tx models.Store) error {
+		return tx.Organizations().RemoveMember(ctx, second.Id, userId)
+	})
+	if err != models.ErrMemberNotFound {
+		t.Errorf("Expected ErrMemberNotFound. Got %v", err)
+	}
+
+	// The data of an organization is not visible from the other ones
+	firstCtx := models.WithOrganization(ctx, first.Id)
+	secondCtx := models.WithOrganization(ctx, second.Id)
+	c := createCustomer(t, firstCtx, s, userId)
+	p := models.PicturePath{Path: "static/storetest_org.jpg"}
+	if err = s.Pictures().Add(firstCtx, &p); err != nil {
+		t.Fatal(err)
+	}
+	a := models.Attachment{CustomerId: c.Id, Title: "Contract", FileName: "contract.pdf",
+		FilePath: "attachments/storetest_org.pdf", MimeType: "application/pdf", Size: 100, UploadedByUserId: userId}
+	if err = s.Attachments().Add(firstCtx, &a); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, otherCtx := range map[string]context.Context{"another organization": secondCtx, "no organization": ctx} {
+		if _, err = s.Customers().Get(otherCtx, c.Id); err != sql.ErrNoRows {
+			t.Errorf("Expected sql.ErrNoRows for a customer with %s. Got %v", name, err)
+		}
+		if list, _ := s.Customers().List(otherCtx, false); len(list) != 0 {
+			t.Errorf("Expected no customers with %s. Got %+v", name, list)
+		}
+		if count, _ := s.Customers().Count(otherCtx); count != 0 {
+			t.Errorf("Expected no customers with %s. Got %d", name, count)
+		}
+		update := models.Customer{CustomerOut: models.CustomerOut{Id: c.Id, Name: "Name", Surname: "Surname"}, LastModifiedByUserId: userId}
+		if err = s.Customers().Update(otherCtx, &update); err == nil {
+			t.Errorf("Expected an error updating a customer with %s", name)
+		}
+		if _, err = s.Customers().Delete(otherCtx, c.Id); err == nil {
+			t.Errorf("Expected an error deleting a customer with %s", name)
+		}
+		if _, err = s.Pictures().Get(otherCtx, p.Id); err != sql.ErrNoRows {
+			t.Errorf("Expected sql.ErrNoRows for a picture with %s. Got %v", name, err)
+		}
+		if _, err = s.Pictures().Get(otherCtx, 1); err != nil {
+			t.Errorf("Expected the placeholder picture with %s. Got %v", name, err)
+		}
+		if _, err = s.Attachments().Get(otherCtx, c.Id, a.Id); err != sql.ErrNoRows {
+			t.Errorf("Expected sql.ErrNoRows for an attachment with %s. Got %v", name, err)
+		}
+		if list, _ := s.Attachments().List(otherCtx, c.Id); len(list) != 0 {
+			t.Errorf("Expected no attachments with %s. Got %+v", name, list)
+		}
+		other := a
+		other.FilePath = "attachments/storetest_org_other.pdf"
+		if err = s.Attachments().Add(otherCtx, &other); err == nil {
+			t.Errorf("Expected an error adding an attachment with %s", name)
+		}
+		if _, err = s.Attachments().Delete(otherCtx, c.Id, a.Id); err != sql.ErrNoRows {
+			t.Errorf("Expected sql.ErrNoRows deleting an attachment with %s. Got %v", name, err)
+		}
+	}
+	if err = s.Customers().Create(ctx, &models.Customer{CustomerOut: models.CustomerOut{Name: "Name", Surname: "Surname"}, CreatedByUserId: userId}); err != models.ErrNoOrganization {
+		t.Errorf("Expected ErrNoOrganization creating a customer without organization. Got %v", err)
+	}
+	stolen := models.Customer{CustomerOut: models.CustomerOut{Name: "Name", Surname: "Surname"}, PictureId: p.Id, CreatedByUserId: userId}
+	if err = s.Customers().Create(secondCtx, &stolen); err == nil {
+		t.Errorf("Expected an error using the picture of another organization")
+	}
+
+	if got, err := s.Customers().Get(firstCtx, c.Id); err != nil || got.Name != c.Name {
+		t.Errorf("Expected the customer in its organization. Got %+v (%v)", got, err)
+	}
+	if count, _ := s.Customers().Count(models.AllOrganizations(ctx)); count != 1 {
+		t.Errorf("Expected the customer counted in every organization. Got %d", count)
+	}
+}
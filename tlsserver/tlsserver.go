@@ -0,0 +1,198 @@
+package tlsserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"theam.io/jdavidsanchez/test_crm_api/config"
+	"theam.io/jdavidsanchez/test_crm_api/logging"
+)
+
+// Certificates reloads the server certificate and the client CAs from their files, so they can be
+// renewed without restarting. Established connections keep the certificate of their handshake
+type Certificates struct {
+	certFile, keyFile, caFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+func LoadCertificates(c config.TLS) (*Certificates, error) {
+	certs := &Certificates{certFile: c.CertFile, keyFile: c.KeyFile, caFile: c.ClientCAFile}
+	if err := certs.Reload(); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// Reload reads the files again. If any of them is invalid, the previous certificates are kept
+func (c *Certificates) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	var clientCAs *x509.CertPool
+	if c.caFile != "" {
+		pem, err := ioutil.ReadFile(c.caFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in " + c.caFile)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.clientCAs = clientCAs
+	c.modTimes = c.currentModTimes()
+	return nil
+}
+
+func (c *Certificates) currentModTimes() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, name := range []string{c.certFile, c.keyFile, c.caFile} {
+		if info, err := os.Stat(name); err == nil {
+			modTimes[name] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+func (c *Certificates) changed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for name, modTime := range c.currentModTimes() {
+		if !modTime.Equal(c.modTimes[name]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Certificates) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// Watch reloads the certificates when their files change (checked every interval, if not 0) or
+// when reload receives a value (e.g. on SIGHUP), until the context is cancelled
+func (c *Certificates) Watch(ctx context.Context, interval time.Duration, reload <-chan os.Signal) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+			if !c.changed() {
+				continue
+			}
+		case <-reload:
+		}
+		if err := c.Reload(); err != nil {
+			logging.Error(ctx, "Could not reload the TLS certificates, keeping the previous ones", err, nil)
+			continue
+		}
+		logging.Info(ctx, "TLS certificates reloaded", nil)
+	}
+}
+
+// Cipher suites of TLS 1.2 with forward secrecy and authenticated encryption. The ones of TLS 1.3
+// are always secure, and cannot be configured
+var modernCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, // Required by HTTP/2
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// NewConfig returns the TLS configuration of the server, serving HTTP/2 and HTTP/1.1, and asking
+// clients for a certificate if a client CA file is set
+func NewConfig(c config.TLS, certs *Certificates) *tls.Config {
+	base := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: certs.GetCertificate,
+	}
+	if c.MinVersion == "1.3" {
+		base.MinVersion = tls.VersionTLS13
+	}
+	if c.CipherPolicy == "modern" {
+		base.CipherSuites = modernCipherSuites
+	}
+	if c.ClientCAFile == "" {
+		return base
+	}
+
+	clientAuth := tls.VerifyClientCertIfGiven
+	if c.ClientAuth == "require" {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	// A configuration per handshake, with the client CAs loaded at that moment
+	return &tls.Config{
+		MinVersion:     base.MinVersion,
+		NextProtos:     base.NextProtos,
+		GetCertificate: certs.GetCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			config := base.Clone()
+			config.ClientAuth = clientAuth
+			certs.mu.RLock()
+			config.ClientCAs = certs.clientCAs
+			certs.mu.RUnlock()
+			return config, nil
+		},
+	}
+}
+
+// HSTS tells browsers to only use HTTPS for the next maxAge (not sent if 0)
+func HSTS(maxAge time.Duration, next http.Handler) http.Handler {
+	if maxAge <= 0 {
+		return next
+	}
+	value := "max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RedirectHandler redirects the plain HTTP requests to the same URL with HTTPS, in the given port
+func RedirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		// 308 keeps the method and body, unlike 301
+		code := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			code = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, target, code)
+	})
+}
@@ -0,0 +1,228 @@
+package tlsserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"theam.io/jdavidsanchez/test_crm_api/config"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// Issues a certificate for the common name, signed by the parent (self-signed if nil)
+func issue(t *testing.T, commonName string, serial int64, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer := &testCert{cert: template, key: key}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer = parent
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer.cert, &key.PublicKey, signer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func writeFiles(t *testing.T, dir string, server, ca *testCert) config.TLS {
+	t.Helper()
+	c := config.Default().TLS
+	c.CertFile = filepath.Join(dir, "server.crt")
+	c.KeyFile = filepath.Join(dir, "server.key")
+	files := map[string][]byte{c.CertFile: server.certPEM(), c.KeyFile: server.keyPEM(t)}
+	if ca != nil {
+		c.ClientCAFile = filepath.Join(dir, "ca.crt")
+		files[c.ClientCAFile] = ca.certPEM()
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(name, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+// Serves the handler with the TLS configuration, returning its URL
+func startServer(t *testing.T, c config.TLS, certs *Certificates, handler http.Handler) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler, TLSConfig: NewConfig(c, certs)}
+	go server.ServeTLS(listener, "", "")
+	t.Cleanup(func() { server.Close() })
+	return "https://" + listener.Addr().String()
+}
+
+func newClient(ca *testCert, clientCert *testCert) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	tlsConfig := &tls.Config{RootCAs: roots}
+	if clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{clientCert.tlsCertificate()}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, ForceAttemptHTTP2: true}}
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tlsserver-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestReloadCertificates(t *testing.T) {
+	dir := tempDir(t)
+	ca := issue(t, "Test CA", 1, nil)
+	c := writeFiles(t, dir, issue(t, "server", 2, ca), nil)
+	certs, err := LoadCertificates(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := startServer(t, c, certs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serial := func() int64 {
+		t.Helper()
+		client := newClient(ca, nil)
+		defer client.CloseIdleConnections()
+		response, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.ProtoMajor != 2 {
+			t.Errorf("Expected HTTP/2. Got %s", response.Proto)
+		}
+		return response.TLS.PeerCertificates[0].SerialNumber.Int64()
+	}
+	if got := serial(); got != 2 {
+		t.Fatalf("Expected the certificate 2. Got %d", got)
+	}
+
+	// An invalid key keeps the previous certificate
+	ioutil.WriteFile(c.KeyFile, []byte("invalid"), 0600)
+	if err = certs.Reload(); err == nil {
+		t.Errorf("Expected an invalid key to fail")
+	}
+	if got := serial(); got != 2 {
+		t.Errorf("Expected the previous certificate 2. Got %d", got)
+	}
+
+	writeFiles(t, dir, issue(t, "server", 3, ca), nil)
+	if !certs.changed() {
+		t.Errorf("Expected the files to be changed")
+	}
+	if err = certs.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := serial(); got != 3 {
+		t.Errorf("Expected the renewed certificate 3. Got %d", got)
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir := tempDir(t)
+	ca := issue(t, "Test CA", 1, nil)
+	c := writeFiles(t, dir, issue(t, "server", 2, ca), ca)
+	c.MinVersion = "1.3"
+	c.ClientAuth = "require"
+	certs, err := LoadCertificates(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := startServer(t, c, certs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+	}))
+
+	response, err := newClient(ca, issue(t, "service_user", 4, ca)).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if string(body) != "service_user" {
+		t.Errorf("Expected the common name of the client certificate. Got %s", body)
+	}
+
+	if _, err = newClient(ca, nil).Get(url); err == nil {
+		t.Errorf("Expected clients without certificate to be refused")
+	}
+	if _, err = newClient(ca, issue(t, "service_user", 5, nil)).Get(url); err == nil {
+		t.Errorf("Expected certificates of other CAs to be refused")
+	}
+}
+
+func TestRedirectAndHSTS(t *testing.T) {
+	rr := httptest.NewRecorder()
+	RedirectHandler(4443).ServeHTTP(rr, httptest.NewRequest("GET", "http://example.com:8080/customers/all?x=1", nil))
+	if rr.Code != http.StatusMovedPermanently || rr.Header().Get("Location") != "https://example.com:4443/customers/all?x=1" {
+		t.Errorf("Unexpected redirect %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+	rr = httptest.NewRecorder()
+	RedirectHandler(443).ServeHTTP(rr, httptest.NewRequest("POST", "http://example.com/customers/", nil))
+	if rr.Code != http.StatusPermanentRedirect || rr.Header().Get("Location") != "https://example.com/customers/" {
+		t.Errorf("Unexpected redirect %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+
+	rr = httptest.NewRecorder()
+	HSTS(time.Hour, http.NotFoundHandler()).ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if got := rr.Header().Get("Strict-Transport-Security"); got != "max-age=3600" {
+		t.Errorf("Unexpected HSTS header %s", got)
+	}
+}
@@ -0,0 +1,60 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test vectors of RFC 6238 (SHA1), truncated to 6 digits
+func TestCode(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	for _, tt := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		code, err := Code(secret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("Expected the code %s at %d. Got %s", tt.code, tt.unix, code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	code, _ := Code(secret, Step(now))
+	if step, ok := Validate(secret, code, now); !ok || step != Step(now) {
+		t.Errorf("Expected the current code to be valid")
+	}
+	if _, ok := Validate(secret, code, now.Add(Period)); !ok {
+		t.Errorf("Expected the code of the previous step to be valid")
+	}
+	if _, ok := Validate(secret, code, now.Add(3*Period)); ok {
+		t.Errorf("Expected old codes to be refused")
+	}
+	if _, ok := Validate(secret, "12345", now); ok {
+		t.Errorf("Expected codes of the wrong length to be refused")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("CRM API", "jane", "JBSWY3DPEHPK3PXP")
+	if !strings.HasPrefix(uri, "otpauth://totp/CRM%20API:jane?") || !strings.Contains(uri, "secret=JBSWY3DPEHPK3PXP") || !strings.Contains(uri, "issuer=CRM+API") {
+		t.Errorf("Unexpected URI %s", uri)
+	}
+}
@@ -0,0 +1,32 @@
+package tracing
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"theam.io/jdavidsanchez/test_crm_api/utils"
+)
+
+// Middleware starts a server span for every request, continuing the trace of the traceparent
+// header if present. Spans are renamed after the route template, not the actual path, once the
+// router has matched it
+func Middleware(next http.Handler) http.Handler {
+	withRoute := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		span := trace.SpanFromContext(r.Context())
+		span.SetAttributes(semconv.HTTPRoute(route(r)))
+		span.SetName(r.Method + " " + route(r))
+	})
+	return otelhttp.NewHandler(withRoute, "http", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return r.Method + " " + route(r)
+	}))
+}
+
+func route(r *http.Request) string {
+	if template := utils.RouteTemplate(r); template != "" {
+		return template
+	}
+	return r.URL.Path
+}
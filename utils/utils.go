@@ -1,24 +1,91 @@
 package utils
 
 import (
+	"bufio"
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"io"
+	"io/ioutil"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
-	"strconv"
+
+	"github.com/gorilla/mux"
+	"theam.io/jdavidsanchez/test_crm_api/config"
 )
 
 const (
-	PathToImagesDir = "img"
-	PathFileServer  = "static"
+	PathToImagesDir      = "img"
+	PathToAttachmentsDir = "attachments"
+	PathToUploadsDir     = "uploads"
+	PathFileServer       = "static"
+	PlaceholderPicture   = "noPicturePlaceholder.jpg"
+)
+
+// Limits of the uploaded files, and where the pictures are stored (and served from), set with Configure
+var (
+	MaxUploadMemory   int64 = 32 << 20  // 32 MiB
+	MaxAttachmentSize int64 = 512 << 20 // 512 MiB
+	MaxResumableSize  int64 = 512 << 20 // 512 MiB
+	ImagesDir               = PathToImagesDir
 )
 
+func Configure(c *config.Config) {
+	MaxUploadMemory = c.Uploads.MaxMemory
+	MaxAttachmentSize = c.Uploads.MaxAttachmentSize
+	MaxResumableSize = c.Uploads.MaxResumableSize
+	ImagesDir = c.Server.ImagesDir
+}
+
+type UploadedFile struct {
+	Path     string // Where the file was stored, relative to the working directory
+	FileName string // Original name of the uploaded file
+	MimeType string
+	Size     int64
+}
+
+// Picture types accepted in the resumable uploads, with the extension their files are stored with
+var pictureExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+var ErrUnsupportedPicture = errors.New("Unsupported picture type")
+
+// Form fields sent with the streamed files are refused if longer, instead of being truncated
+const maxFieldSize = 1 << 10
+
+var ErrFieldTooLong = errors.New("Form field too long")
+
+// PictureExtension sniffs the type of the file instead of trusting the name given by the client,
+// returning ErrUnsupportedPicture if it is not an image that can be served safely
+func PictureExtension(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	ext, ok := pictureExtensions[http.DetectContentType(head[:n])]
+	if !ok {
+		return "", ErrUnsupportedPicture
+	}
+	return ext, nil
+}
+
 func FileUpload(r *http.Request) (string, error) {
-	r.ParseMultipartForm(32 << 20) // Max memory 32 MiB
+	r.ParseMultipartForm(MaxUploadMemory)
 	file, handler, err := r.FormFile("picture")
 	if err != nil {
 		log.Printf("Error getting file: %s", err.Error())
@@ -26,16 +93,117 @@ func FileUpload(r *http.Request) (string, error) {
 	}
 	defer file.Close() // Close the file when finished
 
-	newFileName, err := generateRandomFilename(PathToImagesDir, handler.Filename)
+	newFileName, _, err := SaveFile(ImagesDir, handler.Filename, file)
 	if err != nil {
-		log.Printf("Error creating file: %s", err.Error())
 		return "", err
 	}
-	f, _ := os.OpenFile(path.Join(PathToImagesDir, newFileName), os.O_WRONLY|os.O_CREATE, 0666)
+	return path.Join(PathFileServer, newFileName), nil
+}
+
+// StreamFileUpload reads a multipart request part by part, storing the file sent in the
+// given field at dir without holding it in memory. The rest of the form fields sent
+// before the file are returned as well
+func StreamFileUpload(r *http.Request, field, dir string) (UploadedFile, map[string]string, error) {
+	var uploaded UploadedFile
+	fields := make(map[string]string)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return uploaded, fields, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return uploaded, fields, http.ErrMissingFile
+		}
+		if err != nil {
+			return uploaded, fields, err
+		}
+
+		if part.FormName() != field {
+			value, err := ioutil.ReadAll(io.LimitReader(part, maxFieldSize+1))
+			part.Close()
+			if err != nil {
+				return uploaded, fields, err
+			}
+			if len(value) > maxFieldSize {
+				return uploaded, fields, ErrFieldTooLong
+			}
+			fields[part.FormName()] = string(value)
+			continue
+		}
+
+		// Sniff the content type from the first bytes instead of trusting the client
+		buffered := bufio.NewReader(part)
+		head, _ := buffered.Peek(512)
+		uploaded.MimeType = http.DetectContentType(head)
+		uploaded.FileName = part.FileName()
+
+		newFileName, size, err := SaveFile(dir, part.FileName(), buffered)
+		part.Close()
+		if err != nil {
+			return uploaded, fields, err
+		}
+		uploaded.Path = path.Join(dir, newFileName)
+		uploaded.Size = size
+		return uploaded, fields, nil
+	}
+}
+
+// SaveFile copies src to a new randomly named file at dir, keeping the extension of
+// filename. If anything fails, the partially written file is removed
+func SaveFile(dir, filename string, src io.Reader) (string, int64, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Printf("Error creating directory: %s", err.Error())
+		return "", 0, err
+	}
+	f, err := createRandomFile(dir, filename)
+	if err != nil {
+		log.Printf("Error creating file: %s", err.Error())
+		return "", 0, err
+	}
 	defer f.Close()
 
-	io.Copy(f, file)
-	return path.Join(PathFileServer, newFileName), nil
+	size, err := io.Copy(f, src)
+	if err != nil {
+		log.Printf("Error writing file: %s", err.Error())
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+	return filepath.Base(f.Name()), size, nil
+}
+
+// MoveFile moves src to a new randomly named file at dir, keeping the extension of filename
+func MoveFile(src, dir, filename string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	f, err := createRandomFile(dir, filename)
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	// The empty file created is replaced, so the name stays reserved until the rename
+	if err := os.Rename(src, f.Name()); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return filepath.Base(f.Name()), nil
+}
+
+// Removes a file stored by FileUpload, given the path it returned
+func RemoveUploadedFile(picturePath string) error {
+	return os.Remove(filepath.Join(ImagesDir, path.Base(picturePath)))
+}
+
+// RandomToken returns n cryptographically secure random bytes, hex encoded
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := cryptorand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
 func ResponseJSON(w http.ResponseWriter, code int, payload interface{}) {
@@ -52,21 +220,78 @@ func CheckErr(err error) {
 	}
 }
 
-// FIXME Change for username + timestamp as filename
-func generateRandomFilename(dir, filename string) (name string, err error) {
-	for i := 0; i < 10000; i++ {
-		/*
-			Careful below! From documentation on rand:
-			Random numbers are generated by a Source. Top-level functions, such as Float64 and Int, use a default shared Source that produces a DETERMINISTIC sequence of values each time a program is run. Use the Seed function to initialize the default Source if different behavior is required for each run.
-		*/
-		name = strconv.Itoa(rand.Int()) + path.Ext(filename)
-		namePath := filepath.Join(dir, name)
-		_, err := os.OpenFile(namePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
-		defer os.Remove(namePath)
-		if os.IsExist(err) {
+// createRandomFile creates a new file at dir, named with a random token and the extension of
+// filename. Picture names cannot be guessed by anyone without their URL
+func createRandomFile(dir, filename string) (*os.File, error) {
+	for i := 0; ; i++ {
+		token, err := RandomToken(16)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(filepath.Join(dir, token+path.Ext(filename)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && i < 10 {
 			continue
 		}
-		break
+		return f, err
+	}
+}
+
+// StatusRecorder is a ResponseWriter that keeps the status code and size of the response
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int
+	Bytes  int64
+}
+
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (r *StatusRecorder) WriteHeader(code int) {
+	r.Status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *StatusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.Bytes += int64(n)
+	return n, err
+}
+
+type routeKey struct{}
+
+// WithRoute lets the handlers that wrap a router know the route template of the requests, with
+// RouteTemplate, once the router has handled them. The router must record it with SetRoute
+func WithRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(routeKey{}).(*string); !ok {
+			r = r.WithContext(context.WithValue(r.Context(), routeKey{}, new(string)))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SetRoute is the router middleware that records the route template for WithRoute. Requests that
+// match no route (404 and 405) don't go through the middlewares, so they have none
+func SetRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if template, ok := r.Context().Value(routeKey{}).(*string); ok {
+			if current := mux.CurrentRoute(r); current != nil {
+				*template, _ = current.GetPathTemplate()
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RouteTemplate returns the template of the route that handled the request, or "" if none did
+func RouteTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		template, _ := current.GetPathTemplate()
+		return template
+	}
+	if template, ok := r.Context().Value(routeKey{}).(*string); ok {
+		return *template
 	}
-	return
+	return ""
 }
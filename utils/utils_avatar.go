@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"fmt"
+	"hash/fnv"
+	"html"
+	"math"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const PathAvatars = "avatars"
+
+// AvatarPath returns the path of the generated avatar for a name. Only the initials and
+// a color derived from the hash of the whole name are part of it, not the name itself
+func AvatarPath(name, surname string) string {
+	return fmt.Sprintf("%s/%s-%s.svg", PathAvatars, url.PathEscape(Initials(name, surname)), AvatarColor(name, surname))
+}
+
+func Initials(name, surname string) string {
+	var initials []rune
+	for _, s := range []string{name, surname} {
+		if r, _ := utf8.DecodeRuneInString(strings.TrimSpace(s)); r != utf8.RuneError {
+			initials = append(initials, unicode.ToUpper(r))
+		}
+	}
+	if len(initials) == 0 {
+		return "?"
+	}
+	return string(initials)
+}
+
+// AvatarColor returns a hex RGB color with a hue taken from the hash of the name. Saturation
+// and lightness are fixed so white initials are always readable over it
+func AvatarColor(name, surname string) string {
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(strings.TrimSpace(name) + " " + strings.TrimSpace(surname))))
+	hue := float64(h.Sum32() % 360)
+	r, g, b := hslToRGB(hue, 0.55, 0.45)
+	return fmt.Sprintf("%02x%02x%02x", r, g, b)
+}
+
+func RenderAvatar(initials, color string) []byte {
+	return []byte(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="128" height="128" viewBox="0 0 128 128">`+
+		`<rect width="128" height="128" fill="#%s"/>`+
+		`<text x="50%%" y="50%%" dy=".35em" text-anchor="middle" fill="#ffffff" `+
+		`font-family="Helvetica, Arial, sans-serif" font-size="56">%s</text></svg>`,
+		color, html.EscapeString(initials)))
+}
+
+func hslToRGB(h, s, l float64) (uint8, uint8, uint8) {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return uint8(math.Round((r + m) * 255)), uint8(math.Round((g + m) * 255)), uint8(math.Round((b + m) * 255))
+}